@@ -0,0 +1,480 @@
+// Package kfake provides an in-process fake Kafka cluster for testing.
+//
+// The fake cluster speaks just enough of the Kafka protocol for the kgo client
+// to produce, consume, and participate in consumer groups: ApiVersions,
+// Metadata, Produce, Fetch, ListOffsets, OffsetForLeaderEpoch, DeleteRecords,
+// CreateTopics, DeleteTopics, CreatePartitions, FindCoordinator,
+// InitProducerID, AddPartitionsToTxn, EndTxn, JoinGroup, SyncGroup, Heartbeat,
+// LeaveGroup, OffsetCommit, OffsetFetch, and DescribeGroups. SASLHandshake is
+// answered, but every mechanism is rejected. Any other request closes the
+// connection, as would a broker that does not understand it.
+//
+// The cluster does not listen on the network. Instead, clients connect to it
+// through DialContext, which can be plugged directly into kgo.Dialer:
+//
+//	c, err := kfake.NewCluster(kfake.SeedTopics(3, "foo"))
+//	if err != nil {
+//		// handle
+//	}
+//	defer c.Close()
+//
+//	cl, err := kgo.NewClient(
+//		kgo.SeedBrokers(c.ListenAddrs()...),
+//		kgo.Dialer(c.DialContext),
+//	)
+//
+// The fake is meant for unit tests, not for correctness against a real
+// broker: there is no replication, no compaction, and no retention, although
+// DeleteRecords can stand in for retention by moving a partition's log start
+// offset forward. Transactions support producing only; offsets cannot be
+// committed in a transaction. Every broker serves every request, regardless
+// of which broker leads the partition.
+//
+// To test how a client recovers from failures, faults can be injected into
+// responses with InjectFault, and all connections can be severed with
+// KillConnections. What clients send can be checked with ObserveKey.
+package kfake
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kbin"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Cluster is a fake Kafka cluster.
+type Cluster struct {
+	cfg cfg
+
+	brokers []*broker
+
+	mu     sync.Mutex
+	data   data
+	groups groups
+	pids   int64
+	txns   map[string]*txn
+
+	die     chan struct{}
+	dieOnce sync.Once
+	wg      sync.WaitGroup
+
+	cxnsMu sync.Mutex
+	cxns   map[net.Conn]struct{}
+
+	faultsMu sync.Mutex
+	faults   map[int16][]Fault
+
+	observersMu sync.Mutex
+	observers   map[int16][]func(kmsg.Request, kmsg.Response)
+	observeMu   sync.Mutex // held while handling observed requests
+}
+
+type broker struct {
+	node int32
+	host string
+	port int32
+}
+
+func (b *broker) addr() string {
+	return net.JoinHostPort(b.host, strconv.Itoa(int(b.port)))
+}
+
+// NewCluster returns a new fake cluster with the given options.
+func NewCluster(opts ...Opt) (*Cluster, error) {
+	cfg := defaultCfg()
+	for _, opt := range opts {
+		opt.apply(&cfg)
+	}
+	if cfg.nbrokers <= 0 {
+		return nil, errors.New("invalid number of brokers, must be at least one")
+	}
+	if cfg.defaultNumParts <= 0 {
+		return nil, errors.New("invalid default number of partitions, must be at least one")
+	}
+
+	c := &Cluster{
+		cfg: cfg,
+
+		txns: make(map[string]*txn),
+
+		die:  make(chan struct{}),
+		cxns: make(map[net.Conn]struct{}),
+	}
+	c.data.init()
+	c.data.leaderEpoch = cfg.leaderEpoch
+	c.groups.init(c)
+
+	for i := 0; i < cfg.nbrokers; i++ {
+		c.brokers = append(c.brokers, &broker{
+			node: int32(i),
+			host: fmt.Sprintf("kfake-%d", i),
+			port: 9092,
+		})
+	}
+	for topic, partitions := range cfg.seedTopics {
+		if partitions <= 0 {
+			partitions = cfg.defaultNumParts
+		}
+		c.data.createTopic(topic, partitions, len(c.brokers))
+	}
+
+	c.wg.Add(1)
+	go c.groups.expireLoop()
+
+	return c, nil
+}
+
+// ListenAddrs returns the addresses of every broker in the cluster. These
+// addresses are only reachable through DialContext.
+func (c *Cluster) ListenAddrs() []string {
+	addrs := make([]string, 0, len(c.brokers))
+	for _, b := range c.brokers {
+		addrs = append(addrs, b.addr())
+	}
+	return addrs
+}
+
+// DialContext opens an in-memory connection to the broker at addr. This
+// function has the same signature as net.Dialer's DialContext and is meant to
+// be used with kgo.Dialer.
+func (c *Cluster) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var known bool
+	for _, b := range c.brokers {
+		known = known || b.addr() == addr
+	}
+	if !known {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("unknown kfake broker address %q", addr)}
+	}
+
+	select {
+	case <-c.die:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("kfake cluster is closed")}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	client, server := net.Pipe()
+
+	c.cxnsMu.Lock()
+	c.cxns[server] = struct{}{}
+	c.cxnsMu.Unlock()
+
+	c.wg.Add(1)
+	go c.serve(server)
+	return client, nil
+}
+
+// Close shuts down the cluster, closing all connections and waiting for all
+// internal goroutines to quit.
+func (c *Cluster) Close() {
+	c.dieOnce.Do(func() {
+		close(c.die)
+
+		c.cxnsMu.Lock()
+		for cxn := range c.cxns {
+			cxn.Close()
+		}
+		c.cxnsMu.Unlock()
+	})
+	c.wg.Wait()
+}
+
+// serve reads requests from a connection, handles them one at a time, and
+// writes responses. As with a real broker, requests on a single connection
+// are processed in order.
+//
+// Responses are written from their own goroutine: our connections are
+// unbuffered pipes, and a real broker's socket buffers allow a client to
+// finish writing many requests before it reads any response.
+func (c *Cluster) serve(cxn net.Conn) {
+	defer c.wg.Done()
+	defer func() {
+		cxn.Close()
+		c.cxnsMu.Lock()
+		delete(c.cxns, cxn)
+		c.cxnsMu.Unlock()
+	}()
+
+	resps := make(chan []byte, 64)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for buf := range resps {
+			if _, err := cxn.Write(buf); err != nil {
+				cxn.Close() // stop reading requests
+				for range resps {
+				}
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(resps)
+		<-writerDone
+	}()
+
+	var sizeBuf [4]byte
+	for {
+		if _, err := io.ReadFull(cxn, sizeBuf[:]); err != nil {
+			return
+		}
+		size := int32(binary.BigEndian.Uint32(sizeBuf[:]))
+		if size < 0 {
+			return
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(cxn, body); err != nil {
+			return
+		}
+
+		req, corrID, err := parseRequest(body)
+		if err != nil {
+			return
+		}
+
+		fault, hasFault := c.popFault(req.Key())
+		if hasFault && fault.CloseConn {
+			return
+		}
+
+		resp := c.handleFaulted(req, fault, hasFault)
+		if resp == nil {
+			if req.Key() == 0 && req.(*kmsg.ProduceRequest).Acks == 0 {
+				continue // acks=0 produce requests have no response
+			}
+			return
+		}
+		if hasFault && fault.CorruptCorrelationID {
+			corrID++
+		}
+
+		buf := make([]byte, 4, 128)
+		buf = kbin.AppendInt32(buf, corrID)
+		if resp.IsFlexible() && resp.Key() != 18 { // ApiVersions responses never have header tags
+			buf = append(buf, 0)
+		}
+		buf = resp.AppendTo(buf)
+		binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+		resps <- buf
+	}
+}
+
+// parseRequest parses a request body, which is everything after the size
+// prefix, into a request and its correlation ID.
+func parseRequest(body []byte) (kmsg.Request, int32, error) {
+	b := kbin.Reader{Src: body}
+	key := b.Int16()
+	version := b.Int16()
+	corrID := b.Int32()
+	b.NullableString() // client ID
+
+	req := kmsg.RequestForKey(key)
+	if req == nil {
+		return nil, 0, fmt.Errorf("unknown request key %d", key)
+	}
+	if version < 0 || version > req.MaxVersion() {
+		return nil, 0, fmt.Errorf("unknown %s version %d", kmsg.NameForKey(key), version)
+	}
+	req.SetVersion(version)
+	if req.IsFlexible() {
+		kmsg.SkipTags(&b)
+	}
+	if !b.Ok() {
+		return nil, 0, errors.New("unable to parse request header")
+	}
+	if err := req.ReadFrom(b.Src); err != nil {
+		return nil, 0, err
+	}
+	return req, corrID, nil
+}
+
+// handleFaulted handles a request, applies a fault to the response if there is
+// one, and passes both to any observers of the request key.
+func (c *Cluster) handleFaulted(req kmsg.Request, fault Fault, hasFault bool) kmsg.Response {
+	observers := c.observersFor(req.Key())
+	if len(observers) > 0 {
+		c.observeMu.Lock()
+		defer c.observeMu.Unlock()
+	}
+
+	resp := c.handle(req)
+	if resp == nil {
+		return nil
+	}
+	if hasFault {
+		if fault.ThrottleMillis > 0 {
+			setThrottle(resp, fault.ThrottleMillis)
+		}
+		if fault.PartitionErrorCode != 0 {
+			setPartitionErrorCode(resp, fault.PartitionErrorCode)
+		}
+		if fault.ErrorCode != 0 {
+			setErrorCode(resp, fault.ErrorCode)
+		}
+	}
+	for _, fn := range observers {
+		fn(req, resp)
+	}
+	return resp
+}
+
+// handle dispatches a request to its handler, returning nil if the request
+// is not supported or should have no response.
+func (c *Cluster) handle(kreq kmsg.Request) kmsg.Response {
+	if !supported(kreq.Key(), kreq.GetVersion()) {
+		return nil
+	}
+	switch req := kreq.(type) {
+	case *kmsg.ApiVersionsRequest:
+		return c.handleApiVersions(req)
+	case *kmsg.MetadataRequest:
+		return c.handleMetadata(req)
+	case *kmsg.ProduceRequest:
+		return c.handleProduce(req)
+	case *kmsg.FetchRequest:
+		return c.handleFetch(req)
+	case *kmsg.ListOffsetsRequest:
+		return c.handleListOffsets(req)
+	case *kmsg.OffsetForLeaderEpochRequest:
+		return c.handleOffsetForLeaderEpoch(req)
+	case *kmsg.DeleteRecordsRequest:
+		return c.handleDeleteRecords(req)
+	case *kmsg.CreatePartitionsRequest:
+		return c.handleCreatePartitions(req)
+	case *kmsg.CreateTopicsRequest:
+		return c.handleCreateTopics(req)
+	case *kmsg.DeleteTopicsRequest:
+		return c.handleDeleteTopics(req)
+	case *kmsg.FindCoordinatorRequest:
+		return c.handleFindCoordinator(req)
+	case *kmsg.InitProducerIDRequest:
+		return c.handleInitProducerID(req)
+	case *kmsg.AddPartitionsToTxnRequest:
+		return c.handleAddPartitionsToTxn(req)
+	case *kmsg.EndTxnRequest:
+		return c.handleEndTxn(req)
+	case *kmsg.JoinGroupRequest:
+		return c.groups.handleJoin(req)
+	case *kmsg.SyncGroupRequest:
+		return c.groups.handleSync(req)
+	case *kmsg.HeartbeatRequest:
+		return c.groups.handleHeartbeat(req)
+	case *kmsg.LeaveGroupRequest:
+		return c.groups.handleLeave(req)
+	case *kmsg.OffsetCommitRequest:
+		return c.groups.handleOffsetCommit(req)
+	case *kmsg.OffsetFetchRequest:
+		return c.groups.handleOffsetFetch(req)
+	case *kmsg.DescribeGroupsRequest:
+		return c.groups.handleDescribe(req)
+	case *kmsg.SASLHandshakeRequest:
+		return c.handleSASLHandshake(req)
+	default:
+		return nil
+	}
+}
+
+// minVersions contains the minimum version the fake cluster supports for
+// every request it handles. The maximum version is always kmsg's maximum.
+var minVersions = map[int16]int16{
+	0:  3, // Produce; v3 introduced record batches, the only format we support
+	1:  4, // Fetch; v4 introduced record batches
+	2:  1, // ListOffsets; v0 uses old style offsets
+	3:  0, // Metadata
+	8:  0, // OffsetCommit
+	9:  0, // OffsetFetch
+	10: 0, // FindCoordinator
+	11: 0, // JoinGroup
+	12: 0, // Heartbeat
+	13: 0, // LeaveGroup
+	14: 0, // SyncGroup
+	15: 0, // DescribeGroups
+	17: 0, // SASLHandshake
+	18: 0, // ApiVersions
+	19: 0, // CreateTopics
+	20: 0, // DeleteTopics
+	21: 0, // DeleteRecords
+	22: 0, // InitProducerID
+	23: 0, // OffsetForLeaderEpoch
+	24: 0, // AddPartitionsToTxn
+	26: 0, // EndTxn
+	37: 0, // CreatePartitions
+}
+
+func supported(key, version int16) bool {
+	min, ok := minVersions[key]
+	return ok && version >= min
+}
+
+func (c *Cluster) handleApiVersions(req *kmsg.ApiVersionsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.ApiVersionsResponse)
+	for key := int16(0); key <= kmsg.MaxKey; key++ {
+		min, ok := minVersions[key]
+		if !ok {
+			continue
+		}
+		max := kmsg.RequestForKey(key).MaxVersion()
+		if capped, ok := c.cfg.maxKeyVersions[key]; ok && capped < max {
+			max = capped
+		}
+		resp.ApiKeys = append(resp.ApiKeys, kmsg.ApiVersionsResponseApiKey{
+			ApiKey:     key,
+			MinVersion: min,
+			MaxVersion: max,
+		})
+	}
+	return resp
+}
+
+// handleSASLHandshake rejects every mechanism: the fake cluster does not
+// support SASL, but answering the handshake lets clients see the rejection
+// rather than a closed connection.
+func (c *Cluster) handleSASLHandshake(req *kmsg.SASLHandshakeRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.SASLHandshakeResponse)
+	resp.ErrorCode = kerr.UnsupportedSaslMechanism.Code
+	return resp
+}
+
+func (c *Cluster) handleFindCoordinator(req *kmsg.FindCoordinatorRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.FindCoordinatorResponse)
+	b := c.coordinator(req.CoordinatorKey)
+	resp.NodeID = b.node
+	resp.Host = b.host
+	resp.Port = b.port
+	return resp
+}
+
+// coordinator returns the broker that coordinates the given group or
+// transactional ID. Every broker can serve every request, but spreading
+// coordinators mirrors a real cluster.
+func (c *Cluster) coordinator(key string) *broker {
+	var h uint32
+	for i := 0; i < len(key); i++ {
+		h = 31*h + uint32(key[i])
+	}
+	return c.brokers[h%uint32(len(c.brokers))]
+}
+
+// sleepOrDie sleeps for the given duration, returning false if the cluster
+// was closed while sleeping.
+func (c *Cluster) sleepOrDie(d time.Duration, wake <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wake:
+	case <-c.die:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package kfake
+
+// Opt is an option to configure a fake cluster.
+type Opt interface {
+	apply(*cfg)
+}
+
+type opt struct{ fn func(*cfg) }
+
+func (opt opt) apply(cfg *cfg) { opt.fn(cfg) }
+
+type cfg struct {
+	nbrokers        int
+	seedTopics      map[string]int32
+	autoCreate      bool
+	defaultNumParts int32
+	leaderEpoch     int32
+
+	unsupportedCodecs map[int8]bool
+	maxKeyVersions    map[int16]int16
+}
+
+func defaultCfg() cfg {
+	return cfg{
+		nbrokers:        3,
+		seedTopics:      make(map[string]int32),
+		defaultNumParts: 10,
+	}
+}
+
+// NumBrokers sets the number of brokers in the fake cluster, overriding the
+// default of 3.
+//
+// Partition leadership is spread across brokers, but every broker serves every
+// request; leadership exists only so that clients spread their requests.
+func NumBrokers(n int) Opt {
+	return opt{func(cfg *cfg) { cfg.nbrokers = n }}
+}
+
+// SeedTopics creates the given topics with the given number of partitions
+// when the cluster is created. If partitions is less than one, the default
+// number of partitions is used (see DefaultNumPartitions).
+func SeedTopics(partitions int32, topics ...string) Opt {
+	return opt{func(cfg *cfg) {
+		for _, topic := range topics {
+			cfg.seedTopics[topic] = partitions
+		}
+	}}
+}
+
+// AllowAutoTopicCreation allows metadata requests to create topics that do
+// not exist if the request also allows auto topic creation.
+func AllowAutoTopicCreation() Opt {
+	return opt{func(cfg *cfg) { cfg.autoCreate = true }}
+}
+
+// UnsupportedCompression makes produce requests fail with
+// UNSUPPORTED_COMPRESSION_TYPE for batches compressed with any of the given
+// codecs, as if the brokers were too old to support them. Codecs are the
+// values Kafka uses in record batch attributes: 1 for gzip, 2 for snappy, 3
+// for lz4, and 4 for zstd.
+func UnsupportedCompression(codecs ...int8) Opt {
+	return opt{func(cfg *cfg) {
+		if cfg.unsupportedCodecs == nil {
+			cfg.unsupportedCodecs = make(map[int8]bool)
+		}
+		for _, codec := range codecs {
+			cfg.unsupportedCodecs[codec] = true
+		}
+	}}
+}
+
+// MaxKeyVersion caps the max version the cluster advertises for a request
+// key in ApiVersions responses, as if the brokers were too old to support
+// newer versions. Requests at higher versions are still handled.
+func MaxKeyVersion(key, version int16) Opt {
+	return opt{func(cfg *cfg) {
+		if cfg.maxKeyVersions == nil {
+			cfg.maxKeyVersions = make(map[int16]int16)
+		}
+		cfg.maxKeyVersions[key] = version
+	}}
+}
+
+// LeaderEpoch sets the initial leader epoch of every partition, overriding
+// the default of 0. Leadership only changes through MoveLeader, so until then
+// this is the only epoch the cluster reports: it is returned in metadata,
+// list offsets, and offset for leader epoch responses, and is written into
+// produced batches.
+func LeaderEpoch(epoch int32) Opt {
+	return opt{func(cfg *cfg) { cfg.leaderEpoch = epoch }}
+}
+
+// DefaultNumPartitions sets the number of partitions for automatically
+// created topics or seed topics without a partition count, overriding the
+// default of 10.
+func DefaultNumPartitions(n int32) Opt {
+	return opt{func(cfg *cfg) { cfg.defaultNumParts = n }}
+}
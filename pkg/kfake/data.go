@@ -0,0 +1,605 @@
+package kfake
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// data contains all topics and partitions in the cluster. All fields are
+// guarded by the cluster's mu.
+type data struct {
+	topics map[string]*topic
+
+	// notify is closed and replaced whenever records are produced, waking
+	// any fetch that is waiting for data.
+	notify chan struct{}
+
+	leaderEpoch int32 // the initial epoch of every partition; see LeaderEpoch
+}
+
+type topic struct {
+	partitions []*partition
+}
+
+type partition struct {
+	leader   int32
+	epoch    int32
+	batches  []batch
+	hw       int64 // high watermark: the offset of the next produced record
+	logStart int64 // moved forward by DeleteRecords
+
+	ongoing []ongoingTxn // transactions not yet ended; see lso
+	aborted []abortedTxn // for read committed fetches
+}
+
+// batch is a produced record batch, rewritten to have its final base offset.
+type batch struct {
+	firstOffset   int64
+	lastOffset    int64
+	maxTimestamp  int64
+	pid           int64
+	transactional bool
+	raw           []byte
+}
+
+func (d *data) init() {
+	d.topics = make(map[string]*topic)
+	d.notify = make(chan struct{})
+}
+
+func (d *data) createTopic(name string, partitions int32, nbrokers int) *topic {
+	t := new(topic)
+	offset := len(d.topics) // spread partition leaders across topics
+	for i := int32(0); i < partitions; i++ {
+		t.partitions = append(t.partitions, &partition{
+			leader: int32((offset + int(i)) % nbrokers),
+			epoch:  d.leaderEpoch,
+		})
+	}
+	d.topics[name] = t
+	return t
+}
+
+func (d *data) partition(t string, p int32) *partition {
+	topic, exists := d.topics[t]
+	if !exists || p < 0 || int(p) >= len(topic.partitions) {
+		return nil
+	}
+	return topic.partitions[p]
+}
+
+func (c *Cluster) handleMetadata(req *kmsg.MetadataRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.MetadataResponse)
+
+	for _, b := range c.brokers {
+		resp.Brokers = append(resp.Brokers, kmsg.MetadataResponseBroker{
+			NodeID: b.node,
+			Host:   b.host,
+			Port:   b.port,
+		})
+	}
+	clusterID := "kfake"
+	resp.ClusterID = &clusterID
+	resp.ControllerID = c.brokers[0].node
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addTopic := func(name string, t *topic) {
+		rt := kmsg.MetadataResponseTopic{Topic: name}
+		if t == nil {
+			rt.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			resp.Topics = append(resp.Topics, rt)
+			return
+		}
+		for i, p := range t.partitions {
+			rp := kmsg.NewMetadataResponseTopicPartition()
+			rp.Partition = int32(i)
+			rp.Leader = p.leader
+			rp.LeaderEpoch = p.epoch
+			rp.Replicas = []int32{p.leader}
+			rp.ISR = []int32{p.leader}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+	}
+
+	// Prior to v1, an empty topic list means all topics; v1+ uses null.
+	if req.Topics == nil || req.Version == 0 && len(req.Topics) == 0 {
+		for name, t := range c.data.topics {
+			addTopic(name, t)
+		}
+		return resp
+	}
+
+	autoCreate := c.cfg.autoCreate && (req.Version < 4 || req.AllowAutoTopicCreation)
+	for _, rt := range req.Topics {
+		if rt.Topic == nil { // topic IDs are not supported
+			resp.Topics = append(resp.Topics, kmsg.MetadataResponseTopic{
+				ErrorCode: kerr.UnknownTopicOrPartition.Code,
+				TopicID:   rt.TopicID,
+			})
+			continue
+		}
+		name := *rt.Topic
+		t, exists := c.data.topics[name]
+		if !exists && autoCreate {
+			t = c.data.createTopic(name, c.cfg.defaultNumParts, len(c.brokers))
+		}
+		addTopic(name, t)
+	}
+	return resp
+}
+
+func (c *Cluster) handleProduce(req *kmsg.ProduceRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.ProduceResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var produced bool
+	for _, rt := range req.Topics {
+		st := kmsg.ProduceResponseTopic{Topic: rt.Topic}
+		for _, rp := range rt.Partitions {
+			sp := kmsg.NewProduceResponseTopicPartition()
+			sp.Partition = rp.Partition
+			sp.LogStartOffset = 0
+
+			p := c.data.partition(rt.Topic, rp.Partition)
+			if p == nil {
+				sp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+
+			batches, err := splitBatches(rp.Records, c.cfg.unsupportedCodecs)
+			if err != nil {
+				sp.ErrorCode = err.(*kerr.Error).Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+
+			sp.BaseOffset = p.hw
+			for _, b := range batches {
+				p.append(b)
+				p.trackTxnBatch(p.batches[len(p.batches)-1])
+			}
+			produced = produced || len(batches) > 0
+			st.Partitions = append(st.Partitions, sp)
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+
+	if produced {
+		close(c.data.notify)
+		c.data.notify = make(chan struct{})
+	}
+
+	if req.Acks == 0 {
+		return nil
+	}
+	return resp
+}
+
+// splitBatches validates and splits raw produced records into individual
+// record batches. Only magic v2 record batches are supported.
+func splitBatches(raw []byte, unsupportedCodecs map[int8]bool) ([]batch, error) {
+	var batches []batch
+	for len(raw) > 0 {
+		if len(raw) < 12 {
+			return nil, kerr.CorruptMessage
+		}
+		length := int32(binary.BigEndian.Uint32(raw[8:]))
+		if length < 0 || int(length) > len(raw)-12 {
+			return nil, kerr.CorruptMessage
+		}
+		rawBatch := raw[:12+length]
+		raw = raw[12+length:]
+
+		var kb kmsg.RecordBatch
+		if err := kb.ReadFrom(rawBatch); err != nil {
+			return nil, kerr.CorruptMessage
+		}
+		if kb.Magic != 2 {
+			return nil, kerr.UnsupportedForMessageFormat
+		}
+		if unsupportedCodecs[int8(kb.Attributes&0x07)] {
+			return nil, kerr.UnsupportedCompressionType
+		}
+		batches = append(batches, batch{
+			lastOffset:    int64(kb.LastOffsetDelta),
+			maxTimestamp:  kb.MaxTimestamp,
+			pid:           kb.ProducerID,
+			transactional: kb.Attributes&0x10 != 0,
+			raw:           append([]byte(nil), rawBatch...),
+		})
+	}
+	return batches, nil
+}
+
+// append adds a batch to the partition, rewriting the batch's base offset.
+// The batch's lastOffset must be its last offset delta.
+//
+// The CRC of a record batch begins after the base offset, length, partition
+// leader epoch, and magic fields, so rewriting those does not invalidate it.
+func (p *partition) append(b batch) {
+	delta := b.lastOffset
+	b.firstOffset = p.hw
+	b.lastOffset = p.hw + delta
+	binary.BigEndian.PutUint64(b.raw[0:], uint64(b.firstOffset))
+	binary.BigEndian.PutUint32(b.raw[12:], uint32(p.epoch)) // partition leader epoch
+	p.batches = append(p.batches, b)
+	p.hw = b.lastOffset + 1
+}
+
+func (c *Cluster) handleFetch(req *kmsg.FetchRequest) kmsg.Response {
+	deadline := time.Now().Add(time.Duration(req.MaxWaitMillis) * time.Millisecond)
+	for {
+		c.mu.Lock()
+		resp, nbytes := c.fetch(req)
+		notify := c.data.notify
+		c.mu.Unlock()
+
+		wait := time.Until(deadline)
+		if nbytes > 0 && nbytes >= int(req.MinBytes) || wait <= 0 {
+			return resp
+		}
+		if !c.sleepOrDie(wait, notify) {
+			return resp
+		}
+	}
+}
+
+// fetch builds a fetch response for the request, returning the response and
+// the number of record bytes in it.
+func (c *Cluster) fetch(req *kmsg.FetchRequest) (*kmsg.FetchResponse, int) {
+	resp := req.ResponseKind().(*kmsg.FetchResponse)
+
+	maxBytes := int(req.MaxBytes)
+	if req.Version < 3 || maxBytes <= 0 {
+		maxBytes = int(^uint(0) >> 1)
+	}
+
+	var nbytes int
+	for _, rt := range req.Topics {
+		st := kmsg.FetchResponseTopic{Topic: rt.Topic}
+		for _, rp := range rt.Partitions {
+			sp := kmsg.NewFetchResponseTopicPartition()
+			sp.Partition = rp.Partition
+			sp.PreferredReadReplica = -1
+
+			p := c.data.partition(rt.Topic, rp.Partition)
+			if p == nil {
+				sp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+			sp.HighWatermark = p.hw
+			sp.LastStableOffset = p.lso()
+			sp.LogStartOffset = p.logStart
+
+			// As with Kafka, a client with a newer epoch than
+			// ours knows of a leader we do not, and a client with
+			// an older epoch has stale metadata.
+			if rp.CurrentLeaderEpoch > p.epoch {
+				sp.ErrorCode = kerr.UnknownLeaderEpoch.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+			if rp.CurrentLeaderEpoch != -1 && rp.CurrentLeaderEpoch < p.epoch {
+				sp.ErrorCode = kerr.FencedLeaderEpoch.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+
+			if rp.FetchOffset < p.logStart || rp.FetchOffset > p.hw {
+				sp.ErrorCode = kerr.OffsetOutOfRange.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+
+			// Reading committed only returns batches before the
+			// last stable offset, along with the aborted
+			// transactions in what is returned so that the client
+			// can drop them.
+			readCommitted := req.IsolationLevel == 1
+			end := p.hw
+			if readCommitted {
+				end = sp.LastStableOffset
+			}
+
+			var pbytes int
+			for _, b := range p.batches {
+				if b.lastOffset < rp.FetchOffset {
+					continue
+				}
+				if b.firstOffset >= end {
+					break
+				}
+				// As with Kafka, we always return at least
+				// one batch so that consumers cannot be stuck
+				// behind a batch larger than their max bytes.
+				if nbytes > 0 && (nbytes+len(b.raw) > maxBytes || pbytes+len(b.raw) > int(rp.PartitionMaxBytes)) {
+					break
+				}
+				sp.RecordBatches = append(sp.RecordBatches, b.raw...)
+				pbytes += len(b.raw)
+				nbytes += len(b.raw)
+			}
+			if readCommitted && pbytes > 0 {
+				for _, a := range p.aborted {
+					if a.lastOffset >= rp.FetchOffset && a.firstOffset < end {
+						sp.AbortedTransactions = append(sp.AbortedTransactions, kmsg.FetchResponseTopicPartitionAbortedTransaction{
+							ProducerID:  a.pid,
+							FirstOffset: a.firstOffset,
+						})
+					}
+				}
+			}
+			st.Partitions = append(st.Partitions, sp)
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp, nbytes
+}
+
+func (c *Cluster) handleListOffsets(req *kmsg.ListOffsetsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rt := range req.Topics {
+		st := kmsg.ListOffsetsResponseTopic{Topic: rt.Topic}
+		for _, rp := range rt.Partitions {
+			sp := kmsg.NewListOffsetsResponseTopicPartition()
+			sp.Partition = rp.Partition
+
+			p := c.data.partition(rt.Topic, rp.Partition)
+			if p == nil {
+				sp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+			sp.LeaderEpoch = p.epoch
+
+			switch rp.Timestamp {
+			case -2:
+				sp.Offset = p.logStart
+			case -1:
+				sp.Offset = p.hw
+				if req.IsolationLevel == 1 {
+					sp.Offset = p.lso()
+				}
+			default:
+				sp.Offset = p.hw
+				for _, b := range p.batches {
+					if b.maxTimestamp >= rp.Timestamp {
+						sp.Offset = b.firstOffset
+						sp.Timestamp = b.maxTimestamp
+						break
+					}
+				}
+			}
+			st.Partitions = append(st.Partitions, sp)
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
+
+func (c *Cluster) handleOffsetForLeaderEpoch(req *kmsg.OffsetForLeaderEpochRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.OffsetForLeaderEpochResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rt := range req.Topics {
+		st := kmsg.OffsetForLeaderEpochResponseTopic{Topic: rt.Topic}
+		for _, rp := range rt.Partitions {
+			sp := kmsg.NewOffsetForLeaderEpochResponseTopicPartition()
+			sp.Partition = rp.Partition
+
+			p := c.data.partition(rt.Topic, rp.Partition)
+			if p == nil {
+				sp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+
+			// Moving leadership never truncates the log, so we
+			// report every epoch as ending at the high watermark.
+			sp.LeaderEpoch = p.epoch
+			sp.EndOffset = p.hw
+			st.Partitions = append(st.Partitions, sp)
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
+
+func (c *Cluster) handleDeleteRecords(req *kmsg.DeleteRecordsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.DeleteRecordsResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rt := range req.Topics {
+		st := kmsg.DeleteRecordsResponseTopic{Topic: rt.Topic}
+		for _, rp := range rt.Partitions {
+			sp := kmsg.NewDeleteRecordsResponseTopicPartition()
+			sp.Partition = rp.Partition
+
+			p := c.data.partition(rt.Topic, rp.Partition)
+			if p == nil {
+				sp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+
+			offset := rp.Offset
+			if offset == -1 { // delete everything up to the high watermark
+				offset = p.hw
+			}
+			if offset < 0 || offset > p.hw {
+				sp.ErrorCode = kerr.OffsetOutOfRange.Code
+				st.Partitions = append(st.Partitions, sp)
+				continue
+			}
+
+			// As with Kafka, we only drop batches that are
+			// entirely before the new log start offset; a fetch
+			// can still return the records before the start in
+			// the first batch.
+			if offset > p.logStart {
+				p.logStart = offset
+				for len(p.batches) > 0 && p.batches[0].lastOffset < offset {
+					p.batches = p.batches[1:]
+				}
+			}
+			sp.LowWatermark = p.logStart
+			st.Partitions = append(st.Partitions, sp)
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
+
+func (c *Cluster) handleCreatePartitions(req *kmsg.CreatePartitionsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.CreatePartitionsResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rt := range req.Topics {
+		st := kmsg.NewCreatePartitionsResponseTopic()
+		st.Topic = rt.Topic
+
+		t, exists := c.data.topics[rt.Topic]
+		switch {
+		case !exists:
+			st.ErrorCode = kerr.UnknownTopicOrPartition.Code
+		case int(rt.Count) <= len(t.partitions):
+			st.ErrorCode = kerr.InvalidPartitions.Code
+		case !req.ValidateOnly:
+			for i := len(t.partitions); i < int(rt.Count); i++ {
+				t.partitions = append(t.partitions, &partition{
+					leader: int32(i % len(c.brokers)),
+					epoch:  c.data.leaderEpoch,
+				})
+			}
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
+
+func (c *Cluster) handleCreateTopics(req *kmsg.CreateTopicsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.CreateTopicsResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rt := range req.Topics {
+		st := kmsg.NewCreateTopicsResponseTopic()
+		st.Topic = rt.Topic
+
+		// We have no replication: each partition is led by its first
+		// replica, and the replication factor is only validated.
+		var leaders []int32
+		numParts, rf := rt.NumPartitions, rt.ReplicationFactor
+		if len(rt.ReplicaAssignment) > 0 {
+			if numParts != -1 || rf != -1 {
+				st.ErrorCode = kerr.InvalidRequest.Code
+			}
+			leaders = make([]int32, len(rt.ReplicaAssignment))
+			seen := make(map[int32]bool)
+			for _, ra := range rt.ReplicaAssignment {
+				if ra.Partition < 0 || int(ra.Partition) >= len(leaders) || seen[ra.Partition] || len(ra.Replicas) == 0 {
+					st.ErrorCode = kerr.InvalidReplicaAssignment.Code
+					break
+				}
+				for _, replica := range ra.Replicas {
+					if replica < 0 || int(replica) >= len(c.brokers) {
+						st.ErrorCode = kerr.InvalidReplicaAssignment.Code
+					}
+				}
+				seen[ra.Partition] = true
+				leaders[ra.Partition] = ra.Replicas[0]
+			}
+			numParts, rf = int32(len(leaders)), int16(len(rt.ReplicaAssignment[0].Replicas))
+		} else {
+			if numParts == -1 {
+				numParts = c.cfg.defaultNumParts
+			}
+			if rf == -1 {
+				rf = 1
+			}
+			switch {
+			case numParts <= 0:
+				st.ErrorCode = kerr.InvalidPartitions.Code
+			case rf <= 0 || int(rf) > len(c.brokers):
+				st.ErrorCode = kerr.InvalidReplicationFactor.Code
+			}
+		}
+		if _, exists := c.data.topics[rt.Topic]; exists {
+			st.ErrorCode = kerr.TopicAlreadyExists.Code
+		}
+		if rt.Topic == "" {
+			st.ErrorCode = kerr.InvalidTopicException.Code
+		}
+
+		if st.ErrorCode == 0 {
+			st.NumPartitions, st.ReplicationFactor = numParts, rf
+			if !req.ValidateOnly {
+				t := c.data.createTopic(rt.Topic, numParts, len(c.brokers))
+				for i, leader := range leaders {
+					t.partitions[i].leader = leader
+				}
+			}
+		} else {
+			st.NumPartitions, st.ReplicationFactor = -1, -1
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
+
+// handleDeleteTopics deletes topics immediately, along with all of their
+// records. Topic IDs are not supported.
+func (c *Cluster) handleDeleteTopics(req *kmsg.DeleteTopicsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.DeleteTopicsResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := req.TopicNames
+	if req.Version >= 6 {
+		names = nil
+		for _, rt := range req.Topics {
+			if rt.Topic == nil {
+				st := kmsg.NewDeleteTopicsResponseTopic()
+				st.TopicID = rt.TopicID
+				st.ErrorCode = kerr.UnknownTopicID.Code
+				resp.Topics = append(resp.Topics, st)
+				continue
+			}
+			names = append(names, *rt.Topic)
+		}
+	}
+	for _, name := range names {
+		name := name
+		st := kmsg.NewDeleteTopicsResponseTopic()
+		st.Topic = &name
+		if _, exists := c.data.topics[name]; !exists {
+			st.ErrorCode = kerr.UnknownTopicOrPartition.Code
+		} else {
+			delete(c.data.topics, name)
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
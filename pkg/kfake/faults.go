@@ -0,0 +1,162 @@
+package kfake
+
+import (
+	"reflect"
+
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Fault is a failure to inject into how the cluster handles a request. Faults
+// exist to exercise a client's connection death, correlation mismatch, and
+// throttling recovery paths, which are otherwise hard to trigger.
+type Fault struct {
+	// CloseConn closes the connection the request arrived on without
+	// handling the request, as if the broker died.
+	CloseConn bool
+
+	// CorruptCorrelationID handles the request but responds with a
+	// correlation ID that does not match the request's. Note that the
+	// cluster does not deduplicate idempotent produce requests, so a
+	// client retrying a corrupted produce response will produce twice.
+	CorruptCorrelationID bool
+
+	// ThrottleMillis, if positive, handles the request and sets the
+	// response's throttle to this many milliseconds. This is ignored for
+	// responses that cannot be throttled.
+	ThrottleMillis int32
+
+	// PartitionErrorCode, if non-zero, handles the request and sets the
+	// error code of every partition in the response to this code. This is
+	// ignored for responses that do not have per partition error codes in
+	// Topics[].Partitions[].ErrorCode.
+	PartitionErrorCode int16
+
+	// ErrorCode, if non-zero, handles the request and sets the top level
+	// error code of the response to this code, such as NOT_COORDINATOR for
+	// a group request to simulate a coordinator moving. This is ignored
+	// for responses without a top level ErrorCode.
+	ErrorCode int16
+}
+
+// InjectFault queues a fault for the next request with the given key, on any
+// connection to any broker. Faults for the same key are applied in the order
+// they were injected, one per request.
+func (c *Cluster) InjectFault(key int16, f Fault) {
+	c.faultsMu.Lock()
+	defer c.faultsMu.Unlock()
+	if c.faults == nil {
+		c.faults = make(map[int16][]Fault)
+	}
+	c.faults[key] = append(c.faults[key], f)
+}
+
+// KillConnections closes every open connection to the cluster. Clients see
+// their in flight and subsequent requests on these connections fail as if
+// the brokers restarted.
+func (c *Cluster) KillConnections() {
+	c.cxnsMu.Lock()
+	defer c.cxnsMu.Unlock()
+	for cxn := range c.cxns {
+		cxn.Close()
+	}
+}
+
+// MoveLeader moves leadership of a partition to the broker with the given
+// node ID and bumps the partition's leader epoch, as if the partition were
+// reelected. Every broker continues to serve every request; only what the
+// cluster reports changes, such as the leader in metadata and the epoch that
+// requests are validated against. This returns the partition's new leader
+// epoch, or -1 if the partition or broker does not exist.
+func (c *Cluster) MoveLeader(topic string, partition, leader int32) int32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.data.partition(topic, partition)
+	if p == nil || leader < 0 || int(leader) >= len(c.brokers) {
+		return -1
+	}
+	p.leader = leader
+	p.epoch++
+	return p.epoch
+}
+
+// ObserveKey calls fn with every request with the given key and the response
+// the cluster replies with, after any fault is applied. Requests with
+// observers are handled one at a time across all connections, meaning fn
+// sees requests in the order the cluster handled them; this allows checking
+// what clients sent and what they were told, such as every offset a group
+// commits. fn must not block, and observing fetch requests serializes long
+// polling.
+func (c *Cluster) ObserveKey(key int16, fn func(kmsg.Request, kmsg.Response)) {
+	c.observersMu.Lock()
+	defer c.observersMu.Unlock()
+	if c.observers == nil {
+		c.observers = make(map[int16][]func(kmsg.Request, kmsg.Response))
+	}
+	c.observers[key] = append(c.observers[key], fn)
+}
+
+// observersFor returns the observers of a request key, if any.
+func (c *Cluster) observersFor(key int16) []func(kmsg.Request, kmsg.Response) {
+	c.observersMu.Lock()
+	defer c.observersMu.Unlock()
+	return c.observers[key]
+}
+
+// popFault returns the next queued fault for a request key, if any.
+func (c *Cluster) popFault(key int16) (Fault, bool) {
+	c.faultsMu.Lock()
+	defer c.faultsMu.Unlock()
+	queued := c.faults[key]
+	if len(queued) == 0 {
+		return Fault{}, false
+	}
+	f := queued[0]
+	if len(queued) == 1 {
+		delete(c.faults, key)
+	} else {
+		c.faults[key] = queued[1:]
+	}
+	return f, true
+}
+
+// setThrottle sets the ThrottleMillis field of a response if it has one.
+// Every throttleable response in kmsg names the field the same.
+func setThrottle(resp kmsg.Response, millis int32) {
+	if _, ok := resp.(kmsg.ThrottleResponse); !ok {
+		return
+	}
+	field := reflect.ValueOf(resp).Elem().FieldByName("ThrottleMillis")
+	if field.IsValid() && field.CanSet() && field.Kind() == reflect.Int32 {
+		field.SetInt(int64(millis))
+	}
+}
+
+// setErrorCode sets the top level ErrorCode field of a response if it has one.
+func setErrorCode(resp kmsg.Response, code int16) {
+	field := reflect.ValueOf(resp).Elem().FieldByName("ErrorCode")
+	if field.IsValid() && field.CanSet() && field.Kind() == reflect.Int16 {
+		field.SetInt(int64(code))
+	}
+}
+
+// setPartitionErrorCode sets the ErrorCode of every partition in a response
+// with Topics[].Partitions[].ErrorCode, which is the common shape of
+// partition oriented responses in kmsg.
+func setPartitionErrorCode(resp kmsg.Response, code int16) {
+	topics := reflect.ValueOf(resp).Elem().FieldByName("Topics")
+	if !topics.IsValid() || topics.Kind() != reflect.Slice {
+		return
+	}
+	for i := 0; i < topics.Len(); i++ {
+		partitions := topics.Index(i).FieldByName("Partitions")
+		if !partitions.IsValid() || partitions.Kind() != reflect.Slice {
+			continue
+		}
+		for j := 0; j < partitions.Len(); j++ {
+			field := partitions.Index(j).FieldByName("ErrorCode")
+			if field.IsValid() && field.CanSet() && field.Kind() == reflect.Int16 {
+				field.SetInt(int64(code))
+			}
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package kfake
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// groups manages all consumer groups in the cluster. This is a simplified
+// group coordinator: there is no initial rebalance delay, no static
+// membership, and no KIP-394 member ID requirement.
+type groups struct {
+	c *Cluster
+
+	mu      sync.Mutex
+	gs      map[string]*group
+	nextMID int64
+}
+
+type groupState int8
+
+const (
+	groupEmpty groupState = iota
+	groupPreparingRebalance
+	groupCompletingRebalance
+	groupStable
+)
+
+func (s groupState) String() string {
+	switch s {
+	case groupEmpty:
+		return "Empty"
+	case groupPreparingRebalance:
+		return "PreparingRebalance"
+	case groupCompletingRebalance:
+		return "CompletingRebalance"
+	case groupStable:
+		return "Stable"
+	}
+	return "Dead"
+}
+
+type group struct {
+	name string
+
+	state        groupState
+	generation   int32
+	protocolType string
+	protocol     string
+	leader       string
+	members      map[string]*member
+
+	// rebalanceID is bumped whenever a rebalance starts or completes,
+	// invalidating any in flight rebalance timeout.
+	rebalanceID int
+
+	commits map[string]map[int32]commit
+}
+
+type member struct {
+	id string
+
+	protocols        []kmsg.JoinGroupRequestProtocol
+	sessionTimeout   time.Duration
+	rebalanceTimeout time.Duration
+	lastSeen         time.Time
+
+	// If a member is waiting in join or sync, the response is prepared
+	// with the request's version and is sent on the channel once the
+	// join or sync completes.
+	join     chan *kmsg.JoinGroupResponse
+	joinResp *kmsg.JoinGroupResponse
+	sync     chan *kmsg.SyncGroupResponse
+	syncResp *kmsg.SyncGroupResponse
+
+	assignment []byte
+}
+
+type commit struct {
+	offset   int64
+	epoch    int32
+	metadata *string
+}
+
+func (gs *groups) init(c *Cluster) {
+	gs.c = c
+	gs.gs = make(map[string]*group)
+}
+
+// group returns the named group, creating it if necessary.
+func (gs *groups) group(name string) *group {
+	g, exists := gs.gs[name]
+	if !exists {
+		g = &group{
+			name:    name,
+			members: make(map[string]*member),
+			commits: make(map[string]map[int32]commit),
+		}
+		gs.gs[name] = g
+	}
+	return g
+}
+
+// expireLoop removes members that have not been seen within their session
+// timeout, triggering a rebalance for their groups.
+func (gs *groups) expireLoop() {
+	defer gs.c.wg.Done()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gs.c.die:
+			return
+		case now := <-ticker.C:
+			gs.mu.Lock()
+			for _, g := range gs.gs {
+				var removed bool
+				for _, m := range g.members {
+					// Members waiting in join are
+					// bounded by the rebalance timeout
+					// instead.
+					if m.join == nil && now.Sub(m.lastSeen) > m.sessionTimeout {
+						g.removeMember(m)
+						removed = true
+					}
+				}
+				if removed {
+					gs.rebalanceAfterRemove(g)
+				}
+			}
+			gs.mu.Unlock()
+		}
+	}
+}
+
+// removeMember deletes a member from the group, failing any join or sync the
+// member is waiting in.
+func (g *group) removeMember(m *member) {
+	delete(g.members, m.id)
+	if m.join != nil {
+		m.joinResp.ErrorCode = kerr.UnknownMemberID.Code
+		m.join <- m.joinResp
+		m.join, m.joinResp = nil, nil
+	}
+	if m.sync != nil {
+		m.syncResp.ErrorCode = kerr.UnknownMemberID.Code
+		m.sync <- m.syncResp
+		m.sync, m.syncResp = nil, nil
+	}
+}
+
+// rebalanceAfterRemove rebalances a group after members were removed, or
+// marks the group empty if no members remain.
+func (gs *groups) rebalanceAfterRemove(g *group) {
+	if len(g.members) == 0 {
+		g.state = groupEmpty
+		g.rebalanceID++
+		return
+	}
+	gs.prepareRebalance(g)
+	g.maybeCompleteJoin()
+}
+
+// prepareRebalance moves the group into a rebalance, if it is not already in
+// one. Members waiting in sync are told to rejoin, and the rebalance
+// completes with whoever has joined once the rebalance timeout elapses.
+func (gs *groups) prepareRebalance(g *group) {
+	if g.state == groupPreparingRebalance {
+		return
+	}
+	g.state = groupPreparingRebalance
+
+	var timeout time.Duration
+	for _, m := range g.members {
+		if m.sync != nil {
+			m.syncResp.ErrorCode = kerr.RebalanceInProgress.Code
+			m.sync <- m.syncResp
+			m.sync, m.syncResp = nil, nil
+		}
+		if m.rebalanceTimeout > timeout {
+			timeout = m.rebalanceTimeout
+		}
+	}
+
+	g.rebalanceID++
+	id := g.rebalanceID
+	time.AfterFunc(timeout, func() {
+		gs.mu.Lock()
+		defer gs.mu.Unlock()
+		if g.rebalanceID == id && g.state == groupPreparingRebalance {
+			g.completeJoin()
+		}
+	})
+}
+
+// maybeCompleteJoin completes the join phase of a rebalance if every member
+// has rejoined.
+func (g *group) maybeCompleteJoin() {
+	if g.state != groupPreparingRebalance {
+		return
+	}
+	for _, m := range g.members {
+		if m.join == nil {
+			return
+		}
+	}
+	g.completeJoin()
+}
+
+// completeJoin finishes the join phase of a rebalance: members that did not
+// rejoin are removed, a protocol is chosen, the generation is bumped, and
+// every waiting member is sent its join response.
+func (g *group) completeJoin() {
+	g.rebalanceID++
+
+	for _, m := range g.members {
+		if m.join == nil {
+			g.removeMember(m)
+		}
+	}
+	if len(g.members) == 0 {
+		g.state = groupEmpty
+		return
+	}
+
+	if _, exists := g.members[g.leader]; !exists {
+		for id := range g.members {
+			g.leader = id
+			break
+		}
+	}
+
+	// We choose the first of the leader's protocols that every member
+	// supports.
+	g.protocol = ""
+	for _, p := range g.members[g.leader].protocols {
+		if g.allSupport(p.Name) {
+			g.protocol = p.Name
+			break
+		}
+	}
+	if g.protocol == "" {
+		for _, m := range g.members {
+			m.joinResp.ErrorCode = kerr.InconsistentGroupProtocol.Code
+			m.join <- m.joinResp
+			m.join, m.joinResp = nil, nil
+			delete(g.members, m.id)
+		}
+		g.state = groupEmpty
+		return
+	}
+
+	g.generation++
+	g.state = groupCompletingRebalance
+
+	now := time.Now()
+	for _, m := range g.members {
+		resp := m.joinResp
+		protocolType, protocol := g.protocolType, g.protocol
+		resp.Generation = g.generation
+		resp.ProtocolType = &protocolType
+		resp.Protocol = &protocol
+		resp.LeaderID = g.leader
+		resp.MemberID = m.id
+		if m.id == g.leader {
+			for _, om := range g.members {
+				resp.Members = append(resp.Members, kmsg.JoinGroupResponseMember{
+					MemberID:         om.id,
+					ProtocolMetadata: om.metadataFor(g.protocol),
+				})
+			}
+		}
+		m.assignment = nil
+		m.lastSeen = now
+		m.join <- resp
+		m.join, m.joinResp = nil, nil
+	}
+}
+
+func (g *group) allSupport(protocol string) bool {
+	for _, m := range g.members {
+		if m.metadataFor(protocol) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataFor returns the member's metadata for the given protocol, or nil
+// if the member does not support it.
+func (m *member) metadataFor(protocol string) []byte {
+	for _, p := range m.protocols {
+		if p.Name == protocol {
+			if p.Metadata == nil {
+				return []byte{}
+			}
+			return p.Metadata
+		}
+	}
+	return nil
+}
+
+// lookup returns the group and member for a request, or the error code to
+// respond with if either does not exist or the generation is stale.
+func (gs *groups) lookup(group, memberID string, generation int32) (*group, *member, int16) {
+	g, exists := gs.gs[group]
+	if !exists {
+		return nil, nil, kerr.UnknownMemberID.Code
+	}
+	m, exists := g.members[memberID]
+	if !exists {
+		return nil, nil, kerr.UnknownMemberID.Code
+	}
+	if generation != g.generation {
+		return nil, nil, kerr.IllegalGeneration.Code
+	}
+	m.lastSeen = time.Now()
+	return g, m, 0
+}
+
+func (gs *groups) handleJoin(req *kmsg.JoinGroupRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.JoinGroupResponse)
+
+	gs.mu.Lock()
+
+	g := gs.group(req.Group)
+	if req.ProtocolType == "" || len(req.Protocols) == 0 ||
+		len(g.members) > 0 && g.protocolType != req.ProtocolType {
+		gs.mu.Unlock()
+		resp.ErrorCode = kerr.InconsistentGroupProtocol.Code
+		return resp
+	}
+
+	var m *member
+	if req.MemberID == "" {
+		gs.nextMID++
+		m = &member{id: fmt.Sprintf("kfake-member-%d", gs.nextMID)}
+		g.members[m.id] = m
+	} else if m = g.members[req.MemberID]; m == nil {
+		gs.mu.Unlock()
+		resp.ErrorCode = kerr.UnknownMemberID.Code
+		return resp
+	}
+
+	rebalanceTimeout := req.RebalanceTimeoutMillis
+	if req.Version == 0 {
+		rebalanceTimeout = req.SessionTimeoutMillis
+	}
+
+	g.protocolType = req.ProtocolType
+	m.protocols = req.Protocols
+	m.sessionTimeout = time.Duration(req.SessionTimeoutMillis) * time.Millisecond
+	m.rebalanceTimeout = time.Duration(rebalanceTimeout) * time.Millisecond
+	m.lastSeen = time.Now()
+	if m.join != nil { // duplicate join from the same member; fail the old one
+		m.joinResp.ErrorCode = kerr.UnknownMemberID.Code
+		m.join <- m.joinResp
+	}
+	wait := make(chan *kmsg.JoinGroupResponse, 1)
+	m.join, m.joinResp = wait, resp
+
+	gs.prepareRebalance(g)
+	g.maybeCompleteJoin()
+
+	gs.mu.Unlock()
+
+	select {
+	case resp := <-wait:
+		return resp
+	case <-gs.c.die:
+		return nil
+	}
+}
+
+func (gs *groups) handleSync(req *kmsg.SyncGroupRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.SyncGroupResponse)
+
+	gs.mu.Lock()
+
+	g, m, errCode := gs.lookup(req.Group, req.MemberID, req.Generation)
+	if errCode != 0 {
+		gs.mu.Unlock()
+		resp.ErrorCode = errCode
+		return resp
+	}
+	protocolType, protocol := g.protocolType, g.protocol
+	resp.ProtocolType = &protocolType
+	resp.Protocol = &protocol
+
+	switch g.state {
+	case groupStable:
+		resp.MemberAssignment = m.assignment
+		gs.mu.Unlock()
+		return resp
+
+	case groupCompletingRebalance:
+		if m.id != g.leader {
+			break
+		}
+		for _, a := range req.GroupAssignment {
+			if am := g.members[a.MemberID]; am != nil {
+				am.assignment = a.MemberAssignment
+			}
+		}
+		g.state = groupStable
+		for _, om := range g.members {
+			if om.sync != nil {
+				om.syncResp.MemberAssignment = om.assignment
+				om.sync <- om.syncResp
+				om.sync, om.syncResp = nil, nil
+			}
+		}
+		resp.MemberAssignment = m.assignment
+		gs.mu.Unlock()
+		return resp
+
+	default:
+		gs.mu.Unlock()
+		resp.ErrorCode = kerr.RebalanceInProgress.Code
+		return resp
+	}
+
+	// We are a follower waiting for the leader's assignment.
+	wait := make(chan *kmsg.SyncGroupResponse, 1)
+	m.sync, m.syncResp = wait, resp
+	gs.mu.Unlock()
+
+	select {
+	case resp := <-wait:
+		return resp
+	case <-gs.c.die:
+		return nil
+	}
+}
+
+func (gs *groups) handleHeartbeat(req *kmsg.HeartbeatRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.HeartbeatResponse)
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	g, _, errCode := gs.lookup(req.Group, req.MemberID, req.Generation)
+	if errCode != 0 {
+		resp.ErrorCode = errCode
+		return resp
+	}
+	if g.state == groupPreparingRebalance {
+		resp.ErrorCode = kerr.RebalanceInProgress.Code
+	}
+	return resp
+}
+
+func (gs *groups) handleLeave(req *kmsg.LeaveGroupRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.LeaveGroupResponse)
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	g, exists := gs.gs[req.Group]
+	if !exists {
+		resp.ErrorCode = kerr.UnknownMemberID.Code
+		return resp
+	}
+
+	leave := func(memberID string) int16 {
+		m, exists := g.members[memberID]
+		if !exists {
+			return kerr.UnknownMemberID.Code
+		}
+		g.removeMember(m)
+		return 0
+	}
+
+	var removed bool
+	if req.Version < 3 {
+		resp.ErrorCode = leave(req.MemberID)
+		removed = resp.ErrorCode == 0
+	} else {
+		for _, rm := range req.Members {
+			errCode := leave(rm.MemberID)
+			removed = removed || errCode == 0
+			resp.Members = append(resp.Members, kmsg.LeaveGroupResponseMember{
+				MemberID:   rm.MemberID,
+				InstanceID: rm.InstanceID,
+				ErrorCode:  errCode,
+			})
+		}
+	}
+	if removed {
+		gs.rebalanceAfterRemove(g)
+	}
+	return resp
+}
+
+func (gs *groups) handleDescribe(req *kmsg.DescribeGroupsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.DescribeGroupsResponse)
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	for _, name := range req.Groups {
+		sg := kmsg.NewDescribeGroupsResponseGroup()
+		sg.Group = name
+		g, exists := gs.gs[name]
+		if !exists {
+			sg.State = "Dead"
+			resp.Groups = append(resp.Groups, sg)
+			continue
+		}
+		sg.State = g.state.String()
+		sg.ProtocolType = g.protocolType
+		if g.state == groupStable {
+			sg.Protocol = g.protocol
+		}
+		for _, m := range g.members {
+			sm := kmsg.NewDescribeGroupsResponseGroupMember()
+			sm.MemberID = m.id
+			if g.state == groupStable {
+				sm.ProtocolMetadata = m.metadataFor(g.protocol)
+				sm.MemberAssignment = m.assignment
+			}
+			sg.Members = append(sg.Members, sm)
+		}
+		resp.Groups = append(resp.Groups, sg)
+	}
+	return resp
+}
+
+func (gs *groups) handleOffsetCommit(req *kmsg.OffsetCommitRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.OffsetCommitResponse)
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	// Commits from outside of the group (generation -1) are always
+	// allowed; otherwise, the member must be in the current generation.
+	var errCode int16
+	g := gs.group(req.Group)
+	if req.Version >= 1 && req.Generation != -1 {
+		_, _, errCode = gs.lookup(req.Group, req.MemberID, req.Generation)
+		if errCode == 0 && g.state == groupCompletingRebalance {
+			errCode = kerr.RebalanceInProgress.Code
+		}
+	}
+
+	for _, rt := range req.Topics {
+		st := kmsg.OffsetCommitResponseTopic{Topic: rt.Topic}
+		for _, rp := range rt.Partitions {
+			st.Partitions = append(st.Partitions, kmsg.OffsetCommitResponseTopicPartition{
+				Partition: rp.Partition,
+				ErrorCode: errCode,
+			})
+			if errCode != 0 {
+				continue
+			}
+			commits := g.commits[rt.Topic]
+			if commits == nil {
+				commits = make(map[int32]commit)
+				g.commits[rt.Topic] = commits
+			}
+			commits[rp.Partition] = commit{
+				offset:   rp.Offset,
+				epoch:    rp.LeaderEpoch,
+				metadata: rp.Metadata,
+			}
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
+
+func (gs *groups) handleOffsetFetch(req *kmsg.OffsetFetchRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.OffsetFetchResponse)
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	g := gs.gs[req.Group]
+
+	addPartition := func(st *kmsg.OffsetFetchResponseTopic, partition int32) {
+		sp := kmsg.NewOffsetFetchResponseTopicPartition()
+		sp.Partition = partition
+		sp.Offset = -1
+		if g != nil {
+			if c, exists := g.commits[st.Topic][partition]; exists {
+				sp.Offset = c.offset
+				sp.LeaderEpoch = c.epoch
+				sp.Metadata = c.metadata
+			}
+		}
+		st.Partitions = append(st.Partitions, sp)
+	}
+
+	// A null topic list (v2+) requests all committed offsets.
+	if req.Topics == nil {
+		if g == nil {
+			return resp
+		}
+		for topic, commits := range g.commits {
+			st := kmsg.OffsetFetchResponseTopic{Topic: topic}
+			for partition := range commits {
+				addPartition(&st, partition)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp
+	}
+
+	for _, rt := range req.Topics {
+		st := kmsg.OffsetFetchResponseTopic{Topic: rt.Topic}
+		for _, partition := range rt.Partitions {
+			addPartition(&st, partition)
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
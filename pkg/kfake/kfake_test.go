@@ -0,0 +1,200 @@
+package kfake
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func newTestClient(t *testing.T, c *Cluster, opts ...kgo.Opt) *kgo.Client {
+	cl, err := kgo.NewClient(append([]kgo.Opt{
+		kgo.SeedBrokers(c.ListenAddrs()...),
+		kgo.Dialer(c.DialContext),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		kgo.FetchMaxWait(100 * time.Millisecond),
+		kgo.MetadataMinAge(100 * time.Millisecond),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	return cl
+}
+
+func produceN(t *testing.T, cl *kgo.Client, topic string, n int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		r := &kgo.Record{Topic: topic, Value: []byte(strconv.Itoa(i))}
+		if err := cl.Produce(ctx, r, func(_ *kgo.Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("produce error: %v", err)
+		}
+	}
+}
+
+// consumeN polls until n records are consumed, returning the values seen.
+func consumeN(t *testing.T, cl *kgo.Client, n int) map[string]int {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	seen := make(map[string]int)
+	for consumed := 0; consumed < n; {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out after consuming %d of %d records", consumed, n)
+		}
+		for _, err := range fetches.Errors() {
+			t.Fatalf("fetch error on %s[%d]: %v", err.Topic, err.Partition, err.Err)
+		}
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			seen[string(iter.Next().Value)]++
+			consumed++
+		}
+	}
+	return seen
+}
+
+func TestProduceConsume(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewCluster(SeedTopics(3, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	const n = 500
+	produceN(t, cl, "foo", n)
+
+	cl.AssignPartitions(kgo.ConsumeTopics(kgo.NewOffset().AtStart(), "foo"))
+	seen := consumeN(t, cl, n)
+	for i := 0; i < n; i++ {
+		if seen[strconv.Itoa(i)] != 1 {
+			t.Errorf("record %d seen %d times, expected once", i, seen[strconv.Itoa(i)])
+		}
+	}
+}
+
+func TestGroupConsume(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewCluster(SeedTopics(4, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	const n = 200
+	produceN(t, cl, "foo", n)
+
+	cl.AssignGroup("group", kgo.GroupTopics("foo"), kgo.DisableAutoCommit())
+	seen := consumeN(t, cl, n)
+	if len(seen) != n {
+		t.Fatalf("saw %d unique records, expected %d", len(seen), n)
+	}
+
+	committed := make(chan error, 1)
+	cl.CommitOffsets(context.Background(), cl.UncommittedOffsets(), func(_ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+		if err == nil {
+			for topic, errs := range kgo.CommitErrors(resp) {
+				for partition, perr := range errs {
+					err = fmt.Errorf("%s[%d]: %v", topic, partition, perr)
+				}
+			}
+		}
+		committed <- err
+	})
+	if err := <-committed; err != nil {
+		t.Fatalf("unable to commit: %v", err)
+	}
+	if uncommitted := cl.UncommittedOffsets(); uncommitted != nil {
+		t.Errorf("got uncommitted offsets %v after committing, expected none", uncommitted)
+	}
+	var localTotal int64
+	for _, partitions := range cl.CommittedOffsetsLocal() {
+		for _, eo := range partitions {
+			localTotal += eo.Offset
+		}
+	}
+	if localTotal != n {
+		t.Errorf("local committed offsets sum to %d, expected %d", localTotal, n)
+	}
+
+	fetchReq := kmsg.NewPtrOffsetFetchRequest()
+	fetchReq.Group = "group"
+	fetchResp, err := fetchReq.RequestWith(context.Background(), cl)
+	if err != nil {
+		t.Fatalf("unable to fetch offsets: %v", err)
+	}
+	var total int64
+	for _, topic := range fetchResp.Topics {
+		for _, partition := range topic.Partitions {
+			total += partition.Offset
+		}
+	}
+	if total != n {
+		t.Errorf("committed offsets sum to %d, expected %d", total, n)
+	}
+}
+
+type throttleHook struct{ throttled chan time.Duration }
+
+func (h *throttleHook) OnThrottle(_ kgo.BrokerMetadata, d time.Duration, _ bool) {
+	select {
+	case h.throttled <- d:
+	default:
+	}
+}
+
+func TestFaults(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewCluster(SeedTopics(1, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	hook := &throttleHook{make(chan time.Duration, 1)}
+	cl := newTestClient(t, c, kgo.WithHooks(hook))
+	defer cl.Close()
+
+	// A produce that hits a dead connection, then a mismatched
+	// correlation ID, should be retried until it succeeds.
+	c.InjectFault(0, Fault{CloseConn: true})
+	c.InjectFault(0, Fault{CorruptCorrelationID: true})
+	produceN(t, cl, "foo", 1)
+
+	c.KillConnections()
+	c.InjectFault(0, Fault{ThrottleMillis: 10})
+	produceN(t, cl, "foo", 1)
+
+	select {
+	case d := <-hook.throttled:
+		if d != 10*time.Millisecond {
+			t.Errorf("got throttle %v, expected 10ms", d)
+		}
+	default:
+		t.Error("expected a throttle to be observed")
+	}
+
+	cl.AssignPartitions(kgo.ConsumeTopics(kgo.NewOffset().AtStart(), "foo"))
+	consumeN(t, cl, 2)
+}
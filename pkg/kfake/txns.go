@@ -0,0 +1,234 @@
+package kfake
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// txn is the state of a transactional ID. This is a simplified transaction
+// coordinator: transactions never time out, and ending a transaction writes
+// its markers immediately.
+type txn struct {
+	pid   int64
+	epoch int16
+
+	// partitions are the partitions added to the ongoing transaction.
+	partitions map[string]map[int32]bool
+}
+
+// ongoingTxn tracks a producer's transaction that is ongoing in a
+// partition, from the first offset it produced in the partition.
+type ongoingTxn struct {
+	pid         int64
+	firstOffset int64
+}
+
+// lso returns the last stable offset: the first offset of the earliest
+// ongoing transaction, or the high watermark if there is none.
+func (p *partition) lso() int64 {
+	lso := p.hw
+	for _, o := range p.ongoing {
+		if o.firstOffset < lso {
+			lso = o.firstOffset
+		}
+	}
+	return lso
+}
+
+// trackTxnBatch starts tracking a producer's transaction in the partition if
+// b is the first transactional batch the producer produced to it.
+func (p *partition) trackTxnBatch(b batch) {
+	if !b.transactional {
+		return
+	}
+	for _, o := range p.ongoing {
+		if o.pid == b.pid {
+			return
+		}
+	}
+	p.ongoing = append(p.ongoing, ongoingTxn{b.pid, b.firstOffset})
+}
+
+// endTxn writes a commit or abort marker for the producer's transaction in
+// the partition and stops tracking the transaction as ongoing.
+func (p *partition) endTxn(pid int64, epoch int16, commit bool) {
+	for i, o := range p.ongoing {
+		if o.pid != pid {
+			continue
+		}
+		p.ongoing = append(p.ongoing[:i], p.ongoing[i+1:]...)
+		if !commit {
+			p.aborted = append(p.aborted, abortedTxn{
+				pid:         pid,
+				firstOffset: o.firstOffset,
+				lastOffset:  p.hw, // the marker below
+			})
+		}
+		break
+	}
+	p.append(controlBatch(pid, epoch, commit))
+}
+
+// abortedTxn is an aborted transaction in a partition, from the first offset
+// the producer produced through its abort marker.
+type abortedTxn struct {
+	pid         int64
+	firstOffset int64
+	lastOffset  int64
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// controlBatch returns a transaction marker batch with one control record.
+func controlBatch(pid int64, epoch int16, commit bool) batch {
+	var typ int16 // 0 is abort, 1 is commit
+	if commit {
+		typ = 1
+	}
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint16(key[2:], uint16(typ)) // version 0, then type
+	value := make([]byte, 6)                         // version 0, then coordinator epoch 0
+
+	rec := kmsg.Record{Key: key, Value: value}
+	rec.Length = int32(len(rec.AppendTo(nil)) - 1) // the length varint for our small record is one byte
+
+	now := time.Now().UnixNano() / 1e6
+	kb := kmsg.RecordBatch{
+		Magic:          2,
+		Attributes:     0x0030, // transactional and control
+		FirstTimestamp: now,
+		MaxTimestamp:   now,
+		ProducerID:     pid,
+		ProducerEpoch:  epoch,
+		FirstSequence:  -1,
+		NumRecords:     1,
+		Records:        rec.AppendTo(nil),
+	}
+	raw := kb.AppendTo(nil)
+	binary.BigEndian.PutUint32(raw[8:], uint32(len(raw)-12))
+	binary.BigEndian.PutUint32(raw[17:], crc32.Checksum(raw[21:], crc32c))
+
+	return batch{
+		maxTimestamp:  now,
+		pid:           pid,
+		transactional: true,
+		raw:           raw,
+	}
+}
+
+func (c *Cluster) handleInitProducerID(req *kmsg.InitProducerIDRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.InitProducerIDResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if req.TransactionalID == nil {
+		c.pids++
+		resp.ProducerID = c.pids
+		return resp
+	}
+
+	// Re-initializing a transactional ID fences the prior producer by
+	// bumping the epoch, and aborts its ongoing transaction.
+	t, exists := c.txns[*req.TransactionalID]
+	if !exists {
+		c.pids++
+		t = &txn{pid: c.pids}
+		c.txns[*req.TransactionalID] = t
+	} else {
+		c.endTxn(t, false)
+		t.epoch++
+	}
+	resp.ProducerID = t.pid
+	resp.ProducerEpoch = t.epoch
+	return resp
+}
+
+// lookupTxn returns the transactional ID's state, or an error code if the
+// producer ID or epoch do not match it.
+func (c *Cluster) lookupTxn(id string, pid int64, epoch int16) (*txn, int16) {
+	t, exists := c.txns[id]
+	switch {
+	case !exists || t.pid != pid:
+		return nil, kerr.InvalidProducerIDMapping.Code
+	case t.epoch != epoch:
+		return nil, kerr.InvalidProducerEpoch.Code
+	}
+	return t, 0
+}
+
+func (c *Cluster) handleAddPartitionsToTxn(req *kmsg.AddPartitionsToTxnRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.AddPartitionsToTxnResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, errCode := c.lookupTxn(req.TransactionalID, req.ProducerID, req.ProducerEpoch)
+	for _, rt := range req.Topics {
+		st := kmsg.AddPartitionsToTxnResponseTopic{Topic: rt.Topic}
+		for _, partition := range rt.Partitions {
+			sp := kmsg.AddPartitionsToTxnResponseTopicPartition{
+				Partition: partition,
+				ErrorCode: errCode,
+			}
+			if errCode == 0 && c.data.partition(rt.Topic, partition) == nil {
+				sp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			}
+			if sp.ErrorCode == 0 {
+				if t.partitions == nil {
+					t.partitions = make(map[string]map[int32]bool)
+				}
+				ps := t.partitions[rt.Topic]
+				if ps == nil {
+					ps = make(map[int32]bool)
+					t.partitions[rt.Topic] = ps
+				}
+				ps[partition] = true
+			}
+			st.Partitions = append(st.Partitions, sp)
+		}
+		resp.Topics = append(resp.Topics, st)
+	}
+	return resp
+}
+
+func (c *Cluster) handleEndTxn(req *kmsg.EndTxnRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.EndTxnResponse)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, errCode := c.lookupTxn(req.TransactionalID, req.ProducerID, req.ProducerEpoch)
+	if errCode != 0 {
+		resp.ErrorCode = errCode
+		return resp
+	}
+	if len(t.partitions) == 0 {
+		resp.ErrorCode = kerr.InvalidTxnState.Code
+		return resp
+	}
+	c.endTxn(t, req.Commit)
+	return resp
+}
+
+// endTxn writes markers to every partition in the transaction and wakes any
+// fetch waiting for the markers to advance the last stable offset.
+func (c *Cluster) endTxn(t *txn, commit bool) {
+	if len(t.partitions) == 0 {
+		return
+	}
+	for topic, partitions := range t.partitions {
+		for partition := range partitions {
+			if p := c.data.partition(topic, partition); p != nil {
+				p.endTxn(t.pid, t.epoch, commit)
+			}
+		}
+	}
+	t.partitions = nil
+	close(c.data.notify)
+	c.data.notify = make(chan struct{})
+}
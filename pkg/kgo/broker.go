@@ -2,6 +2,7 @@ package kgo
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ import (
 	"github.com/twmb/franz-go/pkg/kbin"
 	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/kversion"
 	"github.com/twmb/franz-go/pkg/sasl"
 )
 
@@ -30,6 +32,7 @@ type promisedResp struct {
 	corrID int32
 
 	readTimeout time.Duration
+	stallWait   time.Duration // see noStall
 
 	// With flexible headers, we skip tags at the end of the response
 	// header for now because they're currently unused. However, the
@@ -55,6 +58,11 @@ type promisedResp struct {
 	promise func(kmsg.Response, error)
 
 	enqueue time.Time // used to calculate readWait
+
+	writeWait   time.Duration // for BrokerE2EHook
+	timeToWrite time.Duration
+
+	req kmsg.Request // for requeueing if the connection dies; see requeue
 }
 
 var unknownMetadata = BrokerMetadata{
@@ -83,6 +91,12 @@ type BrokerMetadata struct {
 	// Seed brokers will not have a rack.
 	Rack *string
 
+	// IsSeed is true if this is a seed broker from the SeedBrokers option
+	// rather than a broker discovered from metadata. Seed brokers have a
+	// very negative NodeID, starting at math.MinInt32, that does not
+	// correspond to any real broker ID.
+	IsSeed bool
+
 	_internal struct{} // allow us to add fields later
 }
 
@@ -107,11 +121,14 @@ type broker struct {
 	// write goes to, but the write is expected to be fast whereas the wait
 	// for the response is expected to be slow.
 	//
-	// Produce requests go to cxnProduce, fetch to cxnFetch, and all others
-	// to cxnNormal.
+	// Which connection a request goes to depends on the client's
+	// ConnSharing; by default, produce requests go to cxnProduce, fetch to
+	// cxnFetch, and all others to cxnNormal. cxnGroup is only used with
+	// ConnSharingSplitAll.
 	cxnNormal  *brokerCxn
 	cxnProduce *brokerCxn
 	cxnFetch   *brokerCxn
+	cxnGroup   *brokerCxn
 
 	// dieMu guards sending to reqs in case the broker has been
 	// permanently stopped.
@@ -120,6 +137,30 @@ type broker struct {
 	reqs chan promisedReq
 	// dead is an atomic so a backed up reqs cannot block broker stoppage.
 	dead int32
+
+	// versionGuess is the guessed Kafka version of this broker, stored
+	// as a string once any connection loads ApiVersions.
+	versionGuess atomic.Value
+
+	// dialFailedAt is the atomic unix nano time of the last failed dial,
+	// or zero if the last dial succeeded. This is used with
+	// SeedPolicyFallbackOnly.
+	dialFailedAt int64
+}
+
+// loadVersionGuess returns the guessed Kafka version of this broker, or
+// "unknown" if no connection has loaded ApiVersions yet.
+func (b *broker) loadVersionGuess() string {
+	if guess, ok := b.versionGuess.Load().(string); ok {
+		return guess
+	}
+	return "unknown"
+}
+
+// unreachable returns whether dialing this broker recently failed.
+func (b *broker) unreachable() bool {
+	failedAt := atomic.LoadInt64(&b.dialFailedAt)
+	return failedAt != 0 && b.cl.cfg.clock.Now().Sub(time.Unix(0, failedAt)) < b.cl.cfg.metadataMinAge
 }
 
 const unknownControllerID = -1
@@ -141,6 +182,7 @@ func (cl *Client) newBroker(nodeID int32, host string, port int32, rack *string)
 			Host:   host,
 			Port:   port,
 			Rack:   rack,
+			IsSeed: nodeID < -1, // see unknownSeedID
 		},
 
 		reqs: make(chan promisedReq, 10),
@@ -221,102 +263,279 @@ func (b *broker) handleReqs() {
 		b.cxnNormal.die()
 		b.cxnProduce.die()
 		b.cxnFetch.die()
+		b.cxnGroup.die()
 	}()
 
-	for pr := range b.reqs {
-		req := pr.req
-		cxn, err := b.loadConnection(pr.ctx, req.Key())
-		if err != nil {
-			pr.promise(nil, err)
-			continue
+	var held *promisedReq // taken while coalescing, but not coalescable
+	for {
+		var pr promisedReq
+		if held != nil {
+			pr, held = *held, nil
+		} else {
+			var ok bool
+			if pr, ok = <-b.reqs; !ok {
+				return
+			}
 		}
 
-		if int(req.Key()) > len(cxn.versions[:]) ||
-			b.cl.cfg.maxVersions != nil && !b.cl.cfg.maxVersions.HasKey(req.Key()) {
-			pr.promise(nil, ErrUnknownRequestKey)
+		cxn, ok := b.prepareReq(pr)
+		if !ok {
 			continue
 		}
-
-		// If cxn.versions[0] is non-negative, then we loaded API
-		// versions. If the version for this request is negative, we
-		// know the broker cannot handle this request.
-		if cxn.versions[0] >= 0 && cxn.versions[req.Key()] < 0 {
-			pr.promise(nil, ErrBrokerTooOld)
+		if !b.cl.cfg.coalesce || !coalescable(pr.req) || cxn.throttled() {
+			b.write(cxn, []promisedReq{pr})
 			continue
 		}
 
-		ourMax := req.MaxVersion()
-		if b.cl.cfg.maxVersions != nil {
-			userMax, _ := b.cl.cfg.maxVersions.LookupMaxKeyVersion(req.Key()) // we validated HasKey above
-			if userMax < ourMax {
-				ourMax = userMax
+		// We only coalesce requests that are already queued; we never
+		// wait for more, so that a lone request is not delayed.
+		prs := []promisedReq{pr}
+		maxReqs := maxCoalescedReqs
+		if n := b.cl.cfg.maxInFlight; n > 0 && n < maxReqs {
+			maxReqs = n // we could never write more at once
+		}
+		var closed bool
+	coalesce:
+		for len(prs) < maxReqs {
+			select {
+			case next, ok := <-b.reqs:
+				if !ok {
+					closed = true
+					break coalesce
+				}
+				if !coalescable(next.req) || !b.isLiveCxnFor(cxn, next.req.Key()) {
+					held = &next
+					break coalesce
+				}
+				nextCxn, ok := b.prepareReq(next)
+				if !ok {
+					continue
+				}
+				if nextCxn != cxn { // reauthenticating killed our cxn
+					held = &next
+					break coalesce
+				}
+				prs = append(prs, next)
+			default:
+				break coalesce
 			}
 		}
 
-		// If brokerMax is negative at this point, we have no api
-		// versions because the client is pinned pre 0.10.0 and we
-		// stick with our max.
-		version := ourMax
-		if brokerMax := cxn.versions[req.Key()]; brokerMax >= 0 && brokerMax < ourMax {
-			version = brokerMax
+		b.write(cxn, prs)
+		if closed {
+			return
 		}
+	}
+}
+
+// maxCoalescedReqs is the most requests we write at once when coalescing.
+const maxCoalescedReqs = 32
+
+// minVersionRequest wraps a request that the client issues internally and
+// that must be issued at or above min, failing with ErrBrokerTooOld otherwise.
+// This is for requests using a field that older versions would silently drop.
+type minVersionRequest struct {
+	kmsg.Request
+	min int16
+}
+
+// coalescable returns whether a request can be coalesced with others into one
+// write. Produce and fetch requests can be large and are already batched, and
+// preconnect and sasl probe requests are never written.
+func coalescable(req kmsg.Request) bool {
+	switch req.(type) {
+	case *preconnectRequest, *saslProbeRequest:
+		return false
+	}
+	key := req.Key()
+	return key != 0 && key != 1 // the client's produce and fetch requests are internal types
+}
 
-		// If the version now (after potential broker downgrading) is
-		// lower than we desire, we fail the request for the broker is
-		// too old.
+// prepareReq loads the connection for a request and sets the request's
+// version, returning false if the request has already been promised.
+func (b *broker) prepareReq(pr promisedReq) (*brokerCxn, bool) {
+	req := pr.req
+	if _, isProbe := req.(*saslProbeRequest); isProbe {
+		pr.promise(nil, b.reauthExpiring())
+		return nil, false
+	}
+
+	cxn, err := b.loadConnection(pr.ctx, req.Key())
+	if err != nil {
+		pr.promise(nil, err)
+		return nil, false
+	}
+
+	if _, isPreconnect := req.(*preconnectRequest); isPreconnect {
+		pr.promise(nil, nil)
+		return nil, false
+	}
+
+	if int(req.Key()) > len(cxn.versions[:]) ||
+		b.cl.cfg.maxVersions != nil && !b.cl.cfg.maxVersions.HasKey(req.Key()) {
+		pr.promise(nil, &ErrUnknownRequestKey{Key: req.Key()})
+		return nil, false
+	}
+
+	// If cxn.versions[0] is non-negative, then we loaded API
+	// versions. If the version for this request is negative, we
+	// know the broker cannot handle this request.
+	if cxn.versions[0] >= 0 && cxn.versions[req.Key()] < 0 {
+		var minVersion int16
 		if b.cl.cfg.minVersions != nil {
-			minVersion, minVersionExists := b.cl.cfg.minVersions.LookupMaxKeyVersion(req.Key())
-			if minVersionExists && version < minVersion {
-				pr.promise(nil, ErrBrokerTooOld)
-				continue
-			}
+			minVersion, _ = b.cl.cfg.minVersions.LookupMaxKeyVersion(req.Key())
 		}
+		pr.promise(nil, &ErrBrokerTooOld{
+			Key:              req.Key(),
+			MinVersion:       minVersion,
+			BrokerMaxVersion: -1,
+		})
+		return nil, false
+	}
 
-		req.SetVersion(version) // always go for highest version
-
-		if !cxn.expiry.IsZero() && time.Now().After(cxn.expiry) {
-			// If we are after the reauth time, try to reauth. We
-			// can only have an expiry if we went the authenticate
-			// flow, so we know we are authenticating again.
-			// For KIP-368.
-			if err = cxn.sasl(); err != nil {
-				pr.promise(nil, err)
-				cxn.die()
-				continue
-			}
+	ourMax := req.MaxVersion()
+	if b.cl.cfg.maxVersions != nil {
+		userMax, _ := b.cl.cfg.maxVersions.LookupMaxKeyVersion(req.Key()) // we validated HasKey above
+		if userMax < ourMax {
+			ourMax = userMax
 		}
+	}
 
-		// Juuuust before we issue the request, we check if it was
-		// canceled. We could have previously tried this request, which
-		// then failed and retried due to the error being ErrConnDead.
-		// Checking the context was canceled here ensures we do not
-		// loop. We could be more precise with error tracking, though.
-		select {
-		case <-pr.ctx.Done():
-			pr.promise(nil, pr.ctx.Err())
-			continue
-		default:
+	// If brokerMax is negative at this point, we have no api
+	// versions because the client is pinned pre 0.10.0 and we
+	// stick with our max.
+	version := ourMax
+	if brokerMax := cxn.versions[req.Key()]; brokerMax >= 0 && brokerMax < ourMax {
+		version = brokerMax
+	}
+
+	// If the version now (after potential broker downgrading) is
+	// lower than we desire, we fail the request for the broker is
+	// too old. Internal requests can require a higher version than
+	// the client does, if a field they use would otherwise be
+	// silently dropped.
+	var minVersion int16
+	var minVersionExists bool
+	if b.cl.cfg.minVersions != nil {
+		minVersion, minVersionExists = b.cl.cfg.minVersions.LookupMaxKeyVersion(req.Key())
+	}
+	if warnOnly := b.cl.cfg.minWarnOnly; minVersionExists && version < minVersion && (warnOnly[-1] || warnOnly[req.Key()]) {
+		if !cxn.warnedMin[req.Key()] {
+			cxn.warnedMin[req.Key()] = true
+			b.cl.cfg.logger.Log(LogLevelWarn, "issuing request below its min version because the broker is too old",
+				"addr", b.addr,
+				"id", b.meta.NodeID,
+				"key", req.Key(),
+				"version", version,
+				"min_version", minVersion,
+			)
+		}
+		minVersionExists = false
+	}
+	if mvr, ok := req.(*minVersionRequest); ok && (!minVersionExists || mvr.min > minVersion) {
+		minVersion, minVersionExists = mvr.min, true
+	}
+	if minVersionExists && version < minVersion {
+		brokerMax := cxn.versions[req.Key()]
+		if brokerMax < 0 {
+			brokerMax = version // pinned pre 0.10.0; use what we would send
 		}
+		pr.promise(nil, &ErrBrokerTooOld{
+			Key:              req.Key(),
+			MinVersion:       minVersion,
+			BrokerMaxVersion: brokerMax,
+		})
+		return nil, false
+	}
 
-		corrID, err := cxn.writeRequest(pr.ctx, pr.enqueue, req)
+	if version < ourMax {
+		b.cl.cfg.hooks.each(func(h Hook) {
+			if h, ok := h.(BrokerVersionDowngradeHook); ok {
+				h.OnVersionDowngrade(b.meta, req.Key(), ourMax, version)
+			}
+		})
+	}
 
-		if err != nil {
+	req.SetVersion(version) // always go for highest version
+
+	// If the connection has writes waiting for room, those writes
+	// reauthenticate when they are issued; see writeGated.
+	if !cxn.isGating() {
+		if err = cxn.maybeReauth(); err != nil {
 			pr.promise(nil, err)
-			cxn.die()
-			continue
+			return nil, false
 		}
+	}
 
-		rt, _ := cxn.cl.connTimeoutFn(req)
+	// Juuuust before we issue the request, we check if it was
+	// canceled. We could have previously tried this request, which
+	// then failed and retried due to the error being ErrConnDead.
+	// Checking the context was canceled here ensures we do not
+	// loop. We could be more precise with error tracking, though.
+	select {
+	case <-pr.ctx.Done():
+		pr.promise(nil, pr.ctx.Err())
+		return nil, false
+	default:
+	}
 
-		cxn.waitResp(promisedResp{
-			pr.ctx,
-			corrID,
-			rt,
-			req.IsFlexible() && req.Key() != 18, // response header not flexible if ApiVersions; see promisedResp doc
-			req.ResponseKind(),
-			pr.promise,
-			time.Now(),
-		})
+	return cxn, true
+}
+
+// write writes requests to a connection. If the connection is at its in
+// flight limit, or already has writes waiting for room, the write is queued
+// on the connection and issued by writeGated once responses free room, so
+// that requests on the broker's other connections are not held up.
+func (b *broker) write(cxn *brokerCxn, prs []promisedReq) {
+	if cxn.inflight != nil {
+		cxn.gateMu.Lock()
+		if cxn.gating || !cxn.tryAcquireInFlight(len(prs)) {
+			cxn.gated = append(cxn.gated, prs)
+			if !cxn.gating {
+				cxn.gating = true
+				go cxn.writeGated()
+			}
+			cxn.gateMu.Unlock()
+			return
+		}
+		cxn.gateMu.Unlock()
+	}
+	if len(prs) == 1 {
+		b.writeReq(cxn, prs[0])
+	} else {
+		b.writeReqs(cxn, prs)
+	}
+}
+
+// writeReq writes a single request and, if successful, waits for its response.
+func (b *broker) writeReq(cxn *brokerCxn, pr promisedReq) {
+	req := pr.req
+	version := req.GetVersion() // the promise can retry and reset the version
+	corrID, writeWait, timeToWrite, err := cxn.writeRequest(pr.ctx, pr.enqueue, req)
+	if err != nil {
+		pr.promise(nil, err)
+		cxn.onRequestComplete(req.Key(), version, corrID, writeWait, timeToWrite, 0, 0, err)
+		cxn.die()
+		return
+	}
+	cxn.waitPromisedResp(pr, corrID, writeWait, timeToWrite)
+}
+
+// writeReqs writes many requests in one write and, if successful, waits for
+// their responses in order.
+func (b *broker) writeReqs(cxn *brokerCxn, prs []promisedReq) {
+	corrIDs, writeWaits, timeToWrite, err := cxn.writeRequests(prs)
+	if err != nil {
+		for i, pr := range prs {
+			key, version := pr.req.Key(), pr.req.GetVersion()
+			pr.promise(nil, err)
+			cxn.onRequestComplete(key, version, corrIDs[i], writeWaits[i], timeToWrite, 0, 0, err)
+		}
+		cxn.die()
+		return
+	}
+	for i, pr := range prs {
+		cxn.waitPromisedResp(pr, corrIDs[i], writeWaits[i], timeToWrite)
 	}
 }
 
@@ -335,13 +554,7 @@ func (p bufPool) put(b []byte) { p.p.Put(&b) }
 // loadConection returns the broker's connection, creating it if necessary
 // and returning an error of if that fails.
 func (b *broker) loadConnection(ctx context.Context, reqKey int16) (*brokerCxn, error) {
-	pcxn := &b.cxnNormal
-	if reqKey == 0 {
-		pcxn = &b.cxnProduce
-	} else if reqKey == 1 {
-		pcxn = &b.cxnFetch
-	}
-
+	pcxn, formatter := b.cxnFor(reqKey)
 	if *pcxn != nil && atomic.LoadInt32(&(*pcxn).dead) == 0 {
 		return *pcxn, nil
 	}
@@ -355,9 +568,13 @@ func (b *broker) loadConnection(ctx context.Context, reqKey int16) (*brokerCxn,
 		cl: b.cl,
 		b:  b,
 
-		addr:   b.addr,
-		conn:   conn,
-		deadCh: make(chan struct{}),
+		addr:      b.addr,
+		conn:      conn,
+		formatter: formatter,
+		deadCh:    make(chan struct{}),
+	}
+	if n := b.cl.cfg.maxInFlight; n > 0 {
+		cxn.inflight = make(chan struct{}, n)
 	}
 	if err = cxn.init(); err != nil {
 		b.cl.cfg.logger.Log(LogLevelDebug, "connection initialization failed", "addr", b.addr, "id", b.meta.NodeID, "err", err)
@@ -370,8 +587,90 @@ func (b *broker) loadConnection(ctx context.Context, reqKey int16) (*brokerCxn,
 	return cxn, nil
 }
 
+// cxnFor returns where the connection for a request key is stored, and the
+// formatter that connection uses by default.
+func (b *broker) cxnFor(reqKey int16) (**brokerCxn, *kmsg.RequestFormatter) {
+	pcxn, formatter := &b.cxnNormal, b.cl.reqFormatter
+	if b.cl.cfg.connSharing != ConnSharingAllOnOne {
+		switch reqKey {
+		case 0:
+			pcxn, formatter = &b.cxnProduce, b.cl.produceFormatter
+		case 1:
+			pcxn, formatter = &b.cxnFetch, b.cl.fetchFormatter
+		case 11, 12, 13, 14: // join, heartbeat, leave, sync
+			if b.cl.cfg.connSharing == ConnSharingSplitAll {
+				pcxn = &b.cxnGroup
+			}
+		}
+	}
+	return pcxn, formatter
+}
+
+// isLiveCxnFor returns whether cxn is alive and is the connection a request
+// key would be issued on, meaning loading the connection would not dial.
+func (b *broker) isLiveCxnFor(cxn *brokerCxn, reqKey int16) bool {
+	pcxn, _ := b.cxnFor(reqKey)
+	return *pcxn == cxn && atomic.LoadInt32(&cxn.dead) == 0
+}
+
+// preconnectRequest is an internal request that only loads the connection
+// that an ApiVersions request would use. It is never written to a broker.
+type preconnectRequest struct {
+	kmsg.ApiVersionsRequest
+}
+
+// saslProbeRequest is an internal request that reauthenticates any of the
+// broker's connections that expire before the next probe. It is never written
+// to a broker.
+type saslProbeRequest struct {
+	kmsg.ApiVersionsRequest
+}
+
+// reauthExpiring reauthenticates every live, unthrottled, idle connection
+// whose sasl session expires within the probe interval, killing any
+// connection that fails to reauthenticate. This returns the first error
+// encountered.
+//
+// Reauthenticating reads from the connection, so we skip connections with
+// responses outstanding or writes waiting for room: their reads belong to
+// handleResps. A busy connection reauthenticates when a request is issued
+// after its expiry instead.
+//
+// This must be called in handleReqs, which owns the broker's connections.
+func (b *broker) reauthExpiring() error {
+	var firstErr error
+	reauthBy := b.cl.cfg.clock.Now().Add(b.cl.cfg.saslProbeInterval)
+	for _, cxn := range []*brokerCxn{b.cxnNormal, b.cxnProduce, b.cxnFetch, b.cxnGroup} {
+		if cxn == nil ||
+			atomic.LoadInt32(&cxn.dead) == 1 ||
+			cxn.isGating() ||
+			atomic.LoadInt32(&cxn.outstanding) > 0 ||
+			cxn.expiry.IsZero() ||
+			cxn.expiry.After(reauthBy) ||
+			cxn.throttled() {
+			continue
+		}
+		b.cl.cfg.logger.Log(LogLevelDebug, "reauthenticating connection ahead of sasl expiry", "addr", b.addr, "id", b.meta.NodeID, "expiry", cxn.expiry)
+		if err := cxn.sasl(); err != nil {
+			cxn.die()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
 // connect connects to the broker's addr, returning the new connection.
 func (b *broker) connect(ctx context.Context) (net.Conn, error) {
+	if sem := b.cl.dialSem; sem != nil {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 	b.cl.cfg.logger.Log(LogLevelDebug, "opening connection to broker", "addr", b.addr, "id", b.meta.NodeID)
 	start := time.Now()
 	conn, err := b.cl.cfg.dialFn(ctx, "tcp", b.addr)
@@ -383,16 +682,121 @@ func (b *broker) connect(ctx context.Context) (net.Conn, error) {
 	})
 	if err != nil {
 		b.cl.cfg.logger.Log(LogLevelWarn, "unable to open connection to broker", "addr", b.addr, "id", b.meta.NodeID, "err", err)
+		atomic.StoreInt64(&b.dialFailedAt, b.cl.cfg.clock.Now().UnixNano())
 		if _, ok := err.(net.Error); ok {
 			return nil, ErrNoDial
 		}
 		return nil, err
 	} else {
 		b.cl.cfg.logger.Log(LogLevelDebug, "connection opened to broker", "addr", b.addr, "id", b.meta.NodeID)
+		atomic.StoreInt64(&b.dialFailedAt, 0)
+	}
+	if tcp, ok := underlyingTCPConn(conn); ok {
+		if err := b.cl.cfg.tuneTCP(tcp); err != nil {
+			b.cl.cfg.logger.Log(LogLevelWarn, "unable to set tcp options on broker connection", "addr", b.addr, "id", b.meta.NodeID, "err", err)
+		}
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok && b.cl.cfg.tlsVerifyBroker != nil {
+		if err := b.verifyTLS(ctx, tlsConn); err != nil {
+			b.cl.cfg.logger.Log(LogLevelWarn, "unable to verify tls connection to broker", "addr", b.addr, "id", b.meta.NodeID, "err", err)
+			conn.Close()
+			return nil, ErrNoDial
+		}
 	}
 	return conn, nil
 }
 
+// underlyingTCPConn returns the *net.TCPConn beneath a dialed connection, if
+// there is one. Wrapping connections that expose what they wrap through a
+// NetConn method, such as a *tls.Conn since Go 1.18, are unwrapped so that
+// TCP options apply to TLS connections as well.
+func underlyingTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// verifyTLS handshakes a freshly dialed TLS connection, if necessary, and
+// then runs the user's broker verification.
+func (b *broker) verifyTLS(ctx context.Context, conn *tls.Conn) error {
+	if err := b.cl.cfg.handshakeTLS(ctx, conn); err != nil {
+		return err
+	}
+	return b.cl.cfg.tlsVerifyBroker(b.meta, conn.ConnectionState())
+}
+
+// handshakeTLS performs a TLS handshake if the dialer has not yet done so,
+// failing if the handshake takes longer than ConnTimeoutOverhead or the
+// context is done first so that a stalled peer cannot hang connection setup.
+func (cfg *cfg) handshakeTLS(ctx context.Context, conn *tls.Conn) error {
+	if conn.ConnectionState().HandshakeComplete {
+		return nil
+	}
+	deadline := time.Now().Add(cfg.connTimeoutOverhead)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-quit:
+		}
+	}()
+	err := conn.Handshake()
+	close(quit)
+	<-done
+	conn.SetDeadline(time.Time{})
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// tuneTCP applies the configured TCP options to a freshly dialed connection.
+func (cfg *cfg) tuneTCP(conn *net.TCPConn) error {
+	if err := conn.SetNoDelay(cfg.tcpNoDelay); err != nil {
+		return err
+	}
+	if cfg.tcpKeepAlive < 0 {
+		if err := conn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if cfg.tcpKeepAlive > 0 {
+		if err := conn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := conn.SetKeepAlivePeriod(cfg.tcpKeepAlive); err != nil {
+			return err
+		}
+	}
+	if cfg.tcpReadBuffer > 0 {
+		if err := conn.SetReadBuffer(cfg.tcpReadBuffer); err != nil {
+			return err
+		}
+	}
+	if cfg.tcpWriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(cfg.tcpWriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // brokerCxn manages an actual connection to a Kafka broker. This is separate
 // the broker struct to allow lazy connection (re)creation.
 type brokerCxn struct {
@@ -404,6 +808,12 @@ type brokerCxn struct {
 	addr     string
 	versions [kmsg.MaxKey + 1]int16
 
+	// formatter is the client's request formatter for this connection's
+	// role, which determines the client ID in request headers. If produce
+	// or fetch requests share this connection, they still use their own
+	// formatter; see writeRequest.
+	formatter *kmsg.RequestFormatter
+
 	mechanism sasl.Mechanism
 	expiry    time.Time
 
@@ -417,8 +827,52 @@ type brokerCxn struct {
 	resps chan promisedResp
 	// dead is an atomic so that a backed up resps cannot block cxn death.
 	dead int32
+	// outstanding, atomic, is the number of responses waiting to be
+	// read. While this is non-zero, handleResps owns reading the conn.
+	outstanding int32
 	// closed in cloneConn; allows throttle waiting to quit
 	deadCh chan struct{}
+
+	// inflight, if non-nil, has a slot for every request awaiting its
+	// response; see MaxInFlightPerConnection.
+	inflight chan struct{}
+
+	// gateMu guards gated and gating. Writes that are waiting for room
+	// in inflight queue in gated and are issued in order by writeGated,
+	// which runs while gating is true.
+	gateMu sync.Mutex
+	gated  [][]promisedReq
+	gating bool
+
+	// warnedMin tracks which keys we logged were issued below their min
+	// version; see MinVersionsWarnOnly.
+	warnedMin [kmsg.MaxKey + 1]bool
+
+	// readIDs is a ring of the most recently read correlation IDs, kept
+	// only if DetectDuplicateCorrelationIDs. Responses are only read from
+	// one goroutine at a time, so this needs no lock.
+	readIDs   [16]int32
+	nReadIDs  int
+	readIDsAt int
+}
+
+// trackReadID remembers a correlation ID that was read.
+func (cxn *brokerCxn) trackReadID(id int32) {
+	cxn.readIDs[cxn.readIDsAt] = id
+	cxn.readIDsAt = (cxn.readIDsAt + 1) % len(cxn.readIDs)
+	if cxn.nReadIDs < len(cxn.readIDs) {
+		cxn.nReadIDs++
+	}
+}
+
+// wasReadID returns whether a correlation ID was recently read.
+func (cxn *brokerCxn) wasReadID(id int32) bool {
+	for _, read := range cxn.readIDs[:cxn.nReadIDs] {
+		if read == id {
+			return true
+		}
+	}
+	return false
 }
 
 func (cxn *brokerCxn) init() error {
@@ -426,15 +880,35 @@ func (cxn *brokerCxn) init() error {
 		cxn.versions[i] = -1
 	}
 
-	if cxn.b.cl.cfg.maxVersions == nil || cxn.b.cl.cfg.maxVersions.HasKey(18) {
-		if err := cxn.requestAPIVersions(); err != nil {
-			cxn.cl.cfg.logger.Log(LogLevelError, "unable to request api versions", "err", err)
-			return err
+	var apiVersionsDur, saslDur time.Duration
+	err := func() error {
+		if cxn.b.cl.cfg.maxVersions == nil || cxn.b.cl.cfg.maxVersions.HasKey(18) {
+			start := time.Now()
+			err := cxn.requestAPIVersions()
+			apiVersionsDur = time.Since(start)
+			if err != nil {
+				cxn.cl.cfg.logger.Log(LogLevelError, "unable to request api versions", "err", err)
+				return err
+			}
 		}
-	}
 
-	if err := cxn.sasl(); err != nil {
-		cxn.cl.cfg.logger.Log(LogLevelError, "unable to initialize sasl", "err", err)
+		if len(cxn.cl.cfg.sasls) > 0 {
+			start := time.Now()
+			err := cxn.sasl()
+			saslDur = time.Since(start)
+			if err != nil {
+				cxn.cl.cfg.logger.Log(LogLevelError, "unable to initialize sasl", "err", err)
+				return err
+			}
+		}
+		return nil
+	}()
+	cxn.cl.cfg.hooks.each(func(h Hook) {
+		if h, ok := h.(BrokerConnectInitHook); ok {
+			h.OnConnectInit(cxn.b.meta, apiVersionsDur, saslDur, err)
+		}
+	})
+	if err != nil {
 		return err
 	}
 
@@ -452,13 +926,13 @@ start:
 		ClientSoftwareVersion: cxn.cl.cfg.softwareVersion,
 	}
 	cxn.cl.cfg.logger.Log(LogLevelDebug, "issuing api versions request", "version", maxVersion)
-	corrID, err := cxn.writeRequest(nil, time.Now(), req)
+	corrID, _, _, err := cxn.writeRequest(nil, time.Now(), req)
 	if err != nil {
 		return err
 	}
 
 	rt, _ := cxn.cl.connTimeoutFn(req)
-	rawResp, err := cxn.readResponse(nil, rt, time.Now(), req.Key(), corrID, false) // api versions does *not* use flexible response headers; see comment in promisedResp
+	rawResp, _, _, err := cxn.readResponse(nil, rt, noStall, time.Now(), req.Key(), corrID, false) // api versions does *not* use flexible response headers; see comment in promisedResp
 	if err != nil {
 		return err
 	}
@@ -502,6 +976,7 @@ start:
 		}
 		cxn.versions[key.ApiKey] = key.MaxVersion
 	}
+	cxn.b.versionGuess.Store(kversion.FromApiVersionsResponse(resp).VersionGuess())
 	cxn.cl.cfg.logger.Log(LogLevelDebug, "initialized api versions", "versions", cxn.versions)
 	return nil
 }
@@ -516,17 +991,18 @@ func (cxn *brokerCxn) sasl() error {
 
 	req := new(kmsg.SASLHandshakeRequest)
 start:
-	if mechanism.Name() != "GSSAPI" && cxn.versions[req.Key()] >= 0 {
+	useHandshake := mechanism.Name() != "GSSAPI" || cxn.cl.cfg.saslGSSAPIHandshake // raw-token GSSAPI skips the handshake
+	if useHandshake && cxn.versions[req.Key()] >= 0 {
 		req.Mechanism = mechanism.Name()
 		req.Version = cxn.versions[req.Key()]
 		cxn.cl.cfg.logger.Log(LogLevelDebug, "issuing SASLHandshakeRequest")
-		corrID, err := cxn.writeRequest(nil, time.Now(), req)
+		corrID, _, _, err := cxn.writeRequest(nil, time.Now(), req)
 		if err != nil {
 			return err
 		}
 
 		rt, _ := cxn.cl.connTimeoutFn(req)
-		rawResp, err := cxn.readResponse(nil, rt, time.Now(), req.Key(), corrID, req.IsFlexible())
+		rawResp, _, _, err := cxn.readResponse(nil, rt, noStall, time.Now(), req.Key(), corrID, req.IsFlexible())
 		if err != nil {
 			return err
 		}
@@ -557,8 +1033,24 @@ start:
 	return cxn.doSasl(authenticate)
 }
 
+// authenticate begins a sasl session, passing our TLS state to the mechanism
+// if the mechanism supports channel binding and the connection uses TLS.
+func (cxn *brokerCxn) authenticate() (sasl.Session, []byte, error) {
+	binder, canBind := cxn.mechanism.(sasl.ChannelBinder)
+	tlsConn, isTLS := cxn.conn.(*tls.Conn)
+	if !canBind || !isTLS {
+		return cxn.mechanism.Authenticate(cxn.cl.ctx, cxn.addr)
+	}
+	// The dialer may not have performed the handshake yet; if so, it is
+	// performed now. If it was already done, this is a no-op.
+	if err := cxn.cl.cfg.handshakeTLS(cxn.cl.ctx, tlsConn); err != nil {
+		return nil, nil, err
+	}
+	return binder.AuthenticateTLS(cxn.cl.ctx, cxn.addr, tlsConn.ConnectionState())
+}
+
 func (cxn *brokerCxn) doSasl(authenticate bool) error {
-	session, clientWrite, err := cxn.mechanism.Authenticate(cxn.cl.ctx, cxn.addr)
+	session, clientWrite, err := cxn.authenticate()
 	if err != nil {
 		return err
 	}
@@ -596,7 +1088,7 @@ func (cxn *brokerCxn) doSasl(authenticate bool) error {
 				return ErrConnDead
 			}
 			if !done {
-				if _, challenge, err, _, _ = cxn.readConn(context.Background(), rt, time.Now()); err != nil {
+				if _, challenge, err, _, _ = cxn.readConn(context.Background(), rt, noStall, time.Now()); err != nil {
 					return err
 				}
 			}
@@ -608,12 +1100,12 @@ func (cxn *brokerCxn) doSasl(authenticate bool) error {
 			req.Version = cxn.versions[req.Key()]
 			cxn.cl.cfg.logger.Log(LogLevelDebug, "issuing SASLAuthenticate", "version", req.Version, "step", step)
 
-			corrID, err := cxn.writeRequest(nil, time.Now(), req)
+			corrID, _, _, err := cxn.writeRequest(nil, time.Now(), req)
 			if err != nil {
 				return err
 			}
 			if !done {
-				rawResp, err := cxn.readResponse(nil, rt, time.Now(), req.Key(), corrID, req.IsFlexible())
+				rawResp, _, _, err := cxn.readResponse(nil, rt, noStall, time.Now(), req.Key(), corrID, req.IsFlexible())
 				if err != nil {
 					return err
 				}
@@ -650,38 +1142,40 @@ func (cxn *brokerCxn) doSasl(authenticate bool) error {
 		if lifetimeMillis < 5000 {
 			return fmt.Errorf("invalid short sasl lifetime millis %d", lifetimeMillis)
 		}
-		cxn.expiry = time.Now().Add(time.Duration(lifetimeMillis)*time.Millisecond - time.Second)
+		cxn.expiry = cxn.cl.cfg.clock.Now().Add(time.Duration(lifetimeMillis)*time.Millisecond - time.Second)
 		cxn.cl.cfg.logger.Log(LogLevelDebug, "connection has a limited lifetime", "reauthenticate_at", cxn.expiry)
 	}
 	return nil
 }
 
 // writeRequest writes a message request to the broker connection, bumping the
-// connection's correlation ID as appropriate for the next write.
-func (cxn *brokerCxn) writeRequest(ctx context.Context, enqueuedForWritingAt time.Time, req kmsg.Request) (int32, error) {
+// connection's correlation ID as appropriate for the next write. This returns
+// the correlation ID of the request and how long the request waited to be
+// written and took to write.
+func (cxn *brokerCxn) writeRequest(ctx context.Context, enqueuedForWritingAt time.Time, req kmsg.Request) (int32, time.Duration, time.Duration, error) {
 	// A nil ctx means we cannot be throttled.
 	if ctx != nil {
 		throttleUntil := time.Unix(0, atomic.LoadInt64(&cxn.throttleUntil))
-		if sleep := throttleUntil.Sub(time.Now()); sleep > 0 {
-			after := time.NewTimer(sleep)
+		if sleep := throttleUntil.Sub(cxn.cl.cfg.clock.Now()); sleep > 0 {
+			after := cxn.cl.cfg.clock.NewTimer(sleep)
 			select {
-			case <-after.C:
+			case <-after.C():
 			case <-ctx.Done():
 				after.Stop()
-				return 0, ctx.Err()
+				return 0, 0, 0, ctx.Err()
 			case <-cxn.cl.ctx.Done():
 				after.Stop()
-				return 0, ctx.Err()
+				return 0, 0, 0, ctx.Err()
 			case <-cxn.deadCh:
 				after.Stop()
-				return 0, ErrConnDead
+				return 0, 0, 0, ErrConnDead
 			}
 		}
 	}
 
 	buf := cxn.cl.bufPool.get()
 	defer cxn.cl.bufPool.put(buf)
-	buf = cxn.cl.reqFormatter.AppendRequest(
+	buf = cxn.formatterFor(ctx, req).AppendRequest(
 		buf[:0],
 		req,
 		cxn.corrID,
@@ -696,12 +1190,220 @@ func (cxn *brokerCxn) writeRequest(ctx context.Context, enqueuedForWritingAt tim
 		}
 	})
 
-	if writeErr != nil {
-		return 0, ErrConnDead
-	}
 	id := cxn.corrID
 	cxn.corrID++
-	return id, nil
+	if writeErr != nil {
+		return id, writeWait, timeToWrite, ErrConnDead
+	}
+	return id, writeWait, timeToWrite, nil
+}
+
+// writeRequests writes many requests in one write, returning the correlation
+// ID and write wait of each, even if the write fails. This is only used for coalescing, which we do not
+// do while the connection is throttled, so unlike writeRequest, this does not
+// wait out any throttle.
+//
+// The write is bounded by the smallest write timeout of the requests but is
+// not interrupted if any one request's context is canceled: we cannot cancel
+// only part of a write, and killing the connection would fail every other
+// request.
+func (cxn *brokerCxn) writeRequests(prs []promisedReq) ([]int32, []time.Duration, time.Duration, error) {
+	buf := cxn.cl.bufPool.get()
+	defer cxn.cl.bufPool.put(buf)
+
+	// AppendRequest writes the request size at the start of the slice it
+	// is given, so we format each request on its own before appending.
+	scratch := cxn.cl.bufPool.get()
+	defer cxn.cl.bufPool.put(scratch)
+
+	var (
+		ends    = make([]int, len(prs))
+		timeout time.Duration
+	)
+	for i, pr := range prs {
+		scratch = cxn.formatterFor(pr.ctx, pr.req).AppendRequest(
+			scratch[:0],
+			pr.req,
+			cxn.corrID+int32(i),
+		)
+		buf = append(buf, scratch...)
+		ends[i] = len(buf)
+		if _, wt := cxn.cl.connTimeoutFn(pr.req); wt > 0 && (timeout == 0 || wt < timeout) {
+			timeout = wt
+		}
+	}
+
+	// writeConn measures the write wait from the first request's enqueue
+	// time, which gives us when the write started.
+	bytesWritten, writeErr, firstWait, timeToWrite := cxn.writeConn(nil, buf, timeout, prs[0].enqueue)
+	writeStart := prs[0].enqueue.Add(firstWait)
+
+	writeWaits := make([]time.Duration, len(prs))
+	var start int
+	for i, pr := range prs {
+		writeWaits[i] = writeStart.Sub(pr.enqueue)
+
+		// Each request is attributed only the bytes of it that were
+		// written.
+		written := bytesWritten - start
+		if written < 0 {
+			written = 0
+		} else if reqLen := ends[i] - start; written > reqLen {
+			written = reqLen
+		}
+		start = ends[i]
+
+		cxn.cl.cfg.hooks.each(func(h Hook) {
+			if h, ok := h.(BrokerWriteHook); ok {
+				h.OnWrite(cxn.b.meta, pr.req.Key(), written, writeWaits[i], timeToWrite, writeErr)
+			}
+		})
+	}
+
+	corrIDs := make([]int32, len(prs))
+	for i := range prs {
+		corrIDs[i] = cxn.corrID
+		cxn.corrID++
+	}
+	if writeErr != nil {
+		return corrIDs, writeWaits, timeToWrite, ErrConnDead
+	}
+	return corrIDs, writeWaits, timeToWrite, nil
+}
+
+// formatterFor returns the formatter to use for a request on this connection.
+func (cxn *brokerCxn) formatterFor(ctx context.Context, req kmsg.Request) *kmsg.RequestFormatter {
+	formatter := cxn.formatter
+	switch req.Key() {
+	case 0:
+		formatter = cxn.cl.produceFormatter
+	case 1:
+		formatter = cxn.cl.fetchFormatter
+	}
+	if ctx != nil {
+		if id, ok := ctx.Value(clientIDKey{}).(string); ok {
+			formatter = kmsg.NewRequestFormatter(kmsg.FormatterClientID(id))
+		}
+	}
+	return formatter
+}
+
+// tryAcquireInFlight takes room for n requests awaiting their responses if
+// the connection has room for all of them, returning whether it did.
+func (cxn *brokerCxn) tryAcquireInFlight(n int) bool {
+	for i := 0; i < n; i++ {
+		select {
+		case cxn.inflight <- struct{}{}:
+		default:
+			for ; i > 0; i-- {
+				<-cxn.inflight
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// acquireInFlight waits until the connection has room for another request
+// awaiting its response, returning an error if the context is done or the
+// connection dies first. The room is released in handleResps once the response
+// is read.
+func (cxn *brokerCxn) acquireInFlight(ctx context.Context) error {
+	select {
+	case cxn.inflight <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cxn.deadCh:
+		return ErrConnDead
+	case <-cxn.cl.ctx.Done():
+		return ErrConnDead
+	}
+}
+
+// isGating returns whether the connection has writes waiting for room.
+func (cxn *brokerCxn) isGating() bool {
+	if cxn.inflight == nil {
+		return false
+	}
+	cxn.gateMu.Lock()
+	defer cxn.gateMu.Unlock()
+	return cxn.gating
+}
+
+// writeGated issues the connection's queued writes in order as responses
+// free room, returning once no writes are queued.
+//
+// Each request waits for room under its own context, so a request canceled
+// while waiting fails without failing the requests it was coalesced with.
+func (cxn *brokerCxn) writeGated() {
+	for {
+		cxn.gateMu.Lock()
+		if len(cxn.gated) == 0 {
+			cxn.gating = false
+			cxn.gateMu.Unlock()
+			return
+		}
+		prs := cxn.gated[0]
+		cxn.gated[0] = nil
+		cxn.gated = cxn.gated[1:]
+		cxn.gateMu.Unlock()
+
+		var acquired []promisedReq
+		for i, pr := range prs {
+			err := cxn.acquireInFlight(pr.ctx)
+			if err == nil {
+				acquired = append(acquired, pr)
+				continue
+			}
+			if err != ErrConnDead {
+				pr.promise(nil, err)
+				continue
+			}
+			for _, pr := range append(acquired, prs[i:]...) {
+				pr.promise(nil, err)
+			}
+			acquired = nil
+			break
+		}
+		if len(acquired) == 0 {
+			continue
+		}
+
+		if err := cxn.maybeReauth(); err != nil {
+			for _, pr := range acquired {
+				pr.promise(nil, err)
+			}
+			continue
+		}
+		if len(acquired) == 1 {
+			cxn.b.writeReq(cxn, acquired[0])
+		} else {
+			cxn.b.writeReqs(cxn, acquired)
+		}
+	}
+}
+
+// maybeReauth reauthenticates the connection if we are after its sasl
+// expiry, killing the connection if reauthenticating fails. We can only have
+// an expiry if we went the authenticate flow, so we know we are
+// authenticating again. For KIP-368.
+func (cxn *brokerCxn) maybeReauth() error {
+	if cxn.expiry.IsZero() || !cxn.cl.cfg.clock.Now().After(cxn.expiry) {
+		return nil
+	}
+	if err := cxn.sasl(); err != nil {
+		cxn.die()
+		return err
+	}
+	return nil
+}
+
+// throttled returns whether the broker is currently throttling this
+// connection.
+func (cxn *brokerCxn) throttled() bool {
+	throttleUntil := time.Unix(0, atomic.LoadInt64(&cxn.throttleUntil))
+	return throttleUntil.After(cxn.cl.cfg.clock.Now())
 }
 
 func (cxn *brokerCxn) writeConn(ctx context.Context, buf []byte, timeout time.Duration, enqueuedForWritingAt time.Time) (bytesWritten int, writeErr error, writeWait, timeToWrite time.Duration) {
@@ -732,11 +1434,63 @@ func (cxn *brokerCxn) writeConn(ctx context.Context, buf []byte, timeout time.Du
 	return
 }
 
-func (cxn *brokerCxn) readConn(ctx context.Context, timeout time.Duration, enqueuedForReadingAt time.Time) (nread int, buf []byte, err error, readWait, timeToRead time.Duration) {
+// noStall disables stall detection for a read; see ConnStallTimeout.
+const noStall time.Duration = -1
+
+// stallReader reads from a connection, failing any read that receives nothing
+// for the stall timeout; see ConnStallTimeout.
+type stallReader struct {
+	conn     net.Conn
+	stall    time.Duration
+	wait     time.Duration // allowed on top of stall for the first read only
+	deadline time.Time     // the read timeout deadline, if any
+
+	killed  *int32 // set before a canceled read sets the deadline to now
+	stalled bool
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(r.wait + r.stall)
+	r.wait = 0
+	stallDeadline := r.deadline.IsZero() || deadline.Before(r.deadline)
+	if !stallDeadline {
+		deadline = r.deadline
+	}
+	r.conn.SetReadDeadline(deadline)
+
+	// If the read was canceled while we were setting our deadline, we may
+	// have overwritten the cancel; we check after to not block.
+	if atomic.LoadInt32(r.killed) == 1 {
+		return 0, ErrConnDead
+	}
+	n, err := r.conn.Read(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && stallDeadline && atomic.LoadInt32(r.killed) == 0 {
+		r.stalled = true
+	}
+	return n, err
+}
+
+func (cxn *brokerCxn) readConn(ctx context.Context, timeout, stallWait time.Duration, enqueuedForReadingAt time.Time) (nread int, buf []byte, err error, readWait, timeToRead time.Duration) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	if timeout > 0 {
+	var (
+		r      io.Reader = cxn.conn
+		sr     *stallReader
+		killed int32
+	)
+	if stall := cxn.cl.cfg.connStallTimeout; stall > 0 && stallWait >= 0 {
+		sr = &stallReader{
+			conn:   cxn.conn,
+			stall:  stall,
+			wait:   stallWait,
+			killed: &killed,
+		}
+		if timeout > 0 {
+			sr.deadline = time.Now().Add(timeout)
+		}
+		r = sr
+	} else if timeout > 0 {
 		cxn.conn.SetReadDeadline(time.Now().Add(timeout))
 	}
 	defer cxn.conn.SetReadDeadline(time.Time{})
@@ -749,7 +1503,7 @@ func (cxn *brokerCxn) readConn(ctx context.Context, timeout time.Duration, enque
 			timeToRead = time.Since(readStart)
 			readWait = readStart.Sub(enqueuedForReadingAt)
 		}()
-		if nread, err = io.ReadFull(cxn.conn, sizeBuf); err != nil {
+		if nread, err = io.ReadFull(r, sizeBuf); err != nil {
 			err = ErrConnDead
 			return
 		}
@@ -762,11 +1516,17 @@ func (cxn *brokerCxn) readConn(ctx context.Context, timeout time.Duration, enque
 			err = &ErrLargeRespSize{Size: size, Limit: maxSize}
 			return
 		}
+		// Responses are decoded from one contiguous buffer, and
+		// fetched records reference that buffer rather than copying
+		// out of it, so we read the whole response into one exactly
+		// sized allocation. Reading in growing chunks would only add
+		// copies and raise the peak; the memory of large fetches is
+		// bounded by FetchMaxBytes and FetchMaxPartitionBytes.
 		buf = make([]byte, size)
 		var nread2 int
-		nread2, err = io.ReadFull(cxn.conn, buf)
-		nread += nread2
+		nread2, err = io.ReadFull(r, buf)
 		buf = buf[:nread2]
+		nread += nread2
 		if err != nil {
 			err = ErrConnDead
 			return
@@ -775,19 +1535,30 @@ func (cxn *brokerCxn) readConn(ctx context.Context, timeout time.Duration, enque
 	select {
 	case <-readDone:
 	case <-cxn.cl.ctx.Done():
+		atomic.StoreInt32(&killed, 1)
 		cxn.conn.SetReadDeadline(time.Now())
 		<-readDone
 	case <-ctx.Done():
+		atomic.StoreInt32(&killed, 1)
 		cxn.conn.SetReadDeadline(time.Now())
 		<-readDone
 	}
+	if sr != nil && sr.stalled {
+		cxn.cl.cfg.logger.Log(LogLevelWarn, "broker sent nothing for the conn stall timeout with requests outstanding, killing connection",
+			"addr", cxn.addr,
+			"id", cxn.b.meta.NodeID,
+			"stall_timeout", cxn.cl.cfg.connStallTimeout,
+			"read", nread,
+		)
+	}
 	return
 }
 
 // readResponse reads a response from conn, ensures the correlation ID is
-// correct, and returns a newly allocated slice on success.
-func (cxn *brokerCxn) readResponse(ctx context.Context, timeout time.Duration, enqueuedForReadingAt time.Time, key int16, corrID int32, flexibleHeader bool) ([]byte, error) {
-	nread, buf, err, readWait, timeToRead := cxn.readConn(ctx, timeout, enqueuedForReadingAt)
+// correct, and returns a newly allocated slice on success, along with how
+// long the response waited to be read and took to read.
+func (cxn *brokerCxn) readResponse(ctx context.Context, timeout, stallWait time.Duration, enqueuedForReadingAt time.Time, key int16, corrID int32, flexibleHeader bool) ([]byte, time.Duration, time.Duration, error) {
+	nread, buf, err, readWait, timeToRead := cxn.readConn(ctx, timeout, stallWait, enqueuedForReadingAt)
 
 	cxn.cl.cfg.hooks.each(func(h Hook) {
 		if h, ok := h.(BrokerReadHook); ok {
@@ -796,23 +1567,35 @@ func (cxn *brokerCxn) readResponse(ctx context.Context, timeout time.Duration, e
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, readWait, timeToRead, err
 	}
 	if len(buf) < 4 {
-		return nil, kbin.ErrNotEnoughData
+		return nil, readWait, timeToRead, kbin.ErrNotEnoughData
 	}
 	gotID := int32(binary.BigEndian.Uint32(buf))
 	if gotID != corrID {
-		return nil, ErrCorrelationIDMismatch
+		if cxn.cl.cfg.detectDups && cxn.wasReadID(gotID) {
+			cxn.cl.cfg.logger.Log(LogLevelError, "read a duplicate response for an already read correlation ID, the broker or a proxy in front of it is sending responses twice; killing connection",
+				"addr", cxn.addr,
+				"id", cxn.b.meta.NodeID,
+				"key", key,
+				"corr_id", gotID,
+				"expected_corr_id", corrID,
+			)
+		}
+		return nil, readWait, timeToRead, ErrCorrelationIDMismatch
+	}
+	if cxn.cl.cfg.detectDups {
+		cxn.trackReadID(gotID)
 	}
 	// If the response header is flexible, we skip the tags at the end of
 	// it. They are currently unused.
 	if flexibleHeader {
 		b := kbin.Reader{Src: buf[4:]}
 		kmsg.SkipTags(&b)
-		return b.Src, b.Complete()
+		return b.Src, readWait, timeToRead, b.Complete()
 	}
-	return buf[4:], nil
+	return buf[4:], readWait, timeToRead, nil
 }
 
 // closeConn is the one place we close broker connections. This is always done
@@ -840,9 +1623,15 @@ func (cxn *brokerCxn) die() {
 
 	cxn.closeConn()
 
+	// Responses that were never read complete with ErrConnDead. A
+	// requeued request is not complete; it is written again and completes
+	// on whichever connection it is written to.
 	go func() {
 		for pr := range cxn.resps {
-			pr.promise(nil, ErrConnDead)
+			if !cxn.requeue(pr) {
+				pr.promise(nil, ErrConnDead)
+				cxn.onRequestComplete(pr.resp.Key(), pr.resp.GetVersion(), pr.corrID, pr.writeWait, pr.timeToWrite, time.Since(pr.enqueue), 0, ErrConnDead)
+			}
 		}
 	}()
 
@@ -852,6 +1641,47 @@ func (cxn *brokerCxn) die() {
 	close(cxn.resps) // after lock, nothing sends down resps
 }
 
+// requeueKeys are the requests that only read state. If a connection dies
+// after one of these is written but before its response is read, issuing the
+// request again is safe.
+var requeueKeys = map[int16]bool{
+	2:  true, // ListOffsets
+	3:  true, // Metadata
+	9:  true, // OffsetFetch
+	10: true, // FindCoordinator
+	15: true, // DescribeGroups
+	16: true, // ListGroups
+	23: true, // OffsetForLeaderEpoch
+	29: true, // DescribeACLs
+	32: true, // DescribeConfigs
+	35: true, // DescribeLogDirs
+	46: true, // ListPartitionReassignments
+	48: true, // DescribeClientQuotas
+	50: true, // DescribeUserSCRAMCredentials
+	60: true, // DescribeCluster
+	61: true, // DescribeProducers
+}
+
+type requeuedKey struct{}
+
+// requeue, called when a connection dies with responses still waiting to be
+// read, issues a request again on its broker if the request only reads state,
+// returning whether it did. The request was written, but the response may
+// never come; rather than failing requests that were queued behind the one
+// that killed the connection, we retry the safe ones once.
+//
+// Everything else, including produce requests that could be duplicated,
+// fails with ErrConnDead as before.
+func (cxn *brokerCxn) requeue(pr promisedResp) bool {
+	if pr.req == nil || !requeueKeys[pr.req.Key()] ||
+		pr.ctx == nil || pr.ctx.Value(requeuedKey{}) != nil ||
+		atomic.LoadInt32(&cxn.b.dead) == 1 || cxn.cl.ctx.Err() != nil {
+		return false
+	}
+	cxn.b.do(context.WithValue(pr.ctx, requeuedKey{}, true), pr.req, pr.promise)
+	return true
+}
+
 // waitResp, called serially by a broker's handleReqs, manages handling a
 // message requests's response.
 func (cxn *brokerCxn) waitResp(pr promisedResp) {
@@ -861,6 +1691,7 @@ func (cxn *brokerCxn) waitResp(pr promisedResp) {
 	if atomic.LoadInt32(&cxn.dead) == 1 {
 		dead = true
 	} else {
+		atomic.AddInt32(&cxn.outstanding, 1)
 		cxn.resps <- pr
 	}
 	cxn.dieMu.RUnlock()
@@ -870,13 +1701,60 @@ func (cxn *brokerCxn) waitResp(pr promisedResp) {
 	}
 }
 
+// waitPromisedResp waits for the response to a written request.
+func (cxn *brokerCxn) waitPromisedResp(pr promisedReq, corrID int32, writeWait, timeToWrite time.Duration) {
+	req := pr.req
+	if noResponse(req) {
+		if cxn.inflight != nil {
+			<-cxn.inflight
+		}
+		pr.promise(req.ResponseKind(), nil)
+		cxn.onRequestComplete(req.Key(), req.GetVersion(), corrID, writeWait, timeToWrite, 0, 0, nil)
+		return
+	}
+	rt, _ := cxn.cl.connTimeoutFn(req)
+	stallWait := noStall
+	if cxn.cl.cfg.connStallTimeout > 0 {
+		stallWait = cxn.cl.requestWaitFn(req)
+	}
+	cxn.waitResp(promisedResp{
+		pr.ctx,
+		corrID,
+		rt,
+		stallWait,
+		req.IsFlexible() && req.Key() != 18, // response header not flexible if ApiVersions; see promisedResp doc
+		req.ResponseKind(),
+		pr.promise,
+		time.Now(),
+		writeWait,
+		timeToWrite,
+		req,
+	})
+}
+
+// noResponse returns whether a request has no response: Kafka does not reply
+// to produce requests with no acks, so these are complete once written.
+func noResponse(req kmsg.Request) bool {
+	switch req := req.(type) {
+	case *produceRequest:
+		return req.acks == 0
+	case *kmsg.ProduceRequest:
+		return req.Acks == 0
+	}
+	return false
+}
+
 // handleResps serially handles all broker responses for an single connection.
 func (cxn *brokerCxn) handleResps() {
 	defer cxn.die() // always track our death
 
 	var successes uint64
 	for pr := range cxn.resps {
-		raw, err := cxn.readResponse(pr.ctx, pr.readTimeout, pr.enqueue, pr.resp.Key(), pr.corrID, pr.flexibleHeader)
+		raw, readWait, timeToRead, err := cxn.readResponse(pr.ctx, pr.readTimeout, pr.stallWait, pr.enqueue, pr.resp.Key(), pr.corrID, pr.flexibleHeader)
+		atomic.AddInt32(&cxn.outstanding, -1)
+		if cxn.inflight != nil {
+			<-cxn.inflight
+		}
 		if err != nil {
 			if successes > 0 || len(cxn.b.cl.cfg.sasls) > 0 {
 				cxn.b.cl.cfg.logger.Log(LogLevelDebug, "read from broker errored, killing connection", "addr", cxn.b.addr, "id", cxn.b.meta.NodeID, "successful_reads", successes, "err", err)
@@ -884,6 +1762,7 @@ func (cxn *brokerCxn) handleResps() {
 				cxn.b.cl.cfg.logger.Log(LogLevelWarn, "read from broker errored, killing connection after 0 successful responses (is sasl missing?)", "addr", cxn.b.addr, "id", cxn.b.meta.NodeID, "err", err)
 			}
 			pr.promise(nil, err)
+			cxn.onRequestComplete(pr.resp.Key(), pr.resp.GetVersion(), pr.corrID, pr.writeWait, pr.timeToWrite, readWait, timeToRead, err)
 			return
 		}
 		successes++
@@ -897,21 +1776,49 @@ func (cxn *brokerCxn) handleResps() {
 			if throttleResponse, ok := pr.resp.(kmsg.ThrottleResponse); ok {
 				millis, throttlesAfterResp := throttleResponse.Throttle()
 				if millis > 0 {
-					if throttlesAfterResp {
-						throttleUntil := time.Now().Add(time.Millisecond * time.Duration(millis)).UnixNano()
+					if throttlesAfterResp || cxn.cl.cfg.throttlePreThrottle {
+						throttleUntil := cxn.cl.cfg.clock.Now().Add(time.Millisecond * time.Duration(millis)).UnixNano()
 						if throttleUntil > cxn.throttleUntil {
 							atomic.StoreInt64(&cxn.throttleUntil, throttleUntil)
 						}
 					}
+					throttle := time.Duration(millis) * time.Millisecond
 					cxn.cl.cfg.hooks.each(func(h Hook) {
 						if h, ok := h.(BrokerThrottleHook); ok {
-							h.OnThrottle(cxn.b.meta, time.Duration(millis)*time.Millisecond, throttlesAfterResp)
+							h.OnThrottle(cxn.b.meta, throttle, throttlesAfterResp)
 						}
 					})
+					if max := cxn.cl.cfg.maxThrottle; max > 0 && throttle > max {
+						cxn.b.cl.cfg.logger.Log(LogLevelWarn, "broker throttled request longer than the max acceptable throttle", "addr", cxn.b.addr, "id", cxn.b.meta.NodeID, "key", pr.resp.Key(), "throttle", throttle, "max", max)
+						throttled := ThrottleExceeded{
+							NodeID:                 cxn.b.meta.NodeID,
+							Key:                    pr.resp.Key(),
+							Throttle:               throttle,
+							ThrottledAfterResponse: throttlesAfterResp,
+						}
+						cxn.cl.cfg.hooks.each(func(h Hook) {
+							if h, ok := h.(BrokerThrottleExceededHook); ok {
+								h.OnThrottleExceeded(cxn.b.meta, throttled)
+							}
+						})
+					}
 				}
 			}
 		}
 
+		// Once we pass the response to the promise, it can be reused
+		// (see ReuseFetchResponses), so we grab what we need first.
+		key, version := pr.resp.Key(), pr.resp.GetVersion()
 		pr.promise(pr.resp, readErr)
+		cxn.onRequestComplete(key, version, pr.corrID, pr.writeWait, pr.timeToWrite, readWait, timeToRead, readErr)
 	}
 }
+
+// onRequestComplete calls any BrokerE2EHook once a request is complete.
+func (cxn *brokerCxn) onRequestComplete(key, version int16, corrID int32, writeWait, timeToWrite, readWait, timeToRead time.Duration, err error) {
+	cxn.cl.cfg.hooks.each(func(h Hook) {
+		if h, ok := h.(BrokerE2EHook); ok {
+			h.OnRequestComplete(cxn.b.meta, key, version, corrID, writeWait, timeToWrite, readWait, timeToRead, err)
+		}
+	})
+}
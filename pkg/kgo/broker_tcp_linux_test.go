@@ -0,0 +1,143 @@
+package kgo
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// tcpOpts are the TCP options set on a socket, as read back from the kernel.
+type tcpOpts struct {
+	noDelay   bool
+	keepAlive bool
+	idle      int // seconds before the first keep alive probe
+}
+
+func readTCPOpts(conn *net.TCPConn) (tcpOpts, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return tcpOpts{}, err
+	}
+	var (
+		opts    tcpOpts
+		sockErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		get := func(level, opt int) int {
+			v, err := syscall.GetsockoptInt(int(fd), level, opt)
+			if err != nil && sockErr == nil {
+				sockErr = err
+			}
+			return v
+		}
+		opts.noDelay = get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0
+		opts.keepAlive = get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0
+		opts.idle = get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return opts, err
+}
+
+func TestTCPOptionsApplied(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name string
+		opts []Opt
+		tls  bool
+
+		exp tcpOpts
+	}{
+		// Our dialer enables keep alives every 15s.
+		{"defaults", nil, false, tcpOpts{true, true, 15}},
+		{"no_delay_off", []Opt{TCPNoDelay(false)}, false, tcpOpts{false, true, 15}},
+		{"keep_alive_period", []Opt{TCPKeepAlive(time.Minute)}, false, tcpOpts{true, true, 60}},
+		{"keep_alive_off", []Opt{TCPKeepAlive(-1)}, false, tcpOpts{true, false, 15}},
+		{"tls_no_delay_off", []Opt{TCPNoDelay(false)}, true, tcpOpts{false, true, 15}},
+		{"tls_keep_alive_period", []Opt{TCPKeepAlive(time.Minute)}, true, tcpOpts{true, true, 60}},
+		{"tls_keep_alive_off", []Opt{TCPKeepAlive(-1)}, true, tcpOpts{true, false, 15}},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("unable to listen: %v", err)
+			}
+			defer ln.Close()
+
+			// The client writes its first request (or TLS
+			// handshake) only after tuning the connection, so
+			// once we read anything, the options are set.
+			written, done := make(chan struct{}), make(chan struct{})
+			defer close(done)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					close(written)
+				}
+				<-done
+			}()
+
+			dialed := make(chan *net.TCPConn, 1)
+			dialer := &net.Dialer{KeepAlive: 15 * time.Second}
+			dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, ln.Addr().String())
+				if err != nil {
+					return nil, err
+				}
+				dialed <- conn.(*net.TCPConn)
+				if test.tls {
+					return tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), nil
+				}
+				return conn, nil
+			}
+
+			cl, err := NewClient(append([]Opt{
+				SeedBrokers(ln.Addr().String()),
+				Dialer(dial),
+				RequestRetries(0),
+			}, test.opts...)...)
+			if err != nil {
+				t.Fatalf("unable to create client: %v", err)
+			}
+			defer cl.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go cl.Request(ctx, kmsg.NewPtrApiVersionsRequest())
+
+			var conn *net.TCPConn
+			select {
+			case conn = <-dialed:
+			case <-ctx.Done():
+				t.Fatal("client did not dial")
+			}
+			select {
+			case <-written:
+			case <-ctx.Done():
+				t.Fatal("client did not write to its connection")
+			}
+
+			got, err := readTCPOpts(conn)
+			if err != nil {
+				t.Fatalf("unable to read tcp options: %v", err)
+			}
+			if got != test.exp {
+				t.Errorf("got tcp options %+v, expected %+v", got, test.exp)
+			}
+		})
+	}
+}
@@ -0,0 +1,1696 @@
+package kgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/kversion"
+	"github.com/twmb/franz-go/pkg/sasl"
+)
+
+func TestWriteRequestWaitsForThrottle(t *testing.T) {
+	clock := newFakeClock()
+	cfg := defaultCfg()
+	cfg.clock = clock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := &Client{
+		cfg:           cfg,
+		ctx:           ctx,
+		ctxCancel:     cancel,
+		connTimeoutFn: connTimeoutBuilder(cfg.connTimeoutOverhead, requestWaitBuilder()),
+		bufPool:       newBufPool(),
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	cxn := &brokerCxn{
+		conn:      client,
+		cl:        cl,
+		b:         &broker{cl: cl},
+		formatter: new(kmsg.RequestFormatter),
+		deadCh:    make(chan struct{}),
+	}
+	atomic.StoreInt64(&cxn.throttleUntil, clock.Now().Add(time.Second).UnixNano())
+
+	written := make(chan error, 1)
+	go func() {
+		_, _, _, err := cxn.writeRequest(context.Background(), clock.Now(), kmsg.NewPtrApiVersionsRequest())
+		written <- err
+	}()
+
+	// The write waits for the rest of the throttle on our clock; nothing
+	// is written until we advance past it.
+	if wait := <-clock.timers; wait != time.Second {
+		t.Fatalf("got throttle wait %v != exp %v", wait, time.Second)
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("write finished while throttled, err: %v", err)
+	default:
+	}
+
+	clock.advance(time.Second)
+	buf := make([]byte, 4)
+	if _, err := server.Read(buf); err != nil {
+		t.Fatalf("unable to read request: %v", err)
+	}
+	go func() { // drain the rest of the request so the write can finish
+		rest := make([]byte, 512)
+		for {
+			if _, err := server.Read(rest); err != nil {
+				return
+			}
+		}
+	}()
+	if err := <-written; err != nil {
+		t.Fatalf("unexpected write err: %v", err)
+	}
+}
+
+func TestDeadCxnRequeuesReadOnlyRequests(t *testing.T) {
+	hook := &e2eHook{reqs: make(map[int16][]e2eReq)}
+	cfg := defaultCfg()
+	cfg.hooks = append(cfg.hooks, hook)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := &Client{cfg: cfg, ctx: ctx, ctxCancel: cancel}
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	b := &broker{cl: cl, reqs: make(chan promisedReq, 10)}
+	cxn := &brokerCxn{
+		conn:   client,
+		cl:     cl,
+		b:      b,
+		resps:  make(chan promisedResp, 10),
+		deadCh: make(chan struct{}),
+	}
+
+	errs := make(chan error, 2)
+	promise := func(_ kmsg.Response, err error) { errs <- err }
+	meta := kmsg.NewPtrMetadataRequest()
+	for _, req := range []kmsg.Request{meta, kmsg.NewPtrProduceRequest()} {
+		cxn.waitResp(promisedResp{ctx: context.Background(), resp: req.ResponseKind(), promise: promise, req: req})
+	}
+	cxn.die()
+
+	// The produce could be duplicated and fails; the metadata request
+	// is issued again on the broker.
+	if err := <-errs; err != ErrConnDead {
+		t.Errorf("got produce err %v, expected ErrConnDead", err)
+	}
+	pr := <-b.reqs
+	if pr.req != meta {
+		t.Fatalf("got requeued request %v, expected the metadata request", pr.req)
+	}
+
+	// A request is only requeued once.
+	cxn = &brokerCxn{
+		conn:   server,
+		cl:     cl,
+		b:      b,
+		resps:  make(chan promisedResp, 10),
+		deadCh: make(chan struct{}),
+	}
+	cxn.waitResp(promisedResp{ctx: pr.ctx, resp: meta.ResponseKind(), promise: pr.promise, req: pr.req})
+	cxn.die()
+	if err := <-errs; err != ErrConnDead {
+		t.Errorf("got requeued metadata err %v, expected ErrConnDead", err)
+	}
+
+	// Both failed requests complete through the E2E hook, which is called
+	// just after their promises; requeuing the metadata request did not
+	// complete it.
+	completed := func() (produces, metas []e2eReq) {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		return hook.reqs[0], hook.reqs[3]
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		produces, metas := completed()
+		if len(produces) == 1 && len(metas) == 1 {
+			if produces[0].err != ErrConnDead || metas[0].err != ErrConnDead {
+				t.Errorf("got hook errs %v and %v, expected ErrConnDead", produces[0].err, metas[0].err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d produce and %d metadata hook calls, expected one each", len(produces), len(metas))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestWriteCxn(conn net.Conn) *brokerCxn {
+	cfg := defaultCfg()
+	ctx, cancel := context.WithCancel(context.Background())
+	cl := &Client{
+		cfg:           cfg,
+		ctx:           ctx,
+		ctxCancel:     cancel,
+		connTimeoutFn: connTimeoutBuilder(cfg.connTimeoutOverhead, requestWaitBuilder()),
+		bufPool:       newBufPool(),
+	}
+	return &brokerCxn{
+		conn:      conn,
+		cl:        cl,
+		b:         &broker{cl: cl},
+		formatter: new(kmsg.RequestFormatter),
+		deadCh:    make(chan struct{}),
+	}
+}
+
+func TestWriteRequestsCoalesces(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	cxn := newTestWriteCxn(client)
+	defer cxn.cl.ctxCancel()
+	cxn.corrID = 5
+
+	var prs []promisedReq
+	for _, req := range []kmsg.Request{
+		kmsg.NewPtrApiVersionsRequest(),
+		kmsg.NewPtrMetadataRequest(),
+		kmsg.NewPtrHeartbeatRequest(),
+	} {
+		req.SetVersion(0)
+		prs = append(prs, promisedReq{ctx: context.Background(), req: req, enqueue: time.Now()})
+	}
+
+	type written struct {
+		corrIDs []int32
+		err     error
+	}
+	done := make(chan written, 1)
+	go func() {
+		corrIDs, _, _, err := cxn.writeRequests(prs)
+		done <- written{corrIDs, err}
+	}()
+
+	// Each request is framed on its own with the next correlation ID.
+	for i, pr := range prs {
+		var size [4]byte
+		if _, err := io.ReadFull(server, size[:]); err != nil {
+			t.Fatalf("unable to read request %d size: %v", i, err)
+		}
+		body := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(server, body); err != nil {
+			t.Fatalf("unable to read request %d: %v", i, err)
+		}
+		key := int16(binary.BigEndian.Uint16(body))
+		corrID := int32(binary.BigEndian.Uint32(body[4:]))
+		if key != pr.req.Key() || corrID != int32(5+i) {
+			t.Errorf("request %d: got key %d corr id %d, expected key %d corr id %d", i, key, corrID, pr.req.Key(), 5+i)
+		}
+	}
+
+	w := <-done
+	if w.err != nil {
+		t.Fatalf("unexpected write err: %v", w.err)
+	}
+	if exp := []int32{5, 6, 7}; !reflect.DeepEqual(w.corrIDs, exp) {
+		t.Errorf("got corr ids %v, expected %v", w.corrIDs, exp)
+	}
+	if cxn.corrID != 8 {
+		t.Errorf("got next corr id %d, expected 8", cxn.corrID)
+	}
+}
+
+// BenchmarkWriteRequests compares writing small requests one at a time
+// against coalescing them into one write.
+func BenchmarkWriteRequests(b *testing.B) {
+	const reqsPerOp = 16
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	cxn := newTestWriteCxn(conn)
+	defer cxn.cl.ctxCancel()
+
+	prs := make([]promisedReq, reqsPerOp)
+	for i := range prs {
+		req := kmsg.NewPtrHeartbeatRequest()
+		req.Group = "group"
+		req.MemberID = "member"
+		req.SetVersion(req.MaxVersion())
+		prs[i] = promisedReq{ctx: context.Background(), req: req}
+	}
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, pr := range prs {
+				if _, _, _, err := cxn.writeRequest(pr.ctx, pr.enqueue, pr.req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("coalesced", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, _, err := cxn.writeRequests(prs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// countingMechanism counts authentication attempts and then fails.
+type countingMechanism struct{ authenticates int32 }
+
+func (*countingMechanism) Name() string { return "PLAIN" }
+
+func (m *countingMechanism) Authenticate(context.Context, string) (sasl.Session, []byte, error) {
+	atomic.AddInt32(&m.authenticates, 1)
+	return nil, nil, errors.New("counting mechanism cannot authenticate")
+}
+
+// bindingMechanism is a channel binding mechanism that records whether it
+// was passed the TLS state and then fails.
+type bindingMechanism struct{ bound int32 }
+
+func (*bindingMechanism) Name() string { return "PLAIN" }
+
+func (*bindingMechanism) Authenticate(context.Context, string) (sasl.Session, []byte, error) {
+	return nil, nil, errors.New("binding mechanism requires tls")
+}
+
+func (m *bindingMechanism) AuthenticateTLS(context.Context, string, tls.ConnectionState) (sasl.Session, []byte, error) {
+	atomic.AddInt32(&m.bound, 1)
+	return nil, nil, errors.New("binding mechanism cannot authenticate")
+}
+
+func TestSASLChannelBindingHandshakeTimesOut(t *testing.T) {
+	cfg := defaultCfg()
+	cfg.connTimeoutOverhead = 100 * time.Millisecond
+	mechanism := new(bindingMechanism)
+	cfg.sasls = []sasl.Mechanism{mechanism}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := &Client{cfg: cfg, ctx: ctx, ctxCancel: cancel}
+
+	// The server side never answers the handshake.
+	client, server := net.Pipe()
+	defer server.Close()
+	cxn := &brokerCxn{
+		conn:   tls.Client(client, &tls.Config{InsecureSkipVerify: true}),
+		cl:     cl,
+		b:      &broker{cl: cl},
+		deadCh: make(chan struct{}),
+	}
+	for i := range cxn.versions {
+		cxn.versions[i] = -1 // no sasl handshake; we authenticate immediately
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cxn.sasl() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("got no error authenticating over a stalled tls handshake")
+		}
+		if bound := atomic.LoadInt32(&mechanism.bound); bound != 0 {
+			t.Errorf("mechanism was bound %d times without a handshake", bound)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sasl hung on a stalled tls handshake")
+	}
+}
+
+// endPointMechanism binds to the server's certificate, as in the
+// tls-server-end-point channel binding type, sending the certificate's hash
+// as its only message.
+type endPointMechanism struct {
+	mu    sync.Mutex
+	state *tls.ConnectionState
+}
+
+func (*endPointMechanism) Name() string { return "END-POINT" }
+
+func (*endPointMechanism) Authenticate(context.Context, string) (sasl.Session, []byte, error) {
+	return nil, nil, errors.New("end point mechanism requires tls")
+}
+
+func (m *endPointMechanism) AuthenticateTLS(_ context.Context, _ string, state tls.ConnectionState) (sasl.Session, []byte, error) {
+	m.mu.Lock()
+	m.state = &state
+	m.mu.Unlock()
+	if len(state.PeerCertificates) == 0 {
+		return nil, nil, errors.New("no peer certificate to bind to")
+	}
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return endPointSession{}, sum[:], nil
+}
+
+type endPointSession struct{}
+
+func (endPointSession) Challenge([]byte) (bool, []byte, error) { return true, nil, nil }
+
+// testCert returns a self signed certificate for tls servers in tests.
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSASLChannelBinding(t *testing.T) {
+	cfg := defaultCfg()
+	mechanism := new(endPointMechanism)
+	cfg.sasls = []sasl.Mechanism{mechanism}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := &Client{
+		cfg:           cfg,
+		ctx:           ctx,
+		ctxCancel:     cancel,
+		connTimeoutFn: connTimeoutBuilder(cfg.connTimeoutOverhead, requestWaitBuilder()),
+		bufPool:       newBufPool(),
+	}
+
+	cert := testCert(t)
+	client, server := net.Pipe()
+	defer server.Close()
+	cxn := &brokerCxn{
+		conn:   tls.Client(client, &tls.Config{InsecureSkipVerify: true}),
+		cl:     cl,
+		b:      &broker{cl: cl},
+		deadCh: make(chan struct{}),
+	}
+	for i := range cxn.versions {
+		cxn.versions[i] = -1 // no sasl handshake; we authenticate immediately
+	}
+
+	// The server reads the raw sasl message, which must be the hash of
+	// its certificate, and replies with a final empty challenge.
+	received := make(chan []byte, 1)
+	go func() {
+		defer close(received)
+		conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		received <- msg
+		conn.Write([]byte{0, 0, 0, 2, 'o', 'k'})
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- cxn.sasl() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unable to authenticate: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sasl hung")
+	}
+
+	mechanism.mu.Lock()
+	state := mechanism.state
+	mechanism.mu.Unlock()
+	if state == nil || !state.HandshakeComplete {
+		t.Fatalf("got tls state %v, expected a completed handshake", state)
+	}
+	if len(state.PeerCertificates) == 0 || !bytes.Equal(state.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		t.Errorf("got peer certificates %v, expected the server's certificate", state.PeerCertificates)
+	}
+	exp := sha256.Sum256(cert.Certificate[0])
+	if got := <-received; !bytes.Equal(got, exp[:]) {
+		t.Errorf("server got %x, expected the binding %x", got, exp)
+	}
+}
+
+func TestReauthExpiring(t *testing.T) {
+	clock := newFakeClock()
+	cfg := defaultCfg()
+	cfg.clock = clock
+	cfg.saslProbeInterval = 10 * time.Second
+
+	mechanism := new(countingMechanism)
+	cfg.sasls = []sasl.Mechanism{mechanism}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := &Client{cfg: cfg, ctx: ctx, ctxCancel: cancel}
+	b := &broker{cl: cl}
+
+	var servers []net.Conn
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+	newCxn := func(expiresIn time.Duration) *brokerCxn {
+		client, server := net.Pipe()
+		servers = append(servers, server)
+		cxn := &brokerCxn{
+			conn:   client,
+			cl:     cl,
+			b:      b,
+			resps:  make(chan promisedResp, 1),
+			deadCh: make(chan struct{}),
+			expiry: clock.Now().Add(expiresIn),
+		}
+		for i := range cxn.versions {
+			cxn.versions[i] = -1 // no handshake; we authenticate immediately
+		}
+		return cxn
+	}
+
+	b.cxnNormal = newCxn(time.Second)  // expires before the next probe
+	b.cxnProduce = newCxn(time.Minute) // expires after the next probe
+	b.cxnFetch = newCxn(time.Second)   // throttled
+	b.cxnGroup = newCxn(-time.Second)  // already expired, but dead
+	b.cxnGroup.die()
+	atomic.StoreInt64(&b.cxnFetch.throttleUntil, clock.Now().Add(time.Second).UnixNano())
+
+	if err := b.reauthExpiring(); err == nil {
+		t.Error("got no error reauthenticating with a failing mechanism")
+	}
+	if n := atomic.LoadInt32(&mechanism.authenticates); n != 1 {
+		t.Errorf("got %d authenticates, expected only the expiring connection to reauthenticate", n)
+	}
+	if atomic.LoadInt32(&b.cxnNormal.dead) != 1 {
+		t.Error("connection that failed to reauthenticate is not dead")
+	}
+	if atomic.LoadInt32(&b.cxnProduce.dead) != 0 || atomic.LoadInt32(&b.cxnFetch.dead) != 0 {
+		t.Error("connections that were skipped were killed")
+	}
+
+	// A connection with a response outstanding is read by handleResps,
+	// so it is not reauthenticated even if it is expiring.
+	b.cxnNormal = newCxn(time.Second)
+	atomic.StoreInt32(&b.cxnNormal.outstanding, 1)
+	if err := b.reauthExpiring(); err != nil {
+		t.Errorf("got unexpected error skipping a busy connection: %v", err)
+	}
+	if n := atomic.LoadInt32(&mechanism.authenticates); n != 1 {
+		t.Errorf("got %d authenticates, expected the busy connection to be skipped", n)
+	}
+}
+
+func TestSASLProbeLoopUsesClock(t *testing.T) {
+	clock := newFakeClock()
+	cfg := defaultCfg()
+	cfg.clock = clock
+	cfg.saslProbeInterval = 10 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cl := &Client{cfg: cfg, ctx: ctx, ctxCancel: cancel}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cl.saslProbeLoop()
+	}()
+
+	for i := 0; i < 2; i++ {
+		if wait := <-clock.timers; wait != cfg.saslProbeInterval {
+			t.Fatalf("got probe wait %v != exp %v", wait, cfg.saslProbeInterval)
+		}
+		clock.advance(cfg.saslProbeInterval)
+	}
+	cancel()
+	<-done
+}
+
+func TestReadConnStall(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		wait    time.Duration
+		delay   time.Duration // before the broker replies
+		partial bool          // whether the broker hangs mid response
+		expErr  error
+	}{
+		{"replied", 0, 0, false, nil},
+		{"replied_within_wait", 500 * time.Millisecond, 200 * time.Millisecond, false, nil},
+		{"hung", 0, time.Minute, false, ErrConnDead},
+		{"hung_mid_response", 0, 0, true, ErrConnDead},
+		{"disabled", noStall, 200 * time.Millisecond, false, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			cxn := newTestWriteCxn(client)
+			defer cxn.cl.ctxCancel()
+			cxn.cl.cfg.connStallTimeout = 100 * time.Millisecond
+
+			go func(delay time.Duration, partial bool) {
+				time.Sleep(delay)
+				server.Write([]byte{0, 0, 0, 4, 0, 0})
+				if !partial {
+					server.Write([]byte{0, 0})
+				}
+			}(test.delay, test.partial)
+
+			start := time.Now()
+			_, _, err, _, _ := cxn.readConn(context.Background(), 10*time.Second, test.wait, time.Now())
+			if err != test.expErr {
+				t.Fatalf("got err %v, expected %v", err, test.expErr)
+			}
+			if err != nil {
+				if elapsed := time.Since(start); elapsed > 5*time.Second {
+					t.Errorf("stalled read took %v, expected it to fail well before its read timeout", elapsed)
+				}
+			}
+		})
+	}
+}
+
+type captureLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (*captureLogger) Level() LogLevel { return LogLevelDebug }
+func (l *captureLogger) Log(level LogLevel, msg string, _ ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level == LogLevelError {
+		l.msgs = append(l.msgs, msg)
+	}
+}
+
+func TestDetectDuplicateCorrelationIDs(t *testing.T) {
+	for _, detect := range []bool{false, true} {
+		client, server := net.Pipe()
+
+		cxn := newTestWriteCxn(client)
+		logger := new(captureLogger)
+		cxn.cl.cfg.logger = logger
+		cxn.cl.cfg.detectDups = detect
+
+		// The broker responds to correlation ID 0 twice.
+		go func() {
+			for i := 0; i < 2; i++ {
+				server.Write([]byte{0, 0, 0, 4, 0, 0, 0, 0})
+			}
+		}()
+
+		if _, _, _, err := cxn.readResponse(context.Background(), time.Second, noStall, time.Now(), 18, 0, false); err != nil {
+			t.Fatalf("unexpected first read err: %v", err)
+		}
+		if _, _, _, err := cxn.readResponse(context.Background(), time.Second, noStall, time.Now(), 18, 1, false); err != ErrCorrelationIDMismatch {
+			t.Errorf("got second read err %v, expected correlation ID mismatch", err)
+		}
+
+		logger.mu.Lock()
+		logged := len(logger.msgs)
+		logger.mu.Unlock()
+		if exp := map[bool]int{false: 0, true: 1}[detect]; logged != exp {
+			t.Errorf("detecting %v: got %d error logs, expected %d", detect, logged, exp)
+		}
+
+		cxn.cl.ctxCancel()
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestUserConnTimeoutFn(t *testing.T) {
+	t.Parallel()
+
+	def := 20 * time.Second
+	fn := userConnTimeoutBuilder(func(req kmsg.Request) (time.Duration, time.Duration) {
+		switch req.Key() {
+		case 0: // produce: only override the write
+			return 0, time.Second
+		case 1: // fetch
+			return 5 * time.Second, 0
+		case 3: // metadata
+			return 2 * time.Second, 3 * time.Second
+		}
+		return 0, 0
+	}, connTimeoutBuilder(def, requestWaitBuilder()))
+
+	for _, test := range []struct {
+		req         kmsg.Request
+		read, write time.Duration
+	}{
+		{&kmsg.MetadataRequest{}, 2 * time.Second, 3 * time.Second},
+		{&kmsg.ProduceRequest{TimeoutMillis: 1000}, def + time.Second, time.Second},
+		{&fetchRequest{maxWait: 500}, 5*time.Second + 500*time.Millisecond, def},
+		{&kmsg.FetchRequest{MaxWaitMillis: 500}, 5*time.Second + 500*time.Millisecond, def},
+		{&kmsg.JoinGroupRequest{RebalanceTimeoutMillis: 60000}, def + time.Minute, def},
+		{&kmsg.SyncGroupRequest{}, time.Minute, def}, // the join above was still stashed
+	} {
+		read, write := fn(test.req)
+		if read != test.read || write != test.write {
+			t.Errorf("key %d: got (%v, %v) != exp (%v, %v)", test.req.Key(), read, write, test.read, test.write)
+		}
+	}
+}
+
+func TestConnTimeoutSharesRequestWait(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1))
+	defer c.Close()
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	// A join seen when deadlining is stashed for a stall wait on the
+	// following sync, and vice versa.
+	cl.connTimeoutFn(&kmsg.JoinGroupRequest{RebalanceTimeoutMillis: 60000})
+	if wait := cl.requestWaitFn(&kmsg.SyncGroupRequest{}); wait != time.Minute {
+		t.Errorf("got sync stall wait %v, expected the join's rebalance timeout %v", wait, time.Minute)
+	}
+	cl.requestWaitFn(&kmsg.JoinGroupRequest{RebalanceTimeoutMillis: 30000})
+	if read, _ := cl.connTimeoutFn(&kmsg.SyncGroupRequest{}); read != 30*time.Second {
+		t.Errorf("got sync read timeout %v, expected the join's rebalance timeout %v", read, 30*time.Second)
+	}
+}
+
+// clientIDConn records the client ID of every request written to it. This
+// assumes each request is written in one Write call, which kgo does.
+type clientIDConn struct {
+	net.Conn
+	mu  *sync.Mutex
+	ids map[int16][]string // request key => client IDs
+}
+
+func (c *clientIDConn) Write(b []byte) (int, error) {
+	// size (4), key (2), version (2), correlation ID (4), client ID.
+	if len(b) >= 14 {
+		key := int16(binary.BigEndian.Uint16(b[4:]))
+		var id string
+		if l := int16(binary.BigEndian.Uint16(b[12:])); l >= 0 && len(b) >= 14+int(l) {
+			id = string(b[14 : 14+int(l)])
+		}
+		c.mu.Lock()
+		c.ids[key] = append(c.ids[key], id)
+		c.mu.Unlock()
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWithClientID(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t)
+	defer c.Close()
+
+	cl, mu, ids := newClientIDClient(t, c)
+	defer cl.Close()
+
+	ctx := context.Background()
+	if _, err := kmsg.NewPtrFindCoordinatorRequest().RequestWith(ctx, cl); err != nil {
+		t.Fatalf("unable to find coordinator: %v", err)
+	}
+	if _, err := kmsg.NewPtrInitProducerIDRequest().RequestWith(WithClientID(ctx, "tenant"), cl); err != nil {
+		t.Fatalf("unable to init producer id: %v", err)
+	}
+
+	checkClientIDs(t, mu, ids, map[int16]string{
+		18: "base",   // api versions, issued internally
+		10: "base",   // find coordinator
+		22: "tenant", // init producer id
+	})
+}
+
+func checkClientIDs(t *testing.T, mu *sync.Mutex, ids map[int16][]string, exps map[int16]string) {
+	t.Helper()
+	mu.Lock()
+	defer mu.Unlock()
+	for key, exp := range exps {
+		got := ids[key]
+		if len(got) == 0 {
+			t.Errorf("key %d: no requests seen", key)
+		}
+		for _, id := range got {
+			if id != exp {
+				t.Errorf("key %d: got client id %q != exp %q", key, id, exp)
+			}
+		}
+	}
+}
+
+func newClientIDClient(t *testing.T, c *kfake.Cluster, opts ...Opt) (*Client, *sync.Mutex, map[int16][]string) {
+	mu := new(sync.Mutex)
+	ids := make(map[int16][]string)
+	cl := newTestClient(t, c, append([]Opt{
+		ClientID("base"),
+		Dialer(func(ctx context.Context, network, host string) (net.Conn, error) {
+			conn, err := c.DialContext(ctx, network, host)
+			if err != nil {
+				return nil, err
+			}
+			return &clientIDConn{conn, mu, ids}, nil
+		}),
+	}, opts...)...)
+	return cl, mu, ids
+}
+
+func TestProduceConsumeClientID(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(3, "foo"))
+	defer c.Close()
+
+	cl, mu, ids := newClientIDClient(t, c,
+		ProduceClientID("producer"),
+		ConsumeClientID("consumer"),
+	)
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	consumeN(t, cl, 10)
+
+	checkClientIDs(t, mu, ids, map[int16]string{
+		0: "producer",
+		1: "consumer",
+		3: "base", // metadata
+	})
+}
+
+func TestMaxAcceptableThrottle(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	hook := &throttleExceededHook{throttled: make(chan ThrottleExceeded, 1)}
+	cl := newTestClient(t, c, MaxAcceptableThrottle(20*time.Millisecond), WithHooks(hook))
+	defer cl.Close()
+
+	ctx := context.Background()
+
+	// Within the max, throttling is silent.
+	c.InjectFault(22, kfake.Fault{ThrottleMillis: 10})
+	if _, err := kmsg.NewPtrInitProducerIDRequest().RequestWith(ctx, cl); err != nil {
+		t.Fatalf("unexpected error for acceptable throttle: %v", err)
+	}
+	select {
+	case throttled := <-hook.throttled:
+		t.Fatalf("unexpected hook call for acceptable throttle: %v", throttled)
+	default:
+	}
+
+	// Beyond the max, the hook is called and the request still succeeds.
+	c.InjectFault(22, kfake.Fault{ThrottleMillis: 50})
+	resp, err := kmsg.NewPtrInitProducerIDRequest().RequestWith(ctx, cl)
+	if err != nil {
+		t.Fatalf("unexpected error for excessive throttle: %v", err)
+	}
+	if resp.ThrottleMillis != 50 {
+		t.Errorf("got throttle millis %d, expected 50", resp.ThrottleMillis)
+	}
+	throttled := <-hook.throttled
+	if throttled.Key != 22 || throttled.Throttle != 50*time.Millisecond {
+		t.Errorf("got %+v, expected key 22 throttled for 50ms", throttled)
+	}
+
+	// Requests the client issues internally call the hook as well.
+	c.InjectFault(0, kfake.Fault{ThrottleMillis: 50})
+	produceN(t, cl, "foo", 1)
+	if throttled := <-hook.throttled; throttled.Key != 0 {
+		t.Errorf("got %+v, expected key 0", throttled)
+	}
+}
+
+// throttleExceededHook records excessive throttles.
+type throttleExceededHook struct{ throttled chan ThrottleExceeded }
+
+func (h *throttleExceededHook) OnThrottleExceeded(_ BrokerMetadata, throttled ThrottleExceeded) {
+	select {
+	case h.throttled <- throttled:
+	default:
+	}
+}
+
+// preThrottleHook records whether throttles were applied after responses.
+type preThrottleHook struct{ after chan bool }
+
+func (h *preThrottleHook) OnThrottle(_ BrokerMetadata, _ time.Duration, throttledAfterResponse bool) {
+	h.after <- throttledAfterResponse
+}
+
+func TestClientSideThrottleOnPreThrottle(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1))
+	defer c.Close()
+
+	// InitProducerID v0 responses are throttled before responding.
+	versions := kversion.Stable()
+	versions.SetMaxKeyVersion(22, 0)
+
+	hook := &preThrottleHook{after: make(chan bool, 1)}
+	cl := newTestClient(t, c,
+		MaxVersions(versions),
+		ClientSideThrottleOnPreThrottle(),
+		WithHooks(hook),
+	)
+	defer cl.Close()
+
+	ctx := context.Background()
+	c.InjectFault(22, kfake.Fault{ThrottleMillis: 300})
+	if _, err := kmsg.NewPtrInitProducerIDRequest().RequestWith(ctx, cl); err != nil {
+		t.Fatalf("unable to init producer id: %v", err)
+	}
+	if after := <-hook.after; after {
+		t.Error("expected the throttle to be applied before the response")
+	}
+
+	start := time.Now()
+	if _, err := kmsg.NewPtrInitProducerIDRequest().RequestWith(ctx, cl); err != nil {
+		t.Fatalf("unable to init producer id: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("second request took %v, expected the client to wait out the throttle", elapsed)
+	}
+}
+
+// fakeGSSAPI is a mechanism named GSSAPI that counts authentication attempts
+// and then fails, since the fake cluster cannot complete SASL.
+type fakeGSSAPI struct{ authenticates int32 }
+
+func (*fakeGSSAPI) Name() string { return "GSSAPI" }
+
+func (m *fakeGSSAPI) Authenticate(context.Context, string) (sasl.Session, []byte, error) {
+	atomic.AddInt32(&m.authenticates, 1)
+	return nil, nil, errors.New("fake gssapi cannot authenticate")
+}
+
+func TestSASLGSSAPIUseHandshake(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1))
+	defer c.Close()
+
+	for _, useHandshake := range []bool{false, true} {
+		mechanism := new(fakeGSSAPI)
+		cl := newTestClient(t, c,
+			SASL(mechanism),
+			SASLGSSAPIUseHandshake(useHandshake),
+			RequestRetries(0),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := cl.Request(ctx, kmsg.NewPtrMetadataRequest())
+		cancel()
+		cl.Close()
+
+		// The fake cluster rejects every mechanism in the handshake; if
+		// we skip the handshake, we authenticate immediately.
+		authenticates := atomic.LoadInt32(&mechanism.authenticates)
+		if useHandshake {
+			if err != kerr.UnsupportedSaslMechanism || authenticates != 0 {
+				t.Errorf("with handshake: got err %v and %d authenticates, expected unsupported mechanism and none", err, authenticates)
+			}
+		} else if err == nil || authenticates == 0 {
+			t.Errorf("without handshake: got err %v and %d authenticates, expected an error after authenticating", err, authenticates)
+		}
+	}
+}
+
+// e2eHook records completed requests by key.
+type e2eHook struct {
+	mu   sync.Mutex
+	reqs map[int16][]e2eReq
+}
+
+type e2eReq struct {
+	version int16
+	total   time.Duration
+	err     error
+}
+
+func (h *e2eHook) OnRequestComplete(_ BrokerMetadata, key, version int16, _ int32, writeWait, timeToWrite, readWait, timeToRead time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reqs[key] = append(h.reqs[key], e2eReq{version, writeWait + timeToWrite + readWait + timeToRead, err})
+}
+
+func TestBrokerE2EHook(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	hook := &e2eHook{reqs: make(map[int16][]e2eReq)}
+	cl := newTestClient(t, c, WithHooks(hook))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := cl.Request(ctx, kmsg.NewPtrMetadataRequest())
+	if err != nil {
+		t.Fatalf("unable to request metadata: %v", err)
+	}
+
+	// A killed connection fails the in flight request, which the hook
+	// sees along with its error.
+	c.InjectFault(10, kfake.Fault{CloseConn: true})
+	if _, err := cl.Request(ctx, kmsg.NewPtrFindCoordinatorRequest()); err != nil {
+		t.Fatalf("unable to find coordinator after retrying: %v", err)
+	}
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+
+	var sawMeta bool
+	for _, r := range hook.reqs[3] {
+		if r.err == nil && r.total > 0 && r.version == resp.GetVersion() {
+			sawMeta = true
+		}
+	}
+	if !sawMeta {
+		t.Errorf("did not see our metadata request complete, saw %v", hook.reqs[3])
+	}
+
+	if finds := hook.reqs[10]; len(finds) != 2 || finds[0].err == nil || finds[1].err != nil {
+		t.Errorf("got find coordinator completions %v, expected one failure and then one success", finds)
+	}
+	if len(hook.reqs[18]) != 0 {
+		t.Errorf("got %d api versions completions, expected none since they initialize connections", len(hook.reqs[18]))
+	}
+}
+
+type connectInitHook struct {
+	mu    sync.Mutex
+	inits []connectInit
+}
+
+type connectInit struct {
+	apiVersions time.Duration
+	sasl        time.Duration
+	err         error
+}
+
+func (h *connectInitHook) OnConnectInit(_ BrokerMetadata, apiVersionsDur, saslDur time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inits = append(h.inits, connectInit{apiVersionsDur, saslDur, err})
+}
+
+func TestBrokerConnectInitHook(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1))
+	defer c.Close()
+
+	for _, withSASL := range []bool{false, true} {
+		hook := new(connectInitHook)
+		opts := []Opt{WithHooks(hook), RequestRetries(0)}
+		if withSASL {
+			opts = append(opts, SASL(new(fakeGSSAPI)), SASLGSSAPIUseHandshake(true))
+		}
+		cl := newTestClient(t, c, opts...)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, reqErr := cl.Request(ctx, kmsg.NewPtrMetadataRequest())
+		cancel()
+		cl.Close()
+
+		hook.mu.Lock()
+		inits := hook.inits
+		hook.mu.Unlock()
+
+		if len(inits) == 0 {
+			t.Fatalf("sasl %v: saw no connection initializations", withSASL)
+		}
+		first := inits[0]
+		if first.apiVersions <= 0 {
+			t.Errorf("sasl %v: got api versions duration %v, expected it to be timed", withSASL, first.apiVersions)
+		}
+		if withSASL {
+			// The fake cluster rejects every mechanism, which fails
+			// initialization after timing the handshake.
+			if first.sasl <= 0 || first.err != kerr.UnsupportedSaslMechanism || reqErr == nil {
+				t.Errorf("with sasl: got sasl duration %v, err %v, request err %v; expected a timed unsupported mechanism failure", first.sasl, first.err, reqErr)
+			}
+		} else if first.sasl != 0 || first.err != nil || reqErr != nil {
+			t.Errorf("without sasl: got sasl duration %v, err %v, request err %v; expected no sasl and no errors", first.sasl, first.err, reqErr)
+		}
+	}
+}
+
+type downgradeHook struct {
+	mu         sync.Mutex
+	downgrades []downgrade
+}
+
+type downgrade struct{ key, wanted, used int16 }
+
+func (h *downgradeHook) OnVersionDowngrade(_ BrokerMetadata, key, wanted, used int16) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.downgrades = append(h.downgrades, downgrade{key, wanted, used})
+}
+
+func TestBrokerVersionDowngradeHook(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.MaxKeyVersion(3, 4))
+	defer c.Close()
+
+	hook := new(downgradeHook)
+	cl := newTestClient(t, c, WithHooks(hook))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, req := range []kmsg.Request{kmsg.NewPtrMetadataRequest(), kmsg.NewPtrFindCoordinatorRequest()} {
+		if _, err := cl.Request(ctx, req); err != nil {
+			t.Fatalf("unable to issue %s: %v", kmsg.NameForKey(req.Key()), err)
+		}
+	}
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+
+	if len(hook.downgrades) == 0 {
+		t.Fatal("saw no downgrades, expected metadata to be downgraded")
+	}
+	wanted, _ := kversion.Stable().LookupMaxKeyVersion(3) // the client default max versions
+	for _, d := range hook.downgrades {
+		if d != (downgrade{3, wanted, 4}) {
+			t.Errorf("got downgrade %+v, expected only metadata downgrades from v%d to v4", d, wanted)
+		}
+	}
+}
+
+func TestConnectionSharing(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name    string
+		sharing ConnSharing
+		dials   int32
+	}{
+		{"split_produce_fetch", ConnSharingSplitProduceFetch, 3},
+		{"all_on_one", ConnSharingAllOnOne, 1},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+			defer c.Close()
+
+			// The seed is an alias for the broker so that we only count
+			// dials to the discovered broker.
+			var dials int32
+			cl := newTestClient(t, c,
+				SeedBrokers("seed:9092"),
+				Dialer(func(ctx context.Context, network, host string) (net.Conn, error) {
+					if host == "seed:9092" {
+						host = c.ListenAddrs()[0]
+					} else {
+						atomic.AddInt32(&dials, 1)
+					}
+					return c.DialContext(ctx, network, host)
+				}),
+				ConnectionSharing(test.sharing),
+			)
+			defer cl.Close()
+
+			produceN(t, cl, "foo", 10)
+			cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+			consumeN(t, cl, 10)
+
+			if got := atomic.LoadInt32(&dials); got != test.dials {
+				t.Errorf("got %d dials to the broker, expected %d", got, test.dials)
+			}
+		})
+	}
+}
+
+// writeCountHook counts writes and the requests written.
+type writeCountHook struct{ writes, bytes int64 }
+
+func (h *writeCountHook) OnWrite(_ BrokerMetadata, _ int16, n int, _, _ time.Duration, _ error) {
+	atomic.AddInt64(&h.writes, 1)
+	atomic.AddInt64(&h.bytes, int64(n))
+}
+
+// e2eIDHook records the correlation IDs of completed requests.
+type e2eIDHook struct {
+	mu  sync.Mutex
+	ids []int32
+}
+
+func (h *e2eIDHook) OnRequestComplete(_ BrokerMetadata, _, _ int16, corrID int32, _, _, _, _ time.Duration, _ error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ids = append(h.ids, corrID)
+}
+
+func TestWriteReqsFailureReportsCorrelationIDs(t *testing.T) {
+	hook := new(e2eIDHook)
+	cfg := defaultCfg()
+	cfg.hooks = hooks{hook}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := &Client{
+		cfg:           cfg,
+		ctx:           ctx,
+		ctxCancel:     cancel,
+		connTimeoutFn: connTimeoutBuilder(cfg.connTimeoutOverhead, requestWaitBuilder()),
+		bufPool:       newBufPool(),
+	}
+
+	// Writing fails because nothing is on the other end.
+	client, server := net.Pipe()
+	server.Close()
+	cxn := &brokerCxn{
+		conn:      client,
+		cl:        cl,
+		b:         &broker{cl: cl},
+		formatter: new(kmsg.RequestFormatter),
+		resps:     make(chan promisedResp, 1),
+		deadCh:    make(chan struct{}),
+		corrID:    5,
+	}
+
+	var prs []promisedReq
+	for i := 0; i < 2; i++ {
+		prs = append(prs, promisedReq{
+			ctx:     context.Background(),
+			req:     kmsg.NewPtrMetadataRequest(),
+			promise: func(kmsg.Response, error) {},
+			enqueue: time.Now(),
+		})
+	}
+	cxn.b.writeReqs(cxn, prs)
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if exp := []int32{5, 6}; !reflect.DeepEqual(hook.ids, exp) {
+		t.Errorf("got failed write correlation IDs %v, expected %v", hook.ids, exp)
+	}
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1))
+	defer c.Close()
+
+	hook := new(writeCountHook)
+	cl := newTestClient(t, c, CoalesceWrites(), WithHooks(hook))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := cl.Broker(0).Request(ctx, kmsg.NewPtrApiVersionsRequest()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each response must be for the request it was issued with, even if
+	// the requests are coalesced into one write.
+	const n = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		topic := fmt.Sprintf("topic-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := kmsg.NewPtrMetadataRequest()
+			rt := kmsg.NewMetadataRequestTopic()
+			rt.Topic = kmsg.StringPtr(topic)
+			req.Topics = append(req.Topics, rt)
+			kresp, err := cl.Broker(0).Request(ctx, req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp := kresp.(*kmsg.MetadataResponse)
+			if len(resp.Topics) != 1 || resp.Topics[0].Topic != topic {
+				errs <- fmt.Errorf("got response topics %v for request of %s", resp.Topics, topic)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Every request is hooked once, and its bytes are attributed to it.
+	if writes := atomic.LoadInt64(&hook.writes); writes < n {
+		t.Errorf("got %d hooked writes, expected at least %d", writes, n)
+	}
+	if bytes := atomic.LoadInt64(&hook.bytes); bytes == 0 {
+		t.Error("got no hooked bytes written")
+	}
+}
+
+// inFlightHook tracks the most requests awaiting responses at once on
+// discovered brokers.
+type inFlightHook struct {
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (h *inFlightHook) OnWrite(meta BrokerMetadata, _ int16, _ int, _, _ time.Duration, err error) {
+	if meta.IsSeed || err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inFlight++
+	if h.inFlight > h.max {
+		h.max = h.inFlight
+	}
+}
+
+func (h *inFlightHook) OnRead(meta BrokerMetadata, _ int16, _ int, _, _ time.Duration, _ error) {
+	if meta.IsSeed {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inFlight--
+}
+
+func TestMaxInFlightPerConnection(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	hook := new(inFlightHook)
+	cl := newTestClient(t, c,
+		ConnectionSharing(ConnSharingAllOnOne),
+		MaxInFlightPerConnection(2),
+		CoalesceWrites(),
+		WithHooks(hook),
+	)
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cl.Broker(0).Request(ctx, kmsg.NewPtrMetadataRequest()); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Producing and consuming on the one connection is unaffected.
+	produceN(t, cl, "foo", 10)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	consumeN(t, cl, 10)
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if hook.max > 2 || hook.max == 0 {
+		t.Errorf("got at most %d requests in flight, expected 1 or 2", hook.max)
+	}
+}
+
+func TestMaxInFlightDoesNotDelayOtherConnections(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, MaxInFlightPerConnection(1))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := cl.Broker(0)
+	if _, err := b.Request(ctx, kmsg.NewPtrMetadataRequest()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A long poll on the empty partition fills the fetch connection, so
+	// a second fetch must wait for room.
+	longPoll := func() *kmsg.FetchRequest {
+		req := kmsg.NewPtrFetchRequest()
+		req.MaxWaitMillis = 2000
+		req.MaxBytes = 1 << 20
+		req.MinBytes = 1
+		rt := kmsg.NewFetchRequestTopic()
+		rt.Topic = "foo"
+		rp := kmsg.NewFetchRequestTopicPartition()
+		rp.PartitionMaxBytes = 1 << 20
+		rt.Partitions = append(rt.Partitions, rp)
+		req.Topics = append(req.Topics, rt)
+		return req
+	}
+	first := make(chan error, 1)
+	go func() {
+		_, err := b.Request(ctx, longPoll())
+		first <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	waitCtx, waitCancel := context.WithCancel(ctx)
+	gated := make(chan error, 1)
+	go func() {
+		_, err := b.Request(waitCtx, longPoll())
+		gated <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// Requests on the broker's other connections are not held up by the
+	// fetch waiting for room.
+	start := time.Now()
+	if _, err := b.Request(ctx, kmsg.NewPtrMetadataRequest()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("metadata took %v behind a full fetch connection", elapsed)
+	}
+
+	// The waiting fetch fails once canceled, before room frees.
+	waitCancel()
+	select {
+	case err := <-gated:
+		if err != context.Canceled {
+			t.Errorf("got gated fetch err %v, expected context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("gated fetch was not failed on cancel")
+	}
+	if err := <-first; err != nil {
+		t.Errorf("long poll failed: %v", err)
+	}
+}
+
+func TestTLSVerifyBrokerHandshakeTimesOut(t *testing.T) {
+	t.Parallel()
+
+	// The "broker" accepts connections but never answers the handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cl, err := NewClient(
+		SeedBrokers(ln.Addr().String()),
+		Dialer(func(ctx context.Context, network, host string) (net.Conn, error) {
+			conn, err := new(net.Dialer).DialContext(ctx, network, host)
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), nil
+		}),
+		TLSVerifyBroker(func(BrokerMetadata, tls.ConnectionState) error { return nil }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := cl.Request(ctx, kmsg.NewPtrMetadataRequest())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("got no error from a broker that never handshakes")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request hung on a stalled tls handshake")
+	}
+}
+
+// warnCounter is a logger that counts warnings.
+type warnCounter struct{ warns int32 }
+
+func (*warnCounter) Level() LogLevel { return LogLevelWarn }
+
+func (w *warnCounter) Log(level LogLevel, _ string, _ ...interface{}) {
+	if level == LogLevelWarn {
+		atomic.AddInt32(&w.warns, 1)
+	}
+}
+
+func TestRequestVersionErrors(t *testing.T) {
+	t.Parallel()
+
+	// The "broker" supports ListOffsets up to v1 and does not support
+	// DescribeConfigs at all.
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.MaxKeyVersion(2, 1))
+	defer c.Close()
+
+	withoutListOffsets := kversion.Stable()
+	withoutListOffsets.SetMaxKeyVersion(2, -1)
+	requireListOffsetsV4 := new(kversion.Versions)
+	requireListOffsetsV4.SetMaxKeyVersion(2, 4)
+	requireDescribeConfigsV1 := new(kversion.Versions)
+	requireDescribeConfigsV1.SetMaxKeyVersion(32, 1)
+
+	for _, test := range []struct {
+		name string
+		opts []Opt
+		req  kmsg.Request
+
+		expUnknown *ErrUnknownRequestKey
+		expTooOld  *ErrBrokerTooOld
+	}{
+		{
+			name:       "unknown_key",
+			opts:       []Opt{MaxVersions(withoutListOffsets)},
+			req:        kmsg.NewPtrListOffsetsRequest(),
+			expUnknown: &ErrUnknownRequestKey{Key: 2},
+		},
+		{
+			name:      "unsupported_key",
+			req:       kmsg.NewPtrDescribeConfigsRequest(),
+			expTooOld: &ErrBrokerTooOld{Key: 32, MinVersion: 0, BrokerMaxVersion: -1},
+		},
+		{
+			name:      "unsupported_key_with_min",
+			opts:      []Opt{MinVersions(requireDescribeConfigsV1)},
+			req:       kmsg.NewPtrDescribeConfigsRequest(),
+			expTooOld: &ErrBrokerTooOld{Key: 32, MinVersion: 1, BrokerMaxVersion: -1},
+		},
+		{
+			name:      "below_min",
+			opts:      []Opt{MinVersions(requireListOffsetsV4)},
+			req:       kmsg.NewPtrListOffsetsRequest(),
+			expTooOld: &ErrBrokerTooOld{Key: 2, MinVersion: 4, BrokerMaxVersion: 1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cl := newTestClient(t, c, test.opts...)
+			defer cl.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err := cl.Request(ctx, test.req)
+
+			// The errors are found through wrapping.
+			err = fmt.Errorf("request failed: %w", err)
+			var unknown *ErrUnknownRequestKey
+			var tooOld *ErrBrokerTooOld
+			if gotUnknown := errors.As(err, &unknown); gotUnknown != (test.expUnknown != nil) || gotUnknown && *unknown != *test.expUnknown {
+				t.Errorf("got err %v, expected ErrUnknownRequestKey %+v", err, test.expUnknown)
+			}
+			if gotTooOld := errors.As(err, &tooOld); gotTooOld != (test.expTooOld != nil) || gotTooOld && *tooOld != *test.expTooOld {
+				t.Errorf("got err %v, expected ErrBrokerTooOld %+v", err, test.expTooOld)
+			}
+		})
+	}
+}
+
+func TestMinVersionsWarnOnly(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	// The "broker" supports ListOffsets up to v1, but we require v4.
+	maxVersions := kversion.Stable()
+	maxVersions.SetMaxKeyVersion(2, 1)
+	minVersions := new(kversion.Versions)
+	minVersions.SetMaxKeyVersion(2, 4)
+
+	list := func(cl *Client) (*kmsg.ListOffsetsResponse, error) {
+		req := kmsg.NewPtrListOffsetsRequest()
+		req.ReplicaID = -1
+		rt := kmsg.NewListOffsetsRequestTopic()
+		rt.Topic = "foo"
+		rp := kmsg.NewListOffsetsRequestTopicPartition()
+		rp.Timestamp = -1
+		rt.Partitions = append(rt.Partitions, rp)
+		req.Topics = append(req.Topics, rt)
+		return req.RequestWith(context.Background(), cl)
+	}
+
+	strict := newTestClient(t, c, MaxVersions(maxVersions), MinVersions(minVersions))
+	defer strict.Close()
+	var tooOld *ErrBrokerTooOld
+	if _, err := list(strict); !errors.As(err, &tooOld) || tooOld.Key != 2 || tooOld.MinVersion != 4 {
+		t.Errorf("got err %v, expected the broker to be too old for ListOffsets v4", err)
+	}
+
+	// Warning only for other keys still fails the request.
+	otherKeys := newTestClient(t, c, MaxVersions(maxVersions), MinVersions(minVersions), MinVersionsWarnOnly(1))
+	defer otherKeys.Close()
+	if _, err := list(otherKeys); !errors.As(err, &tooOld) {
+		t.Errorf("got err %v, expected the broker to be too old", err)
+	}
+
+	logger := new(warnCounter)
+	lenient := newTestClient(t, c, MaxVersions(maxVersions), MinVersions(minVersions), MinVersionsWarnOnly(2), WithLogger(logger))
+	defer lenient.Close()
+	for i := 0; i < 3; i++ {
+		resp, err := list(lenient)
+		if err != nil {
+			t.Fatalf("unable to list offsets: %v", err)
+		}
+		if resp.Version != 1 {
+			t.Errorf("got version %d, expected the best available version 1", resp.Version)
+		}
+	}
+	if warns := atomic.LoadInt32(&logger.warns); warns != 1 {
+		t.Errorf("got %d warnings, expected 1 for the connection", warns)
+	}
+}
+
+type wrappedConn struct{ net.Conn }
+
+func (c wrappedConn) NetConn() net.Conn { return c.Conn }
+
+func TestUnderlyingTCPConn(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// The listener's backlog completes our dial without accepting.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer conn.Close()
+	raw := conn.(*net.TCPConn)
+
+	piped, _ := net.Pipe()
+	defer piped.Close()
+
+	for _, test := range []struct {
+		name string
+		conn net.Conn
+		ok   bool
+	}{
+		{"tcp", raw, true},
+		{"tls", tls.Client(raw, &tls.Config{InsecureSkipVerify: true}), true},
+		{"wrapped_tls", wrappedConn{tls.Client(raw, &tls.Config{InsecureSkipVerify: true})}, true},
+		{"pipe", piped, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := underlyingTCPConn(test.conn)
+			if ok != test.ok || ok && got != raw {
+				t.Errorf("got conn %v ok %v, expected ok %v with the dialed conn", got, ok, test.ok)
+			}
+		})
+	}
+
+	// TCP options apply through the TLS wrapping.
+	cfg := defaultCfg()
+	cfg.tcpKeepAlive = time.Minute
+	cfg.tcpReadBuffer = 1 << 16
+	tcp, _ := underlyingTCPConn(tls.Client(raw, &tls.Config{InsecureSkipVerify: true}))
+	if err := cfg.tuneTCP(tcp); err != nil {
+		t.Errorf("unable to tune the conn beneath a tls conn: %v", err)
+	}
+}
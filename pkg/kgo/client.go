@@ -19,9 +19,11 @@ package kgo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -39,13 +41,18 @@ type Client struct {
 	ctx       context.Context
 	ctxCancel func()
 
+	// closeDone is closed once Close has fully torn down the client, so
+	// that a Close racing another Close still waits for the teardown.
+	closeDone chan struct{}
+
 	rng *rand.Rand
 
-	brokersMu    sync.RWMutex
-	brokers      map[int32]*broker // broker id => broker
-	anyBroker    []*broker
-	anyBrokerIdx int
-	stopBrokers  bool // set to true on close to stop updateBrokers
+	brokersMu     sync.RWMutex
+	brokers       map[int32]*broker // broker id => broker
+	anyBroker     []*broker
+	anyBrokerIdx  int
+	fallbackSeeds []*broker // seeds not in anyBroker, for SeedPolicyFallbackOnly
+	stopBrokers   bool      // set to true on close to stop updateBrokers
 
 	// A sink and a source is created once per node ID and persists
 	// forever. We expect the list to be small.
@@ -56,11 +63,19 @@ type Client struct {
 	sinksAndSourcesMu sync.Mutex
 	sinksAndSources   map[int32]sinkAndSource
 
-	reqFormatter  *kmsg.RequestFormatter
-	connTimeoutFn func(kmsg.Request) (time.Duration, time.Duration)
+	paused     int32 // atomic; see Pause
+	metaLoaded int32 // atomic; set once metadata first loads, see fetchSeedMetadata
+
+	reqFormatter     *kmsg.RequestFormatter
+	produceFormatter *kmsg.RequestFormatter // for produce requests; may be reqFormatter
+	fetchFormatter   *kmsg.RequestFormatter // for fetch requests; may be reqFormatter
+	connTimeoutFn    func(kmsg.Request) (time.Duration, time.Duration)
+	requestWaitFn    func(kmsg.Request) time.Duration // see ConnStallTimeout
 
 	bufPool bufPool // for to brokers to share underlying reusable request buffers
 
+	dialSem chan struct{} // if non-nil, limits dials at once; see MaxConcurrentDials
+
 	controllerIDMu sync.Mutex
 	controllerID   int32
 
@@ -93,8 +108,34 @@ type Client struct {
 
 	updateMetadataCh    chan struct{}
 	updateMetadataNowCh chan struct{} // like above, but with high priority
+	forceMetadataCh     chan struct{} // like above, but interrupts error backoff
 	metawait            metawait
 	metadone            chan struct{}
+
+	metaStatusMu sync.Mutex
+	metaStatus   MetadataStatus
+
+	rawMeta atomic.Value // *kmsg.MetadataResponse; see RawMetadata
+
+	metaSubsMu sync.Mutex
+	metaSubs   []*metadataSub // from OnMetadataUpdate
+
+	// missingParts tracks partitions missing from metadata if using
+	// MissingPartitionGracePeriod. This is only used in the metadata loop.
+	missingParts map[string]map[int32]*missingPartition
+
+	// underReplicated tracks consumed partitions we have warned are under
+	// replicated, for WarnOnUnderReplicated. This is only used in the
+	// metadata loop.
+	underReplicated map[string]map[int32]struct{}
+
+	// metaMergeMu serializes merging a metadata update with pruning topics
+	// (PruneMetadataTopics, MetadataTopicTTL); prunedSeqs is guarded by it.
+	metaMergeMu sync.Mutex
+	prunedSeqs  map[string]prunedSeqs
+
+	failoverSeeds []hostport // from FailoverSeedBrokers
+	failedOver    int32      // atomic; set once we fail over to failoverSeeds
 }
 
 type sinkAndSource struct {
@@ -123,46 +164,42 @@ func NewClient(opts ...Opt) (*Client, error) {
 	if err := cfg.validate(); err != nil {
 		return nil, err
 	}
-
-	type hostport struct {
-		host string
-		port int32
+	if cfg.produceRetries < 0 {
+		cfg.produceRetries = cfg.retries
 	}
-	seeds := make([]hostport, 0, len(cfg.seedBrokers))
-	for _, seedBroker := range cfg.seedBrokers {
-		addr := seedBroker
-		port := int32(9092) // default kafka port
-		if colon := strings.IndexByte(addr, ':'); colon > 0 {
-			port64, err := strconv.ParseInt(addr[colon+1:], 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("unable to parse addr:port in %q", seedBroker)
-			}
-			addr = addr[:colon]
-			port = int32(port64)
-		}
 
-		if addr == "localhost" {
-			addr = "127.0.0.1"
-		}
-
-		seeds = append(seeds, hostport{addr, port})
+	seeds, err := parseSeeds(cfg.seedBrokers)
+	if err != nil {
+		return nil, err
+	}
+	failoverSeeds, err := parseSeeds(cfg.failoverSeeds)
+	if err != nil {
+		return nil, err
 	}
 
+	// Our own context is never derived from the user's client context:
+	// closing must still be able to issue requests (such as leaving the
+	// group) after the user's context is canceled.
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// Timeouts and stall detection share one request wait so that both
+	// see the same last join's rebalance timeout for syncs.
+	requestWait := requestWaitBuilder()
+
 	cl := &Client{
 		cfg:       cfg,
 		ctx:       ctx,
 		ctxCancel: cancel,
+		closeDone: make(chan struct{}),
 		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
 
 		controllerID: unknownControllerID,
-		brokers:      make(map[int32]*broker),
 
 		sinksAndSources: make(map[int32]sinkAndSource),
 
 		reqFormatter:  new(kmsg.RequestFormatter),
-		connTimeoutFn: connTimeoutBuilder(cfg.connTimeoutOverhead),
+		connTimeoutFn: userConnTimeoutBuilder(cfg.connTimeoutFn, connTimeoutBuilder(cfg.connTimeoutOverhead, requestWait)),
+		requestWaitFn: requestWait,
 
 		bufPool: newBufPool(),
 
@@ -173,17 +210,34 @@ func NewClient(opts ...Opt) (*Client, error) {
 
 		updateMetadataCh:    make(chan struct{}, 1),
 		updateMetadataNowCh: make(chan struct{}, 1),
+		forceMetadataCh:     make(chan struct{}, 1),
 		metadone:            make(chan struct{}),
+
+		failoverSeeds: failoverSeeds,
 	}
 	cl.producer.init()
 	cl.consumer.cl = cl
 	cl.consumer.sourcesReadyCond = sync.NewCond(&cl.consumer.sourcesReadyMu)
+	cl.consumer.stopDone = make(chan struct{})
+	if cfg.maxFetchGoroutines > 0 {
+		cl.consumer.fetchSem = make(chan struct{}, cfg.maxFetchGoroutines)
+	}
+	if cfg.maxDials > 0 {
+		cl.dialSem = make(chan struct{}, cfg.maxDials)
+	}
 	cl.topics.Store(make(map[string]*topicPartitions))
 	cl.metawait.init()
 
 	if cfg.id != nil {
 		cl.reqFormatter = kmsg.NewRequestFormatter(kmsg.FormatterClientID(*cfg.id))
 	}
+	cl.produceFormatter, cl.fetchFormatter = cl.reqFormatter, cl.reqFormatter
+	if cfg.produceID != nil {
+		cl.produceFormatter = kmsg.NewRequestFormatter(kmsg.FormatterClientID(*cfg.produceID))
+	}
+	if cfg.consumeID != nil {
+		cl.fetchFormatter = kmsg.NewRequestFormatter(kmsg.FormatterClientID(*cfg.consumeID))
+	}
 
 	compressor, err := newCompressor(cl.cfg.compression...)
 	if err != nil {
@@ -191,28 +245,137 @@ func NewClient(opts ...Opt) (*Client, error) {
 	}
 	cl.compressor = compressor
 
+	cl.brokers, cl.anyBroker = cl.newSeedBrokers(seeds)
+	go cl.updateMetadataLoop()
+	if cfg.saslProbeInterval > 0 && len(cfg.sasls) > 0 {
+		go cl.saslProbeLoop()
+	}
+
+	// If the user's context is canceled, we tear down the client exactly
+	// as if Close were called. If the client is closed first, we quit.
+	if parent := cfg.ctx.Done(); parent != nil {
+		go func() {
+			select {
+			case <-parent:
+				cl.Close()
+			case <-cl.closeDone:
+			}
+		}()
+	}
+
+	return cl, nil
+}
+
+type hostport struct {
+	host string
+	port int32
+}
+
+// parseSeeds parses seed broker addresses, defaulting missing ports to 9092.
+func parseSeeds(seedBrokers []string) ([]hostport, error) {
+	seeds := make([]hostport, 0, len(seedBrokers))
+	for _, seedBroker := range seedBrokers {
+		addr := seedBroker
+		port := int32(9092) // default kafka port
+		if colon := strings.IndexByte(addr, ':'); colon > 0 {
+			port64, err := strconv.ParseInt(addr[colon+1:], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse addr:port in %q", seedBroker)
+			}
+			addr = addr[:colon]
+			port = int32(port64)
+		}
+
+		if addr == "localhost" {
+			addr = "127.0.0.1"
+		}
+
+		seeds = append(seeds, hostport{addr, port})
+	}
+	return seeds, nil
+}
+
+// newSeedBrokers returns new brokers for seeds, keyed by their unknown seed
+// IDs, and the seeds as a list for anyBroker.
+func (cl *Client) newSeedBrokers(seeds []hostport) (map[int32]*broker, []*broker) {
+	brokers := make(map[int32]*broker, len(seeds))
+	anyBroker := make([]*broker, 0, len(seeds))
 	for i, seed := range seeds {
 		b := cl.newBroker(unknownSeedID(i), seed.host, seed.port, nil)
-		cl.brokers[b.meta.NodeID] = b
-		cl.anyBroker = append(cl.anyBroker, b)
+		brokers[b.meta.NodeID] = b
+		anyBroker = append(anyBroker, b)
 	}
-	go cl.updateMetadataLoop()
+	return brokers, anyBroker
+}
 
-	return cl, nil
+// userConnTimeoutBuilder wraps a user provided timeout function, falling back
+// to our default timeouts for anything the user does not set and ensuring
+// fetch reads always allow for the fetch's max wait.
+func userConnTimeoutBuilder(
+	user func(kmsg.Request) (time.Duration, time.Duration),
+	def func(kmsg.Request) (time.Duration, time.Duration),
+) func(kmsg.Request) (time.Duration, time.Duration) {
+	if user == nil {
+		return def
+	}
+	return func(req kmsg.Request) (read, write time.Duration) {
+		defRead, defWrite := def(req) // always called: join stashes the rebalance timeout for sync
+		read, write = user(req)
+		if read == 0 {
+			read = defRead
+		} else {
+			switch t := req.(type) {
+			case *fetchRequest:
+				read += time.Duration(t.maxWait) * time.Millisecond
+			case *kmsg.FetchRequest:
+				read += time.Duration(t.MaxWaitMillis) * time.Millisecond
+			}
+		}
+		if write == 0 {
+			write = defWrite
+		}
+		return read, write
+	}
 }
 
-func connTimeoutBuilder(def time.Duration) func(kmsg.Request) (time.Duration, time.Duration) {
+func connTimeoutBuilder(def time.Duration, requestWait func(kmsg.Request) time.Duration) func(kmsg.Request) (time.Duration, time.Duration) {
+	return func(req kmsg.Request) (read, write time.Duration) {
+		switch req.(type) {
+		default:
+			return def + requestWait(req), def
+
+		// SASL may interact with an external system; we give each step
+		// of the read process 30s by default.
+
+		case *kmsg.SASLHandshakeRequest,
+			*kmsg.SASLAuthenticateRequest:
+			return 30 * time.Second, def
+
+		case *kmsg.SyncGroupRequest:
+			read := def
+			if wait := requestWait(req); wait != 0 {
+				read = wait
+			}
+			return read, def
+		}
+	}
+}
+
+// requestWaitBuilder returns a function that returns how long a broker may
+// wait before replying to a request, such as a fetch waiting for records or a
+// join waiting for the group to rebalance. Requests that are replied to
+// immediately have no wait.
+func requestWaitBuilder() func(kmsg.Request) time.Duration {
 	var joinMu sync.Mutex
 	var lastRebalanceTimeout time.Duration
 
-	return func(req kmsg.Request) (read, write time.Duration) {
+	return func(req kmsg.Request) time.Duration {
 		millis := func(m int32) time.Duration { return time.Duration(m) * time.Millisecond }
 		switch t := req.(type) {
 		default:
 			// Many fields in the definitions have a common field
 			// "TimeoutMillis". If that exists and is an int32,
-			// we use it, otherwise we fallback to our default
-			// for both read and write.
+			// we use it, otherwise the request has no wait.
 			v := reflect.Indirect(reflect.ValueOf(req))
 			if v.Kind() == reflect.Struct { // should be but just in case
 				v = v.FieldByName("TimeoutMillis")
@@ -220,25 +383,18 @@ func connTimeoutBuilder(def time.Duration) func(kmsg.Request) (time.Duration, ti
 				if v != zero {
 					v := v.Interface()
 					if timeoutMillis, ok := v.(int32); ok {
-						return def + millis(timeoutMillis), def
+						return millis(timeoutMillis)
 					}
 				}
 			}
-			return def, def
+			return 0
 
 		case *produceRequest:
-			return def + millis(t.timeout), def
+			return millis(t.timeout)
 		case *fetchRequest:
-			return def + millis(t.maxWait), def
+			return millis(t.maxWait)
 		case *kmsg.FetchRequest:
-			return def + millis(t.MaxWaitMillis), def
-
-		// SASL may interact with an external system; we give each step
-		// of the read process 30s by default.
-
-		case *kmsg.SASLHandshakeRequest,
-			*kmsg.SASLAuthenticateRequest:
-			return 30 * time.Second, def
+			return millis(t.MaxWaitMillis)
 
 		// Join and sync can take a long time. Sync has no notion of
 		// timeouts, but since the flow of requests should be first
@@ -249,17 +405,11 @@ func connTimeoutBuilder(def time.Duration) func(kmsg.Request) (time.Duration, ti
 			lastRebalanceTimeout = millis(t.RebalanceTimeoutMillis)
 			joinMu.Unlock()
 
-			return def + millis(t.RebalanceTimeoutMillis), def
+			return millis(t.RebalanceTimeoutMillis)
 		case *kmsg.SyncGroupRequest:
-			read := def
 			joinMu.Lock()
-			if lastRebalanceTimeout != 0 {
-				read = lastRebalanceTimeout
-			}
-			joinMu.Unlock()
-
-			return read, def
-
+			defer joinMu.Unlock()
+			return lastRebalanceTimeout
 		}
 	}
 }
@@ -273,24 +423,41 @@ func (cl *Client) broker() *broker {
 		cl.anyBrokerIdx = 0
 	}
 
-	b := cl.anyBroker[cl.anyBrokerIdx]
-	cl.anyBrokerIdx++
-	if cl.anyBrokerIdx == len(cl.anyBroker) {
-		cl.anyBrokerIdx = 0
-		cl.rng.Shuffle(len(cl.anyBroker), func(i, j int) { cl.anyBroker[i], cl.anyBroker[j] = cl.anyBroker[j], cl.anyBroker[i] })
+	next := func() *broker {
+		b := cl.anyBroker[cl.anyBrokerIdx]
+		cl.anyBrokerIdx++
+		if cl.anyBrokerIdx == len(cl.anyBroker) {
+			cl.anyBrokerIdx = 0
+			cl.rng.Shuffle(len(cl.anyBroker), func(i, j int) { cl.anyBroker[i], cl.anyBroker[j] = cl.anyBroker[j], cl.anyBroker[i] })
+		}
+		return b
+	}
+
+	b := next()
+	if cl.cfg.seedPolicy != SeedPolicyFallbackOnly || len(cl.fallbackSeeds) == 0 {
+		return b
+	}
+
+	// With SeedPolicyFallbackOnly, anyBroker is only discovered brokers.
+	// We only use a seed if every discovered broker is unreachable.
+	for tries := 1; b.unreachable(); tries++ {
+		if tries == len(cl.anyBroker) {
+			return cl.fallbackSeeds[cl.rng.Intn(len(cl.fallbackSeeds))]
+		}
+		b = next()
 	}
 	return b
 }
 
 func (cl *Client) waitTries(ctx context.Context, tries int) bool {
-	after := time.NewTimer(cl.cfg.retryBackoff(tries))
+	after := cl.cfg.clock.NewTimer(cl.cfg.retryBackoff(tries))
 	defer after.Stop()
 	select {
 	case <-ctx.Done():
 		return false
 	case <-cl.ctx.Done():
 		return false
-	case <-after.C:
+	case <-after.C():
 		return true
 	}
 }
@@ -334,9 +501,20 @@ func (cl *Client) fetchMetadataForTopics(ctx context.Context, all bool, topics [
 }
 
 func (cl *Client) fetchMetadata(ctx context.Context, req *kmsg.MetadataRequest) (*broker, *kmsg.MetadataResponse, error) {
-	r := cl.retriable()
-	meta, err := req.RequestWith(ctx, r)
+	var (
+		br   *broker
+		meta *kmsg.MetadataResponse
+		err  error
+	)
+	if (cl.cfg.seedRetries >= 0 || cl.cfg.initialMetaTimeout > 0) && atomic.LoadInt32(&cl.metaLoaded) == 0 {
+		br, meta, err = cl.fetchSeedMetadata(ctx, req)
+	} else {
+		r := cl.retriable()
+		meta, err = req.RequestWith(ctx, r)
+		br = r.last
+	}
 	if err == nil {
+		atomic.StoreInt32(&cl.metaLoaded, 1)
 		if meta.ControllerID >= 0 {
 			cl.controllerIDMu.Lock()
 			cl.controllerID = meta.ControllerID
@@ -344,7 +522,49 @@ func (cl *Client) fetchMetadata(ctx context.Context, req *kmsg.MetadataRequest)
 		}
 		cl.updateBrokers(meta.Brokers)
 	}
-	return r.last, meta, err
+	return br, meta, err
+}
+
+// fetchSeedMetadata loads our first metadata if using SeedBrokerRetries or
+// InitialMetadataTimeout. We try every seed in order, and then retry them all
+// after backing off. If every try fails, we return every seed's last failure.
+func (cl *Client) fetchSeedMetadata(ctx context.Context, req *kmsg.MetadataRequest) (*broker, *kmsg.MetadataResponse, error) {
+	if timeout := cl.cfg.initialMetaTimeout; timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var seeds []*broker
+	cl.brokersMu.RLock()
+	for i := 0; ; i++ {
+		seed, exists := cl.brokers[unknownSeedID(i)]
+		if !exists {
+			break
+		}
+		seeds = append(seeds, seed)
+	}
+	cl.brokersMu.RUnlock()
+
+	errs := &ErrSeedBrokers{Seeds: make([]SeedBrokerFailure, len(seeds))}
+	if len(seeds) == 0 {
+		return nil, nil, errs // nothing to retry; validating should have caught this
+	}
+	for i, seed := range seeds {
+		errs.Seeds[i].Addr = seed.addr
+	}
+	for tries := 1; ; tries++ {
+		for i, seed := range seeds {
+			resp, err := seed.waitResp(ctx, req)
+			if err == nil {
+				return seed, resp.(*kmsg.MetadataResponse), nil
+			}
+			errs.Seeds[i].Err = err
+		}
+		if cl.cfg.seedRetries >= 0 && tries > cl.cfg.seedRetries || !cl.waitTries(ctx, tries) {
+			return nil, nil, errs
+		}
+	}
 }
 
 // updateBrokers is called with the broker portion of every metadata response.
@@ -378,20 +598,262 @@ func (cl *Client) updateBrokers(brokers []kmsg.MetadataResponseBroker) {
 		newAnyBroker = append(newAnyBroker, b)
 	}
 
+	var seeds []*broker
 	for goneID, goneBroker := range cl.brokers {
 		if goneID < -1 { // seed broker, unknown ID, always keep
-			newBrokers[goneID] = goneBroker
-			newAnyBroker = append(newAnyBroker, goneBroker)
+			seeds = append(seeds, goneBroker)
 		} else {
 			goneBroker.stopForever()
 		}
 	}
 
+	// How we keep seeds depends on our seed policy. We always keep seeds
+	// in our brokers map, because partitions with unknown leaders are
+	// routed to the first seed.
+	haveDiscovered := len(newAnyBroker) > 0
+	cl.fallbackSeeds = nil
+	for _, seed := range seeds {
+		switch {
+		case cl.cfg.seedPolicy == SeedPolicyKeep:
+			newAnyBroker = append(newAnyBroker, seed)
+
+		case !haveDiscovered:
+			// Without any discovered brokers, every policy uses
+			// seeds. If we previously stopped our seeds, we
+			// recreate them so that we can recover.
+			if atomic.LoadInt32(&seed.dead) == 1 {
+				seed = cl.newBroker(seed.meta.NodeID, seed.meta.Host, seed.meta.Port, nil)
+			}
+			newAnyBroker = append(newAnyBroker, seed)
+
+		case cl.cfg.seedPolicy == SeedPolicyCloseAfterMetadata:
+			seed.stopForever()
+
+		case cl.cfg.seedPolicy == SeedPolicyFallbackOnly:
+			cl.fallbackSeeds = append(cl.fallbackSeeds, seed)
+		}
+		newBrokers[seed.meta.NodeID] = seed
+	}
+
 	cl.brokers = newBrokers
 	cl.anyBroker = newAnyBroker
 }
 
+// resetPartitionEpochs forgets the leader epoch of every partition when
+// failing over. Epochs from the primary cluster mean nothing on the failover
+// cluster; if we kept them, a failover cluster with lower epochs would have
+// its metadata ignored as stale forever.
+//
+// This is only called from the metadata loop, so no metadata update is
+// merging concurrently; the merge mu guards against pruning. Partitions are
+// copied rather than modified because they are read without locks.
+func (cl *Client) resetPartitionEpochs() {
+	cl.metaMergeMu.Lock()
+	defer cl.metaMergeMu.Unlock()
+
+	for _, parts := range cl.loadTopics() {
+		v := parts.load()
+		reset := &topicPartitionsData{
+			loadErr:    v.loadErr,
+			isInternal: v.isInternal,
+		}
+		for _, p := range v.partitions {
+			tp := *p
+			tp.leaderEpoch = -1
+			reset.partitions = append(reset.partitions, &tp)
+			if tp.loadErr == nil {
+				reset.writablePartitions = append(reset.writablePartitions, &tp)
+			}
+		}
+		parts.v.Store(reset)
+	}
+}
+
+// maybeFailover fails over to the FailoverSeedBrokers if metadata updates
+// have been failing since failingSince for longer than the failover delay and
+// the most recent dial to every broker failed, returning whether we failed
+// over. This is only called in the metadata loop.
+func (cl *Client) maybeFailover(failingSince time.Time) bool {
+	if len(cl.failoverSeeds) == 0 ||
+		atomic.LoadInt32(&cl.failedOver) == 1 ||
+		time.Since(failingSince) < cl.cfg.failoverAfter {
+		return false
+	}
+
+	cl.brokersMu.Lock()
+	if cl.stopBrokers {
+		cl.brokersMu.Unlock()
+		return false
+	}
+	for _, b := range cl.brokers {
+		if atomic.LoadInt32(&b.dead) == 0 && atomic.LoadInt64(&b.dialFailedAt) == 0 {
+			cl.brokersMu.Unlock()
+			return false
+		}
+	}
+	atomic.StoreInt32(&cl.failedOver, 1)
+	for _, b := range cl.brokers {
+		b.stopForever()
+	}
+	cl.brokers, cl.anyBroker = cl.newSeedBrokers(cl.failoverSeeds)
+	cl.anyBrokerIdx = 0
+	cl.fallbackSeeds = nil
+	cl.brokersMu.Unlock()
+
+	cl.cfg.logger.Log(LogLevelWarn, "primary cluster unreachable, failing over to failover seed brokers",
+		"failing_since", failingSince,
+		"failover_seeds", cl.cfg.failoverSeeds,
+	)
+
+	cl.controllerIDMu.Lock()
+	cl.controllerID = unknownControllerID
+	cl.controllerIDMu.Unlock()
+
+	cl.coordinatorsMu.Lock()
+	cl.coordinators = make(map[coordinatorKey]int32)
+	cl.coordinatorsMu.Unlock()
+
+	cl.resetPartitionEpochs()
+
+	// Our producer ID is meaningless on the new cluster. We reset our
+	// sequence numbers and load a brand new ID.
+	cl.producer.idMu.Lock()
+	for _, tp := range cl.loadTopics() {
+		for _, tpd := range tp.load().partitions {
+			tpd.records.resetSeq()
+		}
+	}
+	cl.producer.id.Store(&producerID{
+		id:    -1,
+		epoch: -1,
+		err:   errReloadProducerID,
+	})
+	cl.producer.idMu.Unlock()
+
+	cl.consumer.resetForFailover()
+	return true
+}
+
+// preconnectBrokers issues a connection-only request to every discovered
+// broker, which opens and initializes that broker's general connection in the
+// background.
+func (cl *Client) preconnectBrokers() {
+	cl.brokersMu.RLock()
+	brokers := make([]*broker, 0, len(cl.brokers))
+	for _, broker := range cl.brokers {
+		if broker.meta.NodeID >= 0 {
+			brokers = append(brokers, broker)
+		}
+	}
+	cl.brokersMu.RUnlock()
+
+	for _, b := range brokers {
+		b := b
+		cl.cfg.logger.Log(LogLevelDebug, "preconnecting to broker", "addr", b.addr, "id", b.meta.NodeID)
+		b.do(cl.ctx, new(preconnectRequest), func(_ kmsg.Response, err error) {
+			if err != nil {
+				cl.cfg.logger.Log(LogLevelWarn, "unable to preconnect to broker", "addr", b.addr, "id", b.meta.NodeID, "err", err)
+			}
+		})
+	}
+}
+
+// saslProbeLoop issues a sasl probe to every broker each probe interval until
+// the client is closed.
+func (cl *Client) saslProbeLoop() {
+	for {
+		timer := cl.cfg.clock.NewTimer(cl.cfg.saslProbeInterval)
+		select {
+		case <-cl.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		cl.brokersMu.RLock()
+		brokers := make([]*broker, 0, len(cl.brokers))
+		for _, broker := range cl.brokers {
+			brokers = append(brokers, broker)
+		}
+		cl.brokersMu.RUnlock()
+
+		for _, b := range brokers {
+			b := b
+			b.do(cl.ctx, new(saslProbeRequest), func(_ kmsg.Response, err error) {
+				if err != nil {
+					cl.cfg.logger.Log(LogLevelWarn, "unable to reauthenticate on sasl health probe", "addr", b.addr, "id", b.meta.NodeID, "err", err)
+				}
+			})
+		}
+	}
+}
+
+// Pause stops all fetching and producing until Resume is called, without
+// closing any connections. This is a coarse, client wide control for
+// maintenance or backpressure, such as to flush a downstream system or
+// rotate credentials, and is unrelated to pausing individual partitions. To
+// pause only consuming, see PauseFetching.
+//
+// Requests that are in flight when pausing are allowed to complete: records
+// from an in flight fetch are still buffered for PollFetches, and in flight
+// produce requests still finish their records. After that, no fetch or
+// produce requests are issued. Records produced while paused are buffered
+// (and count against MaxBufferedRecords), and Flush blocks until the client
+// is resumed and the records finish. Group heartbeats, commits, metadata
+// updates, and other requests continue as normal.
+func (cl *Client) Pause() {
+	atomic.StoreInt32(&cl.paused, 1)
+	cl.refreshPausedCursors()
+}
+
+// Resume resumes fetching and producing after Pause.
+func (cl *Client) Resume() {
+	if atomic.SwapInt32(&cl.paused, 0) == 0 {
+		return
+	}
+	cl.refreshPausedCursors()
+
+	cl.sinksAndSourcesMu.Lock()
+	defer cl.sinksAndSourcesMu.Unlock()
+	for _, sns := range cl.sinksAndSources {
+		sns.sink.maybeDrain()
+		sns.source.maybeConsume()
+	}
+}
+
+// refreshPausedCursors reports all usable cursors as paused, or all paused
+// cursors as usable, if OnCursorStateChange is set, per whether fetching is
+// paused.
+func (cl *Client) refreshPausedCursors() {
+	if cl.cfg.onCursorStateChange == nil {
+		return
+	}
+	cl.sinksAndSourcesMu.Lock()
+	defer cl.sinksAndSourcesMu.Unlock()
+	for _, sns := range cl.sinksAndSources {
+		s := sns.source
+		s.cursorsMu.Lock()
+		for _, c := range s.cursors {
+			c.refreshPaused()
+		}
+		s.cursorsMu.Unlock()
+	}
+}
+
+func (cl *Client) isPaused() bool {
+	return atomic.LoadInt32(&cl.paused) == 1
+}
+
+// isFetchPaused returns whether fetching is paused, either by Pause or by
+// PauseFetching.
+func (cl *Client) isFetchPaused() bool {
+	return cl.isPaused() || cl.consumer.isFetchingPaused()
+}
+
 // Close leaves any group and closes all connections and goroutines.
+//
+// Errors that were injected into fake fetches before closing (for example,
+// ErrDataLoss) are not lost: a final PollFetches after Close returns them.
 func (cl *Client) Close() {
 	// First, kill the consumer. Setting dead to true and then assigning
 	// nothing will
@@ -399,14 +861,25 @@ func (cl *Client) Close() {
 	// 2) ensure consumptions are unassigned, stopping all source filling
 	// 3) ensures no more assigns can happen
 	cl.consumer.mu.Lock()
-	if cl.consumer.dead { // client already closed
+	if cl.consumer.dead { // client already closed, or closing concurrently
 		cl.consumer.mu.Unlock()
+		<-cl.closeDone
 		return
 	}
 	cl.consumer.dead = true
 	cl.consumer.mu.Unlock()
+	defer close(cl.closeDone)
 	cl.AssignPartitions()
 
+	// Assigning nothing stopped the consumer session and waited for all of
+	// its workers, so every fake fetch error that will ever be injected has
+	// been. We keep those so that a final PollFetches returns them, and we
+	// wake any poll that is waiting for more.
+	cl.consumer.sourcesReadyMu.Lock()
+	cl.consumer.pollsClosed = true
+	cl.consumer.sourcesReadyMu.Unlock()
+	cl.consumer.sourcesReadyCond.Broadcast()
+
 	// Now we kill the client context and all brokers, ensuring all
 	// requests fail. This will finish all producer callbacks and
 	// stop the metadata loop.
@@ -477,6 +950,9 @@ func (cl *Client) Close() {
 // The passed context can be used to cancel a request and return early. Note
 // that if the request was written to Kafka but the context canceled before a
 // response is received, Kafka may still operate on the received request.
+//
+// The context can also override the client ID for this request; see
+// WithClientID.
 func (cl *Client) Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
 	resps, merge := cl.shardedRequest(ctx, req)
 	// If there is no merge function, only one request was issued directly
@@ -537,6 +1013,20 @@ start:
 	return resp, err
 }
 
+type clientIDKey struct{}
+
+// WithClientID returns a context that, when passed to Request or
+// RequestSharded, overrides the ClientID option for every request issued
+// with it. Brokers log the client ID and may use it for quotas, so this
+// allows one client to issue requests on behalf of many tenants.
+//
+// This only applies to requests issued directly; requests the client issues
+// internally (producing, consuming, metadata refreshes) always use the
+// client's configured ID.
+func WithClientID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, clientIDKey{}, id)
+}
+
 // ResponseShard ties together a request with either the response it received
 // or an error that prevented a response from being received.
 type ResponseShard struct {
@@ -733,11 +1223,20 @@ func (cl *Client) loadCoordinator(reload bool, ctx context.Context, key coordina
 		return cl.brokerOrErr(nil, coordinator, &errUnknownCoordinator{coordinator, key})
 	}
 
+	// Coordinator errors (such as the coordinator still loading) are
+	// retried with backoff like any other retriable error.
+	r := cl.retriable()
+	r.parseRetryErr = func(resp kmsg.Response) error {
+		return kerr.ErrorForCode(resp.(*kmsg.FindCoordinatorResponse).ErrorCode)
+	}
 	resp, err := (&kmsg.FindCoordinatorRequest{
 		CoordinatorKey:  key.name,
 		CoordinatorType: key.typ,
-	}).RequestWith(ctx, cl.retriable())
+	}).RequestWith(ctx, r)
 
+	if err == nil {
+		err = kerr.ErrorForCode(resp.ErrorCode)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -767,6 +1266,27 @@ func (cl *Client) maybeDeleteStaleCoordinator(name string, typ int8, err error)
 	return false
 }
 
+// TxnCoordinator finds and returns the transaction coordinator for the given
+// transactional ID, refreshing the client's cached coordinator for the ID.
+//
+// The client internally looks up and caches transaction coordinators as
+// needed, and forgets a cached coordinator once a request to it fails with
+// NOT_COORDINATOR (or the coordinator is unavailable or loading). This
+// function is useful to check a transactional setup, or to see where a
+// transactional ID moved to after brokers roll. If the coordinator is still
+// loading, the lookup is retried with backoff per RequestRetries and
+// RetryTimeout.
+func (cl *Client) TxnCoordinator(ctx context.Context, txnID string) (BrokerMetadata, error) {
+	b, err := cl.loadCoordinator(true, ctx, coordinatorKey{
+		name: txnID,
+		typ:  coordinatorTypeTxn,
+	})
+	if err != nil {
+		return BrokerMetadata{}, err
+	}
+	return b.meta, nil
+}
+
 // loadCoordinators does a concurrent load of many coordinators.
 func (cl *Client) loadCoordinators(reload bool, typ int8, names ...string) (map[string]*broker, error) {
 	ctx, cancel := context.WithCancel(cl.ctx)
@@ -1045,6 +1565,830 @@ func (cl *Client) SeedBrokers() []*Broker {
 	}
 }
 
+// ClusterInfo is the cluster ID, controller, and brokers of a cluster, as
+// returned from DescribeCluster.
+type ClusterInfo struct {
+	// ClusterID is the ID of the cluster, if the cluster returned one.
+	ClusterID *string
+
+	// ControllerID is the node ID of the cluster's controller, or nil if
+	// the controller is unknown (the cluster did not return one, or the
+	// controller is currently unavailable).
+	ControllerID *int32
+
+	// Brokers contains all live brokers in the cluster, including their
+	// racks if the brokers have racks.
+	Brokers []BrokerMetadata
+}
+
+// DescribeCluster returns the cluster ID, controller, and live brokers of the
+// cluster.
+//
+// This uses the dedicated DescribeCluster request if the broker the request
+// is issued to supports it (Kafka 2.8+), and otherwise falls back to a
+// metadata request that requests no topics. Like metadata requests, this
+// updates the client's known brokers and controller.
+func (cl *Client) DescribeCluster(ctx context.Context) (ClusterInfo, error) {
+	var (
+		info         ClusterInfo
+		controllerID int32
+		brokers      []kmsg.MetadataResponseBroker
+	)
+
+	resp, err := kmsg.NewPtrDescribeClusterRequest().RequestWith(ctx, cl)
+	switch err.(type) {
+	case nil:
+		if err := kerr.ErrorForCode(resp.ErrorCode); err != nil {
+			return info, err
+		}
+		info.ClusterID = &resp.ClusterID
+		controllerID = resp.ControllerID
+		for _, b := range resp.Brokers {
+			brokers = append(brokers, kmsg.MetadataResponseBroker{
+				NodeID: b.NodeID,
+				Host:   b.Host,
+				Port:   b.Port,
+				Rack:   b.Rack,
+			})
+		}
+		if controllerID >= 0 {
+			cl.controllerIDMu.Lock()
+			cl.controllerID = controllerID
+			cl.controllerIDMu.Unlock()
+		}
+		cl.updateBrokers(brokers)
+
+	case *ErrBrokerTooOld, *ErrUnknownRequestKey:
+		// The broker does not support DescribeCluster, so we fall back
+		// to metadata, which updates our controller and brokers itself.
+		_, meta, err := cl.fetchMetadataForTopics(ctx, false, nil)
+		if err != nil {
+			return info, err
+		}
+		info.ClusterID = meta.ClusterID
+		controllerID = meta.ControllerID
+		brokers = meta.Brokers
+
+	default:
+		return info, err
+	}
+
+	if controllerID != unknownControllerID {
+		info.ControllerID = &controllerID
+	}
+	for _, b := range brokers {
+		info.Brokers = append(info.Brokers, BrokerMetadata{
+			NodeID: b.NodeID,
+			Host:   b.Host,
+			Port:   b.Port,
+			Rack:   b.Rack,
+		})
+	}
+	return info, nil
+}
+
+// BrokerMetadatas returns the metadata of all brokers the client knows of and
+// has not stopped, sorted by node ID. Like DiscoveredBrokers, this does not
+// issue a metadata request.
+//
+// Seed brokers are only included if withSeeds is true, in which case they
+// have IsSeed set and are sorted first (they have very negative node IDs).
+// A seed broker may be the same as a discovered broker; the client does not
+// try to map seeds to discovered brokers.
+func (cl *Client) BrokerMetadatas(withSeeds bool) []BrokerMetadata {
+	cl.brokersMu.RLock()
+	defer cl.brokersMu.RUnlock()
+
+	var metas []BrokerMetadata
+	for _, broker := range cl.brokers {
+		if broker.meta.IsSeed && !withSeeds || atomic.LoadInt32(&broker.dead) == 1 {
+			continue
+		}
+		metas = append(metas, broker.meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].NodeID < metas[j].NodeID })
+	return metas
+}
+
+// TopicSpec describes a topic to create; see CreateTopics.
+type TopicSpec struct {
+	// Topic is the name of the topic to create.
+	Topic string
+
+	// Partitions is the number of partitions to create the topic with. If
+	// this is zero or negative, the broker's num.partitions default is
+	// used, which requires Kafka 2.4.0+.
+	Partitions int32
+
+	// ReplicationFactor is the number of replicas of each partition. If
+	// this is zero or negative, the broker's default.replication.factor
+	// is used, which requires Kafka 2.4.0+.
+	ReplicationFactor int16
+
+	// ReplicaAssignment, if non-empty, explicitly assigns the replicas of
+	// every partition, overriding Partitions and ReplicationFactor. Each
+	// partition from 0 to the number of partitions less one must be
+	// assigned, and the first replica of each is its preferred leader.
+	ReplicaAssignment map[int32][]int32
+
+	// Configs are topic configs to create the topic with, such as
+	// cleanup.policy or retention.ms.
+	Configs map[string]string
+}
+
+// CreateTopics creates topics on the cluster's controller, returning the error
+// for each topic, which is nil if the topic was created. Individual errors,
+// such as TOPIC_ALREADY_EXISTS or INVALID_REPLICATION_FACTOR, can be checked
+// with errors.Is; if Kafka returned an error message, it is included.
+//
+// If validateOnly is true, Kafka validates the request as if it were creating
+// the topics, but does not create them. This requires Kafka 0.10.2.0+; older
+// brokers would silently create the topics, so this returns ErrBrokerTooOld
+// instead.
+//
+// This only returns an error if the request could not be issued. The request
+// waits for topics to be created for up to the context's deadline, or 60s if
+// the context has no deadline.
+func (cl *Client) CreateTopics(ctx context.Context, topics []TopicSpec, validateOnly bool) (map[string]error, error) {
+	req := kmsg.NewPtrCreateTopicsRequest()
+	req.ValidateOnly = validateOnly
+	if deadline, ok := ctx.Deadline(); ok {
+		req.TimeoutMillis = int32(time.Until(deadline).Milliseconds())
+	}
+	for _, spec := range topics {
+		rt := kmsg.NewCreateTopicsRequestTopic()
+		rt.Topic = spec.Topic
+		rt.NumPartitions = spec.Partitions
+		rt.ReplicationFactor = spec.ReplicationFactor
+		if rt.NumPartitions <= 0 || len(spec.ReplicaAssignment) > 0 {
+			rt.NumPartitions = -1
+		}
+		if rt.ReplicationFactor <= 0 || len(spec.ReplicaAssignment) > 0 {
+			rt.ReplicationFactor = -1
+		}
+		for partition, replicas := range spec.ReplicaAssignment {
+			ra := kmsg.NewCreateTopicsRequestTopicReplicaAssignment()
+			ra.Partition = partition
+			ra.Replicas = replicas
+			rt.ReplicaAssignment = append(rt.ReplicaAssignment, ra)
+		}
+		sort.Slice(rt.ReplicaAssignment, func(i, j int) bool {
+			return rt.ReplicaAssignment[i].Partition < rt.ReplicaAssignment[j].Partition
+		})
+		for name, value := range spec.Configs {
+			rc := kmsg.NewCreateTopicsRequestTopicConfig()
+			rc.Name = name
+			rc.Value = kmsg.StringPtr(value)
+			rt.Configs = append(rt.Configs, rc)
+		}
+		req.Topics = append(req.Topics, rt)
+	}
+
+	var kreq kmsg.Request = req
+	if validateOnly {
+		kreq = &minVersionRequest{req, 1} // v1 introduced ValidateOnly
+	}
+	shard := cl.handleAdminReq(ctx, kreq)
+	if shard.Err != nil {
+		return nil, shard.Err
+	}
+	resp := shard.Resp.(*kmsg.CreateTopicsResponse)
+
+	errs := make(map[string]error, len(topics))
+	for _, t := range resp.Topics {
+		err := kerr.ErrorForCode(t.ErrorCode)
+		if err != nil && t.ErrorMessage != nil {
+			err = fmt.Errorf("%s: %w", *t.ErrorMessage, err)
+		}
+		errs[t.Topic] = err
+	}
+	for _, spec := range topics {
+		if _, ok := errs[spec.Topic]; !ok {
+			errs[spec.Topic] = errors.New("topic missing from create topics response")
+		}
+	}
+	return errs, nil
+}
+
+// ISRInfo is the replication state of a partition; see PartitionISR.
+type ISRInfo struct {
+	// Leader is the broker leading the partition, or -1 if there is no
+	// leader.
+	Leader int32
+	// Replicas are all brokers that replicate the partition.
+	Replicas []int32
+	// ISR are the replicas that are in sync with the leader. A produce
+	// with acks=all is rejected if the ISR is smaller than the topic's
+	// min.insync.replicas.
+	ISR []int32
+	// OfflineReplicas are the replicas whose brokers are offline.
+	OfflineReplicas []int32
+	// OfflineReplicasKnown is false if the broker is too old to return
+	// offline replicas (Kafka 1.0.0 added them), in which case
+	// OfflineReplicas is always empty.
+	OfflineReplicasKnown bool
+	// Err is the partition's error in the metadata response, if any, such
+	// as LEADER_NOT_AVAILABLE. Replica lists are still returned if Kafka
+	// included them.
+	Err error
+}
+
+// PartitionISR returns the leader, replicas, in sync replicas, and offline
+// replicas of every partition of a topic, using a fresh metadata request.
+// Producers using acks=all can use this to detect partitions that are at risk
+// of rejecting writes because too few replicas are in sync.
+//
+// This returns the topic's error if the topic could not be loaded, such as
+// UNKNOWN_TOPIC_OR_PARTITION.
+func (cl *Client) PartitionISR(ctx context.Context, topic string) (map[int32]ISRInfo, error) {
+	_, meta, err := cl.fetchMetadataForTopics(ctx, false, []string{topic})
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range meta.Topics {
+		if t.Topic != topic {
+			continue
+		}
+		if err := kerr.ErrorForCode(t.ErrorCode); err != nil {
+			return nil, err
+		}
+		isrs := make(map[int32]ISRInfo, len(t.Partitions))
+		for _, p := range t.Partitions {
+			isrs[p.Partition] = ISRInfo{
+				Leader:               p.Leader,
+				Replicas:             p.Replicas,
+				ISR:                  p.ISR,
+				OfflineReplicas:      p.OfflineReplicas,
+				OfflineReplicasKnown: meta.Version >= 5,
+				Err:                  kerr.ErrorForCode(p.ErrorCode),
+			}
+		}
+		return isrs, nil
+	}
+	return nil, kerr.UnknownTopicOrPartition // kafka did not reply with our topic
+}
+
+// StartEnd is the start and end offset of a partition; see
+// ListStartEndOffsets.
+type StartEnd struct {
+	// Start is the log start offset, or -1 if it could not be listed.
+	Start int64
+	// End is the high watermark, or the last stable offset if the client
+	// uses the ReadCommitted isolation level, or -1 if it could not be
+	// listed.
+	End int64
+	// Err is the first error encountered listing either offset, if any.
+	Err error
+}
+
+// ListStartEndOffsets lists the start and end offsets of all requested
+// partitions. This can be used to compute how many records are retained in
+// each partition (End - Start).
+//
+// Kafka does not allow one ListOffsets request to list the same partition
+// twice, so this issues two requests concurrently: one for start offsets and
+// one for end offsets. Each of these is split by partition leader, as in
+// RequestSharded, so each broker receives one request per timestamp.
+//
+// Every requested partition is in the returned map. Errors for individual
+// partitions, including errors issuing a request to a broker, are in each
+// partition's Err; this only returns an error if the context is canceled.
+func (cl *Client) ListStartEndOffsets(ctx context.Context, topicPartitions map[string][]int32) (map[string]map[int32]StartEnd, error) {
+	var (
+		wg         sync.WaitGroup
+		start, end map[string]map[int32]listedOffset
+	)
+	wg.Add(2)
+	go func() { defer wg.Done(); start = cl.listOffsetsSharded(ctx, topicPartitions, -2) }()
+	go func() { defer wg.Done(); end = cl.listOffsetsSharded(ctx, topicPartitions, -1) }()
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]map[int32]StartEnd, len(topicPartitions))
+	for topic, partitions := range topicPartitions {
+		topicOffsets := make(map[int32]StartEnd, len(partitions))
+		offsets[topic] = topicOffsets
+		for _, partition := range partitions {
+			s, e := start[topic][partition], end[topic][partition]
+			se := StartEnd{Start: s.offset, End: e.offset, Err: s.err}
+			if se.Err == nil {
+				se.Err = e.err
+			}
+			topicOffsets[partition] = se
+		}
+	}
+	return offsets, nil
+}
+
+// ListedOffset is an offset listed for a partition and the leader epoch of that
+// offset; see ListOffsets.
+type ListedOffset struct {
+	// Offset is the listed offset, or -1 if it could not be listed or if
+	// no record matched the listed timestamp.
+	Offset int64
+	// LeaderEpoch is the leader epoch of the record at Offset, or of the
+	// current leader when listing the start or end. This is -1 if it is
+	// unknown, which is the case with brokers before Kafka 2.1.0.
+	LeaderEpoch int32
+	// AtLogStart is true when listing a timestamp returned the partition's
+	// log start offset. The first record at or after the timestamp is the
+	// first record that is still retained, meaning the requested timestamp
+	// may predate the available data: records before the log start, which
+	// retention deleted, could also have been at or after the timestamp.
+	// This is always false when listing the start or end.
+	AtLogStart bool
+	// Err is the error encountered listing the offset, if any.
+	Err error
+}
+
+// ListOffsets lists the offset at timestamp for all requested partitions,
+// along with the leader epoch of each offset. The timestamp can be -2 to list
+// the start offsets, -1 to list the end offsets, or a unix millisecond
+// timestamp to list the offset of the first record at or after it.
+//
+// Storing both the offset and its epoch allows resuming with truncation
+// detection: consuming from NewOffset().At(o.Offset).WithEpoch(o.LeaderEpoch)
+// validates the epoch with the partition leader before consuming and returns
+// ErrDataLoss if the partition was truncated below the offset. This is the
+// building block for storing offsets outside of Kafka.
+//
+// When listing a timestamp, this also lists the start offsets to set each
+// partition's AtLogStart, which replay jobs can use to validate that they can
+// reach the requested time window. If a start offset cannot be listed, the
+// partition's Err is the error from listing it.
+//
+// The list is split by partition leader, as in RequestSharded. Every
+// requested partition is in the returned map. Errors for individual
+// partitions, including errors issuing a request to a broker, are in each
+// partition's Err; this only returns an error if the context is canceled.
+func (cl *Client) ListOffsets(ctx context.Context, topicPartitions map[string][]int32, timestamp int64) (map[string]map[int32]ListedOffset, error) {
+	var (
+		wg            sync.WaitGroup
+		listed, start map[string]map[int32]listedOffset
+	)
+	wg.Add(1)
+	go func() { defer wg.Done(); listed = cl.listOffsetsSharded(ctx, topicPartitions, timestamp) }()
+	if timestamp >= 0 {
+		wg.Add(1)
+		go func() { defer wg.Done(); start = cl.listOffsetsSharded(ctx, topicPartitions, -2) }()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]map[int32]ListedOffset, len(listed))
+	for topic, partitions := range listed {
+		topicOffsets := make(map[int32]ListedOffset, len(partitions))
+		offsets[topic] = topicOffsets
+		for partition, l := range partitions {
+			lo := ListedOffset{
+				Offset:      l.offset,
+				LeaderEpoch: l.epoch,
+				Err:         l.err,
+			}
+			if s, ok := start[topic][partition]; ok && lo.Err == nil {
+				lo.Err = s.err
+				lo.AtLogStart = s.err == nil && lo.Offset >= 0 && lo.Offset == s.offset
+			}
+			topicOffsets[partition] = lo
+		}
+	}
+	return offsets, nil
+}
+
+// EpochEndOffset is the end of a leader epoch in a partition; see
+// OffsetsForLeaderEpoch.
+type EpochEndOffset struct {
+	// LeaderEpoch is the largest leader epoch of the partition that is at
+	// or below the requested epoch, which is the requested epoch if the
+	// partition had it. This is -1 if the requested epoch predates every
+	// epoch the partition knows of, or with brokers before Kafka 2.0.0.
+	LeaderEpoch int32
+	// EndOffset is the offset one past the last record written in
+	// LeaderEpoch, which is the first offset of the next epoch, or the log
+	// end offset if LeaderEpoch is the current epoch. This is -1 if the
+	// end is unknown or if the offset could not be loaded.
+	EndOffset int64
+	// Err is the error encountered loading the end offset, if any.
+	Err error
+}
+
+// OffsetsForLeaderEpoch returns the end offset of the requested leader epoch
+// for every requested partition, issuing OffsetForLeaderEpoch requests to the
+// partition leaders as in RequestSharded. The map passed in is topics to
+// partitions to the leader epoch to find the end of.
+//
+// This is what the client uses internally to detect truncation when resuming
+// from an offset with an epoch (KIP-320); this exposes the same lookup for
+// replication tooling and truncation analysis, such as reconstructing state
+// at a known epoch boundary. Nothing in the client's consuming is affected.
+//
+// Every requested partition is in the returned map. Errors for individual
+// partitions, including errors issuing a request to a broker, are in each
+// partition's Err; this only returns an error if the context is canceled.
+func (cl *Client) OffsetsForLeaderEpoch(ctx context.Context, epochs map[string]map[int32]int32) (map[string]map[int32]EpochEndOffset, error) {
+	req := kmsg.NewPtrOffsetForLeaderEpochRequest()
+	req.ReplicaID = -1
+	ends := make(map[string]map[int32]EpochEndOffset, len(epochs))
+	for topic, partitions := range epochs {
+		reqTopic := kmsg.NewOffsetForLeaderEpochRequestTopic()
+		reqTopic.Topic = topic
+		topicEnds := make(map[int32]EpochEndOffset, len(partitions))
+		ends[topic] = topicEnds
+		for partition, epoch := range partitions {
+			reqPartition := kmsg.NewOffsetForLeaderEpochRequestTopicPartition()
+			reqPartition.Partition = partition
+			reqPartition.CurrentLeaderEpoch = -1 // we are not fencing
+			reqPartition.LeaderEpoch = epoch
+			reqTopic.Partitions = append(reqTopic.Partitions, reqPartition)
+			topicEnds[partition] = EpochEndOffset{LeaderEpoch: -1, EndOffset: -1}
+		}
+		req.Topics = append(req.Topics, reqTopic)
+	}
+	if len(req.Topics) == 0 {
+		return ends, nil
+	}
+
+	set := func(topic string, partition int32, end EpochEndOffset) {
+		if _, ok := ends[topic][partition]; !ok {
+			return // should not happen: kafka replied with something we did not ask for
+		}
+		ends[topic][partition] = end
+	}
+	for _, shard := range cl.RequestSharded(ctx, req) {
+		if shard.Err != nil {
+			for _, t := range shard.Req.(*kmsg.OffsetForLeaderEpochRequest).Topics {
+				for _, p := range t.Partitions {
+					set(t.Topic, p.Partition, EpochEndOffset{-1, -1, shard.Err})
+				}
+			}
+			continue
+		}
+		resp := shard.Resp.(*kmsg.OffsetForLeaderEpochResponse)
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+					set(t.Topic, p.Partition, EpochEndOffset{-1, -1, err})
+					continue
+				}
+				epoch := p.LeaderEpoch
+				if resp.Version < 1 { // KIP-279
+					epoch = -1
+				}
+				set(t.Topic, p.Partition, EpochEndOffset{epoch, p.EndOffset, nil})
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ends, nil
+}
+
+// TopicOffsetsAfterMilli returns, for every partition of the given topics, the
+// offset of the first record with a timestamp at or after milli (unix
+// milliseconds). Partitions that have no record at or after milli return
+// their end offset, so that consuming from the returned offsets consumes
+// everything since milli. This is useful for time based replay, and can be
+// used with Offset.At when assigning partitions.
+//
+// This loads metadata for the topics to know their partitions, and then
+// concurrently lists offsets at milli and end offsets, with each list split
+// by partition leader as in RequestSharded.
+//
+// If a topic cannot be loaded or any partition cannot be listed, this returns
+// the first error encountered along with the offsets of every partition that
+// was listed successfully.
+func (cl *Client) TopicOffsetsAfterMilli(ctx context.Context, milli int64, topics ...string) (map[string]map[int32]int64, error) {
+	_, meta, err := cl.fetchMetadataForTopics(ctx, false, topics)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	topicPartitions := make(map[string][]int32, len(meta.Topics))
+	for _, t := range meta.Topics {
+		if err := kerr.ErrorForCode(t.ErrorCode); err != nil {
+			setErr(err)
+			continue
+		}
+		partitions := make([]int32, 0, len(t.Partitions))
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.Partition)
+		}
+		topicPartitions[t.Topic] = partitions
+	}
+
+	var (
+		wg       sync.WaitGroup
+		at, ends map[string]map[int32]listedOffset
+	)
+	wg.Add(2)
+	go func() { defer wg.Done(); at = cl.listOffsetsSharded(ctx, topicPartitions, milli) }()
+	go func() { defer wg.Done(); ends = cl.listOffsetsSharded(ctx, topicPartitions, -1) }()
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]map[int32]int64, len(topicPartitions))
+	for topic, partitions := range topicPartitions {
+		for _, partition := range partitions {
+			listed := at[topic][partition]
+			if listed.err == nil && listed.offset < 0 { // no record at or after milli
+				listed = ends[topic][partition]
+			}
+			if listed.err != nil {
+				setErr(listed.err)
+				continue
+			}
+			topicOffsets := offsets[topic]
+			if topicOffsets == nil {
+				topicOffsets = make(map[int32]int64, len(partitions))
+				offsets[topic] = topicOffsets
+			}
+			topicOffsets[partition] = listed.offset
+		}
+	}
+	return offsets, firstErr
+}
+
+// GroupLagInfo is the lag of a group on a partition; see GroupLag.
+type GroupLagInfo struct {
+	// Committed is the offset the group committed for this partition, or
+	// -1 if the group has no commit for it.
+	Committed int64
+	// Start is the log start offset, or -1 if it could not be listed.
+	Start int64
+	// End is the high watermark, or the last stable offset if the client
+	// uses the ReadCommitted isolation level, or -1 if it could not be
+	// listed.
+	End int64
+	// Lag is how many records the group has left to consume, End -
+	// Committed. If the group has no commit, this is End - Start, which is
+	// the lag as if the group began consuming from the start. This is -1
+	// if Err is set.
+	Lag int64
+	// Err is the first error encountered loading the committed offset or
+	// listing the start or end offset, if any.
+	Err error
+}
+
+// GroupLag returns the lag of a group for every partition of every topic the
+// group has committed offsets for or is assigned. This combines the steps
+// every lag tool reimplements: describing the group to find what its members
+// are assigned, fetching its committed offsets, loading metadata for all
+// partitions of those topics, and listing their start and end offsets.
+//
+// Assignments are only known for groups using the consumer protocol type
+// (which this client and the Java client use); for other groups, only topics
+// with committed offsets are returned.
+//
+// This returns an error if the group cannot be described or its offsets
+// cannot be fetched, or if the context is canceled. Errors for individual
+// partitions, such as a topic that no longer exists or a failed listing, are
+// in each partition's Err.
+func (cl *Client) GroupLag(ctx context.Context, group string) (map[string]map[int32]GroupLagInfo, error) {
+	var (
+		wg           sync.WaitGroup
+		describeResp kmsg.Response
+		describeErr  error
+		fetchResp    kmsg.Response
+		fetchErr     error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		req := kmsg.NewPtrDescribeGroupsRequest()
+		req.Groups = []string{group}
+		describeResp, describeErr = cl.Request(ctx, req)
+	}()
+	go func() {
+		defer wg.Done()
+		req := kmsg.NewPtrOffsetFetchRequest()
+		req.Group = group // nil topics fetches all committed offsets
+		fetchResp, fetchErr = cl.Request(ctx, req)
+	}()
+	wg.Wait()
+
+	if describeErr != nil {
+		return nil, describeErr
+	}
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	assigned := make(map[string]bool)
+	describe := describeResp.(*kmsg.DescribeGroupsResponse)
+	if len(describe.Groups) != 1 {
+		return nil, fmt.Errorf("describe groups response has %d groups, expected 1", len(describe.Groups))
+	}
+	described := describe.Groups[0]
+	if err := kerr.ErrorForCode(described.ErrorCode); err != nil {
+		return nil, err
+	}
+	if described.ProtocolType == "consumer" {
+		for _, member := range described.Members {
+			var assignment kmsg.GroupMemberAssignment
+			if err := assignment.ReadFrom(member.MemberAssignment); err != nil {
+				return nil, fmt.Errorf("unable to read assignment of group member %s: %w", member.MemberID, err)
+			}
+			for _, t := range assignment.Topics {
+				assigned[t.Topic] = true
+			}
+		}
+	}
+
+	committed := make(map[string]map[int32]listedOffset)
+	fetch := fetchResp.(*kmsg.OffsetFetchResponse)
+	if err := kerr.ErrorForCode(fetch.ErrorCode); err != nil {
+		return nil, err
+	}
+	for _, t := range fetch.Topics {
+		topicCommitted := make(map[int32]listedOffset, len(t.Partitions))
+		committed[t.Topic] = topicCommitted
+		for _, p := range t.Partitions {
+			topicCommitted[p.Partition] = listedOffset{
+				offset: p.Offset,
+				epoch:  -1,
+				err:    kerr.ErrorForCode(p.ErrorCode),
+			}
+		}
+	}
+
+	topics := make([]string, 0, len(assigned)+len(committed))
+	for topic := range committed {
+		topics = append(topics, topic)
+	}
+	for topic := range assigned {
+		if _, ok := committed[topic]; !ok {
+			topics = append(topics, topic)
+		}
+	}
+
+	lags := make(map[string]map[int32]GroupLagInfo, len(topics))
+	if len(topics) == 0 {
+		return lags, nil
+	}
+
+	_, meta, err := cl.fetchMetadataForTopics(ctx, false, topics)
+	if err != nil {
+		return nil, err
+	}
+
+	// A topic that cannot be loaded, such as one that was deleted after
+	// the group committed to it, fails only its committed partitions.
+	topicPartitions := make(map[string][]int32, len(meta.Topics))
+	for _, t := range meta.Topics {
+		if err := kerr.ErrorForCode(t.ErrorCode); err != nil {
+			if topicCommitted := committed[t.Topic]; len(topicCommitted) > 0 {
+				topicLags := make(map[int32]GroupLagInfo, len(topicCommitted))
+				lags[t.Topic] = topicLags
+				for partition, c := range topicCommitted {
+					topicLags[partition] = GroupLagInfo{Committed: c.offset, Start: -1, End: -1, Lag: -1, Err: err}
+				}
+			}
+			continue
+		}
+		partitions := make([]int32, 0, len(t.Partitions))
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.Partition)
+		}
+		topicPartitions[t.Topic] = partitions
+	}
+
+	var start, end map[string]map[int32]listedOffset
+	wg.Add(2)
+	go func() { defer wg.Done(); start = cl.listOffsetsSharded(ctx, topicPartitions, -2) }()
+	go func() { defer wg.Done(); end = cl.listOffsetsSharded(ctx, topicPartitions, -1) }()
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for topic, partitions := range topicPartitions {
+		topicLags := make(map[int32]GroupLagInfo, len(partitions))
+		lags[topic] = topicLags
+		for _, partition := range partitions {
+			c, ok := committed[topic][partition]
+			if !ok {
+				c = listedOffset{offset: -1, epoch: -1}
+			}
+			s, e := start[topic][partition], end[topic][partition]
+			lag := GroupLagInfo{
+				Committed: c.offset,
+				Start:     s.offset,
+				End:       e.offset,
+				Lag:       -1,
+			}
+			for _, err := range []error{c.err, s.err, e.err} {
+				if err != nil {
+					lag.Err = err
+					break
+				}
+			}
+			if lag.Err == nil {
+				from := lag.Committed
+				if from < 0 {
+					from = lag.Start
+				}
+				lag.Lag = lag.End - from
+				if lag.Lag < 0 { // committed past the last stable offset
+					lag.Lag = 0
+				}
+			}
+			topicLags[partition] = lag
+		}
+	}
+	return lags, nil
+}
+
+// listedOffset is the result of listing an offset for a partition.
+type listedOffset struct {
+	offset int64 // -1 if unknown
+	epoch  int32 // -1 if unknown
+	err    error
+}
+
+// listOffsetsSharded lists offsets at timestamp for all requested partitions,
+// splitting the request by partition leader. Every requested partition is in
+// the returned map, with any error from listing the partition or from issuing
+// the request to the partition's broker.
+func (cl *Client) listOffsetsSharded(ctx context.Context, topicPartitions map[string][]int32, timestamp int64) map[string]map[int32]listedOffset {
+	req := kmsg.NewPtrListOffsetsRequest()
+	req.ReplicaID = -1
+	req.IsolationLevel = cl.cfg.isolationLevel
+	listed := make(map[string]map[int32]listedOffset, len(topicPartitions))
+	for topic, partitions := range topicPartitions {
+		reqTopic := kmsg.NewListOffsetsRequestTopic()
+		reqTopic.Topic = topic
+		topicListed := make(map[int32]listedOffset, len(partitions))
+		listed[topic] = topicListed
+		for _, partition := range partitions {
+			reqPartition := kmsg.NewListOffsetsRequestTopicPartition()
+			reqPartition.Partition = partition
+			reqPartition.Timestamp = timestamp
+			reqPartition.MaxNumOffsets = 1
+			reqTopic.Partitions = append(reqTopic.Partitions, reqPartition)
+			topicListed[partition] = listedOffset{offset: -1, epoch: -1}
+		}
+		req.Topics = append(req.Topics, reqTopic)
+	}
+	if len(req.Topics) == 0 {
+		return listed
+	}
+
+	set := func(topic string, partition int32, offset int64, epoch int32, err error) {
+		if _, ok := listed[topic][partition]; !ok {
+			return // should not happen: kafka replied with something we did not ask for
+		}
+		listed[topic][partition] = listedOffset{offset, epoch, err}
+	}
+	for _, shard := range cl.RequestSharded(ctx, req) {
+		if shard.Err != nil {
+			for _, t := range shard.Req.(*kmsg.ListOffsetsRequest).Topics {
+				for _, p := range t.Partitions {
+					set(t.Topic, p.Partition, -1, -1, shard.Err)
+				}
+			}
+			continue
+		}
+		resp := shard.Resp.(*kmsg.ListOffsetsResponse)
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+					set(t.Topic, p.Partition, -1, -1, err)
+					continue
+				}
+				offset := p.Offset
+				if len(p.OldStyleOffsets) > 0 { // list offsets v0
+					offset = p.OldStyleOffsets[0]
+				}
+				epoch := p.LeaderEpoch
+				if resp.Version < 4 { // KIP-320
+					epoch = -1
+				}
+				set(t.Topic, p.Partition, offset, epoch, nil)
+			}
+		}
+	}
+	return listed
+}
+
 // Broker pairs a broker ID with a client to directly issue requests to a
 // specific broker.
 type Broker struct {
@@ -0,0 +1,1141 @@
+package kgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/kversion"
+)
+
+func TestDescribeCluster(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(2))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	// The cluster does not support DescribeCluster, so this exercises the
+	// metadata fallback.
+	info, err := cl.DescribeCluster(context.Background())
+	if err != nil {
+		t.Fatalf("unable to describe cluster: %v", err)
+	}
+	if info.ClusterID == nil || *info.ClusterID != "kfake" {
+		t.Errorf("got cluster ID %v, expected kfake", info.ClusterID)
+	}
+	if info.ControllerID == nil || *info.ControllerID != 0 {
+		t.Errorf("got controller ID %v, expected 0", info.ControllerID)
+	}
+	if len(info.Brokers) != 2 {
+		t.Errorf("got %d brokers, expected 2", len(info.Brokers))
+	}
+}
+
+func TestBrokerMetadatas(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(2))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	if _, err := cl.DescribeCluster(context.Background()); err != nil {
+		t.Fatalf("unable to load brokers: %v", err)
+	}
+
+	discovered := cl.BrokerMetadatas(false)
+	if len(discovered) != 2 {
+		t.Fatalf("got %d discovered brokers, expected 2", len(discovered))
+	}
+	for _, b := range discovered {
+		if b.IsSeed || b.NodeID < 0 {
+			t.Errorf("unexpected seed in discovered brokers: %+v", b)
+		}
+	}
+
+	all := cl.BrokerMetadatas(true)
+	if len(all) != 4 {
+		t.Fatalf("got %d brokers with seeds, expected 4", len(all))
+	}
+	for _, b := range all[:2] {
+		if !b.IsSeed {
+			t.Errorf("expected seeds to sort first, got %+v", b)
+		}
+	}
+}
+
+// seedWriteHook counts requests written to seed brokers.
+type seedWriteHook struct{ writes int64 }
+
+func (h *seedWriteHook) OnWrite(meta BrokerMetadata, _ int16, _ int, _, _ time.Duration, _ error) {
+	if meta.IsSeed {
+		atomic.AddInt64(&h.writes, 1)
+	}
+}
+
+// newSeedPolicyClient returns a client seeded with an alias for the first
+// broker, and a function that makes all non-seed addresses undialable.
+func newSeedPolicyClient(t *testing.T, c *kfake.Cluster, policy SeedPolicy, opts ...Opt) (*Client, func()) {
+	var down int32
+	dial := func(ctx context.Context, network, host string) (net.Conn, error) {
+		if host == "seed:9092" {
+			return c.DialContext(ctx, network, c.ListenAddrs()[0])
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("broker down")}
+		}
+		return c.DialContext(ctx, network, host)
+	}
+	cl := newTestClient(t, c, append([]Opt{
+		SeedBrokers("seed:9092"),
+		Dialer(dial),
+		SeedBrokerPolicy(policy),
+	}, opts...)...)
+	if _, err := cl.DescribeCluster(context.Background()); err != nil {
+		t.Fatalf("unable to load brokers: %v", err)
+	}
+	return cl, func() {
+		atomic.StoreInt32(&down, 1)
+		c.KillConnections()
+	}
+}
+
+func countSeeds(metas []BrokerMetadata) (seeds int) {
+	for _, meta := range metas {
+		if meta.IsSeed {
+			seeds++
+		}
+	}
+	return seeds
+}
+
+func TestSeedPolicyKeep(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t)
+	defer c.Close()
+
+	cl, _ := newSeedPolicyClient(t, c, SeedPolicyKeep)
+	defer cl.Close()
+
+	if seeds := countSeeds(cl.BrokerMetadatas(true)); seeds != 1 {
+		t.Errorf("got %d seeds, expected the seed to be kept", seeds)
+	}
+}
+
+func TestSeedPolicyCloseAfterMetadata(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(3, "foo"))
+	defer c.Close()
+
+	cl, _ := newSeedPolicyClient(t, c, SeedPolicyCloseAfterMetadata)
+	defer cl.Close()
+
+	metas := cl.BrokerMetadatas(true)
+	if seeds := countSeeds(metas); seeds != 0 || len(metas) != 3 {
+		t.Errorf("got %d brokers with %d seeds, expected only the 3 discovered brokers", len(metas), seeds)
+	}
+
+	// The client still works entirely through discovered brokers.
+	produceN(t, cl, "foo", 10)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	consumeN(t, cl, 10)
+}
+
+func TestSeedPolicyFallbackOnly(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t)
+	defer c.Close()
+
+	hook := new(seedWriteHook)
+	// Brokers are considered unreachable for the metadata min age after
+	// a failed dial, which must outlast our retry backoff.
+	cl, downDiscovered := newSeedPolicyClient(t, c, SeedPolicyFallbackOnly,
+		WithHooks(hook),
+		MetadataMinAge(10*time.Second),
+	)
+	defer cl.Close()
+
+	if seeds := countSeeds(cl.BrokerMetadatas(true)); seeds != 1 {
+		t.Errorf("got %d seeds, expected the seed to be kept", seeds)
+	}
+
+	metadata := func() {
+		req := kmsg.NewPtrMetadataRequest()
+		req.Topics = []kmsg.MetadataRequestTopic{}
+		if _, err := req.RequestWith(context.Background(), cl); err != nil {
+			t.Fatalf("unable to request metadata: %v", err)
+		}
+	}
+
+	atomic.StoreInt64(&hook.writes, 0)
+	for i := 0; i < 10; i++ {
+		metadata()
+	}
+	if writes := atomic.LoadInt64(&hook.writes); writes != 0 {
+		t.Errorf("got %d writes to the seed while discovered brokers are reachable, expected 0", writes)
+	}
+
+	downDiscovered()
+	metadata()
+	if writes := atomic.LoadInt64(&hook.writes); writes == 0 {
+		t.Error("expected requests to fall back to the seed once discovered brokers are unreachable")
+	}
+}
+
+func TestBrokerUnreachable(t *testing.T) {
+	clock := newFakeClock()
+	cfg := defaultCfg()
+	cfg.clock = clock
+	cfg.metadataMinAge = time.Minute
+
+	var refuse bool
+	cfg.dialFn = func(context.Context, string, string) (net.Conn, error) {
+		if refuse {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	b := &broker{cl: &Client{cfg: cfg}}
+
+	if b.unreachable() {
+		t.Fatal("broker is unreachable before any dial")
+	}
+
+	// A failed dial makes the broker unreachable for the metadata min
+	// age, measured on the client's clock.
+	refuse = true
+	if _, err := b.connect(context.Background()); err == nil {
+		t.Fatal("got no error from a refused dial")
+	}
+	clock.advance(time.Minute - time.Millisecond)
+	if !b.unreachable() {
+		t.Fatal("broker is reachable before the metadata min age passed")
+	}
+	clock.advance(time.Millisecond)
+	if b.unreachable() {
+		t.Fatal("broker is still unreachable once the metadata min age passed")
+	}
+
+	// A successful dial clears the failure immediately.
+	if _, err := b.connect(context.Background()); err == nil {
+		t.Fatal("got no error from a refused dial")
+	}
+	refuse = false
+	conn, err := b.connect(context.Background())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	conn.Close()
+	if b.unreachable() {
+		t.Error("broker is unreachable after a successful dial")
+	}
+}
+
+func TestSeedBrokerRetries(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t)
+	defer c.Close()
+
+	// Dials to "down" seeds always fail; "up" dials the cluster.
+	var dials int64
+	dial := func(ctx context.Context, network, host string) (net.Conn, error) {
+		atomic.AddInt64(&dials, 1)
+		if strings.HasPrefix(host, "down") {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("seed down")}
+		}
+		return c.DialContext(ctx, network, c.ListenAddrs()[0])
+	}
+	metadata := func(cl *Client) error {
+		req := kmsg.NewPtrMetadataRequest()
+		req.Topics = []kmsg.MetadataRequestTopic{}
+		_, err := req.RequestWith(context.Background(), cl)
+		return err
+	}
+
+	for _, test := range []struct {
+		name  string
+		opt   Opt
+		dials int64 // if positive, the exact number of dials expected
+	}{
+		{"retries", SeedBrokerRetries(2), 6},
+		{"timeout", InitialMetadataTimeout(300 * time.Millisecond), 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt64(&dials, 0)
+			cl := newTestClient(t, c,
+				SeedBrokers("down-0:9092", "down-1:9092"),
+				Dialer(dial),
+				RetryBackoff(func(int) time.Duration { return 10 * time.Millisecond }),
+				test.opt,
+			)
+			defer cl.Close()
+
+			start := time.Now()
+			err := metadata(cl)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("metadata took %v, expected to fail fast", elapsed)
+			}
+			var seedErr *ErrSeedBrokers
+			if !errors.As(err, &seedErr) {
+				t.Fatalf("got err %v, expected *ErrSeedBrokers", err)
+			}
+			if len(seedErr.Seeds) != 2 || seedErr.Seeds[0].Addr != "down-0:9092" || seedErr.Seeds[1].Addr != "down-1:9092" {
+				t.Fatalf("got seed failures %v, expected one for each seed", seedErr.Seeds)
+			}
+			for _, seed := range seedErr.Seeds {
+				if seed.Err == nil {
+					t.Errorf("seed %s: got no error", seed.Addr)
+				}
+			}
+			if test.dials > 0 && !errors.Is(err, ErrNoDial) {
+				t.Errorf("got err %v, expected it to unwrap to the seeds' ErrNoDial", err)
+			}
+			if got := atomic.LoadInt64(&dials); test.dials > 0 && got != test.dials {
+				t.Errorf("got %d dials, expected %d", got, test.dials)
+			}
+		})
+	}
+
+	// A working seed after a down seed loads metadata, after which the
+	// down seed no longer matters.
+	cl := newTestClient(t, c,
+		SeedBrokers("down-0:9092", "up:9092"),
+		Dialer(dial),
+		SeedBrokerRetries(0),
+	)
+	defer cl.Close()
+	for i := 0; i < 3; i++ {
+		if err := metadata(cl); err != nil {
+			t.Fatalf("unable to load metadata with one working seed: %v", err)
+		}
+	}
+}
+
+func TestEmptySeedBrokers(t *testing.T) {
+	t.Parallel()
+
+	for _, opts := range [][]Opt{
+		{SeedBrokers()},
+		{SeedBrokers("")},
+		{SeedBrokers("127.0.0.1:9092", "")},
+		{FailoverSeedBrokers(time.Second, "")},
+	} {
+		if cl, err := NewClient(opts...); err == nil {
+			cl.Close()
+			t.Errorf("got no error creating a client with an empty seed broker")
+		}
+	}
+}
+
+func TestListStartEndOffsets(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		if err := cl.Produce(ctx, &Record{Topic: "foo", Partition: 0}, func(_ *Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+
+	offsets, err := cl.ListStartEndOffsets(ctx, map[string][]int32{
+		"foo": {0, 1},
+		"bar": {0},
+	})
+	if err != nil {
+		t.Fatalf("unable to list offsets: %v", err)
+	}
+
+	for p, exp := range map[int32]StartEnd{
+		0: {Start: 0, End: 5},
+		1: {Start: 0, End: 0},
+	} {
+		if got := offsets["foo"][p]; got != exp {
+			t.Errorf("foo %d: got %+v != exp %+v", p, got, exp)
+		}
+	}
+	if got := offsets["bar"][0]; got.Err != kerr.UnknownTopicOrPartition || got.Start != -1 || got.End != -1 {
+		t.Errorf("bar 0: got %+v, expected unknown topic", got)
+	}
+}
+
+func TestTopicOffsetsAfterMilli(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The producer stamps records with the current time, so we produce
+	// two records with a gap between them, remembering a time in the
+	// middle. Each produce is in its own batch, since we wait for each.
+	produce := func() {
+		errs := make(chan error, 1)
+		r := &Record{Topic: "foo", Partition: 0}
+		if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+	before := time.Now().Add(-time.Hour).UnixNano() / 1e6
+	produce()
+	time.Sleep(20 * time.Millisecond)
+	between := time.Now().UnixNano() / 1e6
+	time.Sleep(20 * time.Millisecond)
+	produce()
+	after := time.Now().Add(time.Hour).UnixNano() / 1e6
+
+	for _, test := range []struct {
+		milli int64
+		exp   map[int32]int64
+	}{
+		{before, map[int32]int64{0: 0, 1: 0}},
+		{between, map[int32]int64{0: 1, 1: 0}},
+		{after, map[int32]int64{0: 2, 1: 0}}, // past everything: end offsets
+	} {
+		offsets, err := cl.TopicOffsetsAfterMilli(ctx, test.milli, "foo")
+		if err != nil {
+			t.Fatalf("milli %d: unable to list offsets: %v", test.milli, err)
+		}
+		for p, exp := range test.exp {
+			if got := offsets["foo"][p]; got != exp {
+				t.Errorf("milli %d partition %d: got offset %d != exp %d", test.milli, p, got, exp)
+			}
+		}
+	}
+
+	if _, err := cl.TopicOffsetsAfterMilli(ctx, 0, "foo", "missing"); err != kerr.UnknownTopicOrPartition {
+		t.Errorf("got err %v, expected unknown topic for a missing topic", err)
+	}
+}
+
+func TestFailoverSeedBrokers(t *testing.T) {
+	t.Parallel()
+
+	// Epochs mean nothing across clusters; a failover cluster with lower
+	// epochs must not have its metadata ignored as stale.
+	for _, primaryEpoch := range []int32{0, 5} {
+		primaryEpoch := primaryEpoch
+		t.Run(fmt.Sprintf("primary_epoch_%d", primaryEpoch), func(t *testing.T) {
+			t.Parallel()
+			testFailoverSeedBrokers(t, primaryEpoch)
+		})
+	}
+}
+
+func testFailoverSeedBrokers(t *testing.T, primaryEpoch int32) {
+	primary := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"), kfake.LeaderEpoch(primaryEpoch))
+	defer primary.Close()
+	backup := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer backup.Close()
+
+	for _, c := range []struct {
+		c *kfake.Cluster
+		n int
+	}{{primary, 5}, {backup, 10}} {
+		producer := newTestClient(t, c.c)
+		produceN(t, producer, "foo", c.n)
+		producer.Close()
+	}
+
+	// Both fake clusters use the same broker addresses; once the client
+	// dials the backup seed, every later dial goes to the backup cluster.
+	var onBackup int32
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "backup:9092" {
+			atomic.StoreInt32(&onBackup, 1)
+			return backup.DialContext(ctx, network, backup.ListenAddrs()[0])
+		}
+		if atomic.LoadInt32(&onBackup) == 1 {
+			return backup.DialContext(ctx, network, addr)
+		}
+		return primary.DialContext(ctx, network, addr)
+	}
+
+	cl := newTestClient(t, primary,
+		Dialer(dial),
+		FailoverSeedBrokers(200*time.Millisecond, "backup:9092"),
+		RetryTimeout(func(int16) time.Duration { return 100 * time.Millisecond }),
+	)
+	defer cl.Close()
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+	consumeN(t, cl, 5)
+
+	primary.Close()
+
+	// Our offset (5) is meaningless on the backup cluster; we must reset
+	// to the start and consume all 10 backup records.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var offsets []int64
+	for len(offsets) < 10 {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out after consuming offsets %v from the backup cluster", offsets)
+		}
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			offsets = append(offsets, iter.Next().Offset)
+		}
+	}
+	for i, offset := range offsets {
+		if offset != int64(i) {
+			t.Fatalf("got offsets %v after failover, expected 0 through 9", offsets)
+		}
+	}
+	if atomic.LoadInt32(&onBackup) != 1 {
+		t.Error("client never dialed the backup seed")
+	}
+}
+
+func TestRawMetadata(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(2), kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	if meta := cl.RawMetadata(); meta != nil {
+		t.Fatalf("got metadata %v before loading any, expected nil", meta)
+	}
+
+	produceN(t, cl, "foo", 1)
+
+	check := func(meta *kmsg.MetadataResponse) {
+		t.Helper()
+		if meta == nil {
+			t.Fatal("got nil metadata after loading topics")
+		}
+		if len(meta.Brokers) != 2 {
+			t.Errorf("got %d brokers, expected 2", len(meta.Brokers))
+		}
+		if len(meta.Topics) != 1 || meta.Topics[0].Topic != "foo" || len(meta.Topics[0].Partitions) != 2 {
+			t.Errorf("got topics %v, expected foo with 2 partitions", meta.Topics)
+		}
+	}
+
+	// Modifying the returned metadata must not modify the client's.
+	meta := cl.RawMetadata()
+	check(meta)
+	meta.Brokers = nil
+	meta.Topics[0].Topic = "modified"
+	meta.Topics[0].Partitions[0].Replicas[0] = -1
+	check(cl.RawMetadata())
+	if r := cl.RawMetadata().Topics[0].Partitions[0].Replicas[0]; r < 0 {
+		t.Errorf("got replica %d, expected the client's metadata to be unmodified", r)
+	}
+}
+
+func TestPartitionISR(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(3, "foo"))
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Metadata v4 and below have no offline replicas.
+	old := kversion.Stable()
+	old.SetMaxKeyVersion(3, 4)
+
+	for _, test := range []struct {
+		opts        []Opt
+		expOfflines bool
+	}{
+		{nil, true},
+		{[]Opt{MaxVersions(old)}, false},
+	} {
+		cl := newTestClient(t, c, test.opts...)
+		defer cl.Close()
+
+		isrs, err := cl.PartitionISR(ctx, "foo")
+		if err != nil {
+			t.Fatalf("unable to load isrs: %v", err)
+		}
+		if len(isrs) != 3 {
+			t.Fatalf("got %d partitions, expected 3", len(isrs))
+		}
+		for p, isr := range isrs {
+			if isr.Err != nil || isr.Leader < 0 {
+				t.Errorf("partition %d: got err %v and leader %d, expected a leader", p, isr.Err, isr.Leader)
+			}
+			if len(isr.Replicas) != 1 || len(isr.ISR) != 1 || isr.ISR[0] != isr.Leader {
+				t.Errorf("partition %d: got replicas %v and isr %v, expected only the leader %d", p, isr.Replicas, isr.ISR, isr.Leader)
+			}
+			if isr.OfflineReplicasKnown != test.expOfflines {
+				t.Errorf("partition %d: got offline replicas known %v != exp %v", p, isr.OfflineReplicasKnown, test.expOfflines)
+			}
+		}
+
+		if _, err := cl.PartitionISR(ctx, "missing"); err != kerr.UnknownTopicOrPartition {
+			t.Errorf("got err %v, expected unknown topic", err)
+		}
+	}
+}
+
+func TestListOffsets(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10) // all to partition 0
+
+	ctx := context.Background()
+	listed, err := cl.ListOffsets(ctx, map[string][]int32{"foo": {0, 1}, "missing": {0}}, -1)
+	if err != nil {
+		t.Fatalf("unable to list offsets: %v", err)
+	}
+	for partition, exp := range map[int32]int64{0: 10, 1: 0} {
+		l := listed["foo"][partition]
+		if l.Err != nil || l.Offset != exp || l.LeaderEpoch != 0 {
+			t.Errorf("foo[%d]: got %+v, expected offset %d epoch 0", partition, l, exp)
+		}
+	}
+	if err := listed["missing"][0].Err; err != kerr.UnknownTopicOrPartition {
+		t.Errorf("missing[0]: got err %v, expected %v", err, kerr.UnknownTopicOrPartition)
+	}
+
+	// Resuming from a listed offset and epoch validates the epoch
+	// before consuming.
+	produceN(t, cl, "foo", 5)
+	l := listed["foo"][0]
+	cl.AssignPartitions(ConsumePartitions(map[string]map[int32]Offset{
+		"foo": {0: NewOffset().At(l.Offset).WithEpoch(l.LeaderEpoch)},
+	}))
+	if seen := consumeN(t, cl, 5); len(seen) != 5 {
+		t.Errorf("saw %d unique records, expected 5", len(seen))
+	}
+
+	// Brokers before KIP-320 do not return epochs.
+	old := newTestClient(t, c, MaxVersions(kversion.V2_0_0()))
+	defer old.Close()
+	listed, err = old.ListOffsets(ctx, map[string][]int32{"foo": {0}}, -2)
+	if err != nil {
+		t.Fatalf("unable to list offsets: %v", err)
+	}
+	if l := listed["foo"][0]; l.Err != nil || l.Offset != 0 || l.LeaderEpoch != -1 {
+		t.Errorf("got %+v, expected offset 0 epoch -1", l)
+	}
+}
+
+func TestListOffsetsAtLogStart(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	// One record per batch so that deleting drops whole batches.
+	for i := 0; i < 5; i++ {
+		produceN(t, cl, "foo", 1)
+	}
+	time.Sleep(5 * time.Millisecond)
+	between := time.Now().UnixNano() / 1e6
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		produceN(t, cl, "foo", 1)
+	}
+
+	req := kmsg.NewDeleteRecordsRequest()
+	rt := kmsg.NewDeleteRecordsRequestTopic()
+	rt.Topic = "foo"
+	rp := kmsg.NewDeleteRecordsRequestTopicPartition()
+	rp.Offset = 3
+	rt.Partitions = append(rt.Partitions, rp)
+	req.Topics = append(req.Topics, rt)
+	if _, err := req.RequestWith(context.Background(), cl); err != nil {
+		t.Fatalf("unable to delete records: %v", err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		timestamp  int64
+		offset     int64
+		atLogStart bool
+	}{
+		{"before_retention", 0, 3, true},
+		{"retained", between, 5, false},
+		{"start", -2, 3, false},
+	} {
+		listed, err := cl.ListOffsets(context.Background(), map[string][]int32{"foo": {0}}, test.timestamp)
+		if err != nil {
+			t.Fatalf("%s: unable to list offsets: %v", test.name, err)
+		}
+		if l := listed["foo"][0]; l.Err != nil || l.Offset != test.offset || l.AtLogStart != test.atLogStart {
+			t.Errorf("%s: got %+v, expected offset %d at log start %v", test.name, l, test.offset, test.atLogStart)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 1)
+
+	cl.Pause()
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// While paused, neither the produce nor the fetch should be issued.
+	errs := make(chan error, 1)
+	r := &Record{Topic: "foo", Value: []byte("paused")}
+	if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+		t.Fatalf("unable to produce: %v", err)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("produce finished while paused: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	pollCtx, pollCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	fetches := cl.PollFetches(pollCtx)
+	pollCancel()
+	if iter := fetches.RecordIter(); !iter.Done() {
+		t.Fatalf("consumed record %q while paused", iter.Next().Value)
+	}
+
+	cl.Resume()
+
+	if err := <-errs; err != nil {
+		t.Fatalf("unable to produce after resuming: %v", err)
+	}
+	var values []string
+	for len(values) < 2 {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out after consuming %v", values)
+		}
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			values = append(values, string(iter.Next().Value))
+		}
+	}
+	if values[1] != "paused" {
+		t.Errorf("got values %v, expected the paused record second", values)
+	}
+}
+
+func TestClientContextCancelCloses(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	clientCtx, clientCancel := context.WithCancel(context.Background())
+	defer clientCancel()
+
+	cl := newTestClient(t, c, WithClientContext(clientCtx), MaxBufferedRecords(1))
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 1)
+
+	// Pausing keeps our first record buffered, so our second produce
+	// blocks until the client context is canceled.
+	cl.Pause()
+
+	errs := make(chan error, 1)
+	r := &Record{Topic: "foo", Value: []byte("buffered")}
+	if err := cl.Produce(context.Background(), r, func(_ *Record, err error) { errs <- err }); err != nil {
+		t.Fatalf("unable to produce: %v", err)
+	}
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- cl.Produce(context.Background(), &Record{Topic: "foo"}, nil)
+	}()
+
+	select {
+	case err := <-blocked:
+		t.Fatalf("produce returned before the client context was canceled: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	clientCancel()
+
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got blocked produce err %v, expected context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("blocked produce did not return after canceling the client context")
+	}
+
+	// The buffered record is failed as if the client were closed.
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("buffered record unexpectedly succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("buffered record did not finish after canceling the client context")
+	}
+
+	if _, err := kmsg.NewPtrMetadataRequest().RequestWith(context.Background(), cl); err == nil {
+		t.Error("request unexpectedly succeeded after canceling the client context")
+	}
+}
+
+// leaveGroupHook counts LeaveGroup requests that were answered.
+type leaveGroupHook struct{ left int32 }
+
+func (h *leaveGroupHook) OnRequestComplete(_ BrokerMetadata, key, _ int16, _ int32, _, _, _, _ time.Duration, err error) {
+	if key == 13 && err == nil {
+		atomic.AddInt32(&h.left, 1)
+	}
+}
+
+func TestClientContextCancelLeavesGroup(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	clientCtx, clientCancel := context.WithCancel(context.Background())
+	defer clientCancel()
+
+	hook := new(leaveGroupHook)
+	cl := newTestClient(t, c, WithClientContext(clientCtx), WithHooks(hook))
+	cl.AssignGroup("group", GroupTopics("foo"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := cl.WaitForGroupAssignment(ctx); err != nil {
+		t.Fatalf("unable to join group: %v", err)
+	}
+
+	// Canceling the client context closes the client, and a concurrent
+	// Close waits for that close to finish. Leaving the group uses the
+	// client's own context, so it is still sent.
+	clientCancel()
+	cl.Close()
+	if left := atomic.LoadInt32(&hook.left); left != 1 {
+		t.Errorf("got %d answered LeaveGroup requests, expected 1", left)
+	}
+}
+
+func TestCreateTopics(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(3), kfake.DefaultNumPartitions(2))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errs, err := cl.CreateTopics(ctx, []TopicSpec{
+		{Topic: "validated", Partitions: 3, ReplicationFactor: 1},
+		{Topic: "too-replicated", Partitions: 3, ReplicationFactor: 4},
+	}, true)
+	if err != nil {
+		t.Fatalf("unable to validate topics: %v", err)
+	}
+	if err := errs["validated"]; err != nil {
+		t.Errorf("got validate err %v, expected nil", err)
+	}
+	if err := errs["too-replicated"]; !errors.Is(err, kerr.InvalidReplicationFactor) {
+		t.Errorf("got validate err %v, expected invalid replication factor", err)
+	}
+	if _, err := cl.PartitionISR(ctx, "validated"); err != kerr.UnknownTopicOrPartition {
+		t.Errorf("got err %v, expected validate only to not create the topic", err)
+	}
+
+	// Before v1, validate only would be dropped and create the topic.
+	old := newTestClient(t, c, MaxVersions(kversion.V0_10_1()))
+	defer old.Close()
+	var tooOld *ErrBrokerTooOld
+	if _, err := old.CreateTopics(ctx, []TopicSpec{{Topic: "validated"}}, true); !errors.As(err, &tooOld) || tooOld.MinVersion != 1 {
+		t.Errorf("got err %v, expected ErrBrokerTooOld requiring v1", err)
+	}
+	if _, err := cl.PartitionISR(ctx, "validated"); err != kerr.UnknownTopicOrPartition {
+		t.Errorf("got err %v, expected the too old validate only to not create the topic", err)
+	}
+
+	errs, err = cl.CreateTopics(ctx, []TopicSpec{
+		{Topic: "explicit", Partitions: 3, ReplicationFactor: 1, Configs: map[string]string{"cleanup.policy": "compact"}},
+		{Topic: "defaulted"},
+		{Topic: "assigned", ReplicaAssignment: map[int32][]int32{0: {2}, 1: {1}}},
+	}, false)
+	if err != nil {
+		t.Fatalf("unable to create topics: %v", err)
+	}
+	for topic, err := range errs {
+		if err != nil {
+			t.Errorf("topic %s: got create err %v, expected nil", topic, err)
+		}
+	}
+
+	for _, test := range []struct {
+		topic   string
+		leaders []int32 // nil if any leader is fine
+		parts   int
+	}{
+		{"explicit", nil, 3},
+		{"defaulted", nil, 2},
+		{"assigned", []int32{2, 1}, 2},
+	} {
+		isrs, err := cl.PartitionISR(ctx, test.topic)
+		if err != nil {
+			t.Errorf("topic %s: unable to load isrs: %v", test.topic, err)
+			continue
+		}
+		if len(isrs) != test.parts {
+			t.Errorf("topic %s: got %d partitions, expected %d", test.topic, len(isrs), test.parts)
+		}
+		for i, leader := range test.leaders {
+			if got := isrs[int32(i)].Leader; got != leader {
+				t.Errorf("topic %s partition %d: got leader %d, expected %d", test.topic, i, got, leader)
+			}
+		}
+	}
+
+	errs, err = cl.CreateTopics(ctx, []TopicSpec{{Topic: "explicit", Partitions: 1}}, false)
+	if err != nil {
+		t.Fatalf("unable to create topics: %v", err)
+	}
+	if err := errs["explicit"]; !errors.Is(err, kerr.TopicAlreadyExists) {
+		t.Errorf("got create err %v, expected topic already exists", err)
+	}
+}
+
+func TestTxnCoordinator(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t)
+	defer c.Close()
+
+	hook := &e2eHook{reqs: make(map[int16][]e2eReq)}
+	cl := newTestClient(t, c, WithHooks(hook))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req := kmsg.NewPtrFindCoordinatorRequest()
+	req.CoordinatorKey = "txn"
+	req.CoordinatorType = 1
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		t.Fatalf("unable to find coordinator: %v", err)
+	}
+
+	// A loading coordinator is retried.
+	finds := func() int {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		return len(hook.reqs[10])
+	}
+	before := finds()
+	c.InjectFault(10, kfake.Fault{ErrorCode: kerr.CoordinatorLoadInProgress.Code})
+	meta, err := cl.TxnCoordinator(ctx, "txn")
+	if err != nil {
+		t.Fatalf("unable to load txn coordinator: %v", err)
+	}
+	if meta.NodeID != resp.NodeID {
+		t.Errorf("got coordinator %d, expected %d", meta.NodeID, resp.NodeID)
+	}
+	if n := finds() - before; n != 2 {
+		t.Errorf("issued %d find coordinator requests, expected 2", n)
+	}
+
+	// A non-retriable error is returned.
+	c.InjectFault(10, kfake.Fault{ErrorCode: kerr.TransactionalIDAuthorizationFailed.Code})
+	if _, err := cl.TxnCoordinator(ctx, "txn"); err != kerr.TransactionalIDAuthorizationFailed {
+		t.Errorf("got err %v, expected transactional id authorization failed", err)
+	}
+}
+
+func TestOffsetsForLeaderEpoch(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(2), kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10) // all to partition 0
+
+	ctx := context.Background()
+	ends, err := cl.OffsetsForLeaderEpoch(ctx, map[string]map[int32]int32{
+		"foo":     {0: 0, 1: 0},
+		"missing": {0: 0},
+	})
+	if err != nil {
+		t.Fatalf("unable to load epoch end offsets: %v", err)
+	}
+	for partition, exp := range map[int32]int64{0: 10, 1: 0} {
+		e := ends["foo"][partition]
+		if e.Err != nil || e.EndOffset != exp || e.LeaderEpoch != 0 {
+			t.Errorf("foo[%d]: got %+v, expected end offset %d epoch 0", partition, e, exp)
+		}
+	}
+	if e := ends["missing"][0]; e.Err != kerr.UnknownTopicOrPartition || e.EndOffset != -1 {
+		t.Errorf("missing[0]: got %+v, expected end offset -1 and err %v", e, kerr.UnknownTopicOrPartition)
+	}
+
+	// Brokers before KIP-279 do not return the epoch.
+	old := newTestClient(t, c, MaxVersions(kversion.V1_1_0()))
+	defer old.Close()
+	ends, err = old.OffsetsForLeaderEpoch(ctx, map[string]map[int32]int32{"foo": {0: 0}})
+	if err != nil {
+		t.Fatalf("unable to load epoch end offsets: %v", err)
+	}
+	if e := ends["foo"][0]; e.Err != nil || e.EndOffset != 10 || e.LeaderEpoch != -1 {
+		t.Errorf("got %+v, expected end offset 10 epoch -1", e)
+	}
+}
+
+// connectedHook records the brokers that were successfully connected to.
+type connectedHook struct {
+	mu        sync.Mutex
+	connected map[int32]int
+}
+
+func (h *connectedHook) OnConnect(meta BrokerMetadata, _ time.Duration, _ net.Conn, err error) {
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected[meta.NodeID]++
+}
+
+func (h *connectedHook) snapshot() map[int32]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := make(map[int32]int, len(h.connected))
+	for id, n := range h.connected {
+		s[id] = n
+	}
+	return s
+}
+
+func TestPreconnectAllBrokers(t *testing.T) {
+	t.Parallel()
+
+	const nbrokers = 5
+	c := newTestCluster(t, kfake.NumBrokers(nbrokers))
+	defer c.Close()
+
+	// Every dial is slow enough that preconnecting would dial all brokers
+	// at once without a limit.
+	var dialing, maxDialing int32
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		now := atomic.AddInt32(&dialing, 1)
+		defer atomic.AddInt32(&dialing, -1)
+		for {
+			max := atomic.LoadInt32(&maxDialing)
+			if now <= max || atomic.CompareAndSwapInt32(&maxDialing, max, now) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		return c.DialContext(ctx, network, addr)
+	}
+
+	hook := &connectedHook{connected: make(map[int32]int)}
+	cl := newTestClient(t, c,
+		Dialer(dial),
+		PreconnectAllBrokers(),
+		MaxConcurrentDials(2),
+		WithHooks(hook),
+	)
+	defer cl.Close()
+
+	// Once the client loads metadata from a seed broker, every broker
+	// must be connected in the background.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cl.triggerUpdateMetadataNow()
+	for {
+		connected := hook.snapshot()
+		var n int
+		for id := int32(0); id < nbrokers; id++ {
+			if connected[id] > 0 {
+				n++
+			}
+		}
+		if n == nbrokers {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out with %d of %d brokers preconnected: %v", n, nbrokers, connected)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if max := atomic.LoadInt32(&maxDialing); max > 2 {
+		t.Errorf("got %d dials at once, expected at most 2", max)
+	}
+
+	// The first request to every broker uses its preconnected connection.
+	before := hook.snapshot()
+	for id := 0; id < nbrokers; id++ {
+		if _, err := cl.Broker(id).Request(ctx, kmsg.NewPtrApiVersionsRequest()); err != nil {
+			t.Fatalf("broker %d: unable to request: %v", id, err)
+		}
+	}
+	if after := hook.snapshot(); !reflect.DeepEqual(before, after) {
+		t.Errorf("got connections %v after the first requests, expected %v from preconnecting", after, before)
+	}
+}
@@ -0,0 +1,32 @@
+package kgo
+
+import "time"
+
+// clock is the source of time for the parts of the client that compare
+// against or wait until a point in time: throttling, sasl reauthentication,
+// retry backoff, and how long a broker is unreachable after a failed dial.
+// The client always uses the real clock; tests can use a fake one to control
+// time without sleeping.
+//
+// Connection read and write deadlines always use the real time, since they
+// are enforced by the operating system.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+}
+
+// timer is the clock's equivalent of a *time.Timer.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                 { return time.Now() }
+func (realClock) NewTimer(d time.Duration) timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/golang/snappy"
 	"github.com/klauspost/compress/zstd"
@@ -72,6 +73,7 @@ func (c CompressionCodec) WithLevel(level int) CompressionCodec {
 
 type compressor struct {
 	options  []int8
+	disabled uint32 // atomic bitmask of disabled codecs; see disable
 	gzPool   sync.Pool
 	lz4Pool  sync.Pool
 	zstdPool sync.Pool
@@ -148,6 +150,49 @@ out:
 	return c, nil
 }
 
+// codecFor returns the codec the compressor prefers for a produce request
+// version, or 0 if no compression would be used. This is safe to call on a
+// nil compressor.
+func (c *compressor) codecFor(produceRequestVersion int16) int8 {
+	if c == nil {
+		return 0
+	}
+	disabled := atomic.LoadUint32(&c.disabled)
+	for _, option := range c.options {
+		if option == 4 && produceRequestVersion < 7 || disabled&(1<<uint(option)) != 0 {
+			continue
+		}
+		return option
+	}
+	return 0
+}
+
+// disable stops the compressor from using codec, falling back to the next
+// preferred codec, or to no compression if none are left.
+func (c *compressor) disable(codec int8) {
+	for {
+		old := atomic.LoadUint32(&c.disabled)
+		if atomic.CompareAndSwapUint32(&c.disabled, old, old|1<<uint(codec)) {
+			return
+		}
+	}
+}
+
+// codecName returns the name of a compression codec.
+func codecName(codec int8) string {
+	switch codec {
+	case 1:
+		return "gzip"
+	case 2:
+		return "snappy"
+	case 3:
+		return "lz4"
+	case 4:
+		return "zstd"
+	}
+	return "none"
+}
+
 type zstdEncoder struct {
 	inner *zstd.Encoder
 }
@@ -158,16 +203,13 @@ type zstdEncoder struct {
 // The writer should be put back to its pool after the returned slice is done
 // being used.
 func (c *compressor) compress(dst *sliceWriter, src []byte, produceRequestVersion int16) ([]byte, int8) {
-	dst.inner = dst.inner[:0]
+	return c.compressWith(dst, src, c.codecFor(produceRequestVersion))
+}
 
-	var use int8
-	for _, option := range c.options {
-		if option == 4 && produceRequestVersion < 7 {
-			continue
-		}
-		use = option
-		break
-	}
+// compressWith is compress, but uses the given codec, which must be one the
+// compressor supports, rather than the codec preferred for a request version.
+func (c *compressor) compressWith(dst *sliceWriter, src []byte, use int8) ([]byte, int8) {
+	dst.inner = dst.inner[:0]
 
 	switch use {
 	case 0:
@@ -202,7 +244,7 @@ func (c *compressor) compress(dst *sliceWriter, src []byte, produceRequestVersio
 		dst.inner = zstdEnc.inner.EncodeAll(src, dst.inner)
 	}
 
-	return dst.inner, int8(use)
+	return dst.inner, use
 }
 
 type decompressor struct {
@@ -2,6 +2,7 @@ package kgo
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math"
@@ -10,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/twmb/franz-go/pkg/kmsg"
 	"github.com/twmb/franz-go/pkg/kversion"
 	"github.com/twmb/franz-go/pkg/sasl"
 )
@@ -46,8 +48,19 @@ func (consumerOpt) consumerOpt()       {}
 type cfg struct {
 	// ***GENERAL SECTION***
 	id                  *string
+	ctx                 context.Context
 	dialFn              func(context.Context, string, string) (net.Conn, error)
 	connTimeoutOverhead time.Duration
+	connTimeoutFn       func(kmsg.Request) (time.Duration, time.Duration)
+	connStallTimeout    time.Duration
+	tlsVerifyBroker     func(BrokerMetadata, tls.ConnectionState) error
+
+	tcpKeepAlive   time.Duration
+	tcpNoDelay     bool
+	tcpReadBuffer  int
+	tcpWriteBuffer int
+
+	clock clock // always the real clock outside of tests
 
 	softwareName    string // KIP-511
 	softwareVersion string // KIP-511
@@ -55,23 +68,49 @@ type cfg struct {
 	logger Logger
 
 	seedBrokers []string
+	seedPolicy  SeedPolicy
+	seedRetries int // negative if unset; see SeedBrokerRetries
+	connSharing ConnSharing
+	coalesce    bool
+	maxInFlight int // unlimited if zero
+	maxDials    int // unlimited if zero
+	detectDups  bool
 	maxVersions *kversion.Versions
 	minVersions *kversion.Versions
+	minWarnOnly map[int16]bool // keys whose min version only warns, -1 for all
+
+	initialMetaTimeout time.Duration
+
+	failoverSeeds []string
+	failoverAfter time.Duration
 
 	retryBackoff          func(int) time.Duration
+	metadataErrBackoff    func(int) time.Duration // if nil, uses retryBackoff
+	metadataErrMin        time.Duration           // for validating metadataErrBackoff
+	metadataErrMax        time.Duration
 	retries               int
 	retryTimeout          func(int16) time.Duration
 	brokerConnDeadRetries int
 
 	maxBrokerWriteBytes int32
 	maxBrokerReadBytes  int32
+	maxThrottle         time.Duration
+	throttlePreThrottle bool
 
 	allowAutoTopicCreation bool
 
-	metadataMaxAge time.Duration
-	metadataMinAge time.Duration
+	metadataMaxAge    time.Duration
+	metadataMinAge    time.Duration
+	metadataAllTopics *bool // if nil, all topics only when consuming regex
+	metadataTopicTTL  time.Duration
 
-	sasls []sasl.Mechanism
+	onLeaderChange func(string, int32, int32, int32, int32)
+
+	preconnect bool
+
+	sasls               []sasl.Mechanism
+	saslGSSAPIHandshake bool
+	saslProbeInterval   time.Duration
 
 	hooks hooks
 
@@ -81,18 +120,28 @@ type cfg struct {
 	acks        Acks
 	compression []CompressionCodec // order of preference
 
+	downgradeCompression bool
+
 	maxRecordBatchBytes int32
+	maxRecordBytes      int32 // if zero, no client-side record limit
 	maxBufferedRecords  int64
 	produceTimeout      time.Duration
+	produceRetries      int     // if negative, uses retries
+	produceID           *string // if nil, uses id
 	linger              time.Duration
 	recordTimeout       time.Duration
 	manualFlushing      bool
 
-	partitioner Partitioner
+	partitioner     Partitioner
+	headerValidator func([]RecordHeader) error
+	interceptors    []ProducerInterceptor
 
 	stopOnDataLoss bool
 	onDataLoss     func(string, int32)
 
+	deadLetter                func(*Record, error)
+	deadLetterReplacesPromise bool
+
 	// ***CONSUMER SECTION***
 	maxWait        int32
 	minBytes       int32
@@ -102,12 +151,56 @@ type cfg struct {
 	isolationLevel int8
 	keepControl    bool
 	rack           string
+	followerTopics map[string]struct{}
+	followerLease  time.Duration      // if zero, uses metadataMaxAge
+	fetchBrokers   map[int32]struct{} // if nil, all brokers are allowed
+
+	clampTimestamps bool
+	timestampClamp  time.Duration
+
+	consumerInterceptors []ConsumerInterceptor
+
+	maxFetchGoroutines     int
+	fetchDecodeConcurrency int
+	reuseFetchResps        bool
+
+	consumeID *string // if nil, uses id
+
+	onOffsetsLoaded     func([]LoadedPartition)
+	onPartitionsAdded   func(map[string][]int32)
+	onCursorStateChange func(string, int32, CursorState)
+	onCursorReset       func(CursorReset)
+
+	redeliverPartitionErrs bool
+
+	noTruncationDetection bool
+
+	missingFatal bool
+	missingGrace time.Duration
+
+	underReplicatedMin      int // if zero, we do not warn
+	underReplicatedReplicas bool
+
+	panicOnConcurrentPoll bool
 }
 
 func (cfg *cfg) validate() error {
 	if len(cfg.seedBrokers) == 0 {
 		return errors.New("config erroneously has no seed brokers")
 	}
+	for _, seeds := range [][]string{cfg.seedBrokers, cfg.failoverSeeds} {
+		for _, seed := range seeds {
+			if seed == "" {
+				return errors.New("config erroneously has an empty seed broker")
+			}
+		}
+	}
+	if len(cfg.failoverSeeds) > 0 && cfg.failoverAfter <= 0 {
+		return errors.New("config erroneously has failover seed brokers without a positive failover delay")
+	}
+	if cfg.ctx == nil {
+		return errors.New("config erroneously has a nil client context")
+	}
 
 	for _, limit := range []struct {
 		name    string
@@ -176,11 +269,26 @@ func (cfg *cfg) validate() error {
 		{name: "conn timeout max overhead", v: int64(cfg.connTimeoutOverhead), allowed: int64(15 * time.Minute), badcmp: i64gt, durs: true},
 		{name: "conn timeout min overhead", v: int64(cfg.connTimeoutOverhead), allowed: int64(time.Second), badcmp: i64lt, durs: true},
 
+		{name: "initial metadata timeout", v: int64(cfg.initialMetaTimeout), allowed: 0, badcmp: i64lt, durs: true},
+		{name: "sasl health probe interval", v: int64(cfg.saslProbeInterval), allowed: 0, badcmp: i64lt, durs: true},
+		{name: "max in flight per connection", v: int64(cfg.maxInFlight), allowed: 0, badcmp: i64lt},
+		{name: "max concurrent dials", v: int64(cfg.maxDials), allowed: 0, badcmp: i64lt},
+		{name: "fetch preferred replica lease", v: int64(cfg.followerLease), allowed: 0, badcmp: i64lt, durs: true},
+
 		// 10ms <= metadata <= 1hr
 		{name: "metadata max age", v: int64(cfg.metadataMaxAge), allowed: int64(time.Hour), badcmp: i64gt, durs: true},
 		{name: "metadata min age", v: int64(cfg.metadataMinAge), allowed: int64(10 * time.Millisecond), badcmp: i64lt, durs: true},
 		{v: int64(cfg.metadataMaxAge), allowed: int64(cfg.metadataMinAge), badcmp: i64lt, fmt: "metadata max age %v is erroneously less than metadata min age %v", durs: true},
 
+		// 1ns <= metadata error backoff min <= max, if set.
+		{name: "metadata error backoff min", v: int64(cfg.metadataErrMin), allowed: 1, badcmp: func(l, r int64) (bool, string) {
+			if cfg.metadataErrBackoff == nil {
+				return false, "" // using RetryBackoff
+			}
+			return l < r, "less"
+		}, durs: true},
+		{v: int64(cfg.metadataErrMax), allowed: int64(cfg.metadataErrMin), badcmp: i64lt, fmt: "metadata error backoff max %v is erroneously less than metadata error backoff min %v", durs: true},
+
 		// Some random producer settings.
 		{name: "max buffered records", v: int64(cfg.maxBufferedRecords), allowed: 1, badcmp: i64lt},
 		{name: "linger", v: int64(cfg.linger), allowed: int64(time.Minute), badcmp: i64gt, durs: true},
@@ -196,6 +304,7 @@ func (cfg *cfg) validate() error {
 		// milliseconds, but we want the error message to be in the
 		// nice time.Duration string format.
 		{name: "max fetch wait", v: int64(cfg.maxWait) * int64(time.Millisecond), allowed: int64(10 * time.Millisecond), badcmp: i64lt, durs: true},
+		{name: "fetch timestamp clamp", v: int64(cfg.timestampClamp), allowed: 0, badcmp: i64lt, durs: true},
 	} {
 		bad, cmp := limit.badcmp(limit.v, limit.allowed)
 		if bad {
@@ -219,48 +328,26 @@ func defaultCfg() cfg {
 	defaultID := "kgo"
 	return cfg{
 		id:     &defaultID,
+		ctx:    context.Background(),
 		dialFn: (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
 
 		connTimeoutOverhead: 20 * time.Second,
 
+		tcpNoDelay: true,
+
+		clock: realClock{},
+
 		softwareName:    "kgo",
 		softwareVersion: "0.1.0",
 
 		logger: new(nopLogger),
 
 		seedBrokers: []string{"127.0.0.1"},
+		seedRetries: -1,
 		maxVersions: kversion.Stable(),
 
-		retryBackoff: func() func(int) time.Duration {
-			var rngMu sync.Mutex
-			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-			return func(fails int) time.Duration {
-				const (
-					min = 100 * time.Millisecond
-					max = time.Second
-				)
-				if fails <= 0 {
-					return min
-				}
-				if fails > 10 {
-					return max
-				}
-
-				backoff := min * time.Duration(1<<(fails-1))
-
-				rngMu.Lock()
-				jitter := 0.8 + 0.4*rng.Float64()
-				rngMu.Unlock()
-
-				backoff = time.Duration(float64(backoff) * jitter)
-
-				if backoff > max {
-					return max
-				}
-				return backoff
-			}
-		}(),
-		retries: math.MaxInt32, // effectively unbounded
+		retryBackoff: jitteredBackoff(100*time.Millisecond, time.Second),
+		retries:      math.MaxInt32, // effectively unbounded
 		retryTimeout: func(key int16) time.Duration {
 			if key == 26 { // EndTxn key
 				return 5 * time.Minute
@@ -276,6 +363,7 @@ func defaultCfg() cfg {
 		metadataMinAge: 10 * time.Second,
 
 		txnTimeout:          60 * time.Second,
+		produceRetries:      -1,
 		acks:                AllISRAcks(),
 		compression:         []CompressionCodec{SnappyCompression(), NoCompression()},
 		maxRecordBatchBytes: 1000000, // Kafka max.message.bytes default is 1000012
@@ -296,6 +384,11 @@ func defaultCfg() cfg {
 
 // ClientID uses id for all requests sent to Kafka brokers, overriding the
 // default "kgo".
+//
+// The client ID is distinct from the software name and version: brokers log
+// it and can apply quotas and ACLs based on it. To override the ID for
+// individual requests, see WithClientID, and to use a different ID for
+// produce or fetch requests, see ProduceClientID and ConsumeClientID.
 func ClientID(id string) Opt {
 	return clientOpt{func(cfg *cfg) { cfg.id = &id }}
 }
@@ -348,6 +441,66 @@ func ConnTimeoutOverhead(overhead time.Duration) Opt {
 	return clientOpt{func(cfg *cfg) { cfg.connTimeoutOverhead = overhead }}
 }
 
+// ConnTimeoutFn uses the given function to determine the read and write
+// timeouts for each request, overriding the timeouts that are otherwise
+// derived from ConnTimeoutOverhead. If a request's response is not read (or
+// the request is not written) within the returned timeout, the connection is
+// closed and the request fails with ErrConnDead.
+//
+// The function must be safe for concurrent use. If the function returns zero
+// for either timeout, the client falls back to its default for that timeout,
+// so it is only necessary to handle the requests you care about.
+//
+// For fetch requests (key 1), the client always adds FetchMaxWait on top of
+// the returned read timeout, since Kafka may wait that long before replying.
+// Note that the client issues fetches with an internal type, so switch on the
+// request's Key rather than on *kmsg.FetchRequest.
+//
+// By default, any request with a TimeoutMillis field is given that timeout
+// plus the overhead. JoinGroup and SyncGroup block while a group rebalances,
+// so they are given the group's rebalance timeout plus the overhead; if you
+// override these, be sure to allow at least the rebalance timeout, or group
+// members will be kicked from the group mid-rebalance. Metadata and most
+// other requests are fast and are given only the overhead.
+func ConnTimeoutFn(fn func(kmsg.Request) (read, write time.Duration)) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.connTimeoutFn = fn }}
+}
+
+// ConnStallTimeout kills a connection if the broker stops sending responses
+// for the given duration while requests are outstanding, overriding the
+// default of no stall detection.
+//
+// A broker that accepts connections but hangs otherwise leaves requests
+// waiting until their read timeout, which is TimeoutMillis plus the
+// ConnTimeoutOverhead for most requests. If the broker sends nothing for the
+// stall timeout, the connection is killed so that every request on it fails
+// (or is retried) immediately and the client reconnects.
+//
+// Some requests legitimately wait before Kafka replies: fetches wait up to
+// FetchMaxWait for records, produce requests wait up to ProduceRequestTimeout
+// for acks, and joining a group waits up to the rebalance timeout. The stall
+// timeout is measured after that wait for the response that is being read.
+// Once a response begins arriving, the stall timeout applies between reads
+// of its bytes. A request's read timeout still applies if it is shorter.
+func ConnStallTimeout(timeout time.Duration) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.connStallTimeout = timeout }}
+}
+
+// WithClientContext ties the lifetime of the client to ctx, overriding the
+// default of context.Background, which is never canceled.
+//
+// Canceling ctx is treated exactly like calling Close: the client leaves any
+// group, fails all buffered records, and closes all connections and
+// goroutines. This allows tying the lifetime of the client to an application
+// or request scoped context. The client's own requests do not use ctx, so
+// that closing can still leave the group after ctx is canceled; only ctx's
+// cancellation is observed.
+//
+// Close should still be called if ctx is never canceled.
+func WithClientContext(ctx context.Context) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.ctx = ctx }}
+}
+
 // Dialer uses fn to dial addresses, overriding the default dialer that uses a
 // 10s dial timeout and no TLS.
 //
@@ -369,6 +522,266 @@ func Dialer(fn func(ctx context.Context, network, host string) (net.Conn, error)
 	return clientOpt{func(cfg *cfg) { cfg.dialFn = fn }}
 }
 
+// TLSVerifyBroker sets a function to verify a broker's TLS connection after
+// the handshake, allowing verification that depends on which broker was
+// dialed (for example, checking a SPIFFE ID or SAN against the broker's node
+// ID or rack).
+//
+// This is only called if the Dialer returns a *tls.Conn. If the handshake has
+// not yet been performed, it is performed before calling fn, and it fails if
+// it does not complete within ConnTimeoutOverhead. Returning an error closes
+// the connection, and the dial fails with ErrNoDial. This check runs in
+// addition to any verification in the tls.Config itself.
+func TLSVerifyBroker(fn func(meta BrokerMetadata, cs tls.ConnectionState) error) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.tlsVerifyBroker = fn }}
+}
+
+// TCPKeepAlive sets the keep alive period on connections to brokers. By
+// default, the period is left as the dialer set it (the default dialer uses a
+// 15s period). Using a negative duration disables keep alives.
+//
+// This and the other TCP options are applied to connections after dialing,
+// before any TLS handshake the client performs, if the dialed connection is a
+// *net.TCPConn or wraps one. A *tls.Conn (when built with Go 1.18 or newer),
+// or any other connection with a NetConn method returning the connection it
+// wraps, is unwrapped to its *net.TCPConn. If a custom Dialer returns a
+// connection with no underlying *net.TCPConn, these options are skipped.
+func TCPKeepAlive(period time.Duration) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.tcpKeepAlive = period }}
+}
+
+// TCPNoDelay sets whether TCP_NODELAY is set on connections to brokers,
+// overriding the default true. Disabling this enables Nagle's algorithm, which
+// can increase latency for small requests.
+//
+// See TCPKeepAlive for when TCP options are applied.
+func TCPNoDelay(noDelay bool) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.tcpNoDelay = noDelay }}
+}
+
+// TCPReadBuffer sets the size of the operating system's receive buffer for
+// connections to brokers. By default, the operating system default is used.
+//
+// See TCPKeepAlive for when TCP options are applied.
+func TCPReadBuffer(bytes int) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.tcpReadBuffer = bytes }}
+}
+
+// TCPWriteBuffer sets the size of the operating system's transmit buffer for
+// connections to brokers. By default, the operating system default is used.
+//
+// See TCPKeepAlive for when TCP options are applied.
+func TCPWriteBuffer(bytes int) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.tcpWriteBuffer = bytes }}
+}
+
+// SeedPolicy is how the client treats seed brokers once it has discovered the
+// real brokers in the cluster; see SeedBrokerPolicy.
+type SeedPolicy uint8
+
+const (
+	// SeedPolicyKeep keeps seed brokers open and uses them for requests
+	// the same as discovered brokers. This is the default.
+	SeedPolicyKeep SeedPolicy = iota
+
+	// SeedPolicyCloseAfterMetadata stops seed brokers, closing their
+	// connections, once a metadata response returns the cluster's
+	// brokers. If a later metadata response returns no brokers, the seeds
+	// are recreated so that the client can recover.
+	SeedPolicyCloseAfterMetadata
+
+	// SeedPolicyFallbackOnly keeps seed brokers, but only uses them for
+	// requests that can go to any broker when every discovered broker is
+	// unreachable. A discovered broker is considered unreachable for the
+	// metadata min age after dialing it fails.
+	SeedPolicyFallbackOnly
+)
+
+// SeedBrokerPolicy sets how the client treats seed brokers once it discovers
+// the real brokers in the cluster, overriding the default SeedPolicyKeep.
+//
+// Seed brokers are internally tracked under very negative node IDs, and the
+// client does not map seeds to the discovered brokers they correspond to.
+// Keeping seeds can double the connections to the brokers that are also
+// seeds, whereas closing them removes a fallback if the cluster's advertised
+// addresses become unreachable.
+//
+// Requests that target partitions whose leaders are unknown are still routed
+// to the first seed under every policy; with SeedPolicyCloseAfterMetadata,
+// these fail with ErrBrokerDead and are retried once metadata is reloaded.
+func SeedBrokerPolicy(policy SeedPolicy) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.seedPolicy = policy }}
+}
+
+// SeedBrokerRetries sets how many times the client retries its seed brokers
+// when loading its first metadata, after every seed has failed once. By
+// default, the first metadata load is retried like any other request (see
+// RequestRetries and RetryTimeout), which can block for a long time if the
+// seeds are unreachable.
+//
+// With this option, until metadata is first loaded, the client tries each
+// seed in order and, if every seed fails, backs off (see RetryBackoff) and
+// tries them all again, up to n more times. If every try fails, the metadata
+// load fails with *ErrSeedBrokers, which contains the last failure from each
+// seed. The first request that needs metadata (or the metadata loop) thus
+// fails fast with a clear reason in a misconfigured environment.
+//
+// Using only InitialMetadataTimeout without this option retries the seeds
+// until the timeout.
+func SeedBrokerRetries(n int) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.seedRetries = n }}
+}
+
+// InitialMetadataTimeout sets how long the client tries its seed brokers when
+// loading its first metadata before failing with *ErrSeedBrokers; see
+// SeedBrokerRetries. By default, there is no timeout other than the context
+// of the request that needs metadata.
+func InitialMetadataTimeout(timeout time.Duration) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.initialMetaTimeout = timeout }}
+}
+
+// FailoverSeedBrokers sets seed brokers for a secondary cluster that the client
+// fails over to if the primary cluster (the cluster of SeedBrokers) is
+// entirely unreachable for the given duration. This is meant for
+// active-passive deployments where a disaster recovery cluster mirrors the
+// primary cluster.
+//
+// The primary cluster is considered entirely unreachable once metadata
+// updates have continuously failed for the duration and the most recent dial
+// to every known broker failed. This is checked after every failed metadata
+// update, and a single update can retry for up to RetryTimeout, so the client
+// may take longer than the duration to fail over.
+//
+// On failover, the client stops every broker it knows of, forgets its
+// controller and group coordinators, and begins using the failover seeds as if
+// they were the original seed brokers. Failover happens at most once: the
+// client never fails back to the primary cluster.
+//
+// Offsets are specific to a cluster, and a mirrored cluster's offsets are not
+// guaranteed to line up with the primary cluster's. On failover, direct
+// consumers reset every partition they are consuming to ConsumeResetOffset
+// rather than continuing from their current offsets. Group consumers stop
+// fetching at their current offsets; the group is then rejoined on the
+// failover cluster, and consuming resumes from the offsets committed there
+// (or the reset offset, if there are none). An idempotent producer loads a
+// new producer ID from the failover cluster. Transactions that are in
+// progress during failover fail, and should be aborted.
+func FailoverSeedBrokers(after time.Duration, seeds ...string) Opt {
+	return clientOpt{func(cfg *cfg) {
+		cfg.failoverAfter = after
+		cfg.failoverSeeds = append(cfg.failoverSeeds[:0], seeds...)
+	}}
+}
+
+// ConnSharing is how requests to a broker share connections; see
+// ConnectionSharing.
+type ConnSharing uint8
+
+const (
+	// ConnSharingSplitProduceFetch uses one connection for produce
+	// requests, one for fetch requests, and one for everything else. This
+	// is the default.
+	ConnSharingSplitProduceFetch ConnSharing = iota
+
+	// ConnSharingAllOnOne sends every request to a broker on a single
+	// connection.
+	ConnSharingAllOnOne
+
+	// ConnSharingSplitAll is ConnSharingSplitProduceFetch, but
+	// additionally uses a separate connection for the group requests that
+	// can block: JoinGroup, SyncGroup, Heartbeat, and LeaveGroup.
+	ConnSharingSplitAll
+)
+
+// ConnectionSharing sets how requests to a broker share connections,
+// overriding the default ConnSharingSplitProduceFetch. Connections are only
+// opened when a request needs them, so a consume only client never opens
+// produce connections regardless of this option.
+//
+// Kafka processes the requests on one connection one at a time, so a
+// request that the broker holds onto delays every request behind it on the
+// same connection. Fetch requests wait up to FetchMaxWait and produce
+// requests with acks can wait on replication, which is why these are split
+// by default. ConnSharingAllOnOne minimizes connections for light clients at
+// the cost of this delay; ConnSharingSplitAll additionally keeps a JoinGroup,
+// which can block for the group's rebalance timeout, from delaying metadata
+// and other requests to the group's coordinator.
+//
+// Every connection negotiates versions and authenticates on its own, and
+// produce and fetch requests use ProduceClientID and ConsumeClientID even
+// when they share a connection.
+func ConnectionSharing(sharing ConnSharing) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.connSharing = sharing }}
+}
+
+// CoalesceWrites opts in to writing requests that are queued for the same
+// connection at the same time with one write, rather than one write per
+// request.
+//
+// Clients that issue many small concurrent requests (heartbeats, offset
+// commits, metadata) to the same broker spend much of their write time in
+// syscalls; coalescing amortizes that cost. The client never waits for more
+// requests to arrive, so a lone request is written exactly as it would be
+// without this option. Produce and fetch requests are never coalesced, nor
+// are requests on a connection that the broker is throttling.
+//
+// Each coalesced request keeps its own correlation ID and response timeout,
+// and the write is bounded by the smallest write timeout of the requests in
+// it. Because a write cannot be partially canceled, canceling the context of
+// one coalesced request does not interrupt the write; the request fails once
+// its context is noticed to be done while waiting for its response.
+func CoalesceWrites() Opt {
+	return clientOpt{func(cfg *cfg) { cfg.coalesce = true }}
+}
+
+// MaxInFlightPerConnection sets the maximum number of requests that can be
+// awaiting responses on a single broker connection, overriding the default of
+// no limit. This is the equivalent of Kafka's
+// max.in.flight.requests.per.connection.
+//
+// Once a connection is at the limit, the client waits for a response before
+// writing the next request on that connection. Requests on the broker's other
+// connections, such as group heartbeats while produce requests are backed up,
+// are not delayed; see ConnectionSharing for which requests share connections.
+// A request that is waiting for room fails if its context is canceled.
+//
+// Produce requests without idempotency can be reordered if a request fails
+// and is retried while later requests are in flight. The producer issues up
+// to four concurrent produce requests per broker (one before Kafka 1.0); a
+// limit of 1 preserves ordering at the cost of throughput.
+func MaxInFlightPerConnection(n int) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.maxInFlight = n }}
+}
+
+// MaxConcurrentDials sets the maximum number of broker connections the client
+// dials at once, overriding the default of no limit.
+//
+// Connections are opened lazily on first use, but many can be opened at once
+// when the client starts, such as when preconnecting to every broker (see
+// PreconnectAllBrokers) or when producing to or fetching from many brokers.
+// A limit smooths out the burst of dials (and TLS handshakes, if the dialer
+// performs them) against brokers and any proxies in front of them. A dial
+// that is waiting for room fails if its request's context is canceled.
+func MaxConcurrentDials(n int) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.maxDials = n }}
+}
+
+// DetectDuplicateCorrelationIDs opts into diagnosing responses that repeat
+// the correlation ID of a response that was already read.
+//
+// Responses are read in the order requests were written, and a response with
+// an unexpected correlation ID already kills the connection with
+// ErrCorrelationIDMismatch. A buggy broker or proxy that sends a response
+// twice causes exactly this, but the mismatch alone does not say why. With
+// this option, every connection remembers the last few correlation IDs it
+// read, and a mismatch on one of them is logged at the error level as a
+// duplicate response, along with the broker and request involved.
+//
+// This is meant for debugging and is cheap, but is off by default.
+func DetectDuplicateCorrelationIDs() Opt {
+	return clientOpt{func(cfg *cfg) { cfg.detectDups = true }}
+}
+
 // SeedBrokers sets the seed brokers for the client to use, overriding the
 // default 127.0.0.1:9092.
 //
@@ -401,11 +814,63 @@ func MaxVersions(versions *kversion.Versions) Opt {
 //
 // Unlike MaxVersions, if a request is issued that is unknown to the min
 // versions, the request is allowed. It is assumed that there is no lower bound
-// for that request.
+// for that request. To require a minimum for only some requests, start from
+// an empty kversion.Versions and set only those keys, e.g. setting key 1 to 11
+// requires Fetch v11+ while leaving every other request unbounded.
+//
+// See MinVersionsWarnOnly to log rather than fail requests that would be
+// downgraded past their minimum.
 func MinVersions(versions *kversion.Versions) Opt {
 	return clientOpt{func(cfg *cfg) { cfg.minVersions = versions }}
 }
 
+// MinVersionsWarnOnly sets requests for the given keys, or all requests if no
+// keys are given, to be issued at the best version the broker supports even
+// if that is below MinVersions, rather than failing with ErrBrokerTooOld. The
+// first such request on every broker connection is logged at the warn level.
+//
+// This allows asserting capabilities on mixed version clusters without hard
+// failures: the logs show which brokers do not meet the minimum. Note that
+// the client itself may still require a minimum version for some requests
+// it builds, such as CreateTopics with validateOnly, which always fail if
+// the broker is too old.
+func MinVersionsWarnOnly(keys ...int16) Opt {
+	return clientOpt{func(cfg *cfg) {
+		cfg.minWarnOnly = map[int16]bool{-1: len(keys) == 0}
+		for _, key := range keys {
+			cfg.minWarnOnly[key] = true
+		}
+	}}
+}
+
+// jitteredBackoff returns an exponential backoff function that starts at min,
+// doubles per failure up to max, and has +/-20% jitter.
+func jitteredBackoff(min, max time.Duration) func(int) time.Duration {
+	var rngMu sync.Mutex
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return func(fails int) time.Duration {
+		if fails <= 0 {
+			return min
+		}
+
+		backoff := min
+		for i := 1; i < fails && backoff < max; i++ {
+			backoff *= 2
+		}
+
+		rngMu.Lock()
+		jitter := 0.8 + 0.4*rng.Float64()
+		rngMu.Unlock()
+
+		backoff = time.Duration(float64(backoff) * jitter)
+
+		if backoff > max {
+			return max
+		}
+		return backoff
+	}
+}
+
 // RetryBackoff sets the backoff strategy for how long to backoff for a given
 // amount of retries, overriding the default exponential backoff that ranges
 // from 100ms min to 1s max.
@@ -492,6 +957,41 @@ func BrokerMaxReadBytes(v int32) Opt {
 	return clientOpt{func(cfg *cfg) { cfg.maxBrokerReadBytes = v }}
 }
 
+// MaxAcceptableThrottle sets the longest a broker can throttle a request
+// before the client surfaces the throttle, overriding the default of always
+// silently accepting throttles.
+//
+// Brokers throttle clients that exceed their quotas. By default, the client
+// absorbs throttling: for Kafka >= 2.0.0, it waits out the throttle before
+// writing the next request on the connection. With this option, when a
+// request is throttled longer than max, the client logs at the warn level and
+// calls any BrokerThrottleExceededHook with the throttled request, allowing
+// applications to notice that they are quota starved and shed load or alert.
+//
+// The throttled request itself is unaffected: the broker processed it, so the
+// client returns its response as usual and the throttle is still waited out.
+// This applies to every request, including those the client issues internally
+// when producing, fetching, and managing groups. To observe all throttling,
+// use a BrokerThrottleHook.
+func MaxAcceptableThrottle(max time.Duration) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.maxThrottle = max }}
+}
+
+// ClientSideThrottleOnPreThrottle opts in to the client waiting out a
+// throttle before writing the next request on a connection even if the broker
+// already applied the throttle before responding.
+//
+// Kafka < 2.0.0 (and older request versions on newer brokers) throttle by
+// delaying the response, so by default the client does not wait again once it
+// receives the response. A client that immediately sends another request can
+// then be throttled again in a tight loop. With this option, the client also
+// delays its next request, which spreads load against old brokers at the cost
+// of waiting up to twice the throttle. BrokerThrottleHook is called in either
+// case.
+func ClientSideThrottleOnPreThrottle() Opt {
+	return clientOpt{func(cfg *cfg) { cfg.throttlePreThrottle = true }}
+}
+
 // MetadataMaxAge sets the maximum age for the client's cached metadata,
 // overriding the default 5m, to allow detection of new topics, partitions,
 // etc.
@@ -512,6 +1012,92 @@ func MetadataMinAge(age time.Duration) Opt {
 	return clientOpt{func(cfg *cfg) { cfg.metadataMinAge = age }}
 }
 
+// MetadataErrorBackoff sets how long the metadata loop backs off after
+// consecutive failed metadata requests, overriding the default of using the
+// RetryBackoff function.
+//
+// The backoff starts at min, doubles with every consecutive failure up to max,
+// and has jitter so that many clients do not retry a recovering cluster in
+// lockstep. min must be positive and max must be at least min. The backoff resets once a metadata request succeeds. While backing
+// off, the client does not issue metadata requests, even if internally
+// triggered; ForceMetadataRefresh interrupts the backoff. The current state
+// of the metadata loop can be inspected with MetadataStatus.
+func MetadataErrorBackoff(min, max time.Duration) Opt {
+	return clientOpt{func(cfg *cfg) {
+		cfg.metadataErrBackoff = jitteredBackoff(min, max)
+		cfg.metadataErrMin, cfg.metadataErrMax = min, max
+	}}
+}
+
+// MetadataAllTopics sets whether the metadata loop requests metadata for all
+// topics in the cluster or only for the topics the client is using,
+// overriding the default of requesting all topics only when consuming with
+// regular expressions or a ConsumeTopicMatcher.
+//
+// Requesting all topics is how a regex consumer discovers newly created
+// topics that match its expressions: every topic in the response is tracked,
+// and the consumer then assigns any new matches. The tradeoff is a larger
+// metadata response on every update, which can be significant in clusters
+// with many topics. Topics that appear or disappear are reflected in
+// OnMetadataUpdate snapshots.
+//
+// If false, a regex consumer only matches topics the client already uses,
+// for example topics it produces to. If true, a client that consumes exact
+// topics or only produces still tracks every topic in the cluster.
+func MetadataAllTopics(all bool) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.metadataAllTopics = &all }}
+}
+
+// MetadataTopicTTL sets how long a topic can go unused before the client
+// stops requesting metadata for it, overriding the default of never expiring
+// topics.
+//
+// Every topic the client produces to is added to the client's metadata
+// requests and, by default, stays there for the life of the client. A
+// client that produces to many short lived topics therefore issues ever
+// larger metadata requests. With this option, a metadata update prunes any
+// topic that has not had a record produced to it within ttl, that has no
+// buffered records, and that is not being consumed, as if by
+// PruneMetadataTopics. Producing to a pruned topic again re-adds it.
+//
+// This option has no effect while the client requests metadata for all
+// topics (see MetadataAllTopics), since every topic is re-added on the next
+// update.
+func MetadataTopicTTL(ttl time.Duration) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.metadataTopicTTL = ttl }}
+}
+
+// OnPartitionLeaderChange sets a function to call whenever a metadata update
+// sees a partition's leader or leader epoch change. The function is called
+// with the topic, partition, old leader, new leader, and new leader epoch.
+//
+// This is called for every partition the client knows of, not just
+// partitions being consumed, which allows applications that mirror partition
+// leadership to keep their view up to date. When a partition is first
+// discovered, the old leader is -1.
+//
+// The function is called from the metadata loop after a metadata update is
+// applied, outside of any client lock. Slow functions delay the next metadata
+// update.
+func OnPartitionLeaderChange(fn func(topic string, partition, oldLeader, newLeader, newEpoch int32)) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.onLeaderChange = fn }}
+}
+
+// PreconnectAllBrokers opts in to proactively opening a connection to every
+// broker once the client's first metadata load succeeds, rather than waiting
+// for the first request to each broker to lazily open one.
+//
+// Connections are opened in the background and are fully initialized (API
+// versions are loaded and SASL is performed), which removes connection
+// latency from the first requests the client issues. Only the general purpose
+// connection is opened; produce and fetch connections are still opened on
+// first use. Preconnect failures are logged but otherwise ignored; the
+// connection will be retried lazily as usual. Preconnecting opens connections
+// like any other request, so it waits for room under MaxConcurrentDials.
+func PreconnectAllBrokers() Opt {
+	return clientOpt{func(cfg *cfg) { cfg.preconnect = true }}
+}
+
 // SASL appends sasl authentication options to use for all connections.
 //
 // SASL is tried in order; if the broker supports the first mechanism, all
@@ -522,6 +1108,39 @@ func SASL(sasls ...sasl.Mechanism) Opt {
 	return clientOpt{func(cfg *cfg) { cfg.sasls = append(cfg.sasls, sasls...) }}
 }
 
+// SASLGSSAPIUseHandshake sets whether the GSSAPI mechanism is preceded by a
+// SASLHandshakeRequest, overriding the default of false.
+//
+// By default, GSSAPI skips the handshake and writes raw Kerberos tokens, which
+// is what Kafka expects if the broker only has GSSAPI enabled. Some brokers
+// require the handshake before GSSAPI, just as with every other mechanism; if
+// this is true, GSSAPI goes through the handshake (and SASLAuthenticate, if
+// the broker supports it) like any other mechanism.
+func SASLGSSAPIUseHandshake(use bool) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.saslGSSAPIHandshake = use }}
+}
+
+// SASLHealthProbe sets the client to check every broker connection each
+// interval and reauthenticate any whose SASL session expires before the next
+// check, overriding the default of only reauthenticating when a request is
+// issued on an expired connection.
+//
+// Brokers that limit session lifetimes (KIP-368) require clients to
+// reauthenticate. Without this option, the first request after expiry pays
+// for reauthentication, and a reauthentication failure is only noticed then.
+// With this option, reauthentication happens in the background and failures
+// are logged and kill the connection, so that requests open a fresh one.
+//
+// The probe is internal and never written to brokers or passed to hooks;
+// only the reauthentication requests themselves are. Connections that the
+// broker is throttling, or that are waiting on responses, are skipped until
+// the next probe; a busy connection that expires before it is idle
+// reauthenticates on its next request as if this option were not used. This
+// option does nothing if SASL is not used.
+func SASLHealthProbe(interval time.Duration) Opt {
+	return clientOpt{func(cfg *cfg) { cfg.saslProbeInterval = interval }}
+}
+
 // WithHooks sets hooks to call whenever relevant.
 //
 // Hooks can be used to layer in metrics (such as Prometheus hooks) or anything
@@ -547,7 +1166,8 @@ type Acks struct {
 }
 
 // NoAck considers records sent as soon as they are written on the wire.
-// The leader does not reply to records.
+// The leader does not reply to records, so produced records do not have an
+// offset: their Offset is set to -1.
 func NoAck() Acks { return Acks{0} }
 
 // LeaderAck causes Kafka to reply that a record is written after only
@@ -579,6 +1199,23 @@ func BatchCompression(preference ...CompressionCodec) ProducerOpt {
 	return producerOpt{func(cfg *cfg) { cfg.compression = preference }}
 }
 
+// DowngradeUnsupportedCompression opts in to the client disabling a
+// compression codec when a broker rejects a batch because it does not support
+// that codec, and then retrying the batch with the next preferred codec (see
+// BatchCompression), or with no compression if no codecs are left.
+//
+// By default, a batch that is rejected with UNSUPPORTED_COMPRESSION_TYPE, or
+// with UNSUPPORTED_FOR_MESSAGE_FORMAT when using zstd, fails its records with
+// an *ErrUnsupportedFeature naming the codec. This option is useful when
+// producing to clusters of mixed versions, where zstd only works on some
+// brokers or topics. Disabling a codec is client wide and permanent for the
+// life of the client. Other unsupported features, such as record headers or
+// transactions on topics with an old message format, cannot be downgraded
+// and always fail.
+func DowngradeUnsupportedCompression() ProducerOpt {
+	return producerOpt{func(cfg *cfg) { cfg.downgradeCompression = true }}
+}
+
 // BatchMaxBytes upper bounds the size of a record batch, overriding the
 // default 1MB.
 //
@@ -599,6 +1236,24 @@ func BatchMaxBytes(v int32) ProducerOpt {
 	return producerOpt{func(cfg *cfg) { cfg.maxRecordBatchBytes = v }}
 }
 
+// MaxRecordBytes sets the maximum size of a single record, failing larger
+// records immediately in Produce with an *ErrRecordTooLarge rather than after
+// a produce round trip. By default, there is no per-record limit.
+//
+// This is an uncompressed limit: a record is measured as the uncompressed size
+// of a record batch containing only that record, which counts the key, value,
+// headers, and the record and batch overhead. Kafka checks a topic's
+// max.message.bytes (and the broker's message.max.bytes) against the batch as
+// it is written, after compression. Without compression, setting this to the
+// max.message.bytes of the topics being produced to fails records that the
+// broker would reject with MESSAGE_TOO_LARGE. With compression, this limit is
+// conservative: a record that compresses well may be failed here even though
+// the broker would accept it. Records larger than BatchMaxBytes always fail,
+// with kerr.MessageTooLarge, once they are partitioned.
+func MaxRecordBytes(n int32) ProducerOpt {
+	return producerOpt{func(cfg *cfg) { cfg.maxRecordBytes = n }}
+}
+
 // MaxBufferedRecords sets the max amount of records the client will buffer,
 // blocking produces until records are finished if this limit is reached.
 // This overrides the unbounded default.
@@ -612,6 +1267,77 @@ func RecordPartitioner(partitioner Partitioner) ProducerOpt {
 	return producerOpt{func(cfg *cfg) { cfg.partitioner = partitioner }}
 }
 
+// ProduceHeaderValidator sets a function to validate every produced record's
+// headers before the record is partitioned and batched. If the function
+// returns an error, the record is not produced and its promise is called with
+// that error; other records are unaffected.
+//
+// This can be used to enforce header conventions, such as rejecting
+// duplicate keys or requiring a trace ID header. The function is called
+// inline in Produce, so it should be fast. By default, headers are not
+// validated.
+func ProduceHeaderValidator(fn func([]RecordHeader) error) ProducerOpt {
+	return producerOpt{func(cfg *cfg) { cfg.headerValidator = fn }}
+}
+
+// ProducerInterceptor inspects or modifies a record before it is produced; see
+// ProducerInterceptors.
+type ProducerInterceptor func(*Record) error
+
+// ProducerInterceptors adds interceptors that are called on every produced
+// record before the record is partitioned and batched. This can be used for
+// cross cutting concerns, such as adding tracing headers or encrypting
+// values, without wrapping every call to Produce.
+//
+// Interceptors are called in order, inline in Produce, and each sees the
+// record as modified by the interceptors before it. An interceptor can modify
+// any field of the record, including its Topic. If an interceptor returns an
+// error, later interceptors are not called, the record is not produced, and
+// its promise is called with that error; other records are unaffected.
+//
+// Interceptors run before the ProduceHeaderValidator and before the record is
+// checked against MaxRecordBytes, so those see the record as intercepted.
+// Interceptors must be safe for concurrent use if Produce is called
+// concurrently. Calling this option multiple times adds to the interceptors.
+func ProducerInterceptors(interceptors ...ProducerInterceptor) ProducerOpt {
+	return producerOpt{func(cfg *cfg) { cfg.interceptors = append(cfg.interceptors, interceptors...) }}
+}
+
+// ProduceRetries sets the number of tries that a batch of records is allowed
+// when it fails with a retriable error, overriding the default of using
+// RequestRetries (which defaults to unlimited).
+//
+// Batches that fail with a retriable partition error in a produce response,
+// such as NOT_LEADER_FOR_PARTITION or LEADER_NOT_AVAILABLE, trigger a
+// metadata update and are retried once the partition's leader is known.
+// Batches that fail with a non-retriable error, such as
+// RECORD_LIST_TOO_LARGE or INVALID_REQUIRED_ACKS, fail all records in the
+// batch immediately with that error (a *kerr.Error). Once a batch has been
+// tried n times, its records fail with an error that is ErrRecordRetries (see
+// errors.Is) and that unwraps to the error from the final try.
+//
+// Retries preserve idempotent sequence numbers: a retried batch is resent
+// as is. However, failing records after exhausting retries means the
+// partition's sequence numbers must be reset, which can cause data loss or
+// reordering (see StopOnDataLoss). This is why retries are unlimited by
+// default, with RecordTimeout as the recommended bound.
+func ProduceRetries(n int) ProducerOpt {
+	return producerOpt{func(cfg *cfg) { cfg.produceRetries = n }}
+}
+
+// ProduceClientID uses id as the client ID for produce requests, overriding
+// the client-wide ClientID. By default, produce requests use their own
+// connection to each broker, and every request on that connection uses this
+// ID; see ConnectionSharing.
+//
+// Brokers enforce their produce byte rate quota on the client ID of produce
+// requests; see ConsumeClientID for how this allows independent produce and
+// consume quotas. Other requests the producer issues, such as InitProducerID
+// and transactional requests, still use the client-wide ID.
+func ProduceClientID(id string) ProducerOpt {
+	return producerOpt{func(cfg *cfg) { cfg.produceID = &id }}
+}
+
 // ProduceRequestTimeout sets how long Kafka broker's are allowed to respond to
 // produce requests, overriding the default 30s. If a broker exceeds this
 // duration, it will reply with a request timeout error.
@@ -644,6 +1370,49 @@ func OnDataLoss(fn func(string, int32)) ProducerOpt {
 	return producerOpt{func(cfg *cfg) { cfg.onDataLoss = fn }}
 }
 
+// ProduceDeadLetter sets a function to call with records that the client gave
+// up retrying: records whose batch was tried the maximum number of times (see
+// ProduceRetries), records to a topic that a metadata load failed to find, or
+// records that timed out (see RecordTimeout). The function is called with the
+// record and the error the record failed with: ErrRecordRetries for a batch
+// that exhausted its retries, which unwraps to the error from the final try
+// (such as a connection error); the metadata load's error (such as
+// UNKNOWN_TOPIC_OR_PARTITION) for an unknown topic, or
+// ErrNoPartitionsAvailable instead if RequestRetries is one or less; or
+// ErrRecordTimeout for a record that timed out. This allows routing these
+// records somewhere else, such as a dead letter topic, or persisting them.
+// Records that fail for any other reason, such as a non-retriable error or
+// the client closing, only have their promise called. Notably,
+// ErrNoPartitionsAvailable returned immediately for a known topic with no
+// writable partitions is not a dead letter.
+//
+// Failing a batch after giving up on it fails every buffered record for its
+// partition, to keep sequence numbers in order; all of these records are
+// passed to the function.
+//
+// By default, the function is called just before the record's promise is
+// called with the same error. See DeadLetterReplacesPromise to call the
+// function instead of the promise.
+//
+// The function is called where the promise would be called, which is in the
+// client's produce path: as with a slow promise, a slow function delays
+// handling of produce responses. If the function does anything slow, such
+// as producing the record again with this client, it should hand the record
+// to a separate goroutine. Once the function returns, the record is no
+// longer buffered and Flush can return; a function that hands the record
+// off must track it itself.
+func ProduceDeadLetter(fn func(*Record, error)) ProducerOpt {
+	return producerOpt{func(cfg *cfg) { cfg.deadLetter = fn }}
+}
+
+// DeadLetterReplacesPromise calls the ProduceDeadLetter function instead of
+// the record's promise for records that the client gave up retrying,
+// overriding the default of calling both. This option does nothing if there
+// is no dead letter function.
+func DeadLetterReplacesPromise() ProducerOpt {
+	return producerOpt{func(cfg *cfg) { cfg.deadLetterReplacesPromise = true }}
+}
+
 // Linger sets how long individual topic partitions will linger
 // waiting for more records before triggering a request to be built.
 //
@@ -774,23 +1543,290 @@ func FetchMaxPartitionBytes(b int32) ConsumerOpt {
 	return consumerOpt{func(cfg *cfg) { cfg.maxPartBytes = b }}
 }
 
+// MaxFetchGoroutines caps the number of fetch responses that can be processed
+// at once, overriding the default of no limit (one fetch per broker being
+// consumed from). Using a value less than one is the same as no limit.
+//
+// By default, the client concurrently fetches from every broker that leads a
+// consumed partition and processes every response as soon as it arrives,
+// which can use a lot of memory with a large assignment across many brokers
+// (see FetchMaxBytes). With a limit, responses from brokers queue until a
+// prior response is processed, trading fetch parallelism for less concurrent
+// decoding and decompression. A limit does not apply while waiting for a
+// response, since a broker holds a fetch for up to FetchMaxWait if it has no
+// data, and this would delay other brokers that do have data. A processed
+// fetch is still buffered until it is polled, so at most one fetch per broker
+// can be buffered regardless of this limit. Offset listing and epoch loading
+// requests are short lived and are not limited.
+func MaxFetchGoroutines(n int) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.maxFetchGoroutines = n }}
+}
+
+// FetchDecodeConcurrency sets the number of goroutines that can process the
+// partitions of a single fetch response at once, overriding the default of
+// one (processing partitions serially). Using a value less than two is the
+// same as the default.
+//
+// Fetch responses are read off the broker connection as raw bytes and then
+// processed outside of the connection's read loop: this parsing and
+// decompressing of record batches is what this option parallelizes. For a
+// broker that leads many partitions, processing one large response serially
+// can take a while and delays the next fetch to that broker. Every partition
+// appears once per response and is processed by one goroutine, so records
+// are still returned in order per partition.
+//
+// Each goroutine decompresses its own partitions, so processing uses up to n
+// times more transient decompression memory at once. The processed records
+// themselves use the same amount of memory regardless of this option. The
+// limit applies per fetch response: with many brokers, the total number of
+// goroutines can be n times the number of concurrent fetches (see
+// MaxFetchGoroutines).
+func FetchDecodeConcurrency(n int) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.fetchDecodeConcurrency = n }}
+}
+
+// ReuseFetchResponses pools fetch responses and decodes each new response
+// into a previously used one, reducing allocations and GC pressure when
+// fetching many partitions.
+//
+// A fetch response is returned to the pool once it has been processed into
+// the fetch that is buffered for polling. Records and everything else
+// returned from polling are copied out of or reference the raw response
+// bytes, not the response itself, so pooling does not change the lifetime
+// of anything that is polled.
+//
+// Fetch responses are never exposed to users directly, but if you issue your
+// own fetch requests with Client.Request, those responses are not pooled.
+func ReuseFetchResponses() ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.reuseFetchResps = true }}
+}
+
+// OnOffsetsLoaded sets a function to call whenever the client finishes
+// loading offsets for partitions it is consuming, either by listing offsets
+// (ListOffsets, to resolve an Offset such as the start or end of a
+// partition) or by loading leader epochs (OffsetForLeaderEpoch, to detect
+// log truncation).
+//
+// The function is called with the results of each load response after the
+// loaded offsets have been applied, meaning consuming for successfully loaded
+// partitions begins at the reported offsets. Partitions that failed with a
+// retriable error are reported and then reloaded; partitions that failed
+// with a non-retriable error are also reported through PollFetches.
+//
+// The function is called outside of any client lock, but a slow function
+// delays consuming the loaded partitions.
+func OnOffsetsLoaded(fn func(loaded []LoadedPartition)) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.onOffsetsLoaded = fn }}
+}
+
+// OnPartitionsAdded sets a function to call when a metadata update sees
+// partitions added to topics the client is consuming. The function is called
+// with the added partitions per topic, sorted.
+//
+// Direct consumers (ConsumeTopics) begin consuming the added partitions
+// before the function is called, starting at the ConsumeResetOffset.
+// Partitions added to topics consumed only with ConsumePartitions are not
+// consumed or reported. Group consumers instead rely on the group leader
+// noticing the added partitions and rebalancing; once assigned, a new
+// partition is consumed from its committed offset or, since it has none, the
+// ConsumeResetOffset. In a group, the function is called on every member that
+// sees the added partitions, whether or not the partitions are later assigned
+// to it.
+//
+// The function is called outside of any client lock, but is called inline
+// with processing the metadata update; a slow function delays the client's
+// metadata updates.
+func OnPartitionsAdded(fn func(added map[string][]int32)) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.onPartitionsAdded = fn }}
+}
+
+// OnCursorStateChange sets a function to call whenever a partition being
+// consumed transitions between cursor states; see CursorState for the states.
+// This is meant for metrics: partitions that frequently churn between usable
+// and unset signal rebalance thrashing, and partitions that frequently go back
+// to loading signal repeated offset resets or leader epoch errors.
+//
+// The function is only called when a partition's state changes. It is called
+// inline with the client's consumer processing, sometimes while holding
+// internal consumer locks, and thus must be fast and must not call back into
+// the consumer (e.g., AssignPartitions or PollFetches).
+func OnCursorStateChange(fn func(topic string, partition int32, state CursorState)) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.onCursorStateChange = fn }}
+}
+
+// OnCursorReset sets a function to call whenever the client repositions a
+// partition it is consuming: when the partition is assigned or seeked to a new
+// offset, when a fetch is out of range and the partition is reset (see
+// ConsumeResetOffset), when records being consumed were deleted, or when
+// data loss is detected. The function is passed the partition, the offset
+// the partition was at before, the offset consuming resumes at, and why the
+// partition was repositioned; see CursorResetReason.
+//
+// This is meant for observability: an unexpected reset to the end of a
+// partition silently skips records, which is otherwise only visible in debug
+// logs. Assignments that leave a partition at the offset it was already at
+// are not reported.
+//
+// The function is called inline with the client's consumer processing,
+// sometimes while holding internal consumer locks, and thus must be fast and
+// must not call back into the consumer (e.g., AssignPartitions or
+// PollFetches).
+func OnCursorReset(fn func(CursorReset)) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.onCursorReset = fn }}
+}
+
+// ConsumeClientID uses id as the client ID for fetch requests, overriding the
+// client-wide ClientID. By default, fetch requests use their own connection
+// to each broker, and every request on that connection uses this ID; see
+// ConnectionSharing.
+//
+// Kafka quotas are configured per user, per client ID, or per user and client
+// ID pair, and are tracked separately for produce bytes, fetch bytes, and
+// request time. A broker enforces its fetch byte rate quota on the client ID
+// of fetch requests, so using a distinct consume ID (and likewise a distinct
+// ProduceClientID) lets one process that both produces and consumes have
+// independent rate limits for each. Quotas for an ID are set with
+// kafka-configs.sh using --entity-type clients.
+//
+// Other requests the consumer issues, such as listing offsets and group
+// requests, still use the client-wide ID.
+func ConsumeClientID(id string) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.consumeID = &id }}
+}
+
 // ConsumeResetOffset sets the offset to restart consuming from when a
 // partition has no commits (for groups) or when a fetch sees an
 // OffsetOutOfRange error, overriding the default ConsumeStartOffset.
+//
+// If a fetch is out of range because the offset being consumed is before the
+// partition's log start offset, such as if retention deleted the records
+// while the client was down, the client also resets to this offset and
+// returns an *ErrRecordsDeleted in PollFetches to inform of the skip. With the
+// default reset offset, the client seeks to the log start offset.
 func ConsumeResetOffset(offset Offset) ConsumerOpt {
 	return consumerOpt{func(cfg *cfg) { cfg.resetOffset = offset }}
 }
 
+// DisableTruncationDetection skips truncation detection when assigning
+// partitions, which is otherwise done when consuming from an exact offset that
+// has a known leader epoch (as is the case for offsets committed by this
+// client, or offsets from NewOffset().At(..).WithEpoch(..)).
+//
+// Truncation detection issues an OffsetForLeaderEpoch request before the
+// first fetch to check whether the log was truncated past the offset being
+// consumed, such as after an unclean leader election. Disabling it avoids
+// that round trip and speeds up startup, but the epoch is ignored entirely:
+// the client begins fetching at the exact offset requested, and if the log
+// was truncated, the client does not notice and may silently skip or
+// re-consume data. Only use this option if you trust your offset storage
+// and knowingly accept losing this data loss safety net.
+func DisableTruncationDetection() ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.noTruncationDetection = true }}
+}
+
 // Rack specifies where the client is physically located and changes fetch
 // requests to consume from the closest replica as opposed to the leader
 // replica.
 //
 // Consuming from a preferred replica can increase latency but can decrease
 // cross datacenter costs. See KIP-392 for more information.
+//
+// The rack is also sent to other group members if using the
+// RackLeaderBalancer.
 func Rack(rack string) ConsumerOpt {
 	return consumerOpt{func(cfg *cfg) { cfg.rack = rack }}
 }
 
+// FetchFollowerTopics restricts consuming from the closest replica (see Rack)
+// to only the given topics. All other topics are always listed and fetched
+// from the partition leader.
+//
+// This allows trading freshness for latency per topic: topics that benefit
+// from rack local reads can opt in, while topics that must always see the
+// latest data read from the leader. This option has no effect if Rack is not
+// also used. By default, if Rack is used, all topics may be consumed from
+// followers.
+func FetchFollowerTopics(topics ...string) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) {
+		cfg.followerTopics = make(map[string]struct{}, len(topics))
+		for _, topic := range topics {
+			cfg.followerTopics[topic] = struct{}{}
+		}
+	}}
+}
+
+// FetchPreferredReplicaLease sets how long the client fetches a partition from
+// a preferred replica (see Rack) before returning to the partition leader,
+// overriding the default of the metadata max age (see MetadataMaxAge).
+//
+// The broker may change which replica it prefers, such as after replicas are
+// reassigned or a rack's replica falls behind. Once a partition's lease
+// expires, the client drops the next response from the preferred replica and
+// fetches from the leader again, which either replies with records or points
+// the client to a new preferred replica. Without a lease, the client would
+// keep fetching from a stale follower until that follower returned an error.
+func FetchPreferredReplicaLease(lease time.Duration) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.followerLease = lease }}
+}
+
+// canFetchFollower returns whether a topic can be listed or fetched from a
+// follower replica.
+func (cfg *cfg) canFetchFollower(topic string) bool {
+	if cfg.rack == "" {
+		return false
+	}
+	if cfg.followerTopics == nil {
+		return true
+	}
+	_, ok := cfg.followerTopics[topic]
+	return ok
+}
+
+// RestrictFetchToBrokers restricts fetching to partitions whose leaders are
+// one of the given broker node IDs, which is meant for testing or operating
+// in partitioned networks by simulating partial connectivity. Calling this
+// with no node IDs allows all brokers, which is the default.
+//
+// Partitions whose leaders are not allowed are not fetched and their offsets
+// are not listed or validated; the client does not issue fetch, ListOffsets,
+// or OffsetForLeaderEpoch requests to brokers outside the allowed set. The
+// first time a consumed partition is skipped, ErrFetchRestricted is injected
+// in a fake fetch for the partition. Partitions that are skipped become
+// consumable again once their leader moves to an allowed broker, which the
+// client checks on every metadata update. Preferred replicas outside of the
+// allowed set are ignored, and the partition is fetched from its leader.
+func RestrictFetchToBrokers(nodeIDs ...int32) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) {
+		cfg.fetchBrokers = nil
+		if len(nodeIDs) == 0 {
+			return
+		}
+		cfg.fetchBrokers = make(map[int32]struct{}, len(nodeIDs))
+		for _, id := range nodeIDs {
+			cfg.fetchBrokers[id] = struct{}{}
+		}
+	}}
+}
+
+// canFetchBroker returns whether fetch related requests can be issued to a
+// broker; see RestrictFetchToBrokers.
+func (cfg *cfg) canFetchBroker(nodeID int32) bool {
+	if cfg.fetchBrokers == nil {
+		return true
+	}
+	_, ok := cfg.fetchBrokers[nodeID]
+	return ok
+}
+
+// preferredReplicaLease returns how long a cursor fetches from a preferred
+// replica before returning to the leader.
+func (cfg *cfg) preferredReplicaLease() time.Duration {
+	if cfg.followerLease > 0 {
+		return cfg.followerLease
+	}
+	return cfg.metadataMaxAge
+}
+
 // IsolationLevel controls whether uncommitted or only committed records are
 // returned from fetch requests.
 type IsolationLevel struct {
@@ -817,3 +1853,122 @@ func FetchIsolationLevel(level IsolationLevel) ConsumerOpt {
 func KeepControlRecords() ConsumerOpt {
 	return consumerOpt{func(cfg *cfg) { cfg.keepControl = true }}
 }
+
+// FetchTimestampClamp sets the client to clamp the timestamps of fetched
+// records that are more than max ahead of the client's clock to the current
+// time, overriding the default of returning timestamps as they were produced.
+//
+// Producers with skewed clocks can write records with timestamps far in the
+// future, which can break time based consumption and windowing. A clamped
+// record keeps the timestamp it was produced with in OriginalTimestamp, so
+// nothing is lost and clamped records can be identified. A max of zero
+// clamps any timestamp that is ahead of the client's clock.
+func FetchTimestampClamp(max time.Duration) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.timestampClamp = max; cfg.clampTimestamps = true }}
+}
+
+// ConsumerInterceptor inspects or modifies a fetched record before it is
+// returned from a poll, returning whether to keep the record; see
+// ConsumerInterceptors.
+type ConsumerInterceptor func(*Record) bool
+
+// ConsumerInterceptors adds interceptors that are called on every fetched
+// record before the record is buffered to be returned from a poll. This is
+// the consumer counterpart to ProducerInterceptors and can be used to decrypt
+// values or tag records for tracing and metrics consistently.
+//
+// Interceptors are called in order, and each sees the record as modified by
+// the interceptors before it. If an interceptor returns false, later
+// interceptors are not called and the record is dropped: it is not returned
+// from a poll, but the partition's offset still advances past it, so this
+// client does not fetch it again while it continues consuming the partition.
+// Dropped records are not counted in FetchPartitionStats.
+//
+// Since a dropped record is never polled, it is also not committed. For group
+// consumers, commits only cover records that were polled: if the client
+// restarts, or a rebalance moves the partition, before a record after the
+// dropped one is committed, consuming resumes from the last commit and the
+// dropped record is fetched and passed to the interceptors again.
+//
+// Interceptors are only called on records that would otherwise be returned;
+// they are not called on records in aborted transactions, on control records
+// (unless using KeepControlRecords), or for partitions that only have an
+// error. Interceptors are called while processing fetch responses, which can
+// be concurrent across partitions with FetchDecodeConcurrency, so they must
+// be safe for concurrent use. Calling this option multiple times adds to the
+// interceptors.
+func ConsumerInterceptors(interceptors ...ConsumerInterceptor) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.consumerInterceptors = append(cfg.consumerInterceptors, interceptors...) }}
+}
+
+// MissingPartitionGracePeriod treats consumed partitions that disappear from
+// metadata for longer than grace as deleted, overriding the default of
+// waiting forever for them to come back.
+//
+// A partition is considered missing if a metadata response says its topic
+// does not exist (UNKNOWN_TOPIC_OR_PARTITION), if its topic is absent from a
+// metadata response that listed all topics (regex consuming), or if its topic
+// now has fewer partitions. Other errors, such as the leader not being
+// available, are not counted as missing. Missing partitions are only checked
+// on metadata refreshes, so a partition is declared deleted on the first
+// refresh after the grace period has elapsed; a grace of zero declares a
+// partition deleted as soon as it is seen missing.
+//
+// When a partition assigned to this client is declared deleted, the client
+// stops consuming it and injects a fake fetch with ErrPartitionDeleted so that
+// PollFetches surfaces the deletion. Group members only report partitions in
+// their own assignment. The partition is not consumed again until it is
+// reassigned. If a partition reappears before the grace period elapses, it
+// continues to be consumed as normal.
+//
+// Transient controller or broker hiccups can briefly report topics as
+// missing, so a grace period of at least a few metadata refreshes is
+// recommended.
+func MissingPartitionGracePeriod(grace time.Duration) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.missingFatal, cfg.missingGrace = true, grace }}
+}
+
+// WarnOnUnderReplicated sets the client to log a warning when a consumed
+// partition has fewer than min in sync replicas, or fewer than min replicas
+// if useReplicas is true, overriding the default of not checking.
+//
+// A partition with a single replica, or a single in sync replica, has no
+// redundancy: losing the broker leading it loses data. Checking the in sync
+// replicas (with a min of 2) detects partitions that are currently one broker
+// failure from data loss, while checking the replicas detects topics that were
+// created without redundancy at all.
+//
+// Partitions are checked whenever metadata is updated, and only partitions
+// that are being consumed are checked. A partition is warned about once when
+// it is first seen under replicated, and an info log is emitted once it
+// recovers.
+func WarnOnUnderReplicated(min int, useReplicas bool) ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.underReplicatedMin, cfg.underReplicatedReplicas = min, useReplicas }}
+}
+
+// RedeliverPartitionErrorsUntilSeeked keeps fatal partition errors (data loss
+// or auth failures, which are returned in fake fetches) pending until the
+// affected partition is seeked or reassigned, rather than returning them from
+// only one poll.
+//
+// By default, these errors are returned once. If the application dies or
+// panics while processing the poll that contained the error, the error is
+// lost and the partition can silently remain stuck.
+//
+// Errors that have already been returned do not cause PollFetches to return
+// early; they are only returned again alongside whatever a later poll
+// returns.
+func RedeliverPartitionErrorsUntilSeeked() ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.redeliverPartitionErrs = true }}
+}
+
+// PanicOnConcurrentPoll makes PollFetches and PollFetchesBytes panic with
+// ErrConcurrentPoll if they are called while another poll is still running.
+//
+// By default, a concurrent poll returns immediately with ErrConcurrentPoll
+// as a fetch error with no topic and partition -1. Polling must be done from
+// a single goroutine; panicking surfaces a violation at the offending call
+// rather than wherever the returned error is eventually inspected.
+func PanicOnConcurrentPoll() ConsumerOpt {
+	return consumerOpt{func(cfg *cfg) { cfg.panicOnConcurrentPoll = true }}
+}
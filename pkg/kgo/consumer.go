@@ -2,8 +2,11 @@ package kgo
 
 import (
 	"context"
+	"errors"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kmsg"
@@ -15,6 +18,7 @@ type Offset struct {
 	relative     int64
 	epoch        int32
 	currentEpoch int32 // set by us when mapping offsets to brokers
+	stop         int64 // non-positive means no stop
 }
 
 // NewOffsetcreates and returns an offset to use in AssignPartitions.
@@ -77,6 +81,25 @@ func (o Offset) At(at int64) Offset {
 	return o
 }
 
+// StopAt returns a copy of the calling offset, changing the returned offset to
+// stop consuming once the partition reaches the given offset. Records at or
+// past the stop offset are never returned from PollFetches, and once a
+// partition reaches its stop offset, it is no longer fetched.
+//
+// Once every assigned partition has reached its stop offset, the channel
+// returned from ConsumeComplete is closed. This allows for batch style
+// consumption over a fixed range, e.g. NewOffset().At(100).StopAt(200)
+// consumes offsets 100 thru 199.
+//
+// A stop offset of zero or less means no stop, which is the default.
+func (o Offset) StopAt(offset int64) Offset {
+	if offset < 0 {
+		offset = 0
+	}
+	o.stop = offset
+	return o
+}
+
 type consumerType uint8
 
 const (
@@ -108,6 +131,67 @@ type consumer struct {
 	sourcesReadyForDraining []*source
 	fakeReadyForDraining    []Fetch
 
+	// pollsClosed is set under sourcesReadyMu once the client is closed
+	// and its final consumer session has stopped. After this, no more fake
+	// fetches can be added and polls stop waiting for fetches.
+	pollsClosed bool
+
+	// pollCanceled is set under sourcesReadyMu by CancelPoll and is
+	// cleared once a poll returns because of it.
+	pollCanceled bool
+
+	// pausedFetching is set atomically by PauseFetching and cleared by
+	// ResumeFetching. It is only changed under sourcesReadyMu so that a
+	// waiting poll sees the change.
+	pausedFetching int32
+
+	// polling is swapped to one for the duration of a poll, so that a
+	// concurrent poll is detected rather than racing on the fields above.
+	polling int32
+
+	// fetchThrottled is set atomically when a fetch response is throttled
+	// and is swapped back to zero when polling; see Fetches.WasThrottled.
+	fetchThrottled uint32
+
+	// progressMu guards progress, which is updated in every fetch; see
+	// Client.ConsumerProgress.
+	progressMu sync.Mutex
+	progress   ConsumerProgress
+
+	// fetchSem, if non-nil, limits the number of fetch responses that
+	// are processed at once to its capacity; see MaxFetchGoroutines.
+	fetchSem chan struct{}
+
+	// fetchResps pools fetch responses to decode into if
+	// ReuseFetchResponses is enabled.
+	fetchResps sync.Pool
+
+	// If redelivering partition errors, fake fetch errors that have been
+	// returned from a poll stay here until the partition is seeked or
+	// reassigned. These are guarded by sourcesReadyMu.
+	polls           uint64
+	pendingFakeErrs map[string]map[int32]pendingFakeErr
+
+	// restrictedMu guards partitions that have been reported as restricted
+	// with ErrFetchRestricted, so that we only report each once until the
+	// partition becomes fetchable again; see RestrictFetchToBrokers.
+	restrictedMu sync.Mutex
+	restricted   map[string]map[int32]struct{}
+
+	// stopMu guards tracking partitions that were assigned with a stop
+	// offset, which is used to signal ConsumeComplete.
+	stopMu        sync.Mutex
+	stopPending   map[string]map[int32]struct{} // bounded partitions that have not reached their stop
+	stopBounded   bool                          // whether any assigned partition has a stop
+	stopUnbounded bool                          // whether any assigned partition has no stop
+	stopDone      chan struct{}                 // closed once all bounded partitions are done
+	stopClosed    bool
+
+	// concurrentMu guards the ConsumeConcurrently call in progress, if
+	// any, which stops processing partitions the group revokes or loses.
+	concurrentMu sync.Mutex
+	concurrent   *concurrentConsumer
+
 	// dead is set when the client closes; this being true means that any
 	// Assign does nothing (aside from unassigning everything prior).
 	dead bool
@@ -134,6 +218,255 @@ func (c *consumer) unset() {
 	c.group = nil
 }
 
+// ConsumeComplete returns a channel that is closed once every assigned
+// partition has reached its stop offset (see Offset.StopAt). If any assigned
+// partition has no stop offset, the channel is never closed.
+//
+// Assigning new partitions after the channel has been closed does not reopen
+// the returned channel, but invalidating all assignments (for example,
+// assigning anew with AssignPartitions) resets tracking, and ConsumeComplete
+// returns a new channel.
+func (cl *Client) ConsumeComplete() <-chan struct{} {
+	c := &cl.consumer
+	c.stopMu.Lock()
+	defer c.stopMu.Unlock()
+	return c.stopDone
+}
+
+// PartitionFetchStats is cumulative fetch statistics for a partition since it
+// was assigned.
+type PartitionFetchStats struct {
+	// Fetches is the number of fetch responses that contained this
+	// partition, including responses with no records.
+	Fetches int64
+	// Records is the number of records fetched, not including control
+	// records or records from aborted transactions that were dropped.
+	Records int64
+	// Bytes is the number of record batch bytes fetched, before
+	// decompression.
+	Bytes int64
+}
+
+// FetchPartitionStats returns cumulative fetch statistics for every assigned
+// partition that has been in at least one fetch response since it was
+// assigned. This can be used to find the partitions driving the most fetch
+// load, which consumer lag alone does not show.
+//
+// Stats are counted when a fetch response is buffered, not when it is polled,
+// and stats for a partition are reset when the partition is unassigned.
+// Stats are kept through leader changes and follower fetching.
+func (cl *Client) FetchPartitionStats() map[string]map[int32]PartitionFetchStats {
+	stats := make(map[string]map[int32]PartitionFetchStats)
+	for topic, topicPartitions := range cl.loadTopics() {
+		for _, partition := range topicPartitions.load().partitions {
+			stat := partition.cursor.stats.load()
+			if stat.Fetches == 0 {
+				continue
+			}
+			partStats := stats[topic]
+			if partStats == nil {
+				partStats = make(map[int32]PartitionFetchStats)
+				stats[topic] = partStats
+			}
+			partStats[partition.cursor.partition] = stat
+		}
+	}
+	return stats
+}
+
+// BufferStat is the data buffered for a partition, fetched but not yet polled.
+type BufferStat struct {
+	// Records is the number of buffered records.
+	Records int64
+	// Bytes is the size of the buffered records' keys, values, and
+	// headers, which is the same size PollFetchesBytes uses.
+	Bytes int64
+}
+
+// BufferedFetchStats returns the records and bytes that are buffered for each
+// partition, having been fetched but not yet returned from a poll. Partitions
+// with nothing buffered are not included.
+//
+// The client buffers at most one fetch response per broker, and does not
+// fetch from a broker again until its buffered fetch is polled. Buffered data
+// that keeps growing, or that is always near the fetch limits (FetchMaxBytes,
+// FetchMaxPartitionBytes), indicates that processing is not keeping up with
+// fetching; PollFetchesBytes can bound how much is taken per poll.
+func (cl *Client) BufferedFetchStats() map[string]map[int32]BufferStat {
+	c := &cl.consumer
+	c.sourcesReadyMu.Lock()
+	defer c.sourcesReadyMu.Unlock()
+
+	stats := make(map[string]map[int32]BufferStat)
+	for _, ready := range c.sourcesReadyForDraining {
+		for _, t := range ready.buffered.fetch.Topics {
+			for _, p := range t.Partitions {
+				if len(p.Records) == 0 {
+					continue
+				}
+				partStats := stats[t.Topic]
+				if partStats == nil {
+					partStats = make(map[int32]BufferStat)
+					stats[t.Topic] = partStats
+				}
+				stat := partStats[p.Partition]
+				for _, r := range p.Records {
+					stat.Records++
+					stat.Bytes += int64(recordBytes(r))
+				}
+				partStats[p.Partition] = stat
+			}
+		}
+	}
+	return stats
+}
+
+// ConsumerProgress is when the client last fetched, as returned from
+// Client.ConsumerProgress.
+type ConsumerProgress struct {
+	// LastFetchAttempt is when the client last issued a fetch request,
+	// or the zero time if the client has not yet fetched.
+	LastFetchAttempt time.Time
+
+	// LastNonEmptyFetch is when the client last buffered a fetch
+	// response containing records, or the zero time if no fetch has yet
+	// contained records.
+	LastNonEmptyFetch time.Time
+}
+
+// ConsumerProgress returns when the client last issued a fetch and when a
+// fetch last contained records. This allows a watchdog to tell the difference
+// between a consumer that is idle but healthy (it is caught up, and fetches
+// are being issued but return no records) and a consumer that is stuck (no
+// fetches are being issued at all).
+//
+// An idle consumer issues a fetch at least once every FetchMaxWait while it
+// has partitions to consume. Fetches are not issued while a fetched response
+// is buffered waiting to be polled, or while the client is paused.
+func (cl *Client) ConsumerProgress() ConsumerProgress {
+	c := &cl.consumer
+	c.progressMu.Lock()
+	defer c.progressMu.Unlock()
+	return c.progress
+}
+
+// acquireFetchSem waits for a slot to process a fetch response if fetches are
+// limited, returning false if ctx is canceled first.
+func (c *consumer) acquireFetchSem(ctx context.Context) bool {
+	if c.fetchSem == nil {
+		return true
+	}
+	select {
+	case c.fetchSem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseFetchSem releases a slot acquired with acquireFetchSem.
+func (c *consumer) releaseFetchSem() {
+	if c.fetchSem != nil {
+		<-c.fetchSem
+	}
+}
+
+// trackFetchIssued records that a fetch request was just issued.
+func (c *consumer) trackFetchIssued() {
+	now := c.cl.cfg.clock.Now()
+	c.progressMu.Lock()
+	defer c.progressMu.Unlock()
+	c.progress.LastFetchAttempt = now
+}
+
+// trackFetchBuffered records that a fetch response was just buffered, if it
+// contains records.
+func (c *consumer) trackFetchBuffered(f Fetch) {
+	for i := range f.Topics {
+		for j := range f.Topics[i].Partitions {
+			if len(f.Topics[i].Partitions[j].Records) > 0 {
+				now := c.cl.cfg.clock.Now()
+				c.progressMu.Lock()
+				defer c.progressMu.Unlock()
+				c.progress.LastNonEmptyFetch = now
+				return
+			}
+		}
+	}
+}
+
+// trackStops, called under the consumer mu from assignPartitions, updates
+// which partitions have stop offsets that must be reached before consuming is
+// complete.
+func (c *consumer) trackStops(assignments map[string]map[int32]Offset, how assignHow) {
+	c.stopMu.Lock()
+	defer c.stopMu.Unlock()
+
+	switch how {
+	case assignInvalidateAll:
+		c.stopPending = nil
+		c.stopBounded = false
+		c.stopUnbounded = false
+		if c.stopClosed {
+			c.stopDone = make(chan struct{})
+			c.stopClosed = false
+		}
+
+	case assignInvalidateMatching:
+		for topic, partitions := range assignments {
+			for partition := range partitions {
+				c.deleteStopPendingLocked(topic, partition)
+			}
+		}
+
+	case assignWithoutInvalidating:
+		for topic, partitions := range assignments {
+			for partition, offset := range partitions {
+				if offset.stop <= 0 {
+					c.stopUnbounded = true
+					continue
+				}
+				c.stopBounded = true
+				if c.stopPending == nil {
+					c.stopPending = make(map[string]map[int32]struct{})
+				}
+				topicPending := c.stopPending[topic]
+				if topicPending == nil {
+					topicPending = make(map[int32]struct{})
+					c.stopPending[topic] = topicPending
+				}
+				topicPending[partition] = struct{}{}
+			}
+		}
+	}
+
+	c.maybeCloseStopDoneLocked()
+}
+
+// stopReached is called when a cursor reaches its stop offset.
+func (c *consumer) stopReached(topic string, partition int32) {
+	c.stopMu.Lock()
+	defer c.stopMu.Unlock()
+	c.deleteStopPendingLocked(topic, partition)
+	c.maybeCloseStopDoneLocked()
+}
+
+func (c *consumer) deleteStopPendingLocked(topic string, partition int32) {
+	topicPending := c.stopPending[topic]
+	delete(topicPending, partition)
+	if len(topicPending) == 0 {
+		delete(c.stopPending, topic)
+	}
+}
+
+func (c *consumer) maybeCloseStopDoneLocked() {
+	if c.stopClosed || !c.stopBounded || c.stopUnbounded || len(c.stopPending) > 0 {
+		return
+	}
+	close(c.stopDone)
+	c.stopClosed = true
+}
+
 // addSourceReadyForDraining tracks that a source needs its buffered fetch
 // consumed.
 func (c *consumer) addSourceReadyForDraining(source *source) {
@@ -147,36 +480,209 @@ func (c *consumer) addSourceReadyForDraining(source *source) {
 // errors--data loss or auth failures.
 func (c *consumer) addFakeReadyForDraining(topic string, partition int32, err error) {
 	c.sourcesReadyMu.Lock()
-	c.fakeReadyForDraining = append(c.fakeReadyForDraining, Fetch{Topics: []FetchTopic{{
+	c.fakeReadyForDraining = append(c.fakeReadyForDraining, fakeFetch(topic, partition, err))
+	c.sourcesReadyMu.Unlock()
+	c.sourcesReadyCond.Broadcast()
+}
+
+// trackRestricted tracks whether a partition is restricted from fetching by
+// RestrictFetchToBrokers, injecting ErrFetchRestricted the first time it is.
+func (c *consumer) trackRestricted(topic string, partition int32, restricted bool) {
+	c.restrictedMu.Lock()
+	defer c.restrictedMu.Unlock()
+
+	_, reported := c.restricted[topic][partition]
+	switch {
+	case restricted && !reported:
+		if c.restricted == nil {
+			c.restricted = make(map[string]map[int32]struct{})
+		}
+		if c.restricted[topic] == nil {
+			c.restricted[topic] = make(map[int32]struct{})
+		}
+		c.restricted[topic][partition] = struct{}{}
+		c.cl.cfg.logger.Log(LogLevelInfo, "not fetching partition whose leader is not an allowed fetch broker", "topic", topic, "partition", partition)
+		c.addFakeReadyForDraining(topic, partition, ErrFetchRestricted)
+	case !restricted && reported:
+		delete(c.restricted[topic], partition)
+		if len(c.restricted[topic]) == 0 {
+			delete(c.restricted, topic)
+		}
+	}
+}
+
+func fakeFetch(topic string, partition int32, err error) Fetch {
+	return Fetch{Topics: []FetchTopic{{
 		Topic: topic,
 		Partitions: []FetchPartition{{
 			Partition: partition,
 			Err:       err,
 		}},
-	}}})
-	c.sourcesReadyMu.Unlock()
-	c.sourcesReadyCond.Broadcast()
+	}}}
+}
+
+// pendingFakeErr is a fake fetch error that was returned from a poll and is
+// redelivered until its partition is seeked or reassigned.
+type pendingFakeErr struct {
+	err  error
+	poll uint64 // the poll that first returned this error
+}
+
+// trackPendingFakeErrsLocked, called under sourcesReadyMu, saves fake fetches
+// that are being returned from the given poll for redelivery.
+func (c *consumer) trackPendingFakeErrsLocked(fakes []Fetch, poll uint64) {
+	for _, fake := range fakes {
+		topic, partition := fake.Topics[0].Topic, fake.Topics[0].Partitions[0]
+		if c.pendingFakeErrs == nil {
+			c.pendingFakeErrs = make(map[string]map[int32]pendingFakeErr)
+		}
+		topicPending := c.pendingFakeErrs[topic]
+		if topicPending == nil {
+			topicPending = make(map[int32]pendingFakeErr)
+			c.pendingFakeErrs[topic] = topicPending
+		}
+		topicPending[partition.Partition] = pendingFakeErr{partition.Err, poll}
+	}
+}
+
+// appendRedelivered appends all pending fake fetch errors that were returned
+// from a poll before the given poll, sorted by topic and partition.
+func (c *consumer) appendRedelivered(fetches Fetches, poll uint64) Fetches {
+	c.sourcesReadyMu.Lock()
+	defer c.sourcesReadyMu.Unlock()
+	var redelivered Fetches
+	for topic, partitions := range c.pendingFakeErrs {
+		for partition, pending := range partitions {
+			if pending.poll < poll {
+				redelivered = append(redelivered, fakeFetch(topic, partition, pending.err))
+			}
+		}
+	}
+	sort.Slice(redelivered, func(i, j int) bool {
+		l, r := redelivered[i].Topics[0], redelivered[j].Topics[0]
+		if l.Topic != r.Topic {
+			return l.Topic < r.Topic
+		}
+		return l.Partitions[0].Partition < r.Partitions[0].Partition
+	})
+	return append(fetches, redelivered...)
+}
+
+// clearPendingFakeErrs stops redelivering errors for partitions that are
+// being seeked or reassigned.
+func (c *consumer) clearPendingFakeErrs(assignments map[string]map[int32]Offset, how assignHow) {
+	c.sourcesReadyMu.Lock()
+	defer c.sourcesReadyMu.Unlock()
+	if how == assignInvalidateAll {
+		c.pendingFakeErrs = nil
+		return
+	}
+	for topic, partitions := range assignments {
+		topicPending := c.pendingFakeErrs[topic]
+		for partition := range partitions {
+			delete(topicPending, partition)
+		}
+		if len(topicPending) == 0 {
+			delete(c.pendingFakeErrs, topic)
+		}
+	}
 }
 
 // PollFetches waits for fetches to be available, returning as soon as any
-// broker returns a fetch. If the ctx quits, this function quits.
+// broker returns a fetch. If the ctx quits or CancelPoll is called, this
+// function quits.
 //
 // It is important to check all partition errors in the returned fetches. If
 // any partition has a fatal error and actually had no records, fake fetch will
-// be injected with the error.
+// be injected with the error. See RedeliverPartitionErrorsUntilSeeked to have
+// these errors returned until the partition is seeked or reassigned.
+//
+// Injected errors, such as ErrDataLoss, are kept until they are polled. When
+// partitions are reassigned or seeked, buffered records are discarded, but
+// injected errors are not: they are returned from the next poll. Closing the
+// client is the same: any error injected before Close returns can be retrieved
+// with a final PollFetches after Close. Once the client is closed, PollFetches
+// no longer waits and returns immediately, with the remaining injected errors
+// if there are any and ErrClientClosed as a fetch error with no topic and
+// partition -1 (see Fetches.IsClientClosed). A PollFetches that is waiting
+// when the client closes is woken up.
 //
-// It is invalid to call this multiple times concurrently.
+// Polling must be done from a single goroutine. A poll that is called while
+// another is still running returns immediately with ErrConcurrentPoll as a
+// fetch error with no topic and partition -1, or panics if
+// PanicOnConcurrentPoll is used. To process records from multiple goroutines,
+// see ConsumeConcurrently.
 func (cl *Client) PollFetches(ctx context.Context) Fetches {
+	return cl.pollFetches(ctx, 0)
+}
+
+// PollFetchesBytes is the same as PollFetches, but returns at most maxBytes of
+// records, leaving the rest buffered for the next poll. The size of a record is
+// the length of its key, value, and header keys and values. If maxBytes is zero
+// or negative, this is the same as PollFetches.
+//
+// A partition's buffered records may be split across polls, but individual
+// records are never split. If the first record available is larger than
+// maxBytes, it is returned on its own, so that a large record does not stall
+// polling. Partitions with no records, such as those with only an error, are
+// always returned. A partition is not fetched again until all of its buffered
+// records have been polled.
+//
+// This bounds how much memory a single poll hands to processing; to bound how
+// much the client buffers, see FetchMaxBytes and FetchMaxPartitionBytes.
+//
+// Like PollFetches, this must not be called concurrently with itself or with
+// PollFetches.
+func (cl *Client) PollFetchesBytes(ctx context.Context, maxBytes int) Fetches {
+	return cl.pollFetches(ctx, maxBytes)
+}
+
+func (cl *Client) pollFetches(ctx context.Context, maxBytes int) Fetches {
 	c := &cl.consumer
 
+	if !atomic.CompareAndSwapInt32(&c.polling, 0, 1) {
+		if cl.cfg.panicOnConcurrentPoll {
+			panic(ErrConcurrentPoll)
+		}
+		return Fetches{fakeFetch("", -1, ErrConcurrentPoll)}
+	}
+	defer atomic.StoreInt32(&c.polling, 0)
+
+	redeliver := cl.cfg.redeliverPartitionErrs
+	var poll uint64
+	if redeliver {
+		c.sourcesReadyMu.Lock()
+		c.polls++
+		poll = c.polls
+		c.sourcesReadyMu.Unlock()
+	}
+
 	var fetches Fetches
 	fill := func() {
 		c.sourcesReadyMu.Lock()
 		defer c.sourcesReadyMu.Unlock()
-		for _, ready := range c.sourcesReadyForDraining {
-			fetches = append(fetches, ready.takeBuffered())
+		switch {
+		case c.isFetchingPaused():
+			// Buffered fetches stay buffered until ResumeFetching.
+		case maxBytes <= 0:
+			for _, ready := range c.sourcesReadyForDraining {
+				fetches = append(fetches, ready.takeBuffered())
+			}
+			c.sourcesReadyForDraining = nil
+		default:
+			b := &pollBytes{left: maxBytes}
+			var undrained []*source
+			for _, ready := range c.sourcesReadyForDraining {
+				fetch, drained := ready.takeBufferedBytes(b)
+				if len(fetch.Topics) > 0 {
+					fetches = append(fetches, fetch)
+				}
+				if !drained {
+					undrained = append(undrained, ready)
+				}
+			}
+			c.sourcesReadyForDraining = undrained
 		}
-		c.sourcesReadyForDraining = nil
 
 		// Before returning, we want to update our uncommitted. If we
 		// updated after, then we could end up with weird interactions
@@ -197,12 +703,23 @@ func (cl *Client) PollFetches(ctx context.Context) Fetches {
 		c.mu.Unlock()
 
 		fetches = append(fetches, c.fakeReadyForDraining...)
+		if redeliver {
+			c.trackPendingFakeErrsLocked(c.fakeReadyForDraining, poll)
+		}
 		c.fakeReadyForDraining = nil
+
+		// A poll that returns without waiting satisfies any cancel.
+		if len(fetches) > 0 {
+			c.pollCanceled = false
+		}
 	}
 
 	fill()
 	if len(fetches) > 0 {
-		return fetches
+		if redeliver {
+			fetches = c.appendRedelivered(fetches, poll)
+		}
+		return c.appendPollState(fetches)
 	}
 
 	done := make(chan struct{})
@@ -212,9 +729,10 @@ func (cl *Client) PollFetches(ctx context.Context) Fetches {
 		defer c.sourcesReadyMu.Unlock()
 		defer close(done)
 
-		for !quit && len(c.sourcesReadyForDraining) == 0 {
+		for !quit && !c.pollsClosed && !c.pollCanceled && (len(c.sourcesReadyForDraining) == 0 || c.isFetchingPaused()) && len(c.fakeReadyForDraining) == 0 {
 			c.sourcesReadyCond.Wait()
 		}
+		c.pollCanceled = false
 	}()
 
 	select {
@@ -227,6 +745,88 @@ func (cl *Client) PollFetches(ctx context.Context) Fetches {
 	}
 
 	fill()
+	if redeliver {
+		fetches = c.appendRedelivered(fetches, poll)
+	}
+	return c.appendPollState(fetches)
+}
+
+// PauseFetching pauses consuming every partition until ResumeFetching is
+// called, without unassigning anything. This is an emergency stop for
+// consuming, such as for when a downstream system is unavailable, that does
+// not require knowing what is assigned.
+//
+// While paused, no fetch requests are issued, and PollFetches does not return
+// records: a poll waits as if nothing is buffered, returning only injected
+// errors (such as ErrDataLoss). Records from fetches that were buffered or in
+// flight when pausing stay buffered, and every partition keeps its position,
+// so resuming continues from exactly where polling left off. Group
+// heartbeats and commits continue as normal, and producing is unaffected.
+//
+// This is independent from Pause, which stops both fetching and producing:
+// fetching only begins again once the client is neither paused nor paused
+// with PauseFetching. Partitions are reported as CursorPaused to
+// OnCursorStateChange while paused with either.
+func (cl *Client) PauseFetching() {
+	c := &cl.consumer
+	c.sourcesReadyMu.Lock()
+	atomic.StoreInt32(&c.pausedFetching, 1)
+	c.sourcesReadyMu.Unlock()
+	cl.refreshPausedCursors()
+}
+
+// ResumeFetching resumes consuming after PauseFetching. Any records that were
+// buffered while paused are returned from the next poll.
+func (cl *Client) ResumeFetching() {
+	c := &cl.consumer
+	c.sourcesReadyMu.Lock()
+	resumed := atomic.SwapInt32(&c.pausedFetching, 0) == 1
+	c.sourcesReadyMu.Unlock()
+	if !resumed {
+		return
+	}
+	c.sourcesReadyCond.Broadcast()
+	cl.refreshPausedCursors()
+
+	cl.sinksAndSourcesMu.Lock()
+	defer cl.sinksAndSourcesMu.Unlock()
+	for _, sns := range cl.sinksAndSources {
+		sns.source.maybeConsume()
+	}
+}
+
+func (c *consumer) isFetchingPaused() bool {
+	return atomic.LoadInt32(&c.pausedFetching) == 1
+}
+
+// CancelPoll wakes up a PollFetches that is waiting for fetches, causing it to
+// return whatever is buffered, which may be nothing. If no poll is waiting, the
+// next PollFetches returns immediately. This allows a goroutine other than the
+// poll loop to interrupt the loop without canceling the poll's context, such
+// as to reconfigure consuming.
+//
+// Multiple cancels before a poll returns are the same as one.
+func (cl *Client) CancelPoll() {
+	c := &cl.consumer
+	c.sourcesReadyMu.Lock()
+	c.pollCanceled = true
+	c.sourcesReadyMu.Unlock()
+	c.sourcesReadyCond.Broadcast()
+}
+
+// appendPollState appends a fetch with no topics and Throttled set if a fetch
+// was throttled since the last poll, and a fake fetch with ErrClientClosed if
+// the client is closed.
+func (c *consumer) appendPollState(fetches Fetches) Fetches {
+	if atomic.SwapUint32(&c.fetchThrottled, 0) == 1 {
+		fetches = append(fetches, Fetch{Throttled: true})
+	}
+	c.sourcesReadyMu.Lock()
+	closed := c.pollsClosed
+	c.sourcesReadyMu.Unlock()
+	if closed {
+		fetches = append(fetches, fakeFetch("", -1, ErrClientClosed))
+	}
 	return fetches
 }
 
@@ -281,6 +881,9 @@ func (c *consumer) assignPartitions(assignments map[string]map[int32]Offset, how
 		loadOffsets.loadWithSessionNow(session)
 	}()
 
+	c.trackStops(assignments, how)
+	c.clearPendingFakeErrs(assignments, how)
+
 	if how == assignWithoutInvalidating {
 		session = c.guardSessionChange()
 		defer c.unguardSessionChange()
@@ -304,10 +907,12 @@ func (c *consumer) assignPartitions(assignments map[string]map[int32]Offset, how
 							usedCursor.unset()
 							shouldKeep = false
 						} else { // how == assignSetMatching
+							old := usedCursor.offset
 							usedCursor.setOffset(cursorOffset{
 								offset:            assignPart.at,
 								lastConsumedEpoch: assignPart.epoch,
 							})
+							c.cursorReset(usedCursor, old, CursorResetAssigned)
 						}
 					}
 				}
@@ -368,12 +973,24 @@ func (c *consumer) assignPartitions(assignments map[string]map[int32]Offset, how
 				offset.relative = 0
 			}
 
+			// If we know of this partition, we set its stop now;
+			// otherwise, the stop is set when its offset loads.
+			if partition >= 0 && partition < int32(len(topicParts.partitions)) {
+				topicParts.partitions[partition].cursor.setStopOffset(offset.stop)
+			}
+
 			// If we are requesting an exact offset with an epoch,
 			// we do truncation detection and then use the offset.
 			//
 			// Otherwise, an epoch is specified without an exact
 			// request which is useless for us, or a request is
 			// specified without a known epoch.
+			//
+			// If the user disabled truncation detection, we ignore
+			// the epoch and use the exact offset as is.
+			if c.cl.cfg.noTruncationDetection {
+				offset.epoch = -1
+			}
 			if offset.at >= 0 && offset.epoch >= 0 {
 				loadOffsets.addLoad(topic, partition, loadTypeEpoch, offsetLoad{
 					replica: -1,
@@ -392,11 +1009,14 @@ func (c *consumer) assignPartitions(assignments map[string]map[int32]Offset, how
 			if offset.at >= 0 && partition >= 0 && partition < int32(len(topicParts.partitions)) {
 				part := topicParts.partitions[partition]
 				cursor := part.cursor
+				old := cursor.offset
 				cursor.setOffset(cursorOffset{
 					offset:            offset.at,
 					lastConsumedEpoch: part.leaderEpoch,
 				})
+				c.cursorReset(cursor, old, CursorResetAssigned)
 				cursor.allowUsable()
+				cursor.setState(CursorUsable)
 				c.usingCursors.use(cursor)
 				continue
 			}
@@ -409,20 +1029,135 @@ func (c *consumer) assignPartitions(assignments map[string]map[int32]Offset, how
 	}
 }
 
+// consumingTopic returns whether the consumer is consuming or is configured to
+// consume a topic. This must be called under the consumer mu.
+func (c *consumer) consumingTopic(topic string) bool {
+	for cursor := range c.usingCursors {
+		if cursor.topic == topic {
+			return true
+		}
+	}
+	switch c.typ {
+	case consumerTypeDirect:
+		d := c.direct
+		_, inTopics := d.topics[topic]
+		_, inPartitions := d.partitions[topic]
+		_, inReTopics := d.reTopics[topic]
+		_, inUsing := d.using[topic]
+		return inTopics || inPartitions || inReTopics || inUsing
+	case consumerTypeGroup:
+		g := c.group
+		if _, ok := g.topics[topic]; ok {
+			return true
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		_, inUsing := g.using[topic]
+		return inUsing
+	}
+	return false
+}
+
+// stopDeletedPartitions stops consuming partitions that were declared
+// deleted via MissingPartitionGracePeriod, injecting ErrPartitionDeleted for
+// every partition we were assigned. Partitions assigned to other group
+// members are left for those members to report.
+func (c *consumer) stopDeletedPartitions(deleted map[string][]int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stop := make(map[string]map[int32]Offset)
+	for topic, partitions := range deleted {
+		for _, partition := range partitions {
+			var consuming bool
+			switch c.typ {
+			case consumerTypeDirect:
+				_, consuming = c.direct.using[topic][partition]
+			case consumerTypeGroup:
+				c.group.mu.Lock()
+				for _, assigned := range c.group.nowAssigned[topic] {
+					if assigned == partition {
+						consuming = true
+						break
+					}
+				}
+				c.group.mu.Unlock()
+			}
+			if !consuming {
+				continue
+			}
+			if stop[topic] == nil {
+				stop[topic] = make(map[int32]Offset)
+			}
+			stop[topic][partition] = Offset{}
+		}
+	}
+	if len(stop) == 0 {
+		return
+	}
+
+	c.cl.cfg.logger.Log(LogLevelWarn, "partitions missing from metadata past the grace period, stopping consuming them", "partitions", deleted)
+	c.assignPartitions(stop, assignInvalidateMatching)
+	for topic, partitions := range stop {
+		for partition := range partitions {
+			c.addFakeReadyForDraining(topic, partition, ErrPartitionDeleted)
+		}
+	}
+}
+
+// resetForFailover drops our current offsets after the client fails over to
+// another cluster, since offsets are not comparable across clusters.
+//
+// Direct consumers reset every partition they consume to the reset offset.
+// Group consumers only stop fetching; rejoining the group on the new cluster
+// assigns partitions again at the offsets committed there.
+func (c *consumer) resetForFailover() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.typ {
+	case consumerTypeDirect:
+		assignments := make(map[string]map[int32]Offset)
+		for topic, partitions := range c.direct.using {
+			resets := make(map[int32]Offset, len(partitions))
+			for partition := range partitions {
+				resets[partition] = c.cl.cfg.resetOffset
+			}
+			assignments[topic] = resets
+		}
+		c.assignPartitions(assignments, assignInvalidateAll)
+	case consumerTypeGroup:
+		c.assignPartitions(nil, assignInvalidateAll)
+	}
+}
+
 func (c *consumer) doOnMetadataUpdate() {
+	added := c.findNewAssignments()
+	if fn := c.cl.cfg.onPartitionsAdded; fn != nil && len(added) > 0 {
+		fn(added)
+	}
+}
+
+// findNewAssignments looks for new partitions to consume after a metadata
+// update, returning the partitions that were added to topics we were already
+// consuming.
+func (c *consumer) findNewAssignments() (added map[string][]int32) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	switch c.typ {
 	case consumerTypeUnset:
-		return
+		return nil
 	case consumerTypeDirect:
-		c.assignPartitions(c.direct.findNewAssignments(c.cl.loadTopics()), assignWithoutInvalidating)
+		var assignments map[string]map[int32]Offset
+		assignments, added = c.direct.findNewAssignments(c.cl.loadTopics(), c.cl.cfg.resetOffset)
+		c.assignPartitions(assignments, assignWithoutInvalidating)
 	case consumerTypeGroup:
-		c.group.findNewAssignments(c.cl.loadTopics())
+		added = c.group.findNewAssignments(c.cl.loadTopics())
 	}
 
 	go c.loadSession().doOnMetadataUpdate()
+	return added
 }
 
 func (s *consumerSession) doOnMetadataUpdate() {
@@ -447,10 +1182,29 @@ func (s *consumerSession) doOnMetadataUpdate() {
 type offsetLoad struct {
 	replica int32 // -1 means leader
 	Offset
+
+	// If outOfRange, a fetch at outOfRangeAt failed with OffsetOutOfRange
+	// and this load lists the start offset to see if we are before it.
+	outOfRange   bool
+	outOfRangeAt int64
+
+	// If resetting, this loads the reset offset after an out of range
+	// load. If deleted, the out of range load found that we were before
+	// the log start offset, and outOfRangeAt is kept to report the skip.
+	resetting bool
+	deleted   bool
 }
 
 type offsetLoadMap map[string]map[int32]offsetLoad
 
+// errResetOffset and errResetDeleted are used when an out of range offset load
+// finds that we were past the end or before the start of a partition and we
+// need to reload with the reset offset.
+var (
+	errResetOffset  = errors.New("offset out of range past the end; resetting")
+	errResetDeleted = errors.New("offset out of range before the start; resetting")
+)
+
 func (o offsetLoadMap) errToLoaded(err error) []loadedOffset {
 	var loaded []loadedOffset
 	for t, ps := range o {
@@ -718,7 +1472,8 @@ func (c *consumer) stopSession() listOrEpochLoads {
 
 	// At this point, we have invalidated any buffered data from the prior
 	// session. We leave any fake things that were ready so that the user
-	// can act on errors. The session is dead.
+	// can act on errors, even if this session is stopping because the
+	// client is closing. The session is dead.
 
 	session.listOrEpochLoadsWaiting.mergeFrom(session.listOrEpochLoadsLoading)
 	return session.listOrEpochLoadsWaiting
@@ -781,7 +1536,16 @@ func (s *consumerSession) listOrEpoch(waiting listOrEpochLoads, immediate bool)
 	s.listOrEpochMetaCh = nil
 	s.listOrEpochMu.Unlock()
 
-	brokerLoads := s.mapLoadsToBrokers(loading)
+	brokerLoads, restricted := s.mapLoadsToBrokers(loading)
+
+	// Loads for partitions led by brokers we cannot fetch from wait for
+	// a metadata update to see if their leaders move.
+	if !restricted.isEmpty() {
+		s.listOrEpochMu.Lock()
+		restricted.each(s.listOrEpochLoadsLoading.removeLoad)
+		s.listOrEpochMu.Unlock()
+		restricted.loadWithSession(s)
+	}
 
 	results := make(chan loadedOffsets, 2*len(brokerLoads)) // each broker can receive up to two requests
 
@@ -815,7 +1579,10 @@ func (s *consumerSession) listOrEpoch(waiting listOrEpochLoads, immediate bool)
 // Called within a consumer session, this function handles results from list
 // offsets or epoch loads.
 func (s *consumerSession) handleListOrEpochResults(loaded loadedOffsets) {
-	var reloads listOrEpochLoads
+	var (
+		reloads   listOrEpochLoads
+		reloadNow bool
+	)
 	defer func() {
 		// When we are done handling results, we have finished loading
 		// all the topics and partitions. We remove them from tracking
@@ -826,41 +1593,93 @@ func (s *consumerSession) handleListOrEpochResults(loaded loadedOffsets) {
 		}
 		s.listOrEpochMu.Unlock()
 
-		reloads.loadWithSession(s)
+		if reloadNow {
+			reloads.loadWithSessionNow(s)
+		} else {
+			reloads.loadWithSession(s)
+		}
 	}()
 
 	for _, load := range loaded.loaded {
-		use := func() {
+		use := func(reason CursorResetReason) {
+			if load.request.stop > 0 {
+				load.cursor.setStopOffset(load.request.stop)
+			}
+			old := load.cursor.offset
 			load.cursor.setOffset(cursorOffset{
 				offset:            load.offset,
 				lastConsumedEpoch: load.leaderEpoch,
 			})
+			s.c.cursorReset(load.cursor, old, reason)
 			load.cursor.allowUsable()
+			load.cursor.setState(CursorUsable)
 			s.c.usingCursors.use(load.cursor)
 		}
 
+		if load.err == errResetOffset || load.err == errResetDeleted {
+			reloads.addLoad(load.topic, load.partition, loadTypeList, offsetLoad{
+				replica:      load.request.replica,
+				Offset:       s.c.cl.cfg.resetOffset,
+				outOfRangeAt: load.request.outOfRangeAt,
+				resetting:    true,
+				deleted:      load.err == errResetDeleted,
+			})
+			continue
+		}
+
+		// If the broker fenced our epoch (ours is stale) or does not
+		// know our epoch (ours is newer), leadership is moving. Our
+		// load uses the epoch from our metadata, so we refresh now
+		// rather than waiting for the next regular update; the reload
+		// picks up the epoch from the refreshed metadata.
+		if load.err == kerr.FencedLeaderEpoch || load.err == kerr.UnknownLeaderEpoch {
+			reloadNow = true
+			reloads.addLoad(load.topic, load.partition, loaded.loadType, load.request)
+			continue
+		}
+
 		switch load.err.(type) {
 		case *ErrDataLoss:
-			s.c.addFakeReadyForDraining(load.topic, load.partition, load.err) // signal we lost data, but set the cursor to what we can
-			use()
+			s.c.addFakeReadyForDraining(load.topic, load.partition, load.err) // signal the skip, but set the cursor to what we can
+			use(CursorResetDataLoss)
+
+		case *ErrRecordsDeleted:
+			s.c.addFakeReadyForDraining(load.topic, load.partition, load.err)
+			use(CursorResetRecordsDeleted)
 
 		case nil:
-			use()
+			if load.request.resetting {
+				use(CursorResetOutOfRange)
+			} else {
+				use(CursorResetAssigned)
+			}
 
 		default: // from ErrorCode in a response
-			if !kerr.IsRetriable(load.err) { // non-retriable response error; signal such in a response
+			// If our session is stopping, the request likely failed
+			// because it was canceled. We do not inject that as a
+			// fake error; we reload, and the stop keeps the load for
+			// the next session.
+			if !kerr.IsRetriable(load.err) && s.ctx.Err() == nil { // non-retriable response error; signal such in a response
 				s.c.addFakeReadyForDraining(load.topic, load.partition, load.err)
 				continue
 			}
 			reloads.addLoad(load.topic, load.partition, loaded.loadType, load.request)
 		}
 	}
+
+	if fn := s.c.cl.cfg.onOffsetsLoaded; fn != nil {
+		if public := loaded.public(); len(public) > 0 {
+			fn(public)
+		}
+	}
 }
 
 // Splits the loads into per-broker loads, mapping each partition to the broker
-// that leads that partition.
-func (s *consumerSession) mapLoadsToBrokers(loads listOrEpochLoads) map[*broker]listOrEpochLoads {
+// that leads that partition. Loads for partitions on brokers that we cannot
+// fetch from (see RestrictFetchToBrokers) are returned separately.
+func (s *consumerSession) mapLoadsToBrokers(loads listOrEpochLoads) (map[*broker]listOrEpochLoads, listOrEpochLoads) {
 	brokerLoads := make(map[*broker]listOrEpochLoads)
+	var restricted listOrEpochLoads
 
 	s.c.cl.brokersMu.RLock() // hold mu so we can check if partition leaders exist
 	defer s.c.cl.brokersMu.RUnlock()
@@ -888,7 +1707,7 @@ func (s *consumerSession) mapLoadsToBrokers(loads listOrEpochLoads) map[*broker]
 				if partition >= 0 && partition < int32(len(topicPartitions.partitions)) {
 					topicPartition := topicPartitions.partitions[partition]
 					brokerID := topicPartition.leader
-					if offset.replica != -1 {
+					if offset.replica != -1 && s.c.cl.cfg.canFetchFollower(topic) {
 						// If we are fetching from a follower, we can list
 						// offsets against the follower itself. The replica
 						// being non-negative signals that.
@@ -897,7 +1716,13 @@ func (s *consumerSession) mapLoadsToBrokers(loads listOrEpochLoads) map[*broker]
 					if tryBroker := brokers[brokerID]; tryBroker != nil {
 						broker = tryBroker
 					}
+					if broker != seed && !s.c.cl.cfg.canFetchBroker(brokerID) {
+						s.c.trackRestricted(topic, partition, true)
+						restricted.addLoad(topic, partition, loads.loadType, offset)
+						continue
+					}
 					offset.currentEpoch = topicPartition.leaderEpoch // ensure we set our latest epoch for the partition
+					topicPartition.cursor.setState(CursorLoading)
 				}
 
 				brokerLoad := brokerLoads[broker]
@@ -907,7 +1732,7 @@ func (s *consumerSession) mapLoadsToBrokers(loads listOrEpochLoads) map[*broker]
 		}
 	}
 
-	return brokerLoads
+	return brokerLoads, restricted
 }
 
 // The result of ListOffsets or OffsetForLeaderEpoch for an individual
@@ -938,6 +1763,119 @@ type loadedOffsets struct {
 	loadType listOrEpochLoadType
 }
 
+// public converts loaded offsets for OnOffsetsLoaded.
+func (l loadedOffsets) public() []LoadedPartition {
+	ps := make([]LoadedPartition, 0, len(l.loaded))
+	for _, load := range l.loaded {
+		if load.err == errResetOffset || load.err == errResetDeleted {
+			continue // not loaded yet; we reload with the reset offset
+		}
+		ps = append(ps, LoadedPartition{
+			Topic:       load.topic,
+			Partition:   load.partition,
+			EpochLoad:   l.loadType == loadTypeEpoch,
+			Offset:      load.offset,
+			LeaderEpoch: load.leaderEpoch,
+			Err:         load.err,
+		})
+	}
+	return ps
+}
+
+// CursorResetReason is why the client repositioned a partition's cursor, as
+// reported to the function set with OnCursorReset.
+type CursorResetReason uint8
+
+const (
+	// CursorResetAssigned is a partition that was assigned or set to an
+	// offset, either directly (AssignPartitions, SetOffsets) or through a
+	// group assignment resuming at a committed offset.
+	CursorResetAssigned CursorResetReason = iota
+	// CursorResetOutOfRange is a partition whose fetch offset was past
+	// the end of the partition and was reset to the ConsumeResetOffset.
+	CursorResetOutOfRange
+	// CursorResetRecordsDeleted is a partition whose fetch offset was
+	// before the partition's log start offset, such as if retention
+	// deleted the records, and was reset to the ConsumeResetOffset.
+	CursorResetRecordsDeleted
+	// CursorResetDataLoss is a partition whose log was truncated past the
+	// offset being consumed and was moved to where the log now ends.
+	CursorResetDataLoss
+)
+
+func (r CursorResetReason) String() string {
+	switch r {
+	case CursorResetAssigned:
+		return "ASSIGNED"
+	case CursorResetOutOfRange:
+		return "OUT_OF_RANGE"
+	case CursorResetRecordsDeleted:
+		return "RECORDS_DELETED"
+	case CursorResetDataLoss:
+		return "DATA_LOSS"
+	}
+	return "UNKNOWN"
+}
+
+// CursorReset is a partition that the client repositioned, as passed to the
+// function set with OnCursorReset.
+type CursorReset struct {
+	// Topic and Partition are the partition that was repositioned.
+	Topic     string
+	Partition int32
+
+	// OldOffset is the offset the partition was at before being
+	// repositioned, or -1 if the partition was not being consumed.
+	OldOffset int64
+	// NewOffset is the offset that consuming resumes at.
+	NewOffset int64
+
+	// Reason is why the partition was repositioned.
+	Reason CursorResetReason
+}
+
+// cursorReset reports a cursor that was set to its current offset from old to
+// OnCursorReset, if set. Assignments that do not move the cursor are not
+// reported.
+func (c *consumer) cursorReset(cursor *cursor, old int64, reason CursorResetReason) {
+	fn := c.cl.cfg.onCursorReset
+	if fn == nil || reason == CursorResetAssigned && old == cursor.offset {
+		return
+	}
+	fn(CursorReset{
+		Topic:     cursor.topic,
+		Partition: cursor.partition,
+		OldOffset: old,
+		NewOffset: cursor.offset,
+		Reason:    reason,
+	})
+}
+
+// LoadedPartition is the result of loading an offset for a partition, as
+// passed to the function set with OnOffsetsLoaded.
+type LoadedPartition struct {
+	// Topic and Partition are the partition that was loaded.
+	Topic     string
+	Partition int32
+
+	// EpochLoad is true if this was a leader epoch load to detect log
+	// truncation (OffsetForLeaderEpoch), and false if this was an offset
+	// list (ListOffsets).
+	EpochLoad bool
+
+	// Offset and LeaderEpoch are the offset that consuming resumes at and
+	// the leader epoch of that offset. These may be unset if Err is
+	// non-nil and is not an *ErrDataLoss or *ErrRecordsDeleted.
+	Offset      int64
+	LeaderEpoch int32
+
+	// Err is any error encountered loading this partition. An
+	// *ErrDataLoss means that the epoch load detected truncation, and an
+	// *ErrRecordsDeleted means that the records being consumed were
+	// deleted; the partition resumes at Offset regardless.
+	Err error
+}
+
 func (l *loadedOffsets) add(a loadedOffset) { l.loaded = append(l.loaded, a) }
 func (l *loadedOffsets) addAll(as []loadedOffset) loadedOffsets {
 	l.loaded = append(l.loaded, as...)
@@ -969,6 +1907,13 @@ func (cl *Client) listOffsetsForBrokerLoad(ctx context.Context, broker *broker,
 			}
 
 			if err := kerr.ErrorForCode(rPartition.ErrorCode); err != nil {
+				// We remove the partition from what remains to be
+				// loaded so that it is not also failed below as
+				// unknown, which would reload it twice.
+				delete(loadParts, partition)
+				if len(loadParts) == 0 {
+					delete(load, topic)
+				}
 				loaded.add(loadedOffset{
 					topic:     topic,
 					partition: partition,
@@ -993,19 +1938,44 @@ func (cl *Client) listOffsetsForBrokerLoad(ctx context.Context, broker *broker,
 			if len(rPartition.OldStyleOffsets) > 0 { // if we have any, we used list offsets v0
 				offset = rPartition.OldStyleOffsets[0] + loadPart.relative
 			}
+			start := offset - loadPart.relative
 			if loadPart.at >= 0 {
 				offset = loadPart.at + loadPart.relative // we obey exact requests, even if they end up past the end
 			}
+			if loadPart.at == -2 && offset < start {
+				offset = start // relative to the start cannot go before the start
+			}
 			if offset < 0 {
 				offset = 0
 			}
 
+			var err error
+			if loadPart.outOfRange {
+				// If we were not before the start, we were past
+				// the end: we reset with the reset offset. If we
+				// were before the start, we seek to the start we
+				// just listed if that is our reset offset, and
+				// otherwise we also reset with the reset offset.
+				reset := cl.cfg.resetOffset
+				switch {
+				case loadPart.outOfRangeAt >= start:
+					err = errResetOffset
+				case reset.at != -2 || reset.relative != 0:
+					err = errResetDeleted
+				default:
+					err = &ErrRecordsDeleted{topic, partition, loadPart.outOfRangeAt, start}
+				}
+			} else if loadPart.deleted {
+				err = &ErrRecordsDeleted{topic, partition, loadPart.outOfRangeAt, offset}
+			}
+
 			loaded.add(loadedOffset{
 				topic:       topic,
 				partition:   partition,
 				cursor:      topicPartition.cursor,
 				offset:      offset,
 				leaderEpoch: rPartition.LeaderEpoch,
+				err:         err,
 				request:     loadPart,
 			})
 		}
@@ -1044,6 +2014,13 @@ func (cl *Client) loadEpochsForBrokerLoad(ctx context.Context, broker *broker, l
 			}
 
 			if err := kerr.ErrorForCode(rPartition.ErrorCode); err != nil {
+				// We remove the partition from what remains to be
+				// loaded so that it is not also failed below as
+				// unknown, which would reload it twice.
+				delete(loadParts, partition)
+				if len(loadParts) == 0 {
+					delete(load, topic)
+				}
 				loaded.add(loadedOffset{
 					topic:     topic,
 					partition: partition,
@@ -1067,8 +2044,8 @@ func (cl *Client) loadEpochsForBrokerLoad(ctx context.Context, broker *broker, l
 			offset := loadPart.at
 			var err error
 			if rPartition.EndOffset < offset {
-				offset = rPartition.EndOffset
 				err = &ErrDataLoss{topic, partition, offset, rPartition.EndOffset}
+				offset = rPartition.EndOffset
 			}
 
 			loaded.add(loadedOffset{
@@ -0,0 +1,478 @@
+package kgo
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// ProcessErrPolicy is what ConsumeConcurrently does when processing a record
+// returns an error.
+type ProcessErrPolicy int8
+
+const (
+	// ProcessErrStop stops processing and returns the first error. Records
+	// already being processed finish, and every record that was not yet
+	// processed is skipped.
+	ProcessErrStop ProcessErrPolicy = iota
+
+	// ProcessErrSkip logs the error at the warn level and continues
+	// processing. The record that failed is committed as if it was
+	// processed, meaning it is not consumed again.
+	ProcessErrSkip
+)
+
+// maxConcurrentQueued is how many polled batches of records can be waiting
+// to be processed for any one partition before ConsumeConcurrently stops
+// polling.
+const maxConcurrentQueued = 4
+
+// ConsumeConcurrently polls in a single goroutine and processes the polled
+// records with up to parallelism goroutines, returning once ctx is canceled,
+// the client is closed, or processing fails under ProcessErrStop. Because
+// polling must be done from a single goroutine, this is the built in way to
+// process records concurrently.
+//
+// Every partition has its own long lived worker, which processes the
+// partition's records in order, one at a time; at most parallelism workers
+// process records at once. If parallelism is less than one, records are
+// processed one at a time. Polling continues while workers process, so a slow
+// partition does not hold up the others: polled records queue behind the
+// partition's worker. To bound memory, polling waits while any one partition
+// has four polls of records waiting, until its worker catches up.
+//
+// If fn returns an error, the policy decides whether to stop or to skip the
+// record and continue; see ProcessErrStop and ProcessErrSkip. Records that
+// are skipped because of stopping are not redelivered by the client; they
+// are only consumed again once the client restarts from its committed
+// offsets.
+//
+// When consuming as a group, the offsets of records that were processed are
+// committed after every poll and when returning. Commit failures, which are
+// expected if a commit races a rebalance, are logged and the records are
+// processed again by whichever member consumes the partition next. Because
+// autocommitting commits what has been polled rather than what has been
+// processed, this returns ErrConcurrentAutoCommit unless the group is
+// consumed with DisableAutoCommit.
+//
+// When the group revokes partitions, records of those partitions that are
+// waiting to be processed are dropped, and the revoke waits for the records
+// being processed to finish and commits what was processed before OnRevoked
+// is called. Lost partitions are dropped the same way, but nothing is
+// committed, since another member may already own them. Dropped records are
+// consumed again by whichever member is assigned the partitions next.
+//
+// Partition errors in polled fetches are logged at the warn level and are
+// otherwise ignored, as the client continues consuming where it can. If ctx
+// is canceled, ctx.Err() is returned; if the client is closed, this returns
+// nil. A call concurrent with another poll returns ErrConcurrentPoll.
+func (cl *Client) ConsumeConcurrently(ctx context.Context, parallelism int, policy ProcessErrPolicy, fn func(*Record) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	c := &cl.consumer
+	c.mu.Lock()
+	autocommit := c.typ == consumerTypeGroup && !c.group.autocommitDisable
+	c.mu.Unlock()
+	if autocommit {
+		return ErrConcurrentAutoCommit
+	}
+
+	cc := &concurrentConsumer{
+		cl:      cl,
+		policy:  policy,
+		fn:      fn,
+		sem:     make(chan struct{}, parallelism),
+		drained: make(chan struct{}, 1),
+		workers: make(map[string]map[int32]*partitionWorker),
+	}
+	cc.ctx, cc.cancel = context.WithCancel(ctx)
+	defer cc.cancel()
+
+	c.concurrentMu.Lock()
+	if c.concurrent != nil {
+		c.concurrentMu.Unlock()
+		return ErrConcurrentPoll
+	}
+	c.concurrent = cc
+	c.concurrentMu.Unlock()
+	defer func() {
+		c.concurrentMu.Lock()
+		c.concurrent = nil
+		c.concurrentMu.Unlock()
+	}()
+
+	err := cc.poll(ctx)
+	cc.cancel()
+	cc.wg.Wait()
+	cc.pollMu.Lock()
+	cl.commitProcessed(cc.takeProcessed(nil))
+	cc.pollMu.Unlock()
+
+	if cc.err != nil {
+		return cc.err
+	}
+	return err
+}
+
+// concurrentConsumer dispatches polled records to per partition workers; see
+// ConsumeConcurrently.
+type concurrentConsumer struct {
+	cl     *Client
+	policy ProcessErrPolicy
+	fn     func(*Record) error
+
+	// ctx is canceled once we are stopping, which quits polling and
+	// stops every worker after the record it is processing.
+	ctx    context.Context
+	cancel func()
+
+	sem     chan struct{} // a slot per worker that can process at once
+	drained chan struct{} // signaled when a worker takes a queued batch
+	wg      sync.WaitGroup
+
+	// pollMu is held from every poll through dispatching and committing
+	// what it returned. Revoking partitions grabs it so that records
+	// polled before the revoke are dispatched before they are dropped,
+	// and so that we do not commit revoked partitions concurrently.
+	pollMu sync.Mutex
+
+	mu        sync.Mutex
+	workers   map[string]map[int32]*partitionWorker
+	processed map[string]map[int32]EpochOffset // since the last commit
+	err       error                            // the error we stopped for
+}
+
+// partitionWorker processes the records of one partition in order.
+type partitionWorker struct {
+	topic     string
+	partition int32
+
+	queued [][]*Record   // guarded by the concurrentConsumer mu
+	wake   chan struct{} // signaled when records are queued
+	quit   chan struct{} // closed when the partition is revoked or lost
+	done   chan struct{} // closed once the worker returns
+}
+
+// poll polls until ctx is canceled, the client is closed, or we stop,
+// dispatching records to workers and committing what was processed after
+// every poll.
+func (cc *concurrentConsumer) poll(ctx context.Context) error {
+	for {
+		if !cc.waitQueueRoom() {
+			return ctx.Err()
+		}
+		if quit, err := cc.pollOnce(); quit {
+			return err
+		}
+		if err := cc.ctx.Err(); err != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// pollOnce polls once, dispatching the polled records and committing what
+// was processed, returning whether we should quit and with what error.
+func (cc *concurrentConsumer) pollOnce() (bool, error) {
+	cc.pollMu.Lock()
+	defer cc.pollMu.Unlock()
+
+	fetches := cc.cl.PollFetches(cc.ctx)
+	for _, fe := range fetches.Errors() {
+		switch {
+		case errors.Is(fe.Err, ErrConcurrentPoll):
+			return true, fe.Err
+		case cc.isQuitErr(fe.Err):
+		default:
+			cc.cl.cfg.logger.Log(LogLevelWarn, "consuming concurrently skipping fetch error", "topic", fe.Topic, "partition", fe.Partition, "err", fe.Err)
+		}
+	}
+
+	for _, f := range fetches {
+		for _, ft := range f.Topics {
+			for _, fp := range ft.Partitions {
+				if len(fp.Records) > 0 {
+					cc.dispatch(ft.Topic, fp.Partition, fp.Records)
+				}
+			}
+		}
+	}
+	cc.cl.commitProcessed(cc.takeProcessed(nil))
+
+	return fetches.IsClientClosed(), nil
+}
+
+// isQuitErr returns whether a fetch error is only from our poll being canceled
+// or the client closing, which is not worth logging.
+func (cc *concurrentConsumer) isQuitErr(err error) bool {
+	if err == ErrClientClosed {
+		return true
+	}
+	if ctxErr := cc.ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		return true
+	}
+	if clErr := cc.cl.ctx.Err(); clErr != nil && errors.Is(err, clErr) {
+		return true
+	}
+	return false
+}
+
+// waitQueueRoom waits until no partition has a full queue, returning false if
+// we are stopping first.
+func (cc *concurrentConsumer) waitQueueRoom() bool {
+	for {
+		cc.mu.Lock()
+		full := false
+		for _, ws := range cc.workers {
+			for _, w := range ws {
+				full = full || len(w.queued) >= maxConcurrentQueued
+			}
+		}
+		cc.mu.Unlock()
+		if !full {
+			return cc.ctx.Err() == nil
+		}
+
+		select {
+		case <-cc.drained:
+		case <-cc.ctx.Done():
+			return false
+		}
+	}
+}
+
+// dispatch queues records for their partition's worker, starting the worker
+// if this is the first time we have seen the partition.
+func (cc *concurrentConsumer) dispatch(topic string, partition int32, records []*Record) {
+	cc.mu.Lock()
+	ws := cc.workers[topic]
+	if ws == nil {
+		ws = make(map[int32]*partitionWorker)
+		cc.workers[topic] = ws
+	}
+	w := ws[partition]
+	if w == nil {
+		w = &partitionWorker{
+			topic:     topic,
+			partition: partition,
+			wake:      make(chan struct{}, 1),
+			quit:      make(chan struct{}),
+			done:      make(chan struct{}),
+		}
+		ws[partition] = w
+		cc.wg.Add(1)
+		go cc.work(w)
+	}
+	w.queued = append(w.queued, records)
+	cc.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work processes a partition's queued records until we stop or the partition
+// is revoked or lost.
+func (cc *concurrentConsumer) work(w *partitionWorker) {
+	defer cc.wg.Done()
+	defer close(w.done)
+	for {
+		select {
+		case <-w.wake:
+		case <-w.quit:
+			return
+		case <-cc.ctx.Done():
+			return
+		}
+		for {
+			cc.mu.Lock()
+			if len(w.queued) == 0 {
+				cc.mu.Unlock()
+				break
+			}
+			records := w.queued[0]
+			w.queued[0] = nil
+			w.queued = w.queued[1:]
+			cc.mu.Unlock()
+
+			select {
+			case cc.drained <- struct{}{}:
+			default:
+			}
+
+			if !cc.process(w, records) {
+				return
+			}
+		}
+	}
+}
+
+// process processes a batch of records in order, returning false if we are
+// stopping or the partition was revoked or lost.
+func (cc *concurrentConsumer) process(w *partitionWorker, records []*Record) bool {
+	select {
+	case cc.sem <- struct{}{}:
+	case <-w.quit:
+		return false
+	case <-cc.ctx.Done():
+		return false
+	}
+	defer func() { <-cc.sem }()
+
+	for _, r := range records {
+		select {
+		case <-w.quit:
+			return false
+		case <-cc.ctx.Done():
+			return false
+		default:
+		}
+		if err := cc.fn(r); err != nil {
+			if cc.policy != ProcessErrSkip {
+				cc.stop(err)
+				return false
+			}
+			cc.cl.cfg.logger.Log(LogLevelWarn, "consuming concurrently skipping record that failed processing", "topic", r.Topic, "partition", r.Partition, "offset", r.Offset, "err", err)
+		}
+
+		cc.mu.Lock()
+		if cc.processed == nil {
+			cc.processed = make(map[string]map[int32]EpochOffset)
+		}
+		tprocessed := cc.processed[w.topic]
+		if tprocessed == nil {
+			tprocessed = make(map[int32]EpochOffset)
+			cc.processed[w.topic] = tprocessed
+		}
+		tprocessed[w.partition] = EpochOffset{r.LeaderEpoch, r.Offset + 1}
+		cc.mu.Unlock()
+	}
+	return true
+}
+
+// stop saves the first processing error and stops consuming.
+func (cc *concurrentConsumer) stop(err error) {
+	cc.mu.Lock()
+	if cc.err == nil {
+		cc.err = err
+	}
+	cc.mu.Unlock()
+	cc.cancel()
+}
+
+// takeProcessed returns the offsets processed since they were last taken,
+// for only the given partitions if partitions is non-nil.
+func (cc *concurrentConsumer) takeProcessed(partitions map[string][]int32) map[string]map[int32]EpochOffset {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if partitions == nil {
+		processed := cc.processed
+		cc.processed = nil
+		return processed
+	}
+
+	var processed map[string]map[int32]EpochOffset
+	for topic, ps := range partitions {
+		tprocessed := cc.processed[topic]
+		for _, p := range ps {
+			eo, exists := tprocessed[p]
+			if !exists {
+				continue
+			}
+			delete(tprocessed, p)
+			if processed == nil {
+				processed = make(map[string]map[int32]EpochOffset)
+			}
+			if processed[topic] == nil {
+				processed[topic] = make(map[int32]EpochOffset)
+			}
+			processed[topic][p] = eo
+		}
+		if tprocessed != nil && len(tprocessed) == 0 {
+			delete(cc.processed, topic)
+		}
+	}
+	return processed
+}
+
+// revoke stops processing partitions that the group is revoking or lost. We
+// wake any poll so that records polled before the revoke are dispatched, drop
+// what is queued, and wait for the records being processed to finish. If
+// revoking, what was processed is committed; if lost, it is dropped.
+func (cc *concurrentConsumer) revoke(partitions map[string][]int32, commit bool) {
+	cc.cl.CancelPoll()
+	cc.pollMu.Lock()
+	defer cc.pollMu.Unlock()
+
+	var stopped []*partitionWorker
+	cc.mu.Lock()
+	for topic, ps := range partitions {
+		ws := cc.workers[topic]
+		for _, p := range ps {
+			w := ws[p]
+			if w == nil {
+				continue
+			}
+			delete(ws, p)
+			w.queued = nil
+			close(w.quit)
+			stopped = append(stopped, w)
+		}
+		if ws != nil && len(ws) == 0 {
+			delete(cc.workers, topic)
+		}
+	}
+	cc.mu.Unlock()
+
+	// Dropping queued records may have made room to poll again.
+	select {
+	case cc.drained <- struct{}{}:
+	default:
+	}
+
+	for _, w := range stopped {
+		<-w.done
+	}
+	processed := cc.takeProcessed(partitions)
+	if commit {
+		cc.cl.commitProcessed(processed)
+	}
+}
+
+// revokeConcurrent stops ConsumeConcurrently, if it is running, from
+// processing partitions that the group is revoking or lost; see
+// concurrentConsumer.revoke.
+func (c *consumer) revokeConcurrent(partitions map[string][]int32, commit bool) {
+	c.concurrentMu.Lock()
+	cc := c.concurrent
+	c.concurrentMu.Unlock()
+	if cc != nil && len(partitions) > 0 {
+		cc.revoke(partitions, commit)
+	}
+}
+
+// commitProcessed synchronously commits offsets for processed records if
+// consuming as a group.
+func (cl *Client) commitProcessed(processed map[string]map[int32]EpochOffset) {
+	if len(processed) == 0 {
+		return
+	}
+	done := make(chan struct{})
+	cl.CommitOffsets(cl.ctx, processed, func(_ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+		defer close(done)
+		switch {
+		case errors.Is(err, ErrNotGroup):
+		case err != nil:
+			cl.cfg.logger.Log(LogLevelWarn, "unable to commit concurrently processed records", "err", err)
+		default:
+			if errs := CommitErrors(resp); errs != nil {
+				cl.cfg.logger.Log(LogLevelWarn, "unable to commit some concurrently processed records", "errs", errs)
+			}
+		}
+	})
+	<-done
+}
@@ -0,0 +1,330 @@
+package kgo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestConsumeConcurrently(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(4, "foo"))
+	defer c.Close()
+
+	const n = 200
+	producer := newTestClient(t, c)
+	produceN(t, producer, "foo", n)
+	producer.Close()
+
+	var (
+		mu      sync.Mutex
+		seen    = make(map[string]bool)
+		next    map[int32]int64 // the next offset expected per partition
+		failAt  = int32(-1)
+		errBoom = errors.New("boom")
+	)
+	process := func(r *Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if want, ok := next[r.Partition]; ok && r.Offset != want {
+			t.Errorf("partition %d: processed offset %d, expected %d", r.Partition, r.Offset, want)
+		}
+		if r.Offset == 10 && failAt == -1 {
+			failAt = r.Partition
+			return errBoom
+		}
+		next[r.Partition] = r.Offset + 1
+		seen[string(r.Value)] = true
+		return nil
+	}
+
+	// The first member stops at the first record it processes at offset
+	// 10, committing everything before it.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cl1 := newTestClient(t, c)
+	cl1.AssignGroup("group", GroupTopics("foo"), DisableAutoCommit())
+	next = map[int32]int64{0: 0, 1: 0, 2: 0, 3: 0}
+	if err := cl1.ConsumeConcurrently(ctx, 2, ProcessErrStop, process); !errors.Is(err, errBoom) {
+		t.Fatalf("got %v, expected the processing error", err)
+	}
+	committed := cl1.CommittedOffsetsLocal()["foo"]
+	if got := committed[failAt].Offset; got != 10 {
+		t.Errorf("committed offset %d for the failed partition %d, expected 10", got, failAt)
+	}
+	cl1.Close()
+
+	// The second member resumes every partition from what was committed
+	// and processes everything else.
+	mu.Lock()
+	next = make(map[int32]int64)
+	for p := int32(0); p < 4; p++ {
+		next[p] = committed[p].Offset
+	}
+	mu.Unlock()
+
+	cl2 := newTestClient(t, c)
+	defer cl2.Close()
+	cl2.AssignGroup("group", GroupTopics("foo"), DisableAutoCommit())
+	processCtx, processCancel := context.WithCancel(ctx)
+	defer processCancel()
+	err := cl2.ConsumeConcurrently(processCtx, 4, ProcessErrStop, func(r *Record) error {
+		err := process(r)
+		mu.Lock()
+		if len(seen) == n {
+			processCancel()
+		}
+		mu.Unlock()
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, expected context.Canceled once everything was processed", err)
+	}
+
+	var total int64
+	for _, eo := range cl2.CommittedOffsetsLocal()["foo"] {
+		total += eo.Offset
+	}
+	if total != n {
+		t.Errorf("committed offsets sum to %d, expected %d", total, n)
+	}
+}
+
+func TestConsumeConcurrentlySlowPartition(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	producer := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer producer.Close()
+	produceTo := func(partition int32, n int) {
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			r := &Record{Topic: "foo", Partition: partition, Value: []byte("v")}
+			producer.Produce(context.Background(), r, func(_ *Record, err error) { errs <- err })
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil {
+				t.Errorf("unable to produce: %v", err)
+			}
+		}
+	}
+	produceTo(0, 1)
+	produceTo(1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Partition 0 is stuck on its first record until partition 1 has
+	// processed records that are only produced, and so only polled, after
+	// partition 0 is stuck.
+	var (
+		stuck   = make(chan struct{})
+		unstuck = make(chan struct{})
+		fast    int32
+	)
+	cl := newTestClient(t, c)
+	defer cl.Close()
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+	processCtx, processCancel := context.WithCancel(ctx)
+	defer processCancel()
+	go func() {
+		<-stuck
+		produceTo(1, 5)
+	}()
+	err := cl.ConsumeConcurrently(processCtx, 2, ProcessErrStop, func(r *Record) error {
+		if r.Partition == 0 {
+			close(stuck)
+			select {
+			case <-unstuck:
+			case <-ctx.Done():
+				t.Error("partition 1 was held up by the slow partition 0")
+			}
+			processCancel()
+			return nil
+		}
+		if atomic.AddInt32(&fast, 1) == 6 {
+			close(unstuck)
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, expected context.Canceled", err)
+	}
+}
+
+func TestConsumeConcurrentlySkipPolicy(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	const n = 50
+	producer := newTestClient(t, c)
+	produceN(t, producer, "foo", n)
+	producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	processCtx, processCancel := context.WithCancel(ctx)
+	defer processCancel()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+	cl.AssignGroup("group", GroupTopics("foo"), DisableAutoCommit())
+
+	// Every record at offset 5 fails, and is skipped rather than stopping.
+	var processed int32
+	err := cl.ConsumeConcurrently(processCtx, 2, ProcessErrSkip, func(r *Record) error {
+		if atomic.AddInt32(&processed, 1) == n {
+			processCancel()
+		}
+		if r.Offset == 5 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, expected context.Canceled once everything was processed", err)
+	}
+
+	var total int64
+	for _, eo := range cl.CommittedOffsetsLocal()["foo"] {
+		total += eo.Offset
+	}
+	if total != n {
+		t.Errorf("committed offsets sum to %d, expected %d including the skipped records", total, n)
+	}
+}
+
+func TestConsumeConcurrentlyAutoCommit(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+	cl.AssignGroup("group", GroupTopics("foo"))
+
+	err := cl.ConsumeConcurrently(context.Background(), 1, ProcessErrStop, func(*Record) error { return nil })
+	if err != ErrConcurrentAutoCommit {
+		t.Errorf("got %v, expected ErrConcurrentAutoCommit", err)
+	}
+}
+
+func TestConsumeConcurrentlyRebalance(t *testing.T) {
+	t.Parallel()
+
+	const partitions = 4
+	c := newTestCluster(t, kfake.SeedTopics(partitions, "foo"))
+	defer c.Close()
+
+	// Every commit the cluster accepts must not move a partition's
+	// committed offset backwards.
+	var (
+		commitMu  sync.Mutex
+		committed = make(map[int32]int64)
+	)
+	c.ObserveKey(8, func(kreq kmsg.Request, kresp kmsg.Response) {
+		req := kreq.(*kmsg.OffsetCommitRequest)
+		resp := kresp.(*kmsg.OffsetCommitResponse)
+		commitMu.Lock()
+		defer commitMu.Unlock()
+		for i, rt := range req.Topics {
+			for j, rp := range rt.Partitions {
+				if resp.Topics[i].Partitions[j].ErrorCode != 0 {
+					continue
+				}
+				if prior := committed[rp.Partition]; rp.Offset < prior {
+					t.Errorf("partition %d: committed offset %d after %d", rp.Partition, rp.Offset, prior)
+				}
+				committed[rp.Partition] = rp.Offset
+			}
+		}
+	})
+
+	const n = 400
+	producer := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		r := &Record{Topic: "foo", Partition: int32(i % partitions), Value: []byte(strconv.Itoa(i))}
+		producer.Produce(context.Background(), r, func(_ *Record, err error) { errs <- err })
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+	producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	processCtx, processCancel := context.WithCancel(ctx)
+	defer processCancel()
+
+	var (
+		mu     sync.Mutex
+		seen   = make(map[string]bool)
+		joined = make(chan struct{})
+	)
+	process := func(delay time.Duration) func(*Record) error {
+		return func(r *Record) error {
+			time.Sleep(delay)
+			mu.Lock()
+			defer mu.Unlock()
+			seen[string(r.Value)] = true
+			if len(seen) == n/10 {
+				close(joined)
+			}
+			if len(seen) == n {
+				processCancel()
+			}
+			return nil
+		}
+	}
+	consume := func(delay time.Duration) <-chan error {
+		cl := newTestClient(t, c)
+		cl.AssignGroup("group",
+			GroupTopics("foo"),
+			DisableAutoCommit(),
+			HeartbeatInterval(100*time.Millisecond),
+		)
+		done := make(chan error, 1)
+		go func() {
+			defer cl.Close()
+			done <- cl.ConsumeConcurrently(processCtx, 1, ProcessErrStop, process(delay))
+		}()
+		return done
+	}
+
+	// The first member is slow enough to have records queued for every
+	// partition when the second member joins and takes half of them. The
+	// first member's revoke drops its queued records for the partitions
+	// it loses, rather than processing and committing them after the
+	// second member commits further.
+	done1 := consume(10 * time.Millisecond)
+	select {
+	case <-joined:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the first member to process records")
+	}
+	done2 := consume(0)
+
+	for _, done := range []<-chan error{done1, done2} {
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, expected context.Canceled once everything was processed", err)
+		}
+	}
+}
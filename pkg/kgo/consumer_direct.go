@@ -1,6 +1,9 @@
 package kgo
 
-import "regexp"
+import (
+	"regexp"
+	"sort"
+)
 
 // DirectConsumeOpt is an option to configure direct topic / partition consuming.
 type DirectConsumeOpt interface {
@@ -17,7 +20,11 @@ func (opt directConsumeOpt) apply(cfg *directConsumer) { opt.fn(cfg) }
 // consuming partitions from in those topics.
 //
 // If a metadata update sees partitions added to a topic, the client will
-// automatically begin consuming from those new partitions.
+// automatically begin consuming from those new partitions. New partitions
+// are consumed from the ConsumeResetOffset rather than from offset: records
+// can be produced to a new partition before the client sees it, and starting
+// at the end would silently skip them. See OnPartitionsAdded to be notified
+// of new partitions.
 func ConsumeTopics(offset Offset, topics ...string) DirectConsumeOpt {
 	return directConsumeOpt{func(cfg *directConsumer) {
 		cfg.topics = make(map[string]Offset, len(topics))
@@ -44,14 +51,43 @@ func ConsumeTopicsRegex() DirectConsumeOpt {
 	return directConsumeOpt{func(cfg *directConsumer) { cfg.regexTopics = true }}
 }
 
+// ConsumeTopicMatcher sets a function to decide which topics in the cluster to
+// consume, starting at offset, as an alternative to regular expressions. This
+// allows for prefix, suffix, or case insensitive matching without escaping,
+// or for any other logic, such as looking up topic metadata elsewhere.
+//
+// Like consuming with regular expressions, this causes the client to request
+// metadata for all topics (see MetadataAllTopics). Every metadata update, the
+// function is called for each topic that it has not yet matched, so newly
+// created topics are picked up, and a topic that did not match before is
+// asked about again. Once a topic matches, it is consumed until the next
+// assignment, even if the function would no longer match it. Internal topics
+// are never consumed through a matcher.
+//
+// The function is called while the client's consumer is locked, and it must
+// not call back into the client's consuming functions.
+//
+// Topics from ConsumeTopics and ConsumePartitions are still consumed. If this
+// is used alongside ConsumeTopicsRegex, a topic is consumed if it matches a
+// regular expression or the function.
+func ConsumeTopicMatcher(offset Offset, match func(topic string) bool) DirectConsumeOpt {
+	return directConsumeOpt{func(cfg *directConsumer) {
+		cfg.matcher = match
+		cfg.matcherOffset = offset
+	}}
+}
+
 type directConsumer struct {
 	topics     map[string]Offset
 	partitions map[string]map[int32]Offset
 
 	regexTopics bool
-	reTopics    map[string]Offset
+	reTopics    map[string]Offset // topics matched by regex or the matcher
 	reIgnore    map[string]struct{}
 
+	matcher       func(string) bool
+	matcherOffset Offset
+
 	using map[string]map[int32]struct{}
 }
 
@@ -77,7 +113,7 @@ func (cl *Client) AssignPartitions(opts ...DirectConsumeOpt) {
 	for _, opt := range opts {
 		opt.apply(d)
 	}
-	if len(d.topics) == 0 && len(d.partitions) == 0 || c.dead {
+	if len(d.topics) == 0 && len(d.partitions) == 0 && d.matcher == nil || c.dead {
 		return
 	}
 	c.typ = consumerTypeDirect
@@ -100,12 +136,15 @@ func (cl *Client) AssignPartitions(opts ...DirectConsumeOpt) {
 }
 
 // findNewAssignments returns new partitions to consume at given offsets
-// based off the current topics.
+// based off the current topics, as well as the partitions that were added to
+// topics we were already consuming. Added partitions are consumed from the
+// reset offset.
 func (d *directConsumer) findNewAssignments(
 	topics map[string]*topicPartitions,
-) map[string]map[int32]Offset {
+	resetOffset Offset,
+) (toUse map[string]map[int32]Offset, added map[string][]int32) {
 	// First, we build everything we could theoretically want to consume.
-	toUse := make(map[string]map[int32]Offset, 10)
+	toUse = make(map[string]map[int32]Offset, 10)
 	for topic, topicPartitions := range topics {
 		var useTopic bool
 		var useOffset Offset
@@ -139,11 +178,24 @@ func (d *directConsumer) findNewAssignments(
 			useOffset, useTopic = d.topics[topic]
 		}
 
+		// If nothing above matched, we ask the matcher, which is
+		// asked again every update until it matches.
+		if !useTopic && d.matcher != nil {
+			if offset, exists := d.reTopics[topic]; exists {
+				useTopic = true
+				useOffset = offset
+			} else if d.matcher(topic) {
+				useTopic = true
+				useOffset = d.matcherOffset
+				d.reTopics[topic] = useOffset
+			}
+		}
+
 		// If the above detected that we want to keep this topic, we
 		// set all partitions as usable.
 		if useTopic {
 			partitions := topicPartitions.load()
-			if d.regexTopics && partitions.isInternal {
+			if (d.regexTopics || d.matcher != nil) && partitions.isInternal {
 				continue
 			}
 			toUseTopic := make(map[int32]Offset, len(partitions.partitions))
@@ -180,11 +232,12 @@ func (d *directConsumer) findNewAssignments(
 	}
 
 	if len(toUse) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	// Finally, toUse contains new partitions that we must consume.
-	// Add them to our using map and assign them.
+	// Add them to our using map and assign them. If we were already
+	// using the topic, the partitions were added since we last looked.
 	for topic, partitions := range toUse {
 		topicUsing, exists := d.using[topic]
 		if !exists {
@@ -192,9 +245,19 @@ func (d *directConsumer) findNewAssignments(
 			d.using[topic] = topicUsing
 		}
 		for partition := range partitions {
+			if exists {
+				if _, pinned := d.partitions[topic][partition]; !pinned {
+					partitions[partition] = resetOffset
+				}
+				if added == nil {
+					added = make(map[string][]int32)
+				}
+				added[topic] = append(added[topic], partition)
+			}
 			topicUsing[partition] = struct{}{}
 		}
+		sort.Slice(added[topic], func(i, j int) bool { return added[topic][i] < added[topic][j] })
 	}
 
-	return toUse
+	return toUse, added
 }
@@ -0,0 +1,67 @@
+package kgo
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+)
+
+func TestConsumeTopicMatcher(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "Foo-1", "foo-2", "bar"))
+	defer c.Close()
+
+	// The matcher is asked again on every metadata update.
+	cl := newTestClient(t, c, MetadataMaxAge(200*time.Millisecond))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, topic := range []string{"Foo-1", "foo-2", "bar"} {
+		produceN(t, cl, topic, 1)
+	}
+
+	var allowBar int32
+	cl.AssignPartitions(ConsumeTopicMatcher(NewOffset().AtStart(), func(topic string) bool {
+		return strings.HasPrefix(strings.ToLower(topic), "foo") || topic == "bar" && atomic.LoadInt32(&allowBar) == 1
+	}))
+
+	consumeTopics := func(exp ...string) {
+		t.Helper()
+		want := make(map[string]bool)
+		for _, topic := range exp {
+			want[topic] = true
+		}
+		for len(want) > 0 {
+			fetches := cl.PollFetches(ctx)
+			if ctx.Err() != nil {
+				t.Fatalf("timed out waiting for topics %v", want)
+			}
+			for iter := fetches.RecordIter(); !iter.Done(); {
+				r := iter.Next()
+				if !want[r.Topic] {
+					t.Fatalf("unexpectedly consumed from topic %s", r.Topic)
+				}
+				delete(want, r.Topic)
+			}
+		}
+	}
+	consumeTopics("Foo-1", "foo-2")
+
+	// A newly created topic is matched, as is a topic the matcher
+	// previously rejected.
+	if _, err := cl.CreateTopics(ctx, []TopicSpec{{Topic: "FOO-3", Partitions: 1}}, false); err != nil {
+		t.Fatalf("unable to create topic: %v", err)
+	}
+	produceN(t, cl, "FOO-3", 1)
+	consumeTopics("FOO-3")
+
+	atomic.StoreInt32(&allowBar, 1)
+	consumeTopics("bar")
+}
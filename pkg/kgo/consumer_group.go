@@ -89,6 +89,13 @@ func RebalanceTimeout(timeout time.Duration) GroupOpt {
 // This value can be any value lower than the session timeout, but should be no
 // higher than 1/3rd the session timeout.
 //
+// Heartbeats are issued from a background goroutine for the duration of a
+// group session and are entirely independent of PollFetches. Spending a long
+// time processing records between polls does not cause this member to be
+// removed from the group; only a failure to heartbeat within the session
+// timeout (or to rejoin within the rebalance timeout once a rebalance begins)
+// does.
+//
 // This corresponds to Kafka's heartbeat.interval.ms.
 func HeartbeatInterval(interval time.Duration) GroupOpt {
 	return groupOpt{func(cfg *groupConsumer) { cfg.heartbeatInterval = interval }}
@@ -267,7 +274,12 @@ type groupConsumer struct {
 
 	instanceID   *string
 	lastAssigned map[string][]int32 // only updated in join&sync loop
-	nowAssigned  map[string][]int32 // only updated in join&sync loop
+	nowAssigned  map[string][]int32 // only updated in join&sync loop, under mu; read under mu outside the loop
+
+	// assigned is closed once the first group session's assignment is
+	// active; see WaitForGroupAssignment.
+	assigned     chan struct{}
+	assignedOnce sync.Once
 
 	sessionTimeout    time.Duration
 	rebalanceTimeout  time.Duration
@@ -314,6 +326,7 @@ func (cl *Client) AssignGroup(group string, opts ...GroupOpt) {
 		using:    make(map[string]int),
 		rejoinCh: make(chan struct{}, 1),
 		reSeen:   make(map[string]struct{}),
+		assigned: make(chan struct{}),
 
 		sessionTimeout:    10000 * time.Millisecond,
 		rebalanceTimeout:  60000 * time.Millisecond,
@@ -374,6 +387,7 @@ func (g *groupConsumer) manage() {
 			continue
 		}
 
+		g.c.revokeConcurrent(g.nowAssigned, false)
 		if g.onLost != nil {
 			g.onLost(g.ctx, g.nowAssigned)
 		} else if g.onRevoked != nil {
@@ -390,10 +404,10 @@ func (g *groupConsumer) manage() {
 		//
 		// We need to invalidate everything.
 		g.c.assignPartitions(nil, assignInvalidateAll)
-		g.nowAssigned = nil
 
 		// TODO check if this lock && assign is necessary.
 		g.mu.Lock()
+		g.nowAssigned = nil
 		g.uncommitted = nil
 		g.mu.Unlock()
 
@@ -538,16 +552,17 @@ const (
 func (g *groupConsumer) revoke(stage revokeStage, lost map[string][]int32) {
 	if !g.cooperative { // stage == revokeThisSession if not cooperative
 		g.cl.cfg.logger.Log(LogLevelInfo, "eager consumer revoking prior assigned partitions", "revoking", g.nowAssigned)
+		g.c.revokeConcurrent(g.nowAssigned, true)
 		if g.onRevoked != nil {
 			g.onRevoked(g.ctx, g.nowAssigned)
 		}
-		g.nowAssigned = nil
 
 		// We are setting uncommitted to nil _after_ the heartbeat loop
 		// already invalidated everything. After setting this here,
 		// nothing should be able to recreate uncommitted until a
 		// future fetch after the group is rejoined.
 		g.mu.Lock()
+		g.nowAssigned = nil
 		g.uncommitted = nil
 		g.mu.Unlock()
 		return
@@ -590,6 +605,7 @@ func (g *groupConsumer) revoke(stage revokeStage, lost map[string][]int32) {
 		// not want to allow new fetches for revoked partitions after a
 		// call to revoke before we invalidate those partitions.
 		g.c.assignPartitions(lostOffsets, assignInvalidateMatching)
+		g.c.revokeConcurrent(lost, true)
 	}
 
 	if len(lost) != 0 || stage == revokeThisSession {
@@ -726,11 +742,16 @@ func (g *groupConsumer) setupAssignedAndHeartbeat() error {
 			defer close(fetchDone)
 			defer close(fetchErrCh)
 			g.cl.cfg.logger.Log(LogLevelInfo, "fetching offsets for added partitions", "added", added)
-			fetchErrCh <- g.fetchOffsets(ctx, added)
+			err := g.fetchOffsets(ctx, added)
+			if err == nil {
+				g.markAssigned()
+			}
+			fetchErrCh <- err
 		}()
 	} else {
 		close(fetchDone)
 		close(fetchErrCh)
+		g.markAssigned()
 	}
 
 	// Before we return, we also want to ensure that the user's onAssign is
@@ -751,6 +772,41 @@ func (g *groupConsumer) setupAssignedAndHeartbeat() error {
 	return <-hbErrCh
 }
 
+// markAssigned signals WaitForGroupAssignment once our assignment is active,
+// meaning the partitions we were assigned are being consumed.
+func (g *groupConsumer) markAssigned() {
+	g.assignedOnce.Do(func() { close(g.assigned) })
+}
+
+// WaitForGroupAssignment waits until the client has joined its group and the
+// first assignment is active, meaning every assigned partition has had its
+// offsets fetched and is being consumed. This returns immediately after the
+// first assignment, even if the group has since rebalanced, and also returns
+// once the group assigns this client no partitions.
+//
+// This returns ErrNotGroup if the client is not consuming as a group or if
+// the client leaves its group (is reassigned) while waiting, and the context
+// error if the context is canceled first.
+func (cl *Client) WaitForGroupAssignment(ctx context.Context) error {
+	c := &cl.consumer
+	c.mu.Lock()
+	if c.typ != consumerTypeGroup {
+		c.mu.Unlock()
+		return ErrNotGroup
+	}
+	g := c.group
+	c.mu.Unlock()
+
+	select {
+	case <-g.assigned:
+		return nil
+	case <-g.ctx.Done():
+		return ErrNotGroup
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // heartbeat issues heartbeat requests to Kafka for the duration of a group
 // session.
 //
@@ -761,6 +817,12 @@ func (g *groupConsumer) setupAssignedAndHeartbeat() error {
 //
 // If the offset fetch is successful, then we basically sit in this function
 // until a heartbeat errors or we, being the leader, decide to re-join.
+//
+// Heartbeating is tied to the group session, not to the consumer session: an
+// eager consumer stops its consumer session to revoke partitions and must keep
+// heartbeating while it does so. The heartbeat loop returns (and the group
+// session ends) before every rejoin, and leaving the group cancels the loop
+// and waits for it to return.
 func (g *groupConsumer) heartbeat(fetchErrCh <-chan error, s *assignRevokeSession) error {
 	ticker := time.NewTicker(g.heartbeatInterval)
 	defer ticker.Stop()
@@ -811,6 +873,32 @@ func (g *groupConsumer) heartbeat(fetchErrCh <-chan error, s *assignRevokeSessio
 				err = kerr.ErrorForCode(resp.ErrorCode)
 			}
 			g.cl.cfg.logger.Log(LogLevelDebug, "heartbeat complete", "err", err)
+
+			// If we were fenced, our generation is no longer valid,
+			// and if the broker forgot us, so is our member ID. We
+			// clear them so that our next join starts fresh rather
+			// than spending a round trip being told the same thing.
+			switch err {
+			case kerr.IllegalGeneration:
+				g.mu.Lock()
+				g.generation = -1
+				g.mu.Unlock()
+			case kerr.UnknownMemberID:
+				g.mu.Lock()
+				g.memberID = ""
+				g.generation = -1
+				g.mu.Unlock()
+
+			// If the coordinator moved or is still loading, our
+			// membership is unaffected: the stale coordinator was
+			// forgotten when the request failed, and the next
+			// heartbeat finds the new one. If finding it takes
+			// longer than our session timeout, the new coordinator
+			// will have removed us and will tell us so.
+			case kerr.NotCoordinator, kerr.CoordinatorNotAvailable, kerr.CoordinatorLoadInProgress:
+				g.cl.cfg.logger.Log(LogLevelInfo, "heartbeat hit a coordinator error, keeping our assignment and retrying on the next heartbeat", "err", err)
+				err = nil
+			}
 		}
 
 		if didMetadone && didRevoke {
@@ -1066,10 +1154,13 @@ func (g *groupConsumer) handleSyncResp(resp *kmsg.SyncGroupResponse, plan balanc
 	if g.cooperative {
 		g.lastAssigned = g.nowAssigned
 	}
-	g.nowAssigned = make(map[string][]int32)
+	nowAssigned := make(map[string][]int32)
 	for _, topic := range kassignment.Topics {
-		g.nowAssigned[topic.Topic] = topic.Partitions
+		nowAssigned[topic.Topic] = topic.Partitions
 	}
+	g.mu.Lock()
+	g.nowAssigned = nowAssigned
+	g.mu.Unlock()
 	g.cl.cfg.logger.Log(LogLevelInfo, "synced successfully", "assigned", g.nowAssigned)
 	return nil
 }
@@ -1089,6 +1180,7 @@ func (g *groupConsumer) joinGroupProtocols() []kmsg.JoinGroupRequestProtocol {
 				topics,
 				g.nowAssigned,
 				g.generation,
+				g.cl.cfg.rack,
 			),
 		})
 	}
@@ -1153,7 +1245,12 @@ start:
 				at:    rPartition.Offset,
 				epoch: -1,
 			}
-			if resp.Version >= 5 { // KIP-320
+			// With KIP-320, the commit includes the leader epoch of
+			// the committed offset. Assigning an exact offset with
+			// an epoch validates the epoch before we consume, so
+			// if the partition was truncated below our commit
+			// while we were away, we reset and return ErrDataLoss.
+			if resp.Version >= 5 {
 				offset.epoch = rPartition.LeaderEpoch
 			}
 			if rPartition.Offset == -1 {
@@ -1192,8 +1289,9 @@ start:
 				Offset: offset.at,
 			}
 			topicUncommitted[partition] = uncommit{
-				head:      committed,
-				committed: committed,
+				head:         committed,
+				committed:    committed,
+				hasCommitted: true,
 			}
 		}
 	}
@@ -1220,12 +1318,14 @@ start:
 // topics, which would support groups that consume disparate topics. Ideally,
 // this is uncommon. This does not rejoin if the leader notices a partition is
 // lost, which is finicky.
-func (g *groupConsumer) findNewAssignments(topics map[string]*topicPartitions) {
+//
+// This returns the partitions that were added to topics we were already using.
+func (g *groupConsumer) findNewAssignments(topics map[string]*topicPartitions) (added map[string][]int32) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
 	if g.dying {
-		return
+		return nil
 	}
 
 	type change struct {
@@ -1276,11 +1376,19 @@ func (g *groupConsumer) findNewAssignments(topics map[string]*topicPartitions) {
 	}
 
 	if len(toChange) == 0 {
-		return
+		return nil
 	}
 
 	wasManaging := len(g.using) != 0
 	for topic, change := range toChange {
+		if !change.isNew {
+			if added == nil {
+				added = make(map[string][]int32)
+			}
+			for p := g.using[topic]; p < g.using[topic]+change.delta; p++ {
+				added[topic] = append(added[topic], int32(p))
+			}
+		}
 		g.using[topic] += change.delta
 	}
 
@@ -1291,6 +1399,7 @@ func (g *groupConsumer) findNewAssignments(topics map[string]*topicPartitions) {
 	if numNew > 0 || g.leader {
 		g.rejoin()
 	}
+	return added
 }
 
 // uncommit tracks the latest offset polled (+1) and the latest commit.
@@ -1299,6 +1408,11 @@ func (g *groupConsumer) findNewAssignments(topics map[string]*topicPartitions) {
 type uncommit struct {
 	head      EpochOffset
 	committed EpochOffset
+
+	// hasCommitted is whether committed is an actual commit (from us
+	// committing, setting offsets, or fetching the group's offsets),
+	// rather than the zero value for a partition not yet committed.
+	hasCommitted bool
 }
 
 // EpochOffset combines a record offset with the leader epoch the broker
@@ -1404,6 +1518,7 @@ func (g *groupConsumer) updateCommitted(
 				reqPart.LeaderEpoch,
 				reqPart.Offset,
 			}
+			uncommit.hasCommitted = true
 			topic[respPart.Partition] = uncommit
 		}
 	}
@@ -1500,6 +1615,7 @@ func (cl *Client) SetOffsets(setOffsets map[string]map[int32]EpochOffset) {
 			current, exists := topicUncommitted[partition]
 			if exists && current.head == epochOffset {
 				current.committed = epochOffset
+				current.hasCommitted = true
 				topicUncommitted[partition] = current
 				continue
 			}
@@ -1511,8 +1627,9 @@ func (cl *Client) SetOffsets(setOffsets map[string]map[int32]EpochOffset) {
 				epoch: epochOffset.Epoch,
 			}
 			topicUncommitted[partition] = uncommit{
-				head:      epochOffset,
-				committed: epochOffset,
+				head:         epochOffset,
+				committed:    epochOffset,
+				hasCommitted: true,
 			}
 		}
 		if len(topicAssigns) > 0 {
@@ -1572,6 +1689,53 @@ func (cl *Client) CommittedOffsets() map[string]map[int32]EpochOffset {
 	return g.getUncommittedLocked(false)
 }
 
+// CommittedOffsetsLocal returns the client's view of the last successfully
+// committed offset for every partition it has committed or fetched commits
+// for. Unlike CommittedOffsets, this includes partitions whose committed
+// offset is fully caught up to what has been polled.
+//
+// This does not issue any request; the offsets are what this client has
+// seen from its own commits and from fetching the group's offsets when
+// joining. Commits by other clients are not reflected. Partitions that do
+// not yet have a commit are not included.
+//
+// Combined with UncommittedOffsets, this can help verify that the offsets
+// being committed are what you expect. If there are no committed offsets or
+// the client is not consuming as a group, this returns nil.
+func (cl *Client) CommittedOffsetsLocal() map[string]map[int32]EpochOffset {
+	c := &cl.consumer
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.typ != consumerTypeGroup {
+		return nil
+	}
+
+	g := c.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var committed map[string]map[int32]EpochOffset
+	for topic, partitions := range g.uncommitted {
+		for partition, uncommit := range partitions {
+			if !uncommit.hasCommitted {
+				continue
+			}
+			if committed == nil {
+				committed = make(map[string]map[int32]EpochOffset, len(g.uncommitted))
+			}
+			topicCommitted := committed[topic]
+			if topicCommitted == nil {
+				topicCommitted = make(map[int32]EpochOffset, len(partitions))
+				committed[topic] = topicCommitted
+			}
+			topicCommitted[partition] = uncommit.committed
+		}
+	}
+	return committed
+}
+
 func (g *groupConsumer) getUncommitted() map[string]map[int32]EpochOffset {
 	g.mu.Lock()
 	defer g.mu.Unlock()
@@ -1707,9 +1871,16 @@ func (cl *Client) BlockingCommitOffsets(
 // It is invalid to use this function to commit offsets for a transaction.
 //
 // It is highly recommended to check the response's partition's error codes if
-// the response is non-nil. While unlikely, individual partitions can error.
-// This is most likely to happen if a commit occurs too late in a rebalance
-// event.
+// the response is non-nil, which CommitErrors can help with. While unlikely,
+// individual partitions can error. This is most likely to happen if a commit
+// occurs too late in a rebalance event.
+//
+// The commit is issued with the group generation at the time this function
+// is called. If the group rebalances before the commit reaches Kafka, Kafka
+// rejects every partition in the commit with IllegalGeneration (or
+// RebalanceInProgress if the rebalance is still ongoing), and these errors
+// are visible in the response passed to onDone. A rejected commit is not
+// retried: the offsets may be for partitions that are no longer assigned.
 //
 // If manually committing, you want to set OnRevoked to commit syncronously
 // using BlockingCommitOffsets. Otherwise if committing async OnRevoked may
@@ -1760,6 +1931,37 @@ func (cl *Client) CommitOffsets(
 	}()
 }
 
+// CommitErrors returns the per-partition errors in an offset commit response,
+// returning nil if every partition was committed successfully. This can be
+// used in the onDone functions of CommitOffsets and BlockingCommitOffsets.
+//
+// A commit that raced a group rebalance has every partition fail with
+// kerr.IllegalGeneration, kerr.UnknownMemberID, or kerr.RebalanceInProgress.
+func CommitErrors(resp *kmsg.OffsetCommitResponse) map[string]map[int32]error {
+	if resp == nil {
+		return nil
+	}
+	var errs map[string]map[int32]error
+	for _, topic := range resp.Topics {
+		for _, partition := range topic.Partitions {
+			err := kerr.ErrorForCode(partition.ErrorCode)
+			if err == nil {
+				continue
+			}
+			if errs == nil {
+				errs = make(map[string]map[int32]error)
+			}
+			terrs := errs[topic.Topic]
+			if terrs == nil {
+				terrs = make(map[int32]error)
+				errs[topic.Topic] = terrs
+			}
+			terrs[partition.Partition] = err
+		}
+	}
+	return errs
+}
+
 // defaultRevoke commits the last fetched offsets and waits for the commit to
 // finish. This is the default onRevoked function which, when combined with the
 // default autocommit, ensures we never miss committing everything.
@@ -1865,6 +2067,9 @@ func (g *groupConsumer) commit(
 			onDone(req, nil, err)
 			return
 		}
+		if errs := CommitErrors(resp); errs != nil {
+			g.cl.cfg.logger.Log(LogLevelInfo, "commit had partition errors", "generation", req.Generation, "errs", errs)
+		}
 		g.updateCommitted(req, resp)
 		onDone(req, resp, nil)
 	}()
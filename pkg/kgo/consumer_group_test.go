@@ -0,0 +1,366 @@
+package kgo
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestWaitForGroupAssignment(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cl1 := newTestClient(t, c)
+	defer cl1.Close()
+	if err := cl1.WaitForGroupAssignment(ctx); err != ErrNotGroup {
+		t.Fatalf("got err %v waiting without a group, expected ErrNotGroup", err)
+	}
+
+	cl1.AssignGroup("group", GroupTopics("foo"))
+	if err := cl1.WaitForGroupAssignment(ctx); err != nil {
+		t.Fatalf("unable to wait for the first member's assignment: %v", err)
+	}
+
+	// With one partition, the second member is assigned nothing, which
+	// must still count as being assigned.
+	cl2 := newTestClient(t, c)
+	defer cl2.Close()
+	cl2.AssignGroup("group", GroupTopics("foo"))
+	if err := cl2.WaitForGroupAssignment(ctx); err != nil {
+		t.Fatalf("unable to wait for the second member's assignment: %v", err)
+	}
+}
+
+func TestGroupLag(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(2, "foo"), kfake.SeedTopics(1, "bar"))
+	defer c.Close()
+
+	// Records default to partition 0 with manual partitioning, leaving
+	// foo[1] empty.
+	cl := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10)
+	produceN(t, cl, "bar", 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The group commits only foo[0], and its one member is assigned bar,
+	// which it consumes without committing.
+	commit := kmsg.NewPtrOffsetCommitRequest()
+	commit.Group = "group"
+	commit.Generation = -1
+	ct := kmsg.NewOffsetCommitRequestTopic()
+	ct.Topic = "foo"
+	cp := kmsg.NewOffsetCommitRequestTopicPartition()
+	cp.Partition = 0
+	cp.Offset = 1
+	ct.Partitions = append(ct.Partitions, cp)
+	commit.Topics = append(commit.Topics, ct)
+	if _, err := commit.RequestWith(ctx, cl); err != nil {
+		t.Fatalf("unable to commit: %v", err)
+	}
+
+	member := newTestClient(t, c)
+	defer member.Close()
+	member.AssignGroup("group", GroupTopics("bar"), DisableAutoCommit())
+	consumeN(t, member, 5)
+
+	lags, err := cl.GroupLag(ctx, "group")
+	if err != nil {
+		t.Fatalf("unable to get group lag: %v", err)
+	}
+	for _, exp := range []struct {
+		topic     string
+		partition int32
+		lag       GroupLagInfo
+	}{
+		{"foo", 0, GroupLagInfo{Committed: 1, Start: 0, End: 10, Lag: 9}},
+		{"foo", 1, GroupLagInfo{Committed: -1, Start: 0, End: 0, Lag: 0}},
+		// Without a commit, lag is from the log start.
+		{"bar", 0, GroupLagInfo{Committed: -1, Start: 0, End: 5, Lag: 5}},
+	} {
+		if got := lags[exp.topic][exp.partition]; got != exp.lag {
+			t.Errorf("%s[%d]: got %+v, expected %+v", exp.topic, exp.partition, got, exp.lag)
+		}
+	}
+	if len(lags) != 2 || len(lags["foo"]) != 2 || len(lags["bar"]) != 1 {
+		t.Errorf("got lags %v, expected foo[0], foo[1], and bar[0]", lags)
+	}
+
+	lags, err = cl.GroupLag(ctx, "unknown")
+	if err != nil || len(lags) != 0 {
+		t.Errorf("unknown group: got lags %v, err %v; expected no lags and no error", lags, err)
+	}
+}
+
+func TestGroupCoordinatorFailover(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(3), kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	// With no request retries, coordinator errors reach the heartbeat
+	// loop rather than being retried within the request.
+	hook := &e2eHook{reqs: make(map[int16][]e2eReq)}
+	cl := newTestClient(t, c, RequestRetries(1), WithHooks(hook))
+	defer cl.Close()
+
+	var assigned, revoked, lost int32
+	cl.AssignGroup("group",
+		GroupTopics("foo"),
+		HeartbeatInterval(100*time.Millisecond),
+		OnAssigned(func(context.Context, map[string][]int32) { atomic.AddInt32(&assigned, 1) }),
+		OnRevoked(func(context.Context, map[string][]int32) { atomic.AddInt32(&revoked, 1) }),
+		OnLost(func(context.Context, map[string][]int32) { atomic.AddInt32(&lost, 1) }),
+	)
+
+	produceN(t, cl, "foo", 10)
+	consumeN(t, cl, 10)
+
+	findCoordinators := func() int {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		return len(hook.reqs[10])
+	}
+	before := findCoordinators()
+
+	// The coordinator moves, and then is briefly unavailable.
+	c.InjectFault(12, kfake.Fault{ErrorCode: kerr.NotCoordinator.Code})
+	c.InjectFault(12, kfake.Fault{ErrorCode: kerr.CoordinatorNotAvailable.Code})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for findCoordinators() < before+2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("coordinator was not rediscovered: got %d FindCoordinator requests, expected at least %d", findCoordinators(), before+2)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The group session survives and consuming continues.
+	produceN(t, cl, "foo", 10)
+	consumeN(t, cl, 10)
+
+	if a, r, l := atomic.LoadInt32(&assigned), atomic.LoadInt32(&revoked), atomic.LoadInt32(&lost); a != 1 || r != 0 || l != 0 {
+		t.Errorf("got %d assigns, %d revokes, and %d losses, expected only the initial assign", a, r, l)
+	}
+}
+
+func TestGroupCommittedEpochDataLoss(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10)
+
+	// We commit past the end of the partition with a leader epoch, as if
+	// the partition was truncated after the commit.
+	commitReq := kmsg.NewPtrOffsetCommitRequest()
+	commitReq.Group = "group"
+	commitReq.Generation = -1
+	commitReq.Topics = []kmsg.OffsetCommitRequestTopic{{
+		Topic: "foo",
+		Partitions: []kmsg.OffsetCommitRequestTopicPartition{{
+			Partition:   0,
+			Offset:      20,
+			LeaderEpoch: 0,
+		}},
+	}}
+	if _, err := commitReq.RequestWith(context.Background(), cl); err != nil {
+		t.Fatalf("unable to commit: %v", err)
+	}
+
+	cl.AssignGroup("group", GroupTopics("foo"), DisableAutoCommit())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatal("timed out waiting for data loss")
+		}
+		for _, fe := range fetches.Errors() {
+			dl, ok := fe.Err.(*ErrDataLoss)
+			if !ok {
+				t.Fatalf("got unexpected fetch error %v", fe.Err)
+			}
+			if dl.ConsumedTo != 20 || dl.ResetTo != 10 {
+				t.Errorf("got data loss %v, expected consumed to 20 and reset to 10", dl)
+			}
+			return
+		}
+		if !fetches.RecordIter().Done() {
+			t.Fatal("consumed records without detecting data loss")
+		}
+	}
+}
+
+func TestGroupDeletedPartitionsOnlyAssigned(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	cl1 := newTestClient(t, c)
+	defer cl1.Close()
+	cl2 := newTestClient(t, c)
+	defer cl2.Close()
+	cl1.AssignGroup("group", GroupTopics("foo"))
+	cl2.AssignGroup("group", GroupTopics("foo"))
+
+	assigned := func(cl *Client) []int32 {
+		g := cl.consumer.group
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.nowAssigned["foo"]
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(assigned(cl1)) != 1 || len(assigned(cl2)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("group did not balance: got %v and %v", assigned(cl1), assigned(cl2))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Each member must only report the partition it was assigned.
+	for _, cl := range []*Client{cl1, cl2} {
+		cl.consumer.stopDeletedPartitions(map[string][]int32{"foo": {0, 1}})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		fetches := cl.PollFetches(ctx)
+		cancel()
+		errs := fetches.Errors()
+		if len(errs) != 1 || errs[0].Err != ErrPartitionDeleted || errs[0].Partition != assigned(cl)[0] {
+			t.Errorf("got errors %v, expected ErrPartitionDeleted for only foo[%d]", errs, assigned(cl)[0])
+		}
+	}
+}
+
+func TestGroupHeartbeatsWithoutPolling(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	hook := &e2eHook{reqs: make(map[int16][]e2eReq)}
+	cl := newTestClient(t, c, WithHooks(hook))
+	defer cl.Close()
+
+	var revoked, lost int32
+	cl.AssignGroup("group",
+		GroupTopics("foo"),
+		SessionTimeout(time.Second),
+		HeartbeatInterval(100*time.Millisecond),
+		OnRevoked(func(context.Context, map[string][]int32) { atomic.AddInt32(&revoked, 1) }),
+		OnLost(func(context.Context, map[string][]int32) { atomic.AddInt32(&lost, 1) }),
+	)
+
+	produceN(t, cl, "foo", 10)
+	consumeN(t, cl, 10)
+
+	memberGeneration := func() (string, int32) {
+		g := cl.consumer.group
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.memberID, g.generation
+	}
+	heartbeats := func() int {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		return len(hook.reqs[12])
+	}
+	member, generation := memberGeneration()
+	before := heartbeats()
+
+	// Processing for well past the session timeout without polling must
+	// not cost us our membership.
+	time.Sleep(2500 * time.Millisecond)
+
+	if r, l := atomic.LoadInt32(&revoked), atomic.LoadInt32(&lost); r != 0 || l != 0 {
+		t.Errorf("got %d revokes and %d losses while not polling, expected none", r, l)
+	}
+	if m, g := memberGeneration(); m != member || g != generation {
+		t.Errorf("got member %q generation %d, expected to still be member %q generation %d", m, g, member, generation)
+	}
+	if n := heartbeats() - before; n < 10 {
+		t.Errorf("got %d heartbeats while not polling, expected at least 10", n)
+	}
+
+	produceN(t, cl, "foo", 10)
+	consumeN(t, cl, 10)
+
+	// Leaving the group stops heartbeating.
+	cl.AssignGroup("")
+	left := heartbeats()
+	time.Sleep(500 * time.Millisecond)
+	if n := heartbeats(); n != left {
+		t.Errorf("got %d heartbeats after leaving the group, expected none", n-left)
+	}
+}
+
+func TestGroupHeartbeatFenced(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	// The injected fault does not actually remove us from the group, so
+	// our old member must expire before our rejoin can complete.
+	lost := make(chan struct{}, 1)
+	cl.AssignGroup("group",
+		GroupTopics("foo"),
+		SessionTimeout(time.Second),
+		HeartbeatInterval(100*time.Millisecond),
+		OnLost(func(context.Context, map[string][]int32) {
+			select {
+			case lost <- struct{}{}:
+			default:
+			}
+		}),
+	)
+
+	produceN(t, cl, "foo", 10)
+	consumeN(t, cl, 10)
+
+	memberID := func() string {
+		g := cl.consumer.group
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.memberID
+	}
+	member := memberID()
+
+	// A heartbeat learning the coordinator forgot us loses our partitions
+	// and rejoins as a new member.
+	c.InjectFault(12, kfake.Fault{ErrorCode: kerr.UnknownMemberID.Code})
+	select {
+	case <-lost:
+	case <-time.After(10 * time.Second):
+		t.Fatal("partitions were not lost after being fenced")
+	}
+
+	produceN(t, cl, "foo", 10)
+	consumeN(t, cl, 10)
+	if m := memberID(); m == member || m == "" {
+		t.Errorf("got member %q after being fenced, expected a new member rather than %q", m, member)
+	}
+}
@@ -0,0 +1,1274 @@
+package kgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestMaxFetchGoroutines(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(6, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, MaxFetchGoroutines(1))
+	defer cl.Close()
+
+	const n = 300
+	produceN(t, cl, "foo", n)
+
+	// Partitions are spread across all brokers, so with one response
+	// processed at a time, fetches to every broker must take turns.
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	if seen := consumeN(t, cl, n); len(seen) != n {
+		t.Fatalf("saw %d unique records, expected %d", len(seen), n)
+	}
+
+	// Reassigning stops the session, which must not hang on fetches
+	// waiting for their turn.
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	if seen := consumeN(t, cl, n); len(seen) != n {
+		t.Fatalf("saw %d unique records after reassigning, expected %d", len(seen), n)
+	}
+}
+
+func TestMaxFetchGoroutinesDoesNotWaitOnLongPolls(t *testing.T) {
+	t.Parallel()
+
+	// Partition 0 is led by broker 0 and partition 1 by broker 1.
+	c := newTestCluster(t, kfake.NumBrokers(2), kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c,
+		MaxFetchGoroutines(1),
+		FetchMaxWait(3*time.Second),
+		RecordPartitioner(ManualPartitioner(nil)),
+	)
+	defer cl.Close()
+
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+	// Partition 1 never has data, so its broker always holds our fetch
+	// for the full max wait. Records produced to partition 0 must still
+	// be consumed promptly.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		start := time.Now()
+		if err := cl.Produce(ctx, &Record{Topic: "foo", Partition: 0, Value: []byte("v")}, nil); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+		for consumed := false; !consumed; {
+			fetches := cl.PollFetches(ctx)
+			if ctx.Err() != nil {
+				t.Fatal("timed out waiting for records")
+			}
+			consumed = !fetches.RecordIter().Done()
+		}
+		cancel()
+		if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+			t.Errorf("record %d took %v to consume, expected less than the other broker's max wait", i, elapsed)
+		}
+	}
+}
+
+func TestConsumerInterceptors(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, ConsumerInterceptors(
+		func(r *Record) bool {
+			n, _ := strconv.Atoi(string(r.Value))
+			return n%2 == 0
+		},
+		func(r *Record) bool {
+			r.Value = append([]byte("seen-"), r.Value...)
+			return true
+		},
+	))
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	seen := consumeN(t, cl, 5)
+	for _, v := range []string{"seen-0", "seen-2", "seen-4", "seen-6", "seen-8"} {
+		if seen[v] != 1 {
+			t.Errorf("got %v, expected only even intercepted records", seen)
+			break
+		}
+	}
+
+	// The dropped final record advanced our offset: we only see new
+	// records.
+	produceN(t, cl, "foo", 11)
+	if seen := consumeN(t, cl, 6); len(seen) != 6 || seen["seen-10"] != 1 {
+		t.Errorf("got %v, expected only new even records", seen)
+	}
+}
+
+func TestOnOffsetsLoaded(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	loadedCh := make(chan []LoadedPartition, 10)
+	cl := newTestClient(t, c, OnOffsetsLoaded(func(loaded []LoadedPartition) { loadedCh <- loaded }))
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtEnd(), "foo"))
+
+	var total int64
+	timeout := time.After(10 * time.Second)
+	for seen := 0; seen < 2; {
+		select {
+		case loaded := <-loadedCh:
+			for _, l := range loaded {
+				if l.Err != nil || l.EpochLoad || l.Topic != "foo" {
+					t.Fatalf("unexpected load %+v", l)
+				}
+				total += l.Offset
+				seen++
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for offsets to load")
+		}
+	}
+	if total != 10 {
+		t.Errorf("loaded end offsets sum to %d, expected 10", total)
+	}
+}
+
+func TestFetchPartitionStats(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(3, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		r := &Record{Topic: "foo", Partition: int32(i % 2), Value: []byte(strconv.Itoa(i))}
+		if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	consumeN(t, cl, 10)
+
+	stats := cl.FetchPartitionStats()["foo"]
+	for p, exp := range map[int32]int64{0: 5, 1: 5} {
+		got := stats[p]
+		if got.Records != exp || got.Bytes == 0 || got.Fetches == 0 {
+			t.Errorf("partition %d: got stats %+v, expected %d records with bytes", p, got, exp)
+		}
+	}
+
+	cl.AssignPartitions()
+	if stats := cl.FetchPartitionStats(); len(stats) != 0 {
+		t.Errorf("got stats %v after unassigning, expected none", stats)
+	}
+}
+
+func TestConsumerProgress(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	if p := cl.ConsumerProgress(); !p.LastFetchAttempt.IsZero() || !p.LastNonEmptyFetch.IsZero() {
+		t.Fatalf("got progress %+v before consuming, expected zero times", p)
+	}
+
+	produceN(t, cl, "foo", 3)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	consumeN(t, cl, 3)
+
+	p := cl.ConsumerProgress()
+	if p.LastFetchAttempt.IsZero() || p.LastNonEmptyFetch.IsZero() {
+		t.Fatalf("got progress %+v after consuming, expected non-zero times", p)
+	}
+
+	// We are caught up: polling keeps fetches being issued, but none of
+	// them contain records.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+		cl.PollFetches(ctx)
+		cancel()
+	}
+	idle := cl.ConsumerProgress()
+	if !idle.LastFetchAttempt.After(p.LastFetchAttempt) {
+		t.Errorf("got last fetch attempt %v, expected after %v", idle.LastFetchAttempt, p.LastFetchAttempt)
+	}
+	if !idle.LastNonEmptyFetch.Equal(p.LastNonEmptyFetch) {
+		t.Errorf("got last non-empty fetch %v, expected unchanged %v", idle.LastNonEmptyFetch, p.LastNonEmptyFetch)
+	}
+}
+
+func TestDisableTruncationDetection(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	producer := newTestClient(t, c)
+	produceN(t, producer, "foo", 10)
+	producer.Close()
+
+	for _, disable := range []bool{false, true} {
+		hook := &e2eHook{reqs: make(map[int16][]e2eReq)}
+		opts := []Opt{WithHooks(hook)}
+		if disable {
+			opts = append(opts, DisableTruncationDetection())
+		}
+		cl := newTestClient(t, c, opts...)
+		cl.AssignPartitions(ConsumePartitions(map[string]map[int32]Offset{
+			"foo": {0: NewOffset().At(3).WithEpoch(0)},
+		}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		fetches := cl.PollFetches(ctx)
+		cancel()
+		cl.Close()
+
+		if errs := fetches.Errors(); len(errs) != 0 {
+			t.Fatalf("disable %v: got fetch errors %v", disable, errs)
+		}
+		iter := fetches.RecordIter()
+		if iter.Done() {
+			t.Fatalf("disable %v: got no records", disable)
+		}
+		if r := iter.Next(); r.Offset != 3 {
+			t.Errorf("disable %v: got first offset %d, expected 3", disable, r.Offset)
+		}
+
+		hook.mu.Lock()
+		epochLoads := len(hook.reqs[23])
+		hook.mu.Unlock()
+		if disable && epochLoads != 0 {
+			t.Errorf("got %d offset for leader epoch requests with truncation detection disabled, expected none", epochLoads)
+		} else if !disable && epochLoads == 0 {
+			t.Error("saw no offset for leader epoch requests with truncation detection enabled")
+		}
+	}
+}
+
+func TestOnCursorReset(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	producer := newTestClient(t, c)
+	produceN(t, producer, "foo", 10)
+	producer.Close()
+
+	var mu sync.Mutex
+	var resets []CursorReset
+	cl := newTestClient(t, c, OnCursorReset(func(r CursorReset) {
+		mu.Lock()
+		defer mu.Unlock()
+		resets = append(resets, r)
+	}))
+	defer cl.Close()
+
+	// Consuming past the end resets to the start (the test client's reset
+	// offset) once the fetch is out of range.
+	cl.AssignPartitions(ConsumePartitions(map[string]map[int32]Offset{
+		"foo": {0: NewOffset().At(20)},
+	}))
+	consumeN(t, cl, 10)
+
+	mu.Lock()
+	defer mu.Unlock()
+	exp := []CursorReset{
+		{Topic: "foo", Partition: 0, OldOffset: -1, NewOffset: 20, Reason: CursorResetAssigned},
+		{Topic: "foo", Partition: 0, OldOffset: 20, NewOffset: 0, Reason: CursorResetOutOfRange},
+	}
+	if !reflect.DeepEqual(resets, exp) {
+		t.Errorf("got resets %+v, expected %+v", resets, exp)
+	}
+}
+
+func TestPollFetchesAfterClose(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	loadedCh := make(chan []LoadedPartition, 10)
+	cl := newTestClient(t, c, OnOffsetsLoaded(func(loaded []LoadedPartition) { loadedCh <- loaded }))
+
+	// Consuming at offset 5 in epoch 0 of an empty partition is data loss.
+	cl.AssignPartitions(ConsumePartitions(map[string]map[int32]Offset{
+		"foo": {0: NewOffset().At(5).WithEpoch(0)},
+	}))
+	select {
+	case loaded := <-loadedCh:
+		if _, ok := loaded[0].Err.(*ErrDataLoss); !ok {
+			t.Fatalf("got load err %v, expected data loss", loaded[0].Err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for offsets to load")
+	}
+
+	// We close without polling; the data loss must still be returned,
+	// and polls after close must not block.
+	cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Every poll after close also contains ErrClientClosed.
+	errs := cl.PollFetches(ctx).Errors()
+	if len(errs) != 2 {
+		t.Fatalf("got %d errors after close, expected 2: %v", len(errs), errs)
+	}
+	if _, ok := errs[0].Err.(*ErrDataLoss); !ok {
+		t.Errorf("got err %v after close, expected data loss", errs[0].Err)
+	}
+	if closed := (FetchError{"", -1, ErrClientClosed}); errs[1] != closed {
+		t.Errorf("got err %v after close, expected %v", errs[1], closed)
+	}
+
+	if errs := cl.PollFetches(ctx).Errors(); len(errs) != 1 || errs[0].Err != ErrClientClosed {
+		t.Errorf("got errors %v on a second poll after close, expected only ErrClientClosed", errs)
+	}
+	if ctx.Err() != nil {
+		t.Error("polling after close waited for the context to be done")
+	}
+}
+
+func TestOffsetOutOfRangeResets(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name    string
+		at      int64
+		reset   Offset
+		exp     int64
+		deleted bool
+	}{
+		// Resuming before the log start with the default reset offset
+		// seeks to the start.
+		{"before_start", 2, NewOffset().AtStart(), 5, true},
+		// Resuming before the log start with a different reset offset
+		// uses the reset offset, and still informs of the skip.
+		{"before_start_reset", 2, NewOffset().AtEnd().Relative(-3), 7, true},
+		// Resuming past the end uses the reset offset.
+		{"past_end", 20, NewOffset().AtStart(), 5, false},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+			defer c.Close()
+
+			cl := newTestClient(t, c, ConsumeResetOffset(test.reset))
+			defer cl.Close()
+
+			// Produce one record per batch so that deleting
+			// drops whole batches.
+			for i := 0; i < 10; i++ {
+				produceN(t, cl, "foo", 1)
+			}
+
+			req := kmsg.NewDeleteRecordsRequest()
+			rt := kmsg.NewDeleteRecordsRequestTopic()
+			rt.Topic = "foo"
+			rp := kmsg.NewDeleteRecordsRequestTopicPartition()
+			rp.Offset = 5
+			rt.Partitions = append(rt.Partitions, rp)
+			req.Topics = append(req.Topics, rt)
+			resp, err := req.RequestWith(context.Background(), cl)
+			if err != nil {
+				t.Fatalf("unable to delete records: %v", err)
+			}
+			if err := kerr.ErrorForCode(resp.Topics[0].Partitions[0].ErrorCode); err != nil {
+				t.Fatalf("unable to delete records: %v", err)
+			}
+
+			cl.AssignPartitions(ConsumeTopics(NewOffset().At(test.at), "foo"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var deleted *ErrRecordsDeleted
+			var offsets []int64
+			for len(offsets) == 0 || offsets[len(offsets)-1] < 9 {
+				fetches := cl.PollFetches(ctx)
+				if ctx.Err() != nil {
+					t.Fatalf("timed out after consuming offsets %v", offsets)
+				}
+				for _, err := range fetches.Errors() {
+					if !errors.As(err.Err, &deleted) {
+						t.Fatalf("fetch error on %s[%d]: %v", err.Topic, err.Partition, err.Err)
+					}
+				}
+				for iter := fetches.RecordIter(); !iter.Done(); {
+					offsets = append(offsets, iter.Next().Offset)
+				}
+			}
+
+			if offsets[0] != test.exp {
+				t.Errorf("got first offset %d, expected %d", offsets[0], test.exp)
+			}
+			if !test.deleted {
+				if deleted != nil {
+					t.Errorf("got unexpected %v", deleted)
+				}
+				return
+			}
+			if deleted == nil {
+				t.Fatal("did not see ErrRecordsDeleted")
+			}
+			if deleted.ConsumedTo != test.at || deleted.ResetTo != test.exp {
+				t.Errorf("got consumed to %d reset to %d, expected %d and %d", deleted.ConsumedTo, deleted.ResetTo, test.at, test.exp)
+			}
+		})
+	}
+}
+
+func TestOnPartitionsAdded(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	addedCh := make(chan map[string][]int32, 1)
+	loaded := make(chan struct{})
+	var loadOnce sync.Once
+	cl := newTestClient(t, c,
+		OnPartitionsAdded(func(added map[string][]int32) { addedCh <- added }),
+		OnOffsetsLoaded(func([]LoadedPartition) { loadOnce.Do(func() { close(loaded) }) }),
+	)
+	defer cl.Close()
+
+	// We consume at the end; the record we produce to the new partition
+	// before the consumer sees it must still be consumed.
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtEnd(), "foo"))
+	select {
+	case <-loaded:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the initial partition to load")
+	}
+
+	req := kmsg.NewCreatePartitionsRequest()
+	rt := kmsg.NewCreatePartitionsRequestTopic()
+	rt.Topic = "foo"
+	rt.Count = 2
+	req.Topics = append(req.Topics, rt)
+	resp, err := req.RequestWith(context.Background(), cl)
+	if err != nil {
+		t.Fatalf("unable to create partitions: %v", err)
+	}
+	if err := kerr.ErrorForCode(resp.Topics[0].ErrorCode); err != nil {
+		t.Fatalf("unable to create partitions: %v", err)
+	}
+
+	producer := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	r := &Record{Topic: "foo", Partition: 1, Value: []byte("new")}
+	if err := producer.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+		t.Fatalf("unable to produce: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("produce error: %v", err)
+	}
+
+	cl.ForceMetadataRefresh()
+	select {
+	case added := <-addedCh:
+		if len(added) != 1 || len(added["foo"]) != 1 || added["foo"][0] != 1 {
+			t.Errorf("got added partitions %v, expected foo[1]", added)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for added partitions")
+	}
+
+	if seen := consumeN(t, cl, 1); seen["new"] != 1 {
+		t.Errorf("got %v, expected the record produced to the new partition", seen)
+	}
+}
+
+func TestPauseFetching(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 1)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	consumeN(t, cl, 1)
+
+	cl.PauseFetching()
+	time.Sleep(300 * time.Millisecond) // let any in flight fetch finish
+	lastFetch := cl.ConsumerProgress().LastFetchAttempt
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Producing is unaffected, but nothing is fetched or polled.
+	produceN(t, cl, "foo", 2)
+	pollNothing := func(why string) {
+		pollCtx, pollCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+		defer pollCancel()
+		if iter := cl.PollFetches(pollCtx).RecordIter(); !iter.Done() {
+			t.Fatalf("consumed record %q %s", iter.Next().Value, why)
+		}
+	}
+	pollNothing("while paused")
+	if fetch := cl.ConsumerProgress().LastFetchAttempt; !fetch.Equal(lastFetch) {
+		t.Errorf("fetched at %v while paused, last fetch was at %v", fetch, lastFetch)
+	}
+
+	// The client wide pause still applies after ResumeFetching.
+	cl.Pause()
+	cl.ResumeFetching()
+	pollNothing("while the client is paused")
+	cl.Resume()
+
+	if seen := consumeN(t, cl, 2); len(seen) != 2 || seen["0"] != 1 || seen["1"] != 1 {
+		t.Errorf("got %v after resuming, expected the two records produced while paused", seen)
+	}
+}
+
+func TestConcurrentPoll(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	for _, panics := range []bool{false, true} {
+		var opts []Opt
+		if panics {
+			opts = append(opts, PanicOnConcurrentPoll())
+		}
+		cl := newTestClient(t, c, opts...)
+		cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+		// poll returns ErrConcurrentPoll however the client surfaces it,
+		// or nil if the poll ran alone.
+		var badSurface atomic.Value
+		poll := func(ctx context.Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					if !panics {
+						badSurface.Store(fmt.Sprintf("unexpected panic %v", r))
+					}
+					err, _ = r.(error)
+				}
+			}()
+			errs := cl.PollFetches(ctx).Errors()
+			if len(errs) == 0 {
+				return nil
+			}
+			if panics {
+				badSurface.Store(fmt.Sprintf("got errors %v, expected a panic", errs))
+			} else if errs[0].Topic != "" || errs[0].Partition != -1 {
+				badSurface.Store(fmt.Sprintf("got concurrent poll error on %s/%d, expected no topic and partition -1", errs[0].Topic, errs[0].Partition))
+			}
+			return errs[0].Err
+		}
+		canceled, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// Nothing is produced, so this poll waits until canceled. If it
+		// starts while a probe below is polling, it is the concurrent
+		// poll and simply tries again.
+		ctx, stop := context.WithCancel(context.Background())
+		polled := make(chan error, 1)
+		go func() {
+			for {
+				if err := poll(ctx); !errors.Is(err, ErrConcurrentPoll) {
+					polled <- err
+					return
+				}
+			}
+		}()
+
+		deadline := time.Now().Add(5 * time.Second)
+		var err error
+		for err = poll(canceled); err == nil && time.Now().Before(deadline); err = poll(canceled) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !errors.Is(err, ErrConcurrentPoll) {
+			t.Errorf("panics %v: got %v, expected ErrConcurrentPoll", panics, err)
+		}
+
+		stop()
+		if err := <-polled; err != nil {
+			t.Errorf("panics %v: waiting poll got %v, expected nothing", panics, err)
+		}
+
+		// Once the waiting poll returns, polling is valid again.
+		if err := poll(canceled); err != nil {
+			t.Errorf("panics %v: got %v polling after the waiting poll returned", panics, err)
+		}
+		if bad := badSurface.Load(); bad != nil {
+			t.Errorf("panics %v: %v", panics, bad)
+		}
+		cl.Close()
+	}
+}
+
+func TestOnCursorStateChange(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	var (
+		mu     sync.Mutex
+		states []CursorState
+	)
+	cl := newTestClient(t, c, OnCursorStateChange(func(topic string, partition int32, state CursorState) {
+		if topic == "foo" && partition == 0 {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, state)
+		}
+	}))
+	defer cl.Close()
+
+	waitFor := func(exp ...CursorState) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			mu.Lock()
+			got := append([]CursorState(nil), states...)
+			mu.Unlock()
+			if reflect.DeepEqual(got, exp) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got states %v, expected %v", got, exp)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	waitFor(CursorLoading, CursorUsable)
+
+	cl.Pause()
+	waitFor(CursorLoading, CursorUsable, CursorPaused)
+
+	cl.Resume()
+	waitFor(CursorLoading, CursorUsable, CursorPaused, CursorUsable)
+
+	cl.AssignPartitions()
+	waitFor(CursorLoading, CursorUsable, CursorPaused, CursorUsable, CursorUnset)
+}
+
+func TestFetchesPollState(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 1)
+
+	c.InjectFault(1, kfake.Fault{ThrottleMillis: 1})
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var throttled bool
+	for consumed := false; !consumed; {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatal("timed out waiting for the produced record")
+		}
+		throttled = throttled || fetches.WasThrottled()
+		consumed = !fetches.RecordIter().Done()
+		if fetches.IsClientClosed() {
+			t.Fatal("client unexpectedly closed")
+		}
+	}
+	if !throttled {
+		t.Error("fetches were not throttled, expected the injected throttle")
+	}
+
+	pollCtx, pollCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	fetches := cl.PollFetches(pollCtx)
+	pollCancel()
+	if !fetches.Empty() || fetches.WasThrottled() || fetches.IsClientClosed() {
+		t.Errorf("idle poll: got empty %v, throttled %v, closed %v; expected only empty",
+			fetches.Empty(), fetches.WasThrottled(), fetches.IsClientClosed())
+	}
+
+	cl.Close()
+	if fetches := cl.PollFetches(ctx); !fetches.IsClientClosed() {
+		t.Error("poll after close was not marked as client closed")
+	}
+}
+
+func TestOffsetLoadRetriesLeaderEpochErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, code := range []int16{kerr.FencedLeaderEpoch.Code, kerr.UnknownLeaderEpoch.Code} {
+		code := code
+		t.Run(kerr.ErrorForCode(code).(*kerr.Error).Message, func(t *testing.T) {
+			t.Parallel()
+
+			c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+			defer c.Close()
+
+			var (
+				mu     sync.Mutex
+				loaded []error
+			)
+			cl := newTestClient(t, c, OnOffsetsLoaded(func(ls []LoadedPartition) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, l := range ls {
+					loaded = append(loaded, l.Err)
+				}
+			}))
+			defer cl.Close()
+
+			produceN(t, cl, "foo", 1)
+
+			c.InjectFault(2, kfake.Fault{PartitionErrorCode: code})
+			cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			for consumed := false; !consumed; {
+				fetches := cl.PollFetches(ctx)
+				if ctx.Err() != nil {
+					t.Fatal("timed out waiting for the produced record")
+				}
+				for _, err := range fetches.Errors() {
+					t.Fatalf("fetch error on %s[%d]: %v", err.Topic, err.Partition, err.Err)
+				}
+				consumed = !fetches.RecordIter().Done()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(loaded) != 2 || loaded[0] != kerr.ErrorForCode(code) || loaded[1] != nil {
+				t.Errorf("got offset loads %v, expected the injected error and then a successful reload", loaded)
+			}
+		})
+	}
+}
+
+func TestCancelPoll(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// With nothing assigned, polls only return once canceled.
+	polled := make(chan Fetches, 1)
+	go func() { polled <- cl.PollFetches(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-polled:
+		t.Fatal("poll returned before being canceled")
+	default:
+	}
+	cl.CancelPoll()
+	select {
+	case fetches := <-polled:
+		if len(fetches) != 0 {
+			t.Errorf("got fetches %v from a canceled poll, expected none", fetches)
+		}
+	case <-ctx.Done():
+		t.Fatal("canceled poll did not return")
+	}
+
+	// A cancel before polling returns the next poll immediately, and is
+	// then consumed: the following poll waits for its context.
+	cl.CancelPoll()
+	cl.CancelPoll()
+	cl.PollFetches(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("poll after cancel waited for the context to be done")
+	}
+	shortCtx, shortCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	cl.PollFetches(shortCtx)
+	if shortCtx.Err() == nil {
+		t.Error("poll returned before its context was done, expected the cancel to be consumed")
+	}
+	shortCancel()
+
+	// Polling is otherwise unaffected.
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	produceN(t, cl, "foo", 1)
+	if seen := consumeN(t, cl, 1); seen["0"] != 1 {
+		t.Errorf("got %v, expected to consume the produced record", seen)
+	}
+}
+
+func TestPollFetchesBytes(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	produce := func(value string) {
+		errs := make(chan error, 1)
+		r := &Record{Topic: "foo", Value: []byte(value)}
+		if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("produce error: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		produce(fmt.Sprintf("%03d", i) + strings.Repeat("x", 97))
+	}
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+	// Each 100 byte record is split from the rest of its fetch so that
+	// no poll returns more than 250 bytes.
+	var offsets []int64
+	for len(offsets) < 10 {
+		fetches := cl.PollFetchesBytes(ctx, 250)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out after consuming offsets %v", offsets)
+		}
+		var polled int
+		for iter := fetches.RecordIter(); !iter.Done(); polled++ {
+			r := iter.Next()
+			if exp := fmt.Sprintf("%03d", len(offsets)); !strings.HasPrefix(string(r.Value), exp) {
+				t.Fatalf("got record %.3s at offset %d, expected %s", r.Value, r.Offset, exp)
+			}
+			offsets = append(offsets, r.Offset)
+		}
+		if polled > 2 {
+			t.Errorf("polled %d records of 100 bytes, expected at most 2", polled)
+		}
+	}
+
+	// A record larger than the limit is returned on its own, and fetching
+	// resumes once the prior fetch is fully drained.
+	produce(strings.Repeat("y", 1000))
+	for {
+		fetches := cl.PollFetchesBytes(ctx, 250)
+		if ctx.Err() != nil {
+			t.Fatal("timed out waiting for the large record")
+		}
+		var records []*Record
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			records = append(records, iter.Next())
+		}
+		if len(records) > 0 {
+			if len(records) != 1 || len(records[0].Value) != 1000 || records[0].Offset != 10 {
+				t.Errorf("got %d records, expected only the large record at offset 10", len(records))
+			}
+			break
+		}
+	}
+}
+
+func TestBufferedFetchStats(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		if stat := cl.BufferedFetchStats()["foo"][0]; stat.Records == 10 {
+			if stat.Bytes != 10 { // values "0" through "9"
+				t.Errorf("got %d buffered bytes, expected 10", stat.Bytes)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for buffered records, stats: %v", cl.BufferedFetchStats())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	numRecords := func(fs Fetches) (n int) {
+		for iter := fs.RecordIter(); !iter.Done(); iter.Next() {
+			n++
+		}
+		return n
+	}
+
+	// Polling 4 bytes leaves 6 records buffered.
+	if n := numRecords(cl.PollFetchesBytes(ctx, 4)); n != 4 {
+		t.Fatalf("polled %d records, expected 4", n)
+	}
+	if stat := cl.BufferedFetchStats()["foo"][0]; stat.Records != 6 || stat.Bytes != 6 {
+		t.Errorf("got stat %+v after partial poll, expected 6 records and bytes", stat)
+	}
+	if n := numRecords(cl.PollFetches(ctx)); n != 6 {
+		t.Fatalf("polled %d records, expected 6", n)
+	}
+	if stats := cl.BufferedFetchStats(); len(stats) != 0 {
+		t.Errorf("got stats %v after polling everything, expected none", stats)
+	}
+}
+
+func TestRedeliveredErrsSorted(t *testing.T) {
+	t.Parallel()
+
+	var c consumer
+	c.trackPendingFakeErrsLocked([]Fetch{
+		fakeFetch("foo", 2, ErrPartitionDeleted),
+		fakeFetch("bar", 1, ErrPartitionDeleted),
+		fakeFetch("foo", 0, ErrPartitionDeleted),
+		fakeFetch("bar", 0, ErrPartitionDeleted),
+		fakeFetch("foo", 1, ErrPartitionDeleted),
+	}, 1)
+
+	exp := []FetchError{{"bar", 0, nil}, {"bar", 1, nil}, {"foo", 0, nil}, {"foo", 1, nil}, {"foo", 2, nil}}
+	for i := 0; i < 10; i++ {
+		errs := c.appendRedelivered(nil, 2).Errors()
+		for j := range errs {
+			errs[j].Err = nil
+		}
+		if !reflect.DeepEqual(errs, exp) {
+			t.Fatalf("got redelivered errors %v, expected %v", errs, exp)
+		}
+	}
+}
+
+func TestRedeliverPartitionErrorsUntilSeeked(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name   string
+		assign func(*Client)
+		seek   func(*Client) // seeks partition 0 to offset 1
+
+		// SetOffsets only moves partitions that have a cursor, and
+		// the failed list left none, so it only stops the errors.
+		resumes bool
+	}{
+		{
+			"set_offsets",
+			func(cl *Client) { cl.AssignGroup("group", GroupTopics("foo"), DisableAutoCommit()) },
+			func(cl *Client) { cl.SetOffsets(map[string]map[int32]EpochOffset{"foo": {0: {Epoch: -1, Offset: 1}}}) },
+			false,
+		},
+		{
+			"reassign",
+			func(cl *Client) {
+				cl.AssignPartitions(ConsumePartitions(map[string]map[int32]Offset{"foo": {0: NewOffset().AtStart()}}))
+			},
+			func(cl *Client) {
+				cl.AssignPartitions(ConsumePartitions(map[string]map[int32]Offset{"foo": {0: NewOffset().At(1)}}))
+			},
+			true,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+			defer c.Close()
+
+			producer := newTestClient(t, c)
+			produceN(t, producer, "foo", 3)
+			producer.Close()
+
+			// Listing the start offset fails with a fatal error,
+			// which is returned in a fake fetch and leaves the
+			// partition unconsumed.
+			c.InjectFault(2, kfake.Fault{PartitionErrorCode: kerr.TopicAuthorizationFailed.Code})
+			cl := newTestClient(t, c, RedeliverPartitionErrorsUntilSeeked())
+			defer cl.Close()
+			test.assign(cl)
+
+			poll := func(timeout time.Duration) Fetches {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				return cl.PollFetches(ctx)
+			}
+			isAuthErr := func(errs []FetchError) bool {
+				return len(errs) == 1 && errs[0].Topic == "foo" && errs[0].Partition == 0 && errs[0].Err == kerr.TopicAuthorizationFailed
+			}
+
+			if errs := poll(10 * time.Second).Errors(); !isAuthErr(errs) {
+				t.Fatalf("got errors %v, expected the list offsets error", errs)
+			}
+
+			// Every later poll returns the error again, even with
+			// nothing else to return.
+			for i := 0; i < 3; i++ {
+				if errs := poll(100 * time.Millisecond).Errors(); !isAuthErr(errs) {
+					t.Fatalf("poll %d: got errors %v, expected the error redelivered", i, errs)
+				}
+			}
+
+			// Seeking the partition stops redelivering, and a
+			// reassigned partition is consumed from where we
+			// seeked to.
+			test.seek(cl)
+			if !test.resumes {
+				for i := 0; i < 3; i++ {
+					if errs := poll(100 * time.Millisecond).Errors(); len(errs) != 0 {
+						t.Fatalf("poll %d: got errors %v after seeking, expected none", i, errs)
+					}
+				}
+				return
+			}
+			var offsets []int64
+			for len(offsets) < 2 {
+				fetches := poll(10 * time.Second)
+				if errs := fetches.Errors(); len(errs) != 0 {
+					t.Fatalf("got errors %v after seeking, expected none", errs)
+				}
+				for iter := fetches.RecordIter(); !iter.Done(); {
+					offsets = append(offsets, iter.Next().Offset)
+				}
+			}
+			if !reflect.DeepEqual(offsets, []int64{1, 2}) {
+				t.Errorf("got offsets %v after seeking, expected [1 2]", offsets)
+			}
+			if errs := poll(100 * time.Millisecond).Errors(); len(errs) != 0 {
+				t.Errorf("got errors %v once caught up after seeking, expected none", errs)
+			}
+		})
+	}
+}
+
+func TestMissingPartitionGracePeriod(t *testing.T) {
+	t.Parallel()
+
+	const grace = time.Second
+	for _, test := range []struct {
+		name     string
+		recreate bool // whether foo comes back within the grace period
+	}{
+		{"returns_within_grace", true},
+		{"missing_past_grace", false},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+			defer c.Close()
+
+			admin := newTestClient(t, c)
+			defer admin.Close()
+			request := func(req kmsg.Request) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if _, err := admin.Request(ctx, req); err != nil {
+					t.Fatalf("unable to issue %T: %v", req, err)
+				}
+			}
+
+			// Missing partitions are only expired on metadata
+			// refreshes, so we refresh regularly.
+			cl := newTestClient(t, c, MissingPartitionGracePeriod(grace), MetadataMaxAge(200*time.Millisecond))
+			defer cl.Close()
+			cl.AssignPartitions(ConsumePartitions(map[string]map[int32]Offset{"foo": {0: NewOffset().AtStart()}}))
+
+			produceN(t, admin, "foo", 1)
+			consumeN(t, cl, 1)
+
+			// Only our consumer asks for foo's metadata once it is
+			// deleted: the admin client no longer produces to it.
+			missing := make(chan struct{}, 1)
+			c.ObserveKey(3, func(_ kmsg.Request, kresp kmsg.Response) {
+				for _, rt := range kresp.(*kmsg.MetadataResponse).Topics {
+					if rt.Topic == "foo" && rt.ErrorCode == kerr.UnknownTopicOrPartition.Code {
+						select {
+						case missing <- struct{}{}:
+						default:
+						}
+					}
+				}
+			})
+
+			del := kmsg.NewPtrDeleteTopicsRequest()
+			del.TopicNames = []string{"foo"}
+			del.Topics = []kmsg.DeleteTopicsRequestTopic{{Topic: kmsg.StringPtr("foo")}}
+			request(del)
+			deletedAt := time.Now()
+
+			if test.recreate {
+				// The metadata loop is serial: once a second
+				// response with foo missing is sent, the client
+				// has merged the first and is tracking foo as
+				// missing.
+				for i := 0; i < 2; i++ {
+					select {
+					case <-missing:
+					case <-time.After(10 * time.Second):
+						t.Fatal("client did not see foo missing")
+					}
+				}
+				create := kmsg.NewPtrCreateTopicsRequest()
+				rt := kmsg.NewCreateTopicsRequestTopic()
+				rt.Topic, rt.NumPartitions, rt.ReplicationFactor = "foo", 1, 1
+				create.Topics = append(create.Topics, rt)
+				request(create)
+				if elapsed := time.Since(deletedAt); elapsed >= grace {
+					t.Fatalf("recreating foo took %v, longer than the grace period", elapsed)
+				}
+
+				// Our cursor is at offset 1 from before foo was
+				// deleted; the second record is consumed.
+				produceN(t, admin, "foo", 2)
+				consumeN(t, cl, 1)
+
+				// Once foo is back, it is no longer missing:
+				// nothing is declared deleted after the grace
+				// period would have elapsed.
+				ctx, cancel := context.WithTimeout(context.Background(), 2*grace)
+				defer cancel()
+				for ctx.Err() == nil {
+					if errs := cl.PollFetches(ctx).Errors(); len(errs) > 0 && ctx.Err() == nil {
+						t.Fatalf("got errors %v after foo came back, expected none", errs)
+					}
+				}
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for {
+				fetches := cl.PollFetches(ctx)
+				if ctx.Err() != nil {
+					t.Fatal("timed out waiting for ErrPartitionDeleted")
+				}
+				errs := fetches.Errors()
+				if len(errs) == 0 {
+					continue
+				}
+				if len(errs) != 1 || errs[0].Topic != "foo" || errs[0].Partition != 0 || errs[0].Err != ErrPartitionDeleted {
+					t.Fatalf("got errors %v, expected ErrPartitionDeleted for foo[0]", errs)
+				}
+				if elapsed := time.Since(deletedAt); elapsed < grace {
+					t.Errorf("partition declared deleted after %v, before the grace period of %v", elapsed, grace)
+				}
+				return
+			}
+		})
+	}
+}
+
+func TestStopAtConsumeComplete(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(3, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer cl.Close()
+
+	errs := make(chan error, 30)
+	for i := 0; i < 30; i++ {
+		r := &Record{Topic: "foo", Partition: int32(i % 3)}
+		if err := cl.Produce(context.Background(), r, func(_ *Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("produce error: %v", err)
+		}
+	}
+
+	// Each round reassigns while the prior round's partitions may still
+	// be fetching, which must not race with setting the new stops.
+	for _, stop := range []int64{5, 8, 3} {
+		cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart().StopAt(stop), "foo"))
+		complete := cl.ConsumeComplete()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		consumed := make(map[int32][]int64)
+	poll:
+		for {
+			fetches := cl.PollFetches(ctx)
+			if ctx.Err() != nil {
+				cancel()
+				t.Fatalf("stop %d: timed out waiting for ConsumeComplete, consumed %v", stop, consumed)
+			}
+			for _, err := range fetches.Errors() {
+				t.Fatalf("stop %d: fetch error on %s[%d]: %v", stop, err.Topic, err.Partition, err.Err)
+			}
+			for iter := fetches.RecordIter(); !iter.Done(); {
+				r := iter.Next()
+				consumed[r.Partition] = append(consumed[r.Partition], r.Offset)
+			}
+			select {
+			case <-complete:
+				break poll
+			default:
+			}
+		}
+		cancel()
+
+		for p := int32(0); p < 3; p++ {
+			if got := consumed[p]; int64(len(got)) != stop || got[len(got)-1] != stop-1 {
+				t.Errorf("stop %d: partition %d consumed offsets %v, expected 0 thru %d", stop, p, got, stop-1)
+			}
+		}
+	}
+}
@@ -3,22 +3,17 @@ package kgo
 import (
 	"errors"
 	"fmt"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
 )
 
 var (
-	// ErrUnknownRequestKey is returned when using a kmsg.Request with a
-	// key larger than kmsg.MaxKey.
-	ErrUnknownRequestKey = errors.New("request key is unknown")
-
 	// ErrClientTooOld is returned when issuing request that are unknown or
 	// use an unknown version.
 	ErrClientTooOld = errors.New("client is too old; this client does not know what to do with this request")
 
-	// ErrBrokerTooOld is returned if a connection has loaded broker
-	// ApiVersions and knows that a broker cannot handle the request that
-	// is attempting to be issued.
-	ErrBrokerTooOld = errors.New("broker is too old; the broker has already indicated it will not know how to handle the request")
-
 	// ErrNoResp is the error used if Kafka does not reply to a topic or
 	// partition in a produce request. This error should never be seen.
 	ErrNoResp = errors.New("message was not replied to in a response")
@@ -36,7 +31,9 @@ var (
 	ErrNoDial = errors.New("unable to dial the broker")
 
 	// ErrConnDead is a temporary error returned when any read or write to
-	// a broker connection errors.
+	// a broker connection errors. Requests that only read state, such as
+	// metadata requests, that were waiting on a response when the
+	// connection died are issued again once before failing with this.
 	ErrConnDead = errors.New("connection is dead")
 
 	// ErrInvalidRespSize is a potentially temporary error returned when
@@ -58,8 +55,15 @@ var (
 	// If this error happens, the client closes the broker connection.
 	ErrCorrelationIDMismatch = errors.New("correlation ID mismatch")
 
+	// ErrClientClosed is returned in a fake fetch from PollFetches once
+	// the client is closed, with an empty topic and partition -1. See
+	// Fetches.IsClientClosed.
+	ErrClientClosed = errors.New("client closed")
+
 	// ErrNoPartitionsAvailable is returned immediately when producing a
 	// non-consistent record to a topic that has no writable partitions.
+	// It is also returned for records to a topic that a metadata load
+	// failed to find if RequestRetries is one or less.
 	ErrNoPartitionsAvailable = errors.New("no partitions available")
 
 	// ErrPartitionDeleted is returned when a partition that was being
@@ -68,13 +72,29 @@ var (
 	// Kafka does not allow downsizing partition counts in Kafka, so this
 	// error should generally not appear. This will only appear if a topic
 	// is deleted and recreated with fewer partitions.
+	//
+	// This is also returned in a fake fetch when consuming with
+	// MissingPartitionGracePeriod and a consumed partition stays missing
+	// from metadata past the grace period.
 	ErrPartitionDeleted = errors.New("partition no longer exists")
 
+	// ErrFetchRestricted is returned in a fake fetch when a consumed
+	// partition is not fetched because its leader is not one of the
+	// brokers allowed with RestrictFetchToBrokers. The partition is
+	// consumed once its leader moves to an allowed broker.
+	ErrFetchRestricted = errors.New("partition leader is not an allowed fetch broker")
+
 	// ErrInvalidPartition is returned if the partitioner chooses a
 	// partition that does not exist (returns a partition larger than what
 	// was available).
 	ErrInvalidPartition = errors.New("invalid partition chosen from partitioner")
 
+	// ErrRecordRetries is returned when records fail after being retried
+	// too many times; see ProduceRetries. The error records fail with is
+	// ErrRecordRetries for errors.Is and unwraps to the error from the
+	// final try, if known.
+	ErrRecordRetries = errors.New("record failed after being retried too many times")
+
 	// ErrRecordTimeout is returned when records are unable to be produced
 	// and they hit the configured record timeout limit.
 	ErrRecordTimeout = errors.New("records have timed out before they were able to be produced")
@@ -106,6 +126,16 @@ var (
 	// ErrCommitWithFatalID is returned when trying to commit in
 	// EndTransaction with a producer ID that has failed.
 	ErrCommitWithFatalID = errors.New("cannot commit with a fatal producer id; retry with an abort")
+
+	// ErrConcurrentPoll is returned when PollFetches or PollFetchesBytes
+	// is called while another poll is still running. See
+	// PanicOnConcurrentPoll to panic instead.
+	ErrConcurrentPoll = errors.New("invalid concurrent poll; PollFetches and PollFetchesBytes must be called from a single goroutine")
+
+	// ErrConcurrentAutoCommit is returned from ConsumeConcurrently when
+	// consuming as a group with autocommitting enabled, which commits what
+	// has been polled rather than what has been processed.
+	ErrConcurrentAutoCommit = errors.New("ConsumeConcurrently cannot be used with autocommitting; use DisableAutoCommit")
 )
 
 // ErrDataLoss is returned for Kafka >=2.1.0 when data loss is detected and the
@@ -123,6 +153,77 @@ type ErrDataLoss struct {
 	ResetTo int64
 }
 
+// ErrRecordsDeleted is returned when the offset a partition was being consumed
+// from no longer exists because it is before the partition's log start offset,
+// such as when retention deletes records while a consumer is down. The client
+// resets to the ConsumeResetOffset, by default the log start offset, and
+// continues consuming; this error only informs of the skip.
+type ErrRecordsDeleted struct {
+	// Topic is the topic records were deleted from.
+	Topic string
+	// Partition is the partition records were deleted from.
+	Partition int32
+	// ConsumedTo is what the client had consumed to for this partition
+	// before the records were deleted.
+	ConsumedTo int64
+	// ResetTo is the offset the client reset to; everything from
+	// ConsumedTo to ResetTo was skipped.
+	ResetTo int64
+}
+
+// ErrRecordTooLarge is returned in a record's promise when the record is
+// larger than the limit set with MaxRecordBytes. This unwraps to
+// kerr.MessageTooLarge.
+type ErrRecordTooLarge struct {
+	// Size is the uncompressed size of the record, measured as described
+	// in MaxRecordBytes.
+	Size int32
+	// Limit is the MaxRecordBytes limit.
+	Limit int32
+}
+
+// ErrSeedBrokers is returned when the client cannot load its first metadata
+// from any seed broker with SeedBrokerRetries or InitialMetadataTimeout.
+type ErrSeedBrokers struct {
+	// Seeds contains the last failure from each seed broker, in the order
+	// the seeds were specified.
+	Seeds []SeedBrokerFailure
+}
+
+// SeedBrokerFailure is why a request to a seed broker failed.
+type SeedBrokerFailure struct {
+	// Addr is the seed's address, as specified in SeedBrokers.
+	Addr string
+	// Err is the error from the last request to the seed.
+	Err error
+}
+
+func (e *ErrSeedBrokers) Error() string {
+	var sb strings.Builder
+	sb.WriteString("unable to load metadata from any seed broker")
+	for i, seed := range e.Seeds {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%s: %v", seed.Addr, seed.Err)
+	}
+	return sb.String()
+}
+
+// Unwrap returns the failure from the first seed broker, allowing errors.Is
+// and errors.As to check why seeds failed, such as for a dial or SASL error.
+// The failures from every seed are in Seeds.
+func (e *ErrSeedBrokers) Unwrap() error {
+	for _, seed := range e.Seeds {
+		if seed.Err != nil {
+			return seed.Err
+		}
+	}
+	return nil
+}
+
 // ErrLargeRespSize is return when Kafka replies that a response will be more
 // bytes than this client allows (see the BrokerMaxReadBytes option).
 //
@@ -139,12 +240,98 @@ func (e *ErrLargeRespSize) Error() string {
 		e.Size, e.Limit)
 }
 
+// ErrUnknownRequestKey is returned when using a kmsg.Request with a key larger
+// than kmsg.MaxKey, or with a key that is not present in the client's
+// MaxVersions.
+//
+// This used to be a sentinel error; check for it with errors.As rather than
+// comparing against a variable.
+type ErrUnknownRequestKey struct {
+	// Key is the key of the request that was attempted.
+	Key int16
+}
+
+func (e *ErrUnknownRequestKey) Error() string {
+	return fmt.Sprintf("request key %d is unknown", e.Key)
+}
+
+// ErrBrokerTooOld is returned if a connection has loaded broker ApiVersions
+// and knows that a broker cannot handle the request that is attempting to be
+// issued, either because the broker does not support the request at all or
+// because the broker's max version is lower than the client's configured
+// MinVersions.
+//
+// This used to be a sentinel error; check for it with errors.As rather than
+// comparing against a variable.
+type ErrBrokerTooOld struct {
+	// Key is the key of the request that was attempted.
+	Key int16
+	// MinVersion is the minimum version the client requires for this
+	// request: the MinVersions version if configured, otherwise 0.
+	MinVersion int16
+	// BrokerMaxVersion is the maximum version the broker supports for
+	// this request, or -1 if the broker does not support the request.
+	BrokerMaxVersion int16
+}
+
+func (e *ErrBrokerTooOld) Error() string {
+	if e.BrokerMaxVersion < 0 {
+		return fmt.Sprintf("broker is too old; the broker does not support %s (key %d)",
+			kmsg.NameForKey(e.Key), e.Key)
+	}
+	return fmt.Sprintf("broker is too old; the broker supports %s (key %d) up to v%d but the client requires v%d",
+		kmsg.NameForKey(e.Key), e.Key, e.BrokerMaxVersion, e.MinVersion)
+}
+
+// ErrUnsupportedFeature is returned for produced records when a broker rejects
+// a batch with UNSUPPORTED_COMPRESSION_TYPE or UNSUPPORTED_FOR_MESSAGE_FORMAT.
+// These errors come from older brokers, or topics with an old message format,
+// that cannot handle a feature the client used.
+type ErrUnsupportedFeature struct {
+	// Topic is the topic the batch was produced to.
+	Topic string
+	// Partition is the partition the batch was produced to.
+	Partition int32
+	// NodeID is the broker that rejected the batch.
+	NodeID int32
+	// BrokerVersion is the client's best guess of the broker's Kafka
+	// version (see kversion.Versions.VersionGuess), or "unknown".
+	BrokerVersion string
+	// Feature is the feature the broker most likely does not support,
+	// such as "zstd compression", "transactions", "record headers", or
+	// "idempotent produce".
+	Feature string
+	// Err is the underlying *kerr.Error.
+	Err error
+}
+
+func (e *ErrUnsupportedFeature) Error() string {
+	return fmt.Sprintf("broker %d (Kafka %s) does not support %s for topic %s partition %d: %v",
+		e.NodeID, e.BrokerVersion, e.Feature, e.Topic, e.Partition, e.Err)
+}
+
+// Unwrap returns the underlying *kerr.Error.
+func (e *ErrUnsupportedFeature) Unwrap() error { return e.Err }
+
+func (e *ErrRecordTooLarge) Error() string {
+	return fmt.Sprintf("record size %d is larger than the max record bytes %d", e.Size, e.Limit)
+}
+
+// Unwrap returns kerr.MessageTooLarge.
+func (*ErrRecordTooLarge) Unwrap() error { return kerr.MessageTooLarge }
+
 func (e *ErrDataLoss) Error() string {
 	return fmt.Sprintf("topic %s partition %d lost records;"+
 		" the client consumed to offset %d but was reset to offset %d",
 		e.Topic, e.Partition, e.ConsumedTo, e.ResetTo)
 }
 
+func (e *ErrRecordsDeleted) Error() string {
+	return fmt.Sprintf("topic %s partition %d records were deleted;"+
+		" the client consumed to offset %d and reset to offset %d",
+		e.Topic, e.Partition, e.ConsumedTo, e.ResetTo)
+}
+
 func isRetriableBrokerErr(err error) bool {
 	switch err {
 	case ErrBrokerDead,
@@ -157,6 +344,20 @@ func isRetriableBrokerErr(err error) bool {
 	return false
 }
 
+// errRecordRetries is what records fail with once they have been tried too
+// many times: it is ErrRecordRetries and unwraps to the error from the final
+// try.
+type errRecordRetries struct {
+	err error
+}
+
+func (e *errRecordRetries) Error() string {
+	return fmt.Sprintf("%v: %v", ErrRecordRetries, e.err)
+}
+
+func (e *errRecordRetries) Is(target error) bool { return target == ErrRecordRetries }
+func (e *errRecordRetries) Unwrap() error        { return e.err }
+
 type errUnknownController struct {
 	id int32
 }
@@ -0,0 +1,252 @@
+package kgo
+
+import (
+	"github.com/twmb/franz-go/pkg/kbin"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// pooledFetchResponse is a fetch response that, when read into, decodes into
+// the topic, partition, and aborted transaction slices it decoded into last
+// time if they have enough capacity, rather than allocating new slices. This
+// is only used for ReuseFetchResponses; kmsg itself always allocates new
+// slices when decoding.
+type pooledFetchResponse struct {
+	kmsg.FetchResponse
+}
+
+func (r *pooledFetchResponse) ReadFrom(src []byte) error {
+	return readFetchResponseReusing(&r.FetchResponse, src)
+}
+
+// readFetchResponseReusing is kmsg.FetchResponse.ReadFrom, modified to reuse
+// the slices already in v.
+func readFetchResponseReusing(v *kmsg.FetchResponse, src []byte) error {
+	v.Default()
+	b := kbin.Reader{Src: src}
+	version := v.Version
+	_ = version
+	isFlexible := version >= 12
+	_ = isFlexible
+	s := v
+	if version >= 1 {
+		v := b.Int32()
+		s.ThrottleMillis = v
+	}
+	if version >= 7 {
+		v := b.Int16()
+		s.ErrorCode = v
+	}
+	if version >= 7 {
+		v := b.Int32()
+		s.SessionID = v
+	}
+	{
+		v := s.Topics
+		a := v
+		var l int32
+		if isFlexible {
+			l = b.CompactArrayLen()
+		} else {
+			l = b.ArrayLen()
+		}
+		if !b.Ok() {
+			return b.Complete()
+		}
+		if l > 0 {
+			if int(l) <= cap(a) {
+				a = a[:l]
+			} else {
+				a = make([]kmsg.FetchResponseTopic, l)
+			}
+		}
+		for i := int32(0); i < l; i++ {
+			v := &a[i]
+			v.Default()
+			s := v
+			{
+				var v string
+				if isFlexible {
+					v = b.CompactString()
+				} else {
+					v = b.String()
+				}
+				s.Topic = v
+			}
+			{
+				v := s.Partitions
+				a := v
+				var l int32
+				if isFlexible {
+					l = b.CompactArrayLen()
+				} else {
+					l = b.ArrayLen()
+				}
+				if !b.Ok() {
+					return b.Complete()
+				}
+				if l > 0 {
+					if int(l) <= cap(a) {
+						a = a[:l]
+					} else {
+						a = make([]kmsg.FetchResponseTopicPartition, l)
+					}
+				}
+				for i := int32(0); i < l; i++ {
+					v := &a[i]
+					v.Default()
+					s := v
+					{
+						v := b.Int32()
+						s.Partition = v
+					}
+					{
+						v := b.Int16()
+						s.ErrorCode = v
+					}
+					{
+						v := b.Int64()
+						s.HighWatermark = v
+					}
+					if version >= 4 {
+						v := b.Int64()
+						s.LastStableOffset = v
+					}
+					if version >= 5 {
+						v := b.Int64()
+						s.LogStartOffset = v
+					}
+					if version >= 4 {
+						v := s.AbortedTransactions
+						a := v
+						var l int32
+						if isFlexible {
+							l = b.CompactArrayLen()
+						} else {
+							l = b.ArrayLen()
+						}
+						if version < 0 || l == 0 {
+							a = []kmsg.FetchResponseTopicPartitionAbortedTransaction{}
+						}
+						if !b.Ok() {
+							return b.Complete()
+						}
+						if l > 0 {
+							if int(l) <= cap(a) {
+								a = a[:l]
+							} else {
+								a = make([]kmsg.FetchResponseTopicPartitionAbortedTransaction, l)
+							}
+						}
+						for i := int32(0); i < l; i++ {
+							v := &a[i]
+							v.Default()
+							s := v
+							{
+								v := b.Int64()
+								s.ProducerID = v
+							}
+							{
+								v := b.Int64()
+								s.FirstOffset = v
+							}
+							if isFlexible {
+								kmsg.SkipTags(&b)
+							}
+						}
+						v = a
+						s.AbortedTransactions = v
+					}
+					if version >= 11 {
+						v := b.Int32()
+						s.PreferredReadReplica = v
+					}
+					{
+						var v []byte
+						if isFlexible {
+							v = b.CompactNullableBytes()
+						} else {
+							v = b.NullableBytes()
+						}
+						s.RecordBatches = v
+					}
+					if isFlexible {
+						for i := b.Uvarint(); i > 0; i-- {
+							switch b.Uvarint() {
+							default:
+								b.Span(int(b.Uvarint()))
+							case 0:
+								b := kbin.Reader{Src: b.Span(int(b.Uvarint()))}
+								v := &s.DivergingEpoch
+								v.Default()
+								s := v
+								{
+									v := b.Int32()
+									s.Epoch = v
+								}
+								{
+									v := b.Int32()
+									s.EndOffset = v
+								}
+								if isFlexible {
+									kmsg.SkipTags(&b)
+								}
+								if err := b.Complete(); err != nil {
+									return err
+								}
+							case 1:
+								b := kbin.Reader{Src: b.Span(int(b.Uvarint()))}
+								v := &s.CurrentLeader
+								v.Default()
+								s := v
+								{
+									v := b.Int32()
+									s.LeaderID = v
+								}
+								{
+									v := b.Int32()
+									s.LeaderEpoch = v
+								}
+								if isFlexible {
+									kmsg.SkipTags(&b)
+								}
+								if err := b.Complete(); err != nil {
+									return err
+								}
+							case 2:
+								b := kbin.Reader{Src: b.Span(int(b.Uvarint()))}
+								v := &s.SnapshotID
+								v.Default()
+								s := v
+								{
+									v := b.Int64()
+									s.EndOffset = v
+								}
+								{
+									v := b.Int32()
+									s.Epoch = v
+								}
+								if isFlexible {
+									kmsg.SkipTags(&b)
+								}
+								if err := b.Complete(); err != nil {
+									return err
+								}
+							}
+						}
+					}
+				}
+				v = a
+				s.Partitions = v
+			}
+			if isFlexible {
+				kmsg.SkipTags(&b)
+			}
+		}
+		v = a
+		s.Topics = v
+	}
+	if isFlexible {
+		kmsg.SkipTags(&b)
+	}
+	return b.Complete()
+}
@@ -15,18 +15,25 @@ type GroupBalancer interface {
 	protocolName() string // "sticky"
 
 	// metaFor returns the userdata to use in JoinGroup, given the topic
-	// interests and the current assignment.
+	// interests, the current assignment, and the client's rack.
 	metaFor(
 		interests []string,
 		currentAssignment map[string][]int32,
 		generation int32,
+		rack string,
 	) []byte
 
 	// balance balances topics and partitions among group members.
 	//
 	// The input members are guaranteed to be sorted by member ID, and
-	// each member's topics are guaranteed to be sorted.
-	balance(members []groupMember, topics map[string]int32) balancePlan
+	// each member's topics are guaranteed to be sorted. leaderRacks maps
+	// topics to the rack of each partition's leader, with an empty string
+	// if the rack is unknown.
+	balance(
+		members []groupMember,
+		topics map[string]int32,
+		leaderRacks map[string][]string,
+	) balancePlan
 
 	// isCooperative returns if this is a cooperative balance strategy.
 	isCooperative() bool
@@ -119,7 +126,7 @@ func (g *groupConsumer) balanceGroup(proto string, kmembers []kmsg.JoinGroupResp
 
 	for _, balancer := range g.balancers {
 		if balancer.protocolName() == proto {
-			return balancer.balance(members, g.cl.loadShortTopics()), nil
+			return balancer.balance(members, g.cl.loadShortTopics(), g.cl.loadLeaderRacks()), nil
 		}
 	}
 	return nil, ErrInvalidResp
@@ -187,10 +194,10 @@ type roundRobinBalancer struct{}
 
 func (*roundRobinBalancer) protocolName() string { return "roundrobin" }
 func (*roundRobinBalancer) isCooperative() bool  { return false }
-func (*roundRobinBalancer) metaFor(interests []string, _ map[string][]int32, _ int32) []byte {
+func (*roundRobinBalancer) metaFor(interests []string, _ map[string][]int32, _ int32, _ string) []byte {
 	return basicMetaFor(interests)
 }
-func (*roundRobinBalancer) balance(members []groupMember, topics map[string]int32) balancePlan {
+func (*roundRobinBalancer) balance(members []groupMember, topics map[string]int32, _ map[string][]string) balancePlan {
 	// Get all the topics all members are subscribed to.
 	memberTopics := make(map[string]struct{}, len(topics))
 	for i := range members {
@@ -269,10 +276,10 @@ type rangeBalancer struct{}
 
 func (*rangeBalancer) protocolName() string { return "range" }
 func (*rangeBalancer) isCooperative() bool  { return false }
-func (*rangeBalancer) metaFor(interests []string, _ map[string][]int32, _ int32) []byte {
+func (*rangeBalancer) metaFor(interests []string, _ map[string][]int32, _ int32, _ string) []byte {
 	return basicMetaFor(interests)
 }
-func (*rangeBalancer) balance(members []groupMember, topics map[string]int32) balancePlan {
+func (*rangeBalancer) balance(members []groupMember, topics map[string]int32, _ map[string][]string) balancePlan {
 	topics2PotentialConsumers := make(map[string][]groupMemberID)
 	for i := range members {
 		member := &members[i]
@@ -314,6 +321,98 @@ func (*rangeBalancer) balance(members []groupMember, topics map[string]int32) ba
 	return plan
 }
 
+// RackLeaderBalancer returns a group balancer that assigns each partition to a
+// member in the same rack as the partition's leader. This allows running one
+// consumer (or set of consumers) per rack, such as per availability zone, with
+// each consumer handling only partitions led by brokers in its rack. This
+// avoids cross rack fetch traffic even if follower fetching is not available.
+//
+// Each member sends its rack from the Rack option when joining the group, and
+// the group leader uses the rack of each partition's leader broker from its
+// metadata (see BrokerMetadata.Rack). Partitions are spread evenly across the
+// members within a rack. If a partition's leader has no rack, or no member is
+// in the leader's rack, the partition is assigned to the least loaded member
+// of all members interested in the topic, so that every partition is still
+// consumed.
+//
+// Note that leaders are only looked at when the group is balanced. If
+// leadership for a partition moves to a broker in a different rack, the
+// partition continues to be consumed from its current member (across racks)
+// until the next rebalance, at which point it is reassigned to a member in the
+// new leader's rack. Leadership changes thus cause partition movement on
+// rebalances that the sticky balancers would avoid.
+func RackLeaderBalancer() GroupBalancer {
+	return new(rackLeaderBalancer)
+}
+
+type rackLeaderBalancer struct{}
+
+func (*rackLeaderBalancer) protocolName() string { return "rack-leader" }
+func (*rackLeaderBalancer) isCooperative() bool  { return false }
+
+// metaFor returns our join metadata, with our rack as the userdata.
+func (*rackLeaderBalancer) metaFor(interests []string, _ map[string][]int32, _ int32, rack string) []byte {
+	return (&kmsg.GroupMemberMetadata{
+		Version:  0,
+		Topics:   interests,
+		UserData: []byte(rack),
+	}).AppendTo(nil)
+}
+
+// balance assigns each partition to the least loaded member in the rack of
+// the partition's leader, or to the least loaded member overall if there is
+// no member in that rack.
+func (*rackLeaderBalancer) balance(
+	members []groupMember,
+	topics map[string]int32,
+	leaderRacks map[string][]string,
+) balancePlan {
+	interested := make(map[string][]int, len(topics)) // topic => member indices
+	for i := range members {
+		for _, topic := range members[i].topics {
+			interested[topic] = append(interested[topic], i)
+		}
+	}
+	// Members are sorted; we sort topics so that our plan is stable.
+	sortedTopics := make([]string, 0, len(interested))
+	for topic := range interested {
+		sortedTopics = append(sortedTopics, topic)
+	}
+	sort.Strings(sortedTopics)
+
+	plan := newBalancePlan(members)
+	assigned := make([]int, len(members))
+	for _, topic := range sortedTopics {
+		racks := leaderRacks[topic]
+		for partition := int32(0); partition < topics[topic]; partition++ {
+			var rack string
+			if int(partition) < len(racks) {
+				rack = racks[partition]
+			}
+
+			use := -1
+			if rack != "" {
+				for _, i := range interested[topic] {
+					if string(members[i].userdata) == rack && (use < 0 || assigned[i] < assigned[use]) {
+						use = i
+					}
+				}
+			}
+			if use < 0 {
+				for _, i := range interested[topic] {
+					if use < 0 || assigned[i] < assigned[use] {
+						use = i
+					}
+				}
+			}
+
+			assigned[use]++
+			plan.addPartition(members[use].id, topic, partition)
+		}
+	}
+	return plan
+}
+
 // StickyBalancer returns a group balancer that ensures minimal partition
 // movement on group changes while also ensuring optimal balancing.
 //
@@ -390,7 +489,7 @@ func (s *stickyBalancer) protocolName() string {
 	return "sticky"
 }
 func (s *stickyBalancer) isCooperative() bool { return s.cooperative }
-func (s *stickyBalancer) metaFor(interests []string, currentAssignment map[string][]int32, generation int32) []byte {
+func (s *stickyBalancer) metaFor(interests []string, currentAssignment map[string][]int32, generation int32, _ string) []byte {
 	meta := kmsg.GroupMemberMetadata{
 		Version: 0,
 		Topics:  interests,
@@ -418,7 +517,7 @@ func (s *stickyBalancer) metaFor(interests []string, currentAssignment map[strin
 	return meta.AppendTo(nil)
 
 }
-func (s *stickyBalancer) balance(members []groupMember, topics map[string]int32) balancePlan {
+func (s *stickyBalancer) balance(members []groupMember, topics map[string]int32, _ map[string][]string) balancePlan {
 	stickyMembers := make([]sticky.GroupMember, 0, len(members))
 	for i := range members {
 		member := &members[i]
@@ -98,3 +98,39 @@ func Test_stickyAdjustCooperative(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func Test_rackLeaderBalancer(t *testing.T) {
+	member := func(name, rack string, topics ...string) groupMember {
+		return groupMember{
+			id:       groupMemberID{memberID: name},
+			topics:   topics,
+			userdata: []byte(rack),
+		}
+	}
+	members := []groupMember{
+		member("a", "r1", "t1"),
+		member("b", "r1", "t1"),
+		member("c", "r2", "t1", "t2"),
+		member("d", "", "t1", "t2"), // no rack: only takes partitions with no member in the leader rack
+	}
+	topics := map[string]int32{
+		"t1": 5,
+		"t2": 2,
+	}
+	leaderRacks := map[string][]string{
+		"t1": {"r1", "r2", "r1", "r3", ""}, // r3 has no members; p4's leader has no rack
+		"t2": {"r1", "r2"},                 // no r1 member is interested in t2
+	}
+
+	exp := balancePlan{
+		members[0].id: {"t1": {0, 4}},
+		members[1].id: {"t1": {2}},
+		members[2].id: {"t1": {1}, "t2": {0, 1}},
+		members[3].id: {"t1": {3}},
+	}
+
+	plan := new(rackLeaderBalancer).balance(members, topics, leaderRacks)
+	if diff := cmp.Diff(plan, exp, cmp.AllowUnexported(groupMemberID{})); diff != "" {
+		t.Error(diff)
+	}
+}
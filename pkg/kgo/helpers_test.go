@@ -1,6 +1,7 @@
 package kgo
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"os"
@@ -12,6 +13,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
 )
 
 const testRecordLimit = 1000000
@@ -103,6 +106,79 @@ func tmpGroup(tb testing.TB) (string, func()) {
 	}
 }
 
+// fakeClock is a clock that only moves when advanced. Every timer created is
+// sent on timers, so tests can wait for the client to start waiting.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	pending []*fakeTimer
+
+	timers chan time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Unix(1e9, 0),
+		timers: make(chan time.Duration, 100),
+	}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+	} else {
+		c.pending = append(c.pending, t)
+	}
+	c.timers <- d
+	return t
+}
+
+// advance moves the clock forward, firing every timer that is now due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	keep := c.pending[:0]
+	for _, t := range c.pending {
+		if t.at.After(c.now) {
+			keep = append(keep, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.pending = keep
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, pending := range c.pending {
+		if pending == t {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 // testConsumer performs ETL inside or outside transactions;
 // the ETL functions are defined in group_test.go and txn_test.go
 type testConsumer struct {
@@ -307,3 +383,69 @@ out:
 		}
 	}
 }
+
+// newTestCluster returns an in-process fake cluster for tests that exercise
+// the client against brokers; the caller must close it.
+func newTestCluster(t *testing.T, opts ...kfake.Opt) *kfake.Cluster {
+	c, err := kfake.NewCluster(opts...)
+	if err != nil {
+		t.Fatalf("unable to create cluster: %v", err)
+	}
+	return c
+}
+
+// newTestClient returns a client for the fake cluster c that consumes from
+// the start of partitions and quickly picks up metadata changes.
+func newTestClient(t *testing.T, c *kfake.Cluster, opts ...Opt) *Client {
+	cl, err := NewClient(append([]Opt{
+		SeedBrokers(c.ListenAddrs()...),
+		Dialer(c.DialContext),
+		ConsumeResetOffset(NewOffset().AtStart()),
+		FetchMaxWait(100 * time.Millisecond),
+		MetadataMinAge(100 * time.Millisecond),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	return cl
+}
+
+func produceN(t *testing.T, cl *Client, topic string, n int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		r := &Record{Topic: topic, Value: []byte(strconv.Itoa(i))}
+		if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("produce error: %v", err)
+		}
+	}
+}
+
+// consumeN polls until n records are consumed, returning the values seen.
+func consumeN(t *testing.T, cl *Client, n int) map[string]int {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	seen := make(map[string]int)
+	for consumed := 0; consumed < n; {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out after consuming %d of %d records", consumed, n)
+		}
+		for _, err := range fetches.Errors() {
+			t.Fatalf("fetch error on %s[%d]: %v", err.Topic, err.Partition, err.Err)
+		}
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			seen[string(iter.Next().Value)]++
+			consumed++
+		}
+	}
+	return seen
+}
@@ -34,6 +34,42 @@ type BrokerConnectHook interface {
 	OnConnect(meta BrokerMetadata, dialDur time.Duration, conn net.Conn, err error)
 }
 
+// BrokerConnectInitHook is called after a freshly opened connection to a
+// broker is initialized, that is, after the connection has issued its
+// ApiVersions request and completed any SASL authentication.
+//
+// This complements BrokerConnectHook, which only times the dial, and can be
+// used to distinguish brokers that are slow to dial from brokers that are
+// slow to authenticate.
+type BrokerConnectInitHook interface {
+	// OnConnectInit is passed the broker metadata, how long the
+	// ApiVersions round trip took, how long the full SASL handshake took,
+	// and any error that failed initialization.
+	//
+	// Either duration is zero if that step was skipped (ApiVersions is
+	// skipped if MaxVersions does not include it, and SASL is skipped if
+	// no mechanisms are configured) or if initialization failed before
+	// the step began.
+	OnConnectInit(meta BrokerMetadata, apiVersionsDur, saslDur time.Duration, err error)
+}
+
+// BrokerVersionDowngradeHook is called when a request is issued at a lower
+// version than the client wanted because the broker is too old to support
+// the version the client would otherwise use.
+//
+// This can be used to track how often the client runs against old brokers,
+// which may not support features that newer request versions provide.
+type BrokerVersionDowngradeHook interface {
+	// OnVersionDowngrade is passed the broker metadata, the key of the
+	// request, the version the client wanted to use (the highest version
+	// the client supports, capped by MaxVersions), and the lower version
+	// that is actually used.
+	//
+	// This is called for every downgraded request, once the version for the
+	// request is chosen.
+	OnVersionDowngrade(meta BrokerMetadata, key, wanted, used int16)
+}
+
 // BrokerDisconnectHook is called when a connection to a broker is closed.
 type BrokerDisconnectHook interface {
 	// OnDisconnect is passed the broker metadata and the connection that
@@ -84,6 +120,57 @@ type BrokerThrottleHook interface {
 	//
 	// If throttledAfterResponse is false, then Kafka already applied the
 	// throttle. If it is true, the client internally will not send another
-	// request until the throttle deadline has passed.
+	// request until the throttle deadline has passed. The client also waits
+	// when throttledAfterResponse is false if the
+	// ClientSideThrottleOnPreThrottle option is used.
 	OnThrottle(meta BrokerMetadata, throttleInterval time.Duration, throttledAfterResponse bool)
 }
+
+// BrokerThrottleExceededHook is called after a response to a request is read
+// from a broker, and the response identifies throttling longer than the
+// MaxAcceptableThrottle option allows.
+type BrokerThrottleExceededHook interface {
+	// OnThrottleExceeded is passed the broker metadata and what request
+	// was throttled for how long. The request itself is unaffected; the
+	// throttle is also passed to any BrokerThrottleHook.
+	OnThrottleExceeded(meta BrokerMetadata, throttled ThrottleExceeded)
+}
+
+// ThrottleExceeded describes a request that a broker throttled longer than
+// the MaxAcceptableThrottle option allows; see BrokerThrottleExceededHook.
+type ThrottleExceeded struct {
+	// NodeID is the broker that throttled the request.
+	NodeID int32
+	// Key is the key of the request that was throttled.
+	Key int16
+	// Throttle is how long the broker throttled the client.
+	Throttle time.Duration
+	// ThrottledAfterResponse is whether the throttle is applied after the
+	// response; if so, the client waits out the throttle before writing
+	// another request to this broker connection (see BrokerThrottleHook).
+	ThrottledAfterResponse bool
+}
+
+// BrokerE2EHook is called once a request to a broker is complete: after its
+// response is read and the issuer of the request has been given the response,
+// or after writing the request or reading its response failed, including when
+// the connection dies before the response is read. This gives the whole
+// lifecycle of a request in one callback, which is easier to use for latency
+// metrics than pairing BrokerWriteHook and BrokerReadHook calls.
+//
+// Requests the client issues while initializing a connection, ApiVersions and
+// SASL, do not call this hook, but do call the write and read hooks.
+type BrokerE2EHook interface {
+	// OnRequestComplete is passed the broker metadata, the key, version,
+	// and correlation ID of the request, how long the request waited to be
+	// written (including throttling waiting) and took to write, how long
+	// the response waited to be read and took to read, and any error.
+	//
+	// The total latency of a request is the sum of the four durations. If
+	// writing failed, the read durations are zero. If the connection died
+	// before the response was read, the read wait is how long the request
+	// waited for a response and the read time is zero. The error is the same
+	// error the request's issuer received, which can also be an error
+	// parsing the response.
+	OnRequestComplete(meta BrokerMetadata, key, version int16, corrID int32, writeWait, timeToWrite, readWait, timeToRead time.Duration, err error)
+}
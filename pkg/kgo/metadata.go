@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
 )
 
 type metawait struct {
@@ -84,12 +85,239 @@ func (cl *Client) triggerUpdateMetadataNow() {
 	}
 }
 
+// ForceMetadataRefresh triggers an immediate metadata update, bypassing the
+// minimum metadata age and interrupting any backoff from prior metadata
+// errors. This does not wait for the update to complete.
+func (cl *Client) ForceMetadataRefresh() {
+	select {
+	case cl.forceMetadataCh <- struct{}{}:
+	default:
+	}
+}
+
+// MetadataStatus is the state of the client's metadata loop, as returned from
+// Client.MetadataStatus.
+type MetadataStatus struct {
+	// LastSuccess is when metadata was last successfully loaded, or the
+	// zero time if metadata has never loaded.
+	LastSuccess time.Time
+
+	// ConsecutiveErrors is the number of metadata requests that have
+	// failed since the last success, and LastErr is the most recent
+	// failure. These are reset on success.
+	ConsecutiveErrors int
+	LastErr           error
+
+	// BackoffUntil, if in the future, is when the client will next try to
+	// load metadata after failing. See MetadataErrorBackoff.
+	BackoffUntil time.Time
+}
+
+// MetadataStatus returns the current state of the client's metadata loop,
+// which can be used to check whether the client is able to load metadata
+// (and is backing off) during a cluster outage.
+func (cl *Client) MetadataStatus() MetadataStatus {
+	cl.metaStatusMu.Lock()
+	defer cl.metaStatusMu.Unlock()
+	return cl.metaStatus
+}
+
+// RawMetadata returns a copy of the most recent successful metadata response
+// that the client loaded topics and partitions from, or nil if metadata has
+// not yet been loaded. This allows inspecting every field Kafka returns (ISRs,
+// offline replicas, topic IDs, broker racks, ...) without the client exposing
+// each field individually.
+//
+// The response is deep copied on every call; it is safe to modify.
+func (cl *Client) RawMetadata() *kmsg.MetadataResponse {
+	meta, _ := cl.rawMeta.Load().(*kmsg.MetadataResponse)
+	if meta == nil {
+		return nil
+	}
+	dup := &kmsg.MetadataResponse{Version: meta.Version}
+	if err := dup.ReadFrom(meta.AppendTo(nil)); err != nil {
+		return nil // unreachable: we decoded this same response from Kafka
+	}
+	return dup
+}
+
+// MetadataTopics returns the sorted topics that the client currently requests
+// metadata for. This includes every topic the client has produced to or is
+// consuming, and is every topic in the cluster if the client requests
+// metadata for all topics (see MetadataAllTopics).
+func (cl *Client) MetadataTopics() []string {
+	topics := cl.loadTopics()
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PruneMetadataTopics removes topics from the set of topics that the client
+// requests metadata for, tearing down each topic's internal per-partition
+// produce buffers and fetch cursors. This returns the topics that could not
+// be pruned.
+//
+// The client adds every topic it produces to to its metadata requests and
+// never removes them, so a long lived client that produces to many short
+// lived topics issues ever larger metadata requests. Pruning bounds that
+// set; MetadataTopicTTL prunes automatically.
+//
+// A topic is not pruned if the client is consuming it or is configured to
+// consume it, or if it has records buffered or in flight; these topics are
+// returned and a warning is logged. Producing to a pruned topic again
+// re-adds it, and idempotent sequence numbers continue where they left off.
+//
+// Pruning has no lasting effect while the client requests metadata for all
+// topics (see MetadataAllTopics), since the next update re-adds them.
+func (cl *Client) PruneMetadataTopics(topics ...string) []string {
+	inUse := cl.pruneTopics(topics)
+	if len(inUse) > 0 {
+		cl.cfg.logger.Log(LogLevelWarn, "unable to prune metadata topics that are in use", "topics", inUse)
+	}
+	return inUse
+}
+
+// pruneExpiredTopics prunes topics that have not been produced to within the
+// MetadataTopicTTL. This is only called from the metadata loop.
+func (cl *Client) pruneExpiredTopics() {
+	var (
+		now     = time.Now()
+		ttl     = cl.cfg.metadataTopicTTL
+		expired []string
+	)
+	for topic, parts := range cl.loadTopics() {
+		parts.partsMu.Lock()
+		if parts.produced {
+			parts.produced = false
+			parts.lastUsed = now
+		} else if now.Sub(parts.lastUsed) >= ttl {
+			expired = append(expired, topic)
+		}
+		parts.partsMu.Unlock()
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	// Topics we are consuming are not unused; we bump them so that they
+	// are not pruned the moment consuming stops.
+	topics := cl.loadTopics()
+	for _, topic := range cl.pruneTopics(expired) {
+		if parts, ok := topics[topic]; ok {
+			parts.partsMu.Lock()
+			parts.lastUsed = now
+			parts.partsMu.Unlock()
+		}
+	}
+}
+
+// prunedSeqs saves a pruned topic's idempotent sequence numbers so that
+// producing to the topic again can continue them.
+type prunedSeqs struct {
+	id    int64
+	epoch int16
+	seqs  []int32
+}
+
+// pruneTopics removes the given topics from the topics map, returning any
+// topics that are in use and were not pruned.
+//
+// We hold the merge mu to not race with a metadata update merging a topic we
+// prune, and the consumer mu so that the consumer cannot begin using a topic
+// while we prune it. The unknown topics mu and partitions mu ensure that no
+// producer is buffering into a topic we prune: producers check whether
+// their topic was pruned under the partitions mu.
+func (cl *Client) pruneTopics(topics []string) (inUse []string) {
+	cl.metaMergeMu.Lock()
+	defer cl.metaMergeMu.Unlock()
+
+	c := &cl.consumer
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl.topicsMu.Lock()
+	defer cl.topicsMu.Unlock()
+	cl.unknownTopicsMu.Lock()
+	defer cl.unknownTopicsMu.Unlock()
+
+	var (
+		loaded = cl.loadTopics()
+		prune  []string
+	)
+	for _, topic := range topics {
+		parts, exists := loaded[topic]
+		if !exists {
+			continue
+		}
+		if c.consumingTopic(topic) || cl.unknownTopics[topic] != nil {
+			inUse = append(inUse, topic)
+			continue
+		}
+
+		parts.partsMu.Lock()
+		v := parts.load()
+		var (
+			buffered bool
+			seqs     = make([]int32, len(v.partitions))
+			hasSeqs  bool
+		)
+		for i, p := range v.partitions {
+			p.records.mu.Lock()
+			buffered = buffered || len(p.records.batches) > 0
+			seqs[i] = p.records.seq
+			hasSeqs = hasSeqs || seqs[i] > 0
+			p.records.mu.Unlock()
+		}
+		if buffered {
+			parts.partsMu.Unlock()
+			inUse = append(inUse, topic)
+			continue
+		}
+		parts.pruned = true
+		parts.partsMu.Unlock()
+
+		if hasSeqs {
+			id := cl.producer.id.Load().(*producerID)
+			if cl.prunedSeqs == nil {
+				cl.prunedSeqs = make(map[string]prunedSeqs)
+			}
+			cl.prunedSeqs[topic] = prunedSeqs{id.id, id.epoch, seqs}
+		}
+		for _, p := range v.partitions {
+			p.records.sink.removeRecBuf(p.records)
+			p.cursor.source.removeCursor(p.cursor)
+		}
+		delete(cl.missingParts, topic)
+		prune = append(prune, topic)
+	}
+
+	if len(prune) > 0 {
+		newTopics := cl.cloneTopics()
+		for _, topic := range prune {
+			delete(newTopics, topic)
+		}
+		cl.topics.Store(newTopics)
+		cl.cfg.logger.Log(LogLevelInfo, "pruned metadata topics", "topics", prune)
+	}
+	return inUse
+}
+
 // updateMetadataLoop updates metadata whenever the update ticker ticks,
 // or whenever deliberately triggered.
 func (cl *Client) updateMetadataLoop() {
 	defer close(cl.metadone)
 	var consecutiveErrors int
 	var lastAt time.Time
+	var failingSince time.Time // for FailoverSeedBrokers
+	var preconnected bool
+
+	backoff := cl.cfg.metadataErrBackoff
+	if backoff == nil {
+		backoff = cl.cfg.retryBackoff
+	}
 
 	ticker := time.NewTicker(cl.cfg.metadataMaxAge)
 	defer ticker.Stop()
@@ -102,6 +330,8 @@ func (cl *Client) updateMetadataLoop() {
 		case <-cl.updateMetadataCh:
 		case <-cl.updateMetadataNowCh:
 			now = true
+		case <-cl.forceMetadataCh:
+			now = true
 		}
 
 		var nowTries int
@@ -116,6 +346,8 @@ func (cl *Client) updateMetadataLoop() {
 					return
 				case <-cl.updateMetadataNowCh:
 					timer.Stop()
+				case <-cl.forceMetadataCh:
+					timer.Stop()
 				case <-timer.C:
 				}
 			}
@@ -145,16 +377,45 @@ func (cl *Client) updateMetadataLoop() {
 		if err == nil {
 			lastAt = time.Now()
 			consecutiveErrors = 0
+			failingSince = time.Time{}
+			cl.metaStatusMu.Lock()
+			cl.metaStatus = MetadataStatus{LastSuccess: lastAt}
+			cl.metaStatusMu.Unlock()
+			if cl.cfg.preconnect && !preconnected {
+				preconnected = true
+				go cl.preconnectBrokers()
+			}
+			continue
+		}
+
+		if failingSince.IsZero() {
+			failingSince = time.Now()
+		}
+		if cl.maybeFailover(failingSince) {
+			consecutiveErrors = 0
+			failingSince = time.Time{}
+			cl.triggerUpdateMetadataNow()
 			continue
 		}
 
 		consecutiveErrors++
-		after := time.NewTimer(cl.cfg.retryBackoff(consecutiveErrors))
+		wait := backoff(consecutiveErrors)
+		cl.metaStatusMu.Lock()
+		cl.metaStatus.ConsecutiveErrors = consecutiveErrors
+		cl.metaStatus.LastErr = err
+		cl.metaStatus.BackoffUntil = time.Now().Add(wait)
+		cl.metaStatusMu.Unlock()
+		cl.cfg.logger.Log(LogLevelInfo, "metadata update failed, backing off", "consecutive_errors", consecutiveErrors, "backoff", wait, "err", err)
+
+		after := time.NewTimer(wait)
 		select {
 		case <-cl.ctx.Done():
 			after.Stop()
 			return
 		case <-after.C:
+		case <-cl.forceMetadataCh:
+			after.Stop()
+			cl.triggerUpdateMetadataNow()
 		}
 
 	}
@@ -169,6 +430,10 @@ func (cl *Client) updateMetadataLoop() {
 func (cl *Client) updateMetadata() (needsRetry bool, err error) {
 	defer cl.metawait.signal()
 
+	if cl.cfg.metadataTopicTTL > 0 && !cl.requestsAllTopics() {
+		cl.pruneExpiredTopics()
+	}
+
 	topics := cl.loadTopics()
 	toUpdate := make([]string, 0, len(topics))
 	for topic := range topics {
@@ -180,8 +445,15 @@ func (cl *Client) updateMetadata() (needsRetry bool, err error) {
 		return true, err
 	}
 
-	// If we are consuming with regex and thus fetched all topics, the
-	// metadata may have returned topics we are not yet tracking.
+	// Topics may have been pruned while we were fetching; we merge under
+	// the merge mu against the current topics so that no topic is pruned
+	// while we are merging it.
+	cl.metaMergeMu.Lock()
+	topics = cl.loadTopics()
+
+	// If we fetched all topics (consuming with regex, or per
+	// MetadataAllTopics), the metadata may have returned topics we are
+	// not yet tracking.
 	// We have to add those topics to our topics map so that we can
 	// save their information in the merge just below.
 	if all {
@@ -195,18 +467,42 @@ func (cl *Client) updateMetadata() (needsRetry bool, err error) {
 
 	var consumerSessionStopped bool
 	var reloadOffsets listOrEpochLoads
+	var leaderChanges []partitionLeaderChange
 	for topic, oldParts := range topics {
 		newParts, exists := meta[topic]
+		if cl.cfg.missingFatal {
+			cl.trackMissingPartitions(topic, oldParts.load(), newParts, all)
+		}
 		if !exists {
 			continue
 		}
-		needsRetry = cl.mergeTopicPartitions(topic, oldParts, newParts, &consumerSessionStopped, &reloadOffsets) || needsRetry
+		needsRetry = cl.mergeTopicPartitions(topic, oldParts, newParts, &consumerSessionStopped, &reloadOffsets, &leaderChanges) || needsRetry
 	}
 
 	if consumerSessionStopped {
 		reloadOffsets.loadWithSession(cl.consumer.startNewSession())
 	}
 
+	var deleted map[string][]int32
+	if cl.cfg.missingFatal {
+		deleted = cl.expireMissingPartitions()
+	}
+	cl.metaMergeMu.Unlock()
+	if len(deleted) > 0 {
+		cl.consumer.stopDeletedPartitions(deleted)
+	}
+
+	if cl.cfg.underReplicatedMin > 0 {
+		cl.warnUnderReplicated()
+	}
+
+	// We notify of leader changes only after everything is merged, and we
+	// hold no locks while doing so.
+	for _, c := range leaderChanges {
+		cl.cfg.onLeaderChange(c.topic, c.partition, c.oldLeader, c.newLeader, c.newEpoch)
+	}
+	cl.notifyMetadataUpdate()
+
 	// Finally, trigger the consumer to process any updated metadata, which
 	// can look for new partitions to consume or something or signal a
 	// waiting list or epoch load to continue.
@@ -218,10 +514,7 @@ func (cl *Client) updateMetadata() (needsRetry bool, err error) {
 // fetchTopicMetadata fetches metadata for all reqTopics and returns new
 // topicPartitionsData for each topic.
 func (cl *Client) fetchTopicMetadata(reqTopics []string) (map[string]*topicPartitionsData, bool, error) {
-	cl.consumer.mu.Lock()
-	all := cl.consumer.typ == consumerTypeDirect && cl.consumer.direct.regexTopics ||
-		cl.consumer.typ == consumerTypeGroup && cl.consumer.group.regexTopics
-	cl.consumer.mu.Unlock()
+	all := cl.requestsAllTopics()
 	_, meta, err := cl.fetchMetadataForTopics(cl.ctx, all, reqTopics)
 	if err != nil {
 		return nil, all, err
@@ -327,19 +620,184 @@ func (cl *Client) fetchTopicMetadata(reqTopics []string) (map[string]*topicParti
 		}
 	}
 
+	cl.rawMeta.Store(meta)
+
 	return topics, all, nil
 }
 
+// requestsAllTopics returns whether metadata updates request all topics in
+// the cluster, per MetadataAllTopics or because we consume with regex.
+func (cl *Client) requestsAllTopics() bool {
+	if cl.cfg.metadataAllTopics != nil {
+		return *cl.cfg.metadataAllTopics
+	}
+	cl.consumer.mu.Lock()
+	defer cl.consumer.mu.Unlock()
+	return cl.consumer.typ == consumerTypeDirect && (cl.consumer.direct.regexTopics || cl.consumer.direct.matcher != nil) ||
+		cl.consumer.typ == consumerTypeGroup && cl.consumer.group.regexTopics
+}
+
+// warnUnderReplicated logs a warning for every consumed partition that is newly
+// under replicated per WarnOnUnderReplicated, and an info log for every
+// partition that has recovered. This is only called from the metadata loop.
+func (cl *Client) warnUnderReplicated() {
+	meta, _ := cl.rawMeta.Load().(*kmsg.MetadataResponse)
+	if meta == nil {
+		return
+	}
+
+	c := &cl.consumer
+	consumed := make(map[string]map[int32]struct{})
+	c.mu.Lock()
+	for cursor := range c.usingCursors {
+		if consumed[cursor.topic] == nil {
+			consumed[cursor.topic] = make(map[int32]struct{})
+		}
+		consumed[cursor.topic][cursor.partition] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	var (
+		min   = cl.cfg.underReplicatedMin
+		which = "isr"
+		now   = make(map[string]map[int32]struct{})
+	)
+	if cl.cfg.underReplicatedReplicas {
+		which = "replicas"
+	}
+	for _, t := range meta.Topics {
+		if t.ErrorCode != 0 {
+			if warned := cl.underReplicated[t.Topic]; warned != nil {
+				now[t.Topic] = warned // keep state until we know more
+			}
+			continue
+		}
+		for _, p := range t.Partitions {
+			if _, ok := consumed[t.Topic][p.Partition]; !ok {
+				continue
+			}
+			have := len(p.ISR)
+			if cl.cfg.underReplicatedReplicas {
+				have = len(p.Replicas)
+			}
+			if have >= min {
+				if _, warned := cl.underReplicated[t.Topic][p.Partition]; warned {
+					cl.cfg.logger.Log(LogLevelInfo, "consumed partition is no longer under replicated",
+						"topic", t.Topic,
+						"partition", p.Partition,
+						which, have,
+					)
+				}
+				continue
+			}
+			if now[t.Topic] == nil {
+				now[t.Topic] = make(map[int32]struct{})
+			}
+			now[t.Topic][p.Partition] = struct{}{}
+			if _, warned := cl.underReplicated[t.Topic][p.Partition]; !warned {
+				cl.cfg.logger.Log(LogLevelWarn, "consumed partition is under replicated and at risk of data loss",
+					"topic", t.Topic,
+					"partition", p.Partition,
+					which, have,
+					"min", min,
+				)
+			}
+		}
+	}
+	cl.underReplicated = now
+}
+
+// missingPartition tracks when a partition was first seen missing from
+// metadata, for MissingPartitionGracePeriod.
+type missingPartition struct {
+	since    time.Time
+	declared bool // whether we declared this partition deleted
+}
+
+// trackMissingPartitions updates which of a topic's partitions are missing
+// from metadata, given the topic's data before merging a metadata update
+// and the update's data (which is nil if the topic was not in the response).
+//
+// This is only called from the metadata loop.
+func (cl *Client) trackMissingPartitions(topic string, old, new *topicPartitionsData, all bool) {
+	present := -1 // all partitions missing
+	switch {
+	case new == nil:
+		if !all {
+			return // we did not ask for this topic; no information
+		}
+	case new.loadErr == kerr.UnknownTopicOrPartition:
+	case new.loadErr != nil:
+		return // some other error; we do not know if the topic exists
+	default:
+		present = len(new.partitions)
+	}
+
+	missing := cl.missingParts[topic]
+	for p := range old.partitions {
+		if p < present {
+			delete(missing, int32(p))
+			continue
+		}
+		if missing == nil {
+			if cl.missingParts == nil {
+				cl.missingParts = make(map[string]map[int32]*missingPartition)
+			}
+			missing = make(map[int32]*missingPartition)
+			cl.missingParts[topic] = missing
+		}
+		if _, exists := missing[int32(p)]; !exists {
+			missing[int32(p)] = &missingPartition{since: time.Now()}
+		}
+	}
+	if missing != nil && len(missing) == 0 {
+		delete(cl.missingParts, topic)
+	}
+}
+
+// expireMissingPartitions returns all partitions that have been missing for
+// longer than the grace period and that have not yet been declared deleted.
+func (cl *Client) expireMissingPartitions() map[string][]int32 {
+	var deleted map[string][]int32
+	for topic, partitions := range cl.missingParts {
+		for partition, missing := range partitions {
+			if missing.declared || time.Since(missing.since) < cl.cfg.missingGrace {
+				continue
+			}
+			missing.declared = true
+			if deleted == nil {
+				deleted = make(map[string][]int32)
+			}
+			deleted[topic] = append(deleted[topic], partition)
+		}
+	}
+	return deleted
+}
+
+// partitionLeaderChange is a leader or leader epoch change seen while merging
+// metadata, to be passed to the user's OnPartitionLeaderChange.
+type partitionLeaderChange struct {
+	topic     string
+	partition int32
+	oldLeader int32
+	newLeader int32
+	newEpoch  int32
+}
+
 // mergeTopicPartitions merges a new topicPartition into an old and returns
 // whether the metadata update that caused this merge needs to be retried.
 //
 // Retries are necessary if the topic or any partition has a retriable error.
+//
+// If the user wants to know of leader changes, any changes are appended to
+// leaderChanges.
 func (cl *Client) mergeTopicPartitions(
 	topic string,
 	l *topicPartitions,
 	r *topicPartitionsData,
 	consumerSessionStopped *bool,
 	reloadOffsets *listOrEpochLoads,
+	leaderChanges *[]partitionLeaderChange,
 ) (needsRetry bool) {
 	lv := *l.load() // copy so our field writes do not collide with reads
 	hadPartitions := len(lv.partitions) != 0
@@ -366,6 +824,16 @@ func (cl *Client) mergeTopicPartitions(
 		return retriable
 	}
 
+	// If this topic was pruned while we were producing to it, we continue
+	// its sequence numbers so long as our producer ID is unchanged.
+	var restoreSeqs []int32
+	if saved, ok := cl.prunedSeqs[topic]; ok {
+		delete(cl.prunedSeqs, topic)
+		if id := cl.producer.id.Load().(*producerID); id.id == saved.id && id.epoch == saved.epoch {
+			restoreSeqs = saved.seqs
+		}
+	}
+
 	// Before the atomic update, we keep the latest partitions / writable
 	// partitions. All updates happen in r's slices, and we keep the
 	// results and store them in lv.
@@ -430,6 +898,17 @@ func (cl *Client) mergeTopicPartitions(
 			continue
 		}
 
+		if cl.cfg.onLeaderChange != nil &&
+			(newTP.leader != oldTP.leader || newTP.leaderEpoch != oldTP.leaderEpoch) {
+			*leaderChanges = append(*leaderChanges, partitionLeaderChange{
+				topic:     topic,
+				partition: int32(part),
+				oldLeader: oldTP.leader,
+				newLeader: newTP.leader,
+				newEpoch:  newTP.leaderEpoch,
+			})
+		}
+
 		// If the new sink is the same as the old, we simply copy over
 		// the records pointer and maybe begin producing again.
 		//
@@ -466,12 +945,209 @@ func (cl *Client) mergeTopicPartitions(
 	// Anything left with a negative recBufsIdx / cursorsIdx is a new topic
 	// partition. We use this to add the new tp's records to its sink.
 	// Same reasoning applies to the cursor offset.
-	for _, newTP := range r.partitions {
+	for part, newTP := range r.partitions {
 		if newTP.records.recBufsIdx == -1 {
+			if part < len(restoreSeqs) {
+				newTP.records.seq = restoreSeqs[part]
+				newTP.records.batch0Seq = restoreSeqs[part]
+			}
 			newTP.records.sink.addRecBuf(newTP.records)
 			newTP.cursor.source.addCursor(newTP.cursor)
+
+			if cl.cfg.onLeaderChange != nil && newTP.loadErr == nil {
+				*leaderChanges = append(*leaderChanges, partitionLeaderChange{
+					topic:     topic,
+					partition: int32(part),
+					oldLeader: -1,
+					newLeader: newTP.leader,
+					newEpoch:  newTP.leaderEpoch,
+				})
+			}
 		}
 	}
 
 	return needsRetry
 }
+
+// MetadataSnapshot is a point in time view of the brokers, topics, and
+// partitions the client knows of.
+type MetadataSnapshot struct {
+	// Brokers contains all discovered brokers, sorted by node ID. Seed
+	// brokers are not included.
+	Brokers []BrokerMetadata
+
+	// Topics contains all topics the client is tracking, mapped to their
+	// partitions. Each topic's partitions are indexed by partition number.
+	Topics map[string][]PartitionMetadata
+}
+
+// PartitionMetadata is metadata for a partition in a MetadataSnapshot.
+type PartitionMetadata struct {
+	// Partition is the partition number.
+	Partition int32
+	// Leader is the broker leading this partition.
+	Leader int32
+	// LeaderEpoch is the epoch of the leader, or -1 if the broker does
+	// not support leader epochs.
+	LeaderEpoch int32
+	// Err is any error loading this partition, such as the leader not
+	// being available.
+	Err error
+}
+
+// MetadataDiff is the difference between two metadata snapshots.
+type MetadataDiff struct {
+	// AddedBrokers and RemovedBrokers contain brokers that joined or left
+	// the cluster. A broker whose host, port, or rack changed is both
+	// removed (old metadata) and added (new metadata).
+	AddedBrokers   []BrokerMetadata
+	RemovedBrokers []BrokerMetadata
+
+	// AddedTopics and RemovedTopics contain topics that were added to or
+	// removed from the snapshot.
+	AddedTopics   []string
+	RemovedTopics []string
+
+	// ChangedPartitions contains, for topics in both snapshots, the new
+	// metadata for partitions that were added or whose leader, leader
+	// epoch, or load error changed.
+	ChangedPartitions map[string][]PartitionMetadata
+}
+
+// IsEmpty returns whether nothing changed between the snapshots.
+func (d MetadataDiff) IsEmpty() bool {
+	return len(d.AddedBrokers) == 0 &&
+		len(d.RemovedBrokers) == 0 &&
+		len(d.AddedTopics) == 0 &&
+		len(d.RemovedTopics) == 0 &&
+		len(d.ChangedPartitions) == 0
+}
+
+// DiffFrom returns what changed between old and this snapshot.
+func (new MetadataSnapshot) DiffFrom(old MetadataSnapshot) MetadataDiff {
+	var d MetadataDiff
+
+	oldBrokers := make(map[int32]BrokerMetadata, len(old.Brokers))
+	for _, b := range old.Brokers {
+		oldBrokers[b.NodeID] = b
+	}
+	for _, b := range new.Brokers {
+		ob, exists := oldBrokers[b.NodeID]
+		delete(oldBrokers, b.NodeID)
+		if exists && ob.Host == b.Host && ob.Port == b.Port && stringPtrsEqual(ob.Rack, b.Rack) {
+			continue
+		}
+		if exists {
+			d.RemovedBrokers = append(d.RemovedBrokers, ob)
+		}
+		d.AddedBrokers = append(d.AddedBrokers, b)
+	}
+	for _, b := range old.Brokers {
+		if _, removed := oldBrokers[b.NodeID]; removed {
+			d.RemovedBrokers = append(d.RemovedBrokers, b)
+		}
+	}
+
+	for topic, newParts := range new.Topics {
+		oldParts, exists := old.Topics[topic]
+		if !exists {
+			d.AddedTopics = append(d.AddedTopics, topic)
+			continue
+		}
+		for i, p := range newParts {
+			if i < len(oldParts) {
+				op := oldParts[i]
+				if op.Leader == p.Leader && op.LeaderEpoch == p.LeaderEpoch && op.Err == p.Err {
+					continue
+				}
+			}
+			if d.ChangedPartitions == nil {
+				d.ChangedPartitions = make(map[string][]PartitionMetadata)
+			}
+			d.ChangedPartitions[topic] = append(d.ChangedPartitions[topic], p)
+		}
+	}
+	for topic := range old.Topics {
+		if _, exists := new.Topics[topic]; !exists {
+			d.RemovedTopics = append(d.RemovedTopics, topic)
+		}
+	}
+	sort.Strings(d.AddedTopics)
+	sort.Strings(d.RemovedTopics)
+
+	return d
+}
+
+func stringPtrsEqual(l, r *string) bool {
+	return l == nil && r == nil || l != nil && r != nil && *l == *r
+}
+
+// OnMetadataUpdate registers fn to be called after every metadata update
+// with the snapshots from before and after the update. Use
+// new.DiffFrom(old) to see what changed, such as partition leaders moving,
+// partitions being added, or brokers joining or leaving the cluster.
+//
+// The first call to fn after registering has an empty old snapshot. fn is
+// called from the metadata update goroutine while no client locks are held;
+// it must not block for long, since it delays the next metadata update.
+//
+// This can be called multiple times to register multiple functions.
+func (cl *Client) OnMetadataUpdate(fn func(old, new MetadataSnapshot)) {
+	cl.metaSubsMu.Lock()
+	defer cl.metaSubsMu.Unlock()
+	cl.metaSubs = append(cl.metaSubs, &metadataSub{fn: fn})
+}
+
+type metadataSub struct {
+	fn   func(old, new MetadataSnapshot)
+	last MetadataSnapshot // only accessed in notifyMetadataUpdate
+}
+
+// notifyMetadataUpdate calls all OnMetadataUpdate functions with the current
+// metadata snapshot. This is only called from the metadata loop.
+func (cl *Client) notifyMetadataUpdate() {
+	cl.metaSubsMu.Lock()
+	subs := cl.metaSubs
+	cl.metaSubsMu.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+	snap := cl.metadataSnapshot()
+	for _, sub := range subs {
+		sub.fn(sub.last, snap)
+		sub.last = snap
+	}
+}
+
+// metadataSnapshot returns a snapshot of the client's current metadata.
+func (cl *Client) metadataSnapshot() MetadataSnapshot {
+	var snap MetadataSnapshot
+
+	cl.brokersMu.RLock()
+	for _, b := range cl.brokers {
+		if b.meta.NodeID >= 0 {
+			snap.Brokers = append(snap.Brokers, b.meta)
+		}
+	}
+	cl.brokersMu.RUnlock()
+	sort.Slice(snap.Brokers, func(i, j int) bool {
+		return snap.Brokers[i].NodeID < snap.Brokers[j].NodeID
+	})
+
+	topics := cl.loadTopics()
+	snap.Topics = make(map[string][]PartitionMetadata, len(topics))
+	for topic, parts := range topics {
+		loaded := parts.load().partitions
+		partitions := make([]PartitionMetadata, 0, len(loaded))
+		for i, p := range loaded {
+			partitions = append(partitions, PartitionMetadata{
+				Partition:   int32(i),
+				Leader:      p.leader,
+				LeaderEpoch: p.leaderEpoch,
+				Err:         p.loadErr,
+			})
+		}
+		snap.Topics[topic] = partitions
+	}
+	return snap
+}
@@ -0,0 +1,324 @@
+package kgo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+)
+
+func TestMetadataErrorBackoff(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t)
+	defer c.Close()
+
+	// We seed with a broker that does not exist, so every metadata
+	// request fails.
+	cl, err := NewClient(
+		SeedBrokers("unknown:9092"),
+		Dialer(c.DialContext),
+		MetadataErrorBackoff(time.Hour, time.Hour),
+		RequestRetries(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	waitErrs := func(n int) MetadataStatus {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if status := cl.MetadataStatus(); status.ConsecutiveErrors >= n {
+				return status
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %d consecutive metadata errors", n)
+		return MetadataStatus{}
+	}
+
+	cl.ForceMetadataRefresh()
+	status := waitErrs(1)
+	if status.LastErr == nil || !status.LastSuccess.IsZero() || time.Until(status.BackoffUntil) < 30*time.Minute {
+		t.Fatalf("unexpected status after the first error: %+v", status)
+	}
+
+	// Forcing a refresh interrupts the hour long backoff.
+	cl.ForceMetadataRefresh()
+	waitErrs(2)
+}
+
+func TestMetadataErrorBackoffValidation(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		min, max time.Duration
+		ok       bool
+	}{
+		{"valid", time.Second, time.Minute, true},
+		{"equal", time.Second, time.Second, true},
+		{"zero_min", 0, time.Minute, false},
+		{"negative_min", -time.Second, time.Minute, false},
+		{"max_below_min", time.Minute, time.Second, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cl, err := NewClient(MetadataErrorBackoff(test.min, test.max))
+			if err == nil {
+				cl.Close()
+			}
+			if ok := err == nil; ok != test.ok {
+				t.Errorf("got err %v, expected ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestMetadataAllTopics(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(2, "foo", "bar"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, MetadataAllTopics(true))
+	defer cl.Close()
+
+	tracked := make(chan map[string][]PartitionMetadata, 1)
+	cl.OnMetadataUpdate(func(_, new MetadataSnapshot) {
+		if len(new.Topics) > 0 {
+			select {
+			case tracked <- new.Topics:
+			default:
+			}
+		}
+	})
+	cl.ForceMetadataRefresh()
+
+	select {
+	case topics := <-tracked:
+		for _, topic := range []string{"foo", "bar"} {
+			if len(topics[topic]) != 2 {
+				t.Errorf("topic %s: got %d partitions, expected 2", topic, len(topics[topic]))
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for metadata to track all topics")
+	}
+}
+
+func TestPruneMetadataTopics(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(2, "foo", "bar"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	produceN(t, cl, "foo", 10)
+	produceN(t, cl, "bar", 10)
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "bar"))
+
+	if inUse := cl.PruneMetadataTopics("foo", "bar", "unknown"); !reflect.DeepEqual(inUse, []string{"bar"}) {
+		t.Errorf("got in use topics %v, expected [bar]", inUse)
+	}
+	if topics := cl.MetadataTopics(); !reflect.DeepEqual(topics, []string{"bar"}) {
+		t.Errorf("got metadata topics %v, expected [bar]", topics)
+	}
+
+	// Producing again re-adds the topic.
+	produceN(t, cl, "foo", 10)
+	if topics := cl.MetadataTopics(); !reflect.DeepEqual(topics, []string{"bar", "foo"}) {
+		t.Errorf("got metadata topics %v, expected [bar foo]", topics)
+	}
+
+	ttlCl := newTestClient(t, c, MetadataTopicTTL(100*time.Millisecond))
+	defer ttlCl.Close()
+
+	produceN(t, ttlCl, "foo", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for len(ttlCl.MetadataTopics()) > 0 {
+		ttlCl.ForceMetadataRefresh()
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for foo to expire, topics: %v", ttlCl.MetadataTopics())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestOnPartitionLeaderChange(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(3), kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	type change struct {
+		topic                       string
+		partition                   int32
+		oldLeader, newLeader, epoch int32
+	}
+	var (
+		mu      sync.Mutex
+		changes []change
+	)
+	loadChanges := func() []change {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]change(nil), changes...)
+	}
+
+	cl := newTestClient(t, c, OnPartitionLeaderChange(func(topic string, partition, oldLeader, newLeader, newEpoch int32) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, change{topic, partition, oldLeader, newLeader, newEpoch})
+	}))
+	defer cl.Close()
+
+	// Leader changes are called before metadata update functions, so
+	// once an update is seen, its changes have been recorded.
+	updates := make(chan map[string][]PartitionMetadata, 1)
+	cl.OnMetadataUpdate(func(_, new MetadataSnapshot) {
+		select {
+		case updates <- new.Topics:
+		default:
+		}
+	})
+	waitMeta := func(what string, done func(map[string][]PartitionMetadata) bool) map[string][]PartitionMetadata {
+		timeout := time.After(10 * time.Second)
+		for {
+			cl.ForceMetadataRefresh()
+			select {
+			case topics := <-updates:
+				if done(topics) {
+					return topics
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	refreshUnchanged := func() {
+		for i := 0; i < 3; i++ {
+			waitMeta("a metadata refresh", func(map[string][]PartitionMetadata) bool { return true })
+		}
+	}
+
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	foo := waitMeta("foo to be discovered", func(topics map[string][]PartitionMetadata) bool { return len(topics["foo"]) == 2 })["foo"]
+
+	exp := []change{
+		{"foo", 0, -1, foo[0].Leader, foo[0].LeaderEpoch},
+		{"foo", 1, -1, foo[1].Leader, foo[1].LeaderEpoch},
+	}
+	if got := loadChanges(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got changes %v after discovering foo, expected %v", got, exp)
+	}
+
+	// Refreshing metadata that has not changed calls nothing.
+	refreshUnchanged()
+	if got := loadChanges(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got changes %v after unchanged refreshes, expected %v", got, exp)
+	}
+
+	oldLeader := foo[0].Leader
+	newLeader := (oldLeader + 1) % 3
+	epoch := c.MoveLeader("foo", 0, newLeader)
+	if epoch != foo[0].LeaderEpoch+1 {
+		t.Fatalf("got new epoch %d, expected %d", epoch, foo[0].LeaderEpoch+1)
+	}
+	waitMeta("foo[0] to move", func(topics map[string][]PartitionMetadata) bool { return topics["foo"][0].Leader == newLeader })
+
+	exp = append(exp, change{"foo", 0, oldLeader, newLeader, epoch})
+	if got := loadChanges(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got changes %v after moving foo[0], expected %v", got, exp)
+	}
+	refreshUnchanged()
+	if got := loadChanges(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got changes %v after unchanged refreshes, expected %v", got, exp)
+	}
+
+	// The client follows the move and consumes from the new leader.
+	producer := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer producer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errs := make(chan error, 1)
+	if err := producer.Produce(ctx, &Record{Topic: "foo", Partition: 0}, func(_ *Record, err error) { errs <- err }); err != nil {
+		t.Fatalf("unable to produce: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unable to produce: %v", err)
+	}
+	consumeN(t, cl, 1)
+}
+
+// underReplicatedLogger records the partitions warned about as under
+// replicated.
+type underReplicatedLogger struct {
+	mu     sync.Mutex
+	warned []string
+}
+
+func (*underReplicatedLogger) Level() LogLevel { return LogLevelWarn }
+
+func (l *underReplicatedLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level != LogLevelWarn || !strings.Contains(msg, "under replicated") {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warned = append(l.warned, fmt.Sprintf("%v %v", keyvals[1], keyvals[3]))
+}
+
+func (l *underReplicatedLogger) load() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	warned := append([]string(nil), l.warned...)
+	sort.Strings(warned)
+	return warned
+}
+
+func TestWarnOnUnderReplicated(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(2, "foo", "bar"))
+	defer c.Close()
+
+	for _, test := range []struct {
+		min      int
+		replicas bool
+		exp      []string
+	}{
+		{2, false, []string{"foo 0", "foo 1"}},
+		{2, true, []string{"foo 0", "foo 1"}},
+		{1, false, nil},
+	} {
+		logger := new(underReplicatedLogger)
+		cl := newTestClient(t, c,
+			WithLogger(logger),
+			WarnOnUnderReplicated(test.min, test.replicas),
+		)
+		produceN(t, cl, "foo", 2)
+		produceN(t, cl, "bar", 2) // produced, not consumed: never warned
+		cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+		consumeN(t, cl, 2)
+
+		// Warnings are only logged once, no matter how many metadata
+		// updates see the partitions under replicated.
+		for i := 0; i < 3; i++ {
+			cl.ForceMetadataRefresh()
+			time.Sleep(150 * time.Millisecond)
+		}
+		if warned := logger.load(); !reflect.DeepEqual(warned, test.exp) {
+			t.Errorf("min %d replicas %v: got warnings for %v, expected %v", test.min, test.replicas, warned, test.exp)
+		}
+		cl.Close()
+	}
+}
@@ -70,6 +70,56 @@ func (p *stickyTopicPartitioner) Partition(_ *Record, n int) int {
 	return p.onPart
 }
 
+// ManualPartitioner returns a partitioner that uses a record's Partition field
+// if it is non-negative, and otherwise uses the fallback partitioner. If the
+// fallback is nil, this uses StickyKeyPartitioner(nil).
+//
+// This allows producing records to partitions chosen by the application (for
+// example, to match an external system's sharding) while still letting the
+// fallback partition records that set Partition to -1. Because the zero value
+// of Partition is a valid partition, records that should be partitioned by
+// the fallback must explicitly set Partition to -1. Note that the client sets
+// a record's Partition once the record is successfully produced, so reusing
+// a produced record pins it to the same partition.
+//
+// If a record's Partition does not exist in the topic, the record fails with
+// kerr.UnknownTopicOrPartition. A manually partitioned record is buffered in
+// its partition the same as any other record, meaning idempotent sequence
+// numbers and ordering guarantees are unchanged: sequence numbers are
+// tracked per partition, regardless of how the partition was chosen.
+func ManualPartitioner(fallback Partitioner) Partitioner {
+	if fallback == nil {
+		fallback = StickyKeyPartitioner(nil)
+	}
+	return &manualPartitioner{fallback}
+}
+
+type manualPartitioner struct {
+	fallback Partitioner
+}
+
+func (m *manualPartitioner) ForTopic(topic string) TopicPartitioner {
+	return &manualTopicPartitioner{m.fallback.ForTopic(topic)}
+}
+
+type manualTopicPartitioner struct {
+	fallback TopicPartitioner
+}
+
+func (p *manualTopicPartitioner) OnNewBatch() { p.fallback.OnNewBatch() }
+func (p *manualTopicPartitioner) RequiresConsistency(r *Record) bool {
+	return r.Partition >= 0 || p.fallback.RequiresConsistency(r)
+}
+func (p *manualTopicPartitioner) Partition(r *Record, n int) int {
+	if r.Partition >= 0 {
+		return int(r.Partition)
+	}
+	return p.fallback.Partition(r, n)
+}
+
+// isManual returns whether the record was manually partitioned.
+func (p *manualTopicPartitioner) isManual(r *Record) bool { return r.Partition >= 0 }
+
 // StickyKeyPartitioner mirrors the default Java partitioner from Kafka's 2.4.0
 // release (see KAFKA-8601).
 //
@@ -140,7 +140,7 @@ func TestRecBatchAppendTo(t *testing.T) {
 		kbatch.Length = int32(len(rawBatch[8+4:]))                       // skip first offset (int64) and length
 		kbatch.CRC = int32(crc32.Checksum(rawBatch[8+4+4+1+4:], crc32c)) // skip thru crc
 
-		rawBatch = ourBatch.appendTo(nil, version, 12, 11, true, nil)
+		rawBatch = ourBatch.appendTo(nil, 12, 11, true, nil, 0)
 		ourBatch.wireLength = int32(len(rawBatch)) // fix length PRE compression
 	}
 
@@ -148,7 +148,7 @@ func TestRecBatchAppendTo(t *testing.T) {
 	var checkNum int
 	check := func() {
 		exp := kbatch.AppendTo(nil)
-		gotFull := ourBatch.appendTo(nil, version, 12, 11, true, compressor)
+		gotFull := ourBatch.appendTo(nil, 12, 11, true, compressor, compressor.codecFor(version))
 		ourBatchSize := (&kbin.Reader{Src: gotFull}).Int32()
 		got := gotFull[4:]
 		if ourBatchSize != int32(len(got)) {
@@ -314,11 +314,11 @@ func TestMessageSetAppendTo(t *testing.T) {
 		kset0rawc = kset0c.AppendTo(nil)
 		kset1rawc = kset1c.AppendTo(nil)
 
-		got0raw = ourBatch.appendToAsMessageSet(nil, 1, nil)
-		got1raw = ourBatch.appendToAsMessageSet(nil, 2, nil)
+		got0raw = ourBatch.appendToAsMessageSet(nil, 1, nil, 0)
+		got1raw = ourBatch.appendToAsMessageSet(nil, 2, nil, 0)
 
-		got0rawc = ourBatch.appendToAsMessageSet(nil, 1, compressor)
-		got1rawc = ourBatch.appendToAsMessageSet(nil, 2, compressor)
+		got0rawc = ourBatch.appendToAsMessageSet(nil, 1, compressor, compressor.codecFor(1))
+		got1rawc = ourBatch.appendToAsMessageSet(nil, 2, compressor, compressor.codecFor(2))
 	)
 
 	for i, pair := range []struct {
@@ -447,3 +447,40 @@ func BenchmarkAppendBatch(b *testing.B) {
 	}
 
 }
+
+func TestProduceRequestRecordsEncodedCodec(t *testing.T) {
+	c, err := newCompressor(ZstdCompression(), GzipCompression())
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := seqRecBatch{recBatch: &recBatch{
+		records: []promisedNumberedRecord{{
+			promisedRec: promisedRec{Record: &Record{Value: bytes.Repeat([]byte("v"), 1000)}},
+		}},
+	}}
+	batch.wireLength = int32(len(batch.appendTo(nil, -1, -1, false, nil, 0)))
+	req := &produceRequest{
+		version:    7,
+		compressor: c,
+		batches:    seqRecBatches{"foo": {0: batch}},
+	}
+
+	// The response to a request is for the codec the request was encoded
+	// with, even if the compressor prefers another codec by then.
+	req.AppendTo(nil)
+	c.disable(4)
+	if req.codec != 4 {
+		t.Errorf("got encoded codec %d, expected zstd (4)", req.codec)
+	}
+	if codec := batch.attrs & 0x07; codec != 4 {
+		t.Errorf("got batch codec %d, expected zstd (4)", codec)
+	}
+
+	req.AppendTo(nil)
+	if req.codec != 1 {
+		t.Errorf("got re-encoded codec %d, expected gzip (1) once zstd is disabled", req.codec)
+	}
+	if codec := batch.attrs & 0x07; codec != 1 {
+		t.Errorf("got re-encoded batch codec %d, expected gzip (1)", codec)
+	}
+}
@@ -74,7 +74,9 @@ func noPromise(*Record, error) {}
 //
 // If the record is too large to fit in a batch on its own in a produce
 // request, the promise is called immediately before this function returns
-// with kerr.MessageToLarge.
+// with kerr.MessageToLarge. Similarly, if a ProduceHeaderValidator rejects
+// the record's headers or a ProducerInterceptor fails the record, the
+// promise is called immediately with the validator's or interceptor's error.
 //
 // The context is used if the client currently has the max amount of buffered
 // records. If so, the client waits for some records to complete or for the
@@ -102,6 +104,57 @@ func (cl *Client) Produce(
 	r *Record,
 	promise func(*Record, error),
 ) error {
+	if promise == nil {
+		promise = noPromise
+	}
+	return cl.produce(ctx, promisedRec{promise: promise, Record: r})
+}
+
+// ProduceResult is the result of producing a record, as passed to the promise
+// in ProduceWithResult.
+//
+// If producing failed, Partition, Offset, and BrokerID are -1 and Timestamp
+// is the zero time.
+type ProduceResult struct {
+	// Partition is the partition the record was written to.
+	Partition int32
+	// Offset is the offset of the record in its partition, or -1 with
+	// NoAck.
+	Offset int64
+	// Timestamp is the broker's log append time if the topic uses
+	// LogAppendTime, and otherwise is the record's own timestamp.
+	Timestamp time.Time
+	// BrokerID is the ID of the broker that wrote the record, which is
+	// the partition leader when the record was produced.
+	BrokerID int32
+}
+
+var failedProduceResult = ProduceResult{Partition: -1, Offset: -1, BrokerID: -1}
+
+// ProduceWithResult is exactly like Produce, but calls promise with the
+// ProduceResult of the record, which includes the broker that wrote the
+// record. This can be used to attribute writes when tracing.
+//
+// The result's partition and offset are also set in the record itself, as
+// with Produce, but the broker and log append time are only available in
+// the result.
+//
+// With NoAck, the broker does not reply to produce requests, so records are
+// finished successfully as soon as they are written: the result's Offset (and
+// the record's) is -1, the Timestamp is the record's own timestamp, and
+// BrokerID is the broker the record was written to.
+func (cl *Client) ProduceWithResult(
+	ctx context.Context,
+	r *Record,
+	promise func(*Record, ProduceResult, error),
+) error {
+	if promise == nil {
+		return cl.Produce(ctx, r, nil)
+	}
+	return cl.produce(ctx, promisedRec{promise: noPromise, resultPromise: promise, Record: r})
+}
+
+func (cl *Client) produce(ctx context.Context, pr promisedRec) error {
 	if cl.cfg.txnID != nil && atomic.LoadUint32(&cl.producer.producingTxn) != 1 {
 		return ErrNotInTransaction
 	}
@@ -116,7 +169,7 @@ func (cl *Client) Produce(
 		// waitBuffer as normal.
 		drainBuffered := func() {
 			go func() { <-cl.producer.waitBuffer }()
-			cl.finishRecordPromise(promisedRec{noPromise, nil}, nil)
+			cl.finishRecordPromise(promisedRec{promise: noPromise}, nil)
 		}
 		if cl.cfg.manualFlushing {
 			drainBuffered()
@@ -133,18 +186,54 @@ func (cl *Client) Produce(
 		}
 	}
 
-	if promise == nil {
-		promise = noPromise
+	for _, intercept := range cl.cfg.interceptors {
+		if err := intercept(pr.Record); err != nil {
+			cl.finishRecordPromise(pr, err)
+			return nil
+		}
 	}
-	cl.partitionRecord(promisedRec{promise, r})
+	if cl.cfg.headerValidator != nil {
+		if err := cl.cfg.headerValidator(pr.Headers); err != nil {
+			cl.finishRecordPromise(pr, err)
+			return nil
+		}
+	}
+	if limit := cl.cfg.maxRecordBytes; limit > 0 {
+		if size := singleRecordBatchLength(pr.Record); size > limit {
+			cl.finishRecordPromise(pr, &ErrRecordTooLarge{size, limit})
+			return nil
+		}
+	}
+	cl.partitionRecord(pr)
 	return nil
 }
 
 func (cl *Client) finishRecordPromise(pr promisedRec, err error) {
+	cl.finishRecord(pr, failedProduceResult, err, false)
+}
+
+// giveUpRecordPromise finishes a record that failed because the client gave
+// up retrying it, passing it to the dead letter function if there is one.
+func (cl *Client) giveUpRecordPromise(pr promisedRec, err error) {
+	cl.finishRecord(pr, failedProduceResult, err, true)
+}
+
+func (cl *Client) finishRecord(pr promisedRec, res ProduceResult, err error, gaveUp bool) {
 	// We call the promise before finishing the record; this allows users
 	// of Flush to know that all buffered records are completely done
-	// before Flush returns.
-	pr.promise(pr.Record, err)
+	// before Flush returns. The same goes for dead letters.
+	callPromise := true
+	if fn := cl.cfg.deadLetter; fn != nil && gaveUp {
+		fn(pr.Record, err)
+		callPromise = !cl.cfg.deadLetterReplacesPromise
+	}
+	if callPromise {
+		if pr.resultPromise != nil {
+			pr.resultPromise(pr.Record, res, err)
+		} else {
+			pr.promise(pr.Record, err)
+		}
+	}
 
 	buffered := atomic.AddInt64(&cl.producer.bufferedRecords, -1)
 	if buffered >= cl.cfg.maxBufferedRecords {
@@ -176,7 +265,15 @@ func (cl *Client) doPartitionRecord(parts *topicPartitions, partsData *topicPart
 	}
 
 	parts.partsMu.Lock()
+	if parts.pruned {
+		// The topic was pruned from the topics map after we loaded
+		// it; we partition again to re-add the topic.
+		parts.partsMu.Unlock()
+		cl.partitionRecord(pr)
+		return
+	}
 	defer parts.partsMu.Unlock()
+	parts.produced = true
 	if parts.partitioner == nil {
 		parts.partitioner = cl.cfg.partitioner.ForTopic(pr.Topic)
 	}
@@ -190,9 +287,18 @@ func (cl *Client) doPartitionRecord(parts *topicPartitions, partsData *topicPart
 		return
 	}
 
+	// A manually chosen partition that is out of range does not exist,
+	// which is different from a partitioner misbehaving.
+	invalidPick := func() error {
+		if manual, ok := parts.partitioner.(*manualTopicPartitioner); ok && manual.isManual(pr.Record) {
+			return kerr.UnknownTopicOrPartition
+		}
+		return ErrInvalidPartition
+	}
+
 	pick := parts.partitioner.Partition(pr.Record, len(mapping))
 	if pick < 0 || pick >= len(mapping) {
-		cl.finishRecordPromise(pr, ErrInvalidPartition)
+		cl.finishRecordPromise(pr, invalidPick())
 		return
 	}
 
@@ -203,7 +309,7 @@ func (cl *Client) doPartitionRecord(parts *topicPartitions, partsData *topicPart
 		parts.partitioner.OnNewBatch()
 		pick = parts.partitioner.Partition(pr.Record, len(mapping))
 		if pick < 0 || pick >= len(mapping) {
-			cl.finishRecordPromise(pr, ErrInvalidPartition)
+			cl.finishRecordPromise(pr, invalidPick())
 			return
 		}
 		partition = mapping[pick]
@@ -315,7 +421,7 @@ func (cl *Client) doInitProducerID(lastID int64, lastEpoch int16) (*producerID,
 		// Note this is dependent on the first broker we hit;
 		// there are other areas in this client where we assume
 		// what we hit first is the default.
-		if err == ErrUnknownRequestKey {
+		if _, unknown := err.(*ErrUnknownRequestKey); unknown {
 			cl.cfg.logger.Log(LogLevelInfo, "unable to initialize a producer id because the broker is too old, continuing without a producer id")
 			return &producerID{-1, -1, nil}, true
 		}
@@ -397,7 +503,12 @@ func (cl *Client) partitionsForTopicProduce(pr promisedRec) (*topicPartitions, *
 		// of our lock then load, or the comment above.
 		cl.unknownTopicsMu.Lock()
 		topics = cl.loadTopics()
-		parts = topics[topic]
+		if parts, exists = topics[topic]; !exists {
+			// The topic was concurrently pruned; we start over,
+			// which re-adds it.
+			cl.unknownTopicsMu.Unlock()
+			return cl.partitionsForTopicProduce(pr)
+		}
 		v := parts.load()
 		if len(v.partitions) > 0 {
 			cl.unknownTopicsMu.Unlock()
@@ -485,8 +596,12 @@ func (cl *Client) waitUnknownTopic(
 	delete(cl.unknownTopics, topic)
 	cl.unknownTopicsMu.Unlock()
 
+	finish := cl.finishRecordPromise
+	if err != ErrBrokerDead { // we timed out or ran out of tries
+		finish = cl.giveUpRecordPromise
+	}
 	for _, pr := range unknown.buffered {
-		cl.finishRecordPromise(pr, err)
+		finish(pr, err)
 	}
 }
 
@@ -0,0 +1,411 @@
+package kgo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+)
+
+func TestProduceHeaderValidator(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	errMissingTrace := errors.New("missing trace-id header")
+	cl := newTestClient(t, c, ProduceHeaderValidator(func(headers []RecordHeader) error {
+		for _, h := range headers {
+			if h.Key == "trace-id" {
+				return nil
+			}
+		}
+		return errMissingTrace
+	}))
+	defer cl.Close()
+
+	errs := make(chan error, 2)
+	promise := func(_ *Record, err error) { errs <- err }
+	cl.Produce(context.Background(), &Record{Topic: "foo", Value: []byte("bad")}, promise)
+	cl.Produce(context.Background(), &Record{
+		Topic:   "foo",
+		Value:   []byte("good"),
+		Headers: []RecordHeader{{Key: "trace-id", Value: []byte("abc")}},
+	}, promise)
+
+	var rejected, produced int
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; err {
+		case errMissingTrace:
+			rejected++
+		case nil:
+			produced++
+		default:
+			t.Fatalf("unexpected produce error: %v", err)
+		}
+	}
+	if rejected != 1 || produced != 1 {
+		t.Fatalf("got %d rejected and %d produced, expected one of each", rejected, produced)
+	}
+
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	if seen := consumeN(t, cl, 1); seen["good"] != 1 {
+		t.Errorf("got %v, expected only the record with headers", seen)
+	}
+}
+
+func TestProducerInterceptors(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo", "bar"))
+	defer c.Close()
+
+	errRejected := errors.New("rejected")
+	cl := newTestClient(t, c, ProducerInterceptors(
+		func(r *Record) error {
+			r.Headers = append(r.Headers, RecordHeader{Key: "trace-id", Value: []byte("abc")})
+			return nil
+		},
+		func(r *Record) error {
+			if string(r.Value) == "bad" {
+				return errRejected
+			}
+			r.Topic = "bar" // reroutes, and sees the header from the prior interceptor
+			r.Value = append(r.Value, r.Headers[0].Value...)
+			return nil
+		},
+	))
+	defer cl.Close()
+
+	errs := make(chan error, 2)
+	promise := func(_ *Record, err error) { errs <- err }
+	cl.Produce(context.Background(), &Record{Topic: "foo", Value: []byte("bad")}, promise)
+	cl.Produce(context.Background(), &Record{Topic: "foo", Value: []byte("good")}, promise)
+
+	var rejected, produced int
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; err {
+		case errRejected:
+			rejected++
+		case nil:
+			produced++
+		default:
+			t.Fatalf("unexpected produce error: %v", err)
+		}
+	}
+	if rejected != 1 || produced != 1 {
+		t.Fatalf("got %d rejected and %d produced, expected one of each", rejected, produced)
+	}
+
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "bar"))
+	if seen := consumeN(t, cl, 1); seen["goodabc"] != 1 {
+		t.Errorf("got %v, expected the intercepted record", seen)
+	}
+}
+
+func TestManualPartitioner(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(3, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer cl.Close()
+
+	produce := func(partition int32) (*Record, error) {
+		r := &Record{Topic: "foo", Partition: partition, Value: []byte("v")}
+		done := make(chan error, 1)
+		cl.Produce(context.Background(), r, func(_ *Record, err error) { done <- err })
+		return r, <-done
+	}
+
+	for i := 0; i < 5; i++ {
+		r, err := produce(2)
+		if err != nil {
+			t.Fatalf("unable to produce to partition 2: %v", err)
+		}
+		if r.Partition != 2 || r.Offset != int64(i) {
+			t.Errorf("produced to %d@%d, expected 2@%d", r.Partition, r.Offset, i)
+		}
+	}
+	if _, err := produce(-1); err != nil {
+		t.Fatalf("unable to produce with the fallback partitioner: %v", err)
+	}
+	if _, err := produce(3); err != kerr.UnknownTopicOrPartition {
+		t.Errorf("got err %v producing to a nonexistent partition, expected UnknownTopicOrPartition", err)
+	}
+}
+
+func TestUnsupportedCompression(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(1, "foo"), kfake.UnsupportedCompression(1))
+	defer c.Close()
+
+	produce := func(cl *Client) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		errs := make(chan error, 1)
+		if err := cl.Produce(ctx, &Record{Topic: "foo", Value: []byte(strings.Repeat("v", 1000))}, func(_ *Record, err error) { errs <- err }); err != nil {
+			return err
+		}
+		return <-errs
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		cl := newTestClient(t, c, BatchCompression(GzipCompression()))
+		defer cl.Close()
+
+		var unsupported *ErrUnsupportedFeature
+		err := produce(cl)
+		if !errors.As(err, &unsupported) {
+			t.Fatalf("got err %v, expected *ErrUnsupportedFeature", err)
+		}
+		if unsupported.Feature != "gzip compression" || unsupported.Err != kerr.UnsupportedCompressionType || unsupported.BrokerVersion == "" {
+			t.Errorf("got %+v, expected gzip compression to be unsupported", unsupported)
+		}
+	})
+
+	t.Run("downgrade", func(t *testing.T) {
+		cl := newTestClient(t, c,
+			BatchCompression(GzipCompression()),
+			DowngradeUnsupportedCompression(),
+		)
+		defer cl.Close()
+
+		for i := 0; i < 2; i++ {
+			if err := produce(cl); err != nil {
+				t.Fatalf("produce %d: unable to produce with downgraded compression: %v", i, err)
+			}
+		}
+		cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+		consumeN(t, cl, 2)
+	})
+}
+
+func TestProduceDeadLetter(t *testing.T) {
+	t.Parallel()
+
+	for _, replace := range []bool{false, true} {
+		c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+		for i := 0; i < 10; i++ {
+			c.InjectFault(0, kfake.Fault{CloseConn: true})
+		}
+
+		var deadLetters, promises int32
+		opts := []Opt{
+			ProduceRetries(2),
+			ProduceDeadLetter(func(_ *Record, err error) {
+				// Every try dies with the connection, which is
+				// the error from the final try.
+				if !errors.Is(err, ErrRecordRetries) || !errors.Is(err, ErrConnDead) {
+					t.Errorf("got dead letter err %v, expected retries wrapping conn dead", err)
+				}
+				atomic.AddInt32(&deadLetters, 1)
+			}),
+		}
+		if replace {
+			opts = append(opts, DeadLetterReplacesPromise())
+		}
+		cl := newTestClient(t, c, opts...)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		for i := 0; i < 3; i++ {
+			r := &Record{Topic: "foo", Value: []byte(strconv.Itoa(i))}
+			if err := cl.Produce(ctx, r, func(*Record, error) { atomic.AddInt32(&promises, 1) }); err != nil {
+				t.Fatalf("unable to produce: %v", err)
+			}
+		}
+		if err := cl.Flush(ctx); err != nil {
+			t.Fatalf("unable to flush: %v", err)
+		}
+		cancel()
+		cl.Close()
+		c.Close()
+
+		expPromises := int32(3)
+		if replace {
+			expPromises = 0
+		}
+		if deadLetters != 3 || promises != expPromises {
+			t.Errorf("replace %v: got %d dead letters and %d promises, expected 3 and %d", replace, deadLetters, promises, expPromises)
+		}
+	}
+}
+
+func TestProduceDeadLetterUnknownTopic(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1))
+	defer c.Close()
+
+	// With one try, the first metadata load that fails to find the topic
+	// gives up on its records with ErrNoPartitionsAvailable.
+	deadLetters := make(chan error, 1)
+	cl := newTestClient(t, c,
+		RequestRetries(1),
+		ProduceDeadLetter(func(_ *Record, err error) { deadLetters <- err }),
+	)
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	promised := make(chan error, 1)
+	if err := cl.Produce(ctx, &Record{Topic: "unknown"}, func(_ *Record, err error) { promised <- err }); err != nil {
+		t.Fatalf("unable to produce: %v", err)
+	}
+	if err := <-promised; err != ErrNoPartitionsAvailable {
+		t.Errorf("got promise err %v, expected ErrNoPartitionsAvailable", err)
+	}
+	select {
+	case err := <-deadLetters:
+		if err != ErrNoPartitionsAvailable {
+			t.Errorf("got dead letter err %v, expected ErrNoPartitionsAvailable", err)
+		}
+	default:
+		t.Error("the record was not passed to the dead letter function")
+	}
+}
+
+func TestProduceRetriesWrapsFinalErr(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		c.InjectFault(0, kfake.Fault{PartitionErrorCode: kerr.NotLeaderForPartition.Code})
+	}
+
+	cl := newTestClient(t, c, ProduceRetries(2))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	if err := cl.Produce(ctx, &Record{Topic: "foo", Value: []byte("v")}, func(_ *Record, err error) { errCh <- err }); err != nil {
+		t.Fatalf("unable to produce: %v", err)
+	}
+	if err := <-errCh; !errors.Is(err, ErrRecordRetries) || !errors.Is(err, kerr.NotLeaderForPartition) {
+		t.Errorf("got err %v, expected retries wrapping not leader", err)
+	}
+}
+
+func TestMaxRecordBytes(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	// A batch containing only a record with a one byte key and a ten
+	// byte value is 61 bytes of batch overhead plus 18 bytes of record.
+	cl := newTestClient(t, c, MaxRecordBytes(79))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, test := range []struct {
+		value    string
+		tooLarge bool
+	}{
+		{"0123456789", false},
+		{"0123456789a", true},
+	} {
+		errs := make(chan error, 1)
+		r := &Record{Topic: "foo", Key: []byte("k"), Value: []byte(test.value)}
+		if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+		err := <-errs
+		if !test.tooLarge {
+			if err != nil {
+				t.Errorf("value %q: got unexpected err %v", test.value, err)
+			}
+			continue
+		}
+		var tooLarge *ErrRecordTooLarge
+		if !errors.As(err, &tooLarge) || tooLarge.Size != 80 || tooLarge.Limit != 79 {
+			t.Errorf("value %q: got err %v, expected record size 80 over limit 79", test.value, err)
+		}
+		if !errors.Is(err, kerr.MessageTooLarge) {
+			t.Errorf("value %q: err %v does not unwrap to MessageTooLarge", test.value, err)
+		}
+	}
+}
+
+func TestProduceWithResult(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(3), kfake.SeedTopics(3, "foo"))
+	defer c.Close()
+
+	for _, acks := range []Acks{NoAck(), LeaderAck(), AllISRAcks()} {
+		cl := newTestClient(t, c,
+			RequiredAcks(acks),
+			RecordPartitioner(ManualPartitioner(nil)),
+			MaxRecordBytes(100),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		type result struct {
+			r   *Record
+			res ProduceResult
+			err error
+		}
+		results := make(chan result, 4)
+		promise := func(r *Record, res ProduceResult, err error) { results <- result{r, res, err} }
+		for i := int32(0); i < 3; i++ {
+			r := &Record{Topic: "foo", Partition: i, Value: []byte("v")}
+			if err := cl.ProduceWithResult(ctx, r, promise); err != nil {
+				t.Fatalf("unable to produce: %v", err)
+			}
+		}
+		if err := cl.ProduceWithResult(ctx, &Record{Topic: "foo", Value: make([]byte, 100)}, promise); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+
+		var got []result
+		for i := 0; i < 4; i++ {
+			got = append(got, <-results)
+		}
+
+		leaders := make(map[int32]int32)
+		for _, t := range cl.RawMetadata().Topics {
+			for _, p := range t.Partitions {
+				leaders[p.Partition] = p.Leader
+			}
+		}
+
+		for _, got := range got {
+			if len(got.r.Value) == 100 {
+				var tooLarge *ErrRecordTooLarge
+				if !errors.As(got.err, &tooLarge) || got.res.Partition != -1 || got.res.Offset != -1 || got.res.BrokerID != -1 {
+					t.Errorf("acks %v: got result %+v, err %v for too large record", acks, got.res, got.err)
+				}
+				continue
+			}
+			exp := ProduceResult{
+				Partition: got.r.Partition,
+				Offset:    got.r.Offset,
+				Timestamp: got.r.Timestamp, // kfake does not use LogAppendTime
+				BrokerID:  leaders[got.r.Partition],
+			}
+			if got.err != nil || !reflect.DeepEqual(got.res, exp) {
+				t.Errorf("acks %v: got result %+v, err %v, expected %+v", acks, got.res, got.err, exp)
+			}
+			if noAck := acks == NoAck(); noAck != (got.res.Offset == -1) {
+				t.Errorf("acks %v: got offset %d, expected -1 only with no acks", acks, got.res.Offset)
+			}
+		}
+		cancel()
+		cl.Close()
+	}
+}
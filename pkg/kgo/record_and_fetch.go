@@ -39,7 +39,7 @@ func (a RecordAttrs) TimestampType() int8 {
 	if a.attrs&0b1000_0000 != 0 {
 		return -1
 	}
-	return int8(a.attrs & 0b0000_1000)
+	return int8(a.attrs&0b0000_1000) >> 3
 }
 
 // CompressionType signifies with which algorithm this record was compressed.
@@ -68,6 +68,8 @@ type Record struct {
 	// with the same key to go to the same partition.
 	Key []byte
 	// Value is blob of data to write to Kafka.
+	//
+	// A nil value is a tombstone; see IsTombstone.
 	Value []byte
 
 	// Headers are optional key/value pairs that are passed along with
@@ -88,6 +90,13 @@ type Record struct {
 	// This field is always set in Produce.
 	Timestamp time.Time
 
+	// OriginalTimestamp is the timestamp a fetched record was produced
+	// with if FetchTimestampClamp clamped Timestamp, and is otherwise the
+	// zero time.
+	//
+	// This field is unused when producing.
+	OriginalTimestamp time.Time
+
 	// Topic is the topic that a record is written to.
 	//
 	// This must be set for producing.
@@ -95,8 +104,10 @@ type Record struct {
 
 	// Partition is the partition that a record is written to.
 	//
-	// For producing, this is left unset. This will be set by the client
-	// as appropriate.
+	// For producing, this is left unset unless using the
+	// ManualPartitioner, in which case this is the partition to produce
+	// to, or -1 to use the fallback partitioner. This will be set by the
+	// client as appropriate once the record is produced.
 	Partition int32
 
 	// Attrs specifies what attributes were on this record.
@@ -127,6 +138,24 @@ type Record struct {
 	Offset int64
 }
 
+// IsTombstone returns whether the record is a tombstone, that is, whether its
+// Value is nil. An empty, non-nil Value is not a tombstone.
+//
+// In a compacted topic, a tombstone marks its key as deleted: compaction
+// removes older records for the key, and eventually (after the topic's
+// delete.retention.ms) the tombstone itself. Consumers rebuilding state from
+// a compacted topic should delete the key when they see a tombstone.
+//
+// Compaction does not renumber records, so consuming a compacted topic
+// returns offsets with gaps where records were removed. These gaps are
+// expected and are not data loss; the client only reports ErrDataLoss if
+// the partition was truncated below what was consumed. Separately, the log
+// start offset moving forward means retention deleted the start of the
+// partition, which the client handles as described in ConsumeResetOffset.
+func (r *Record) IsTombstone() bool {
+	return r.Value == nil
+}
+
 // FetchPartition is a response for a partition in a fetched topic from a
 // broker.
 type FetchPartition struct {
@@ -152,6 +181,29 @@ type FetchPartition struct {
 	LogStartOffset int64
 	// Records contains feched records for this partition.
 	Records []*Record
+	// FilteredRecords is the number of records in this fetch that were
+	// dropped while reading committed: records in aborted transactions and
+	// transaction control records. This is always zero when reading
+	// uncommitted.
+	//
+	// Comparing this against len(Records) gives the effective throughput
+	// of a transactional consumer versus the raw fetch throughput.
+	FilteredRecords int
+	// AbortedTransactions are the aborted transactions that Kafka
+	// returned for the range of this fetch, which the client used to drop
+	// aborted records. This is only populated when reading committed
+	// (Kafka does not return aborted transactions otherwise), and is
+	// provided for auditing and debugging transactions.
+	AbortedTransactions []AbortedTransaction
+}
+
+// AbortedTransaction is a transaction that was aborted in a fetched partition.
+type AbortedTransaction struct {
+	// ProducerID is the ID of the producer that aborted the transaction.
+	ProducerID int64
+	// FirstOffset is the first offset in the partition that was part of
+	// the aborted transaction.
+	FirstOffset int64
 }
 
 // FetchTopic is a response for a fetched topic from a broker.
@@ -167,11 +219,63 @@ type FetchTopic struct {
 type Fetch struct {
 	// Topics are all topics being responded to from a fetch to a broker.
 	Topics []FetchTopic
+
+	// Throttled is whether a broker throttled a fetch response since the
+	// prior poll. This is not tied to any one response: PollFetches
+	// signals throttling with an extra Fetch that has no topics and only
+	// this field set. See Fetches.WasThrottled.
+	Throttled bool
 }
 
 // Fetches is a group of fetches from brokers.
 type Fetches []Fetch
 
+// IsClientClosed returns whether the client was closed by the time these
+// fetches were polled, which is signaled with a fake fetch containing
+// ErrClientClosed. Once the client is closed, PollFetches returns immediately,
+// so this can be used to stop polling.
+func (fs Fetches) IsClientClosed() bool {
+	for _, f := range fs {
+		for _, ft := range f.Topics {
+			for _, fp := range ft.Partitions {
+				if fp.Err == ErrClientClosed {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// WasThrottled returns whether any broker throttled a fetch response since
+// the prior poll. Throttled fetches are delayed by the client, so consumers
+// implementing adaptive polling can use this to back off polling.
+func (fs Fetches) WasThrottled() bool {
+	for _, f := range fs {
+		if f.Throttled {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty returns whether the fetches contain no records and no errors, which
+// is the case if the poll context was canceled before any fetch returned
+// anything. Consumers implementing adaptive polling can use this to detect an
+// idle consumer and back off polling.
+func (fs Fetches) Empty() bool {
+	for _, f := range fs {
+		for _, ft := range f.Topics {
+			for _, fp := range ft.Partitions {
+				if fp.Err != nil || len(fp.Records) > 0 {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
 // FetchError is an error in a fetch along with the topic and partition that
 // the error was on.
 type FetchError struct {
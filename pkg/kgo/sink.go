@@ -1,7 +1,6 @@
 package kgo
 
 import (
-	"errors"
 	"hash/crc32"
 	"sync"
 	"sync/atomic"
@@ -201,11 +200,26 @@ func (s *sink) maybeDrain() {
 	if s.cl.cfg.manualFlushing && atomic.LoadInt32(&s.cl.producer.flushing) == 0 {
 		return
 	}
+	if s.cl.isPaused() {
+		return
+	}
 	if s.drainState.maybeBegin() {
 		go s.drain()
 	}
 }
 
+// stopPaused stops the drain loop if the client is paused, returning whether
+// it did. If the client was resumed while we were stopping, Resume may have
+// seen us still draining, so we begin draining again ourself.
+func (s *sink) stopPaused() bool {
+	if !s.cl.isPaused() {
+		return false
+	}
+	s.drainState.hardFinish()
+	s.maybeDrain()
+	return true
+}
+
 func (s *sink) maybeBackoff() {
 	s.backoffMu.Lock()
 	backoff := s.needBackoff
@@ -219,11 +233,11 @@ func (s *sink) maybeBackoff() {
 	s.cl.triggerUpdateMetadata() // as good a time as any
 
 	tries := int(atomic.AddUint32(&s.consecutiveFailures, 1))
-	after := time.NewTimer(s.cl.cfg.retryBackoff(tries))
+	after := s.cl.cfg.clock.NewTimer(s.cl.cfg.retryBackoff(tries))
 	defer after.Stop()
 
 	select {
-	case <-after.C:
+	case <-after.C():
 	case <-s.cl.ctx.Done():
 	}
 }
@@ -265,6 +279,9 @@ func (s *sink) drain() {
 			s.drainState.hardFinish()
 			return
 		}
+		if s.stopPaused() {
+			return
+		}
 
 		s.maybeBackoff()
 
@@ -436,9 +453,9 @@ func (s *sink) requeueUnattemptedReq(req *produceRequest, err error) {
 		// order seq nums; hopefully the client user does not stop
 		// on data loss, since this is not truly data loss.
 		if batch.isTimedOut(s.cl.cfg.recordTimeout) {
-			batch.owner.lockedFailAllRecords(ErrRecordTimeout)
-		} else if batch.tries == s.cl.cfg.retries {
-			batch.owner.lockedFailAllRecords(err)
+			batch.owner.lockedGiveUpAllRecords(ErrRecordTimeout)
+		} else if batch.tries == s.cl.cfg.produceRetries {
+			batch.owner.lockedGiveUpAllRecords(&errRecordRetries{err})
 		}
 		batch.owner.resetBatchDrainIdx()
 		maybeDrain = true
@@ -541,6 +558,23 @@ func (s *sink) handleReqResp(req *produceRequest, resp kmsg.Response, err error)
 	s.firstRespCheck(req.version)
 	atomic.StoreUint32(&s.consecutiveFailures, 0)
 
+	// With no acks, the broker does not reply and the response is empty.
+	// Every batch is successful once written, but we have no offsets.
+	if req.acks == 0 {
+		for _, partitions := range req.batches {
+			for partition, batch := range partitions {
+				if batch.isFirstBatchInRecordBuf() {
+					s.cl.finishBatch(batch.recBatch, req, s.nodeID, &kmsg.ProduceResponseTopicPartition{
+						Partition:     partition,
+						BaseOffset:    -1,
+						LogAppendTime: -1,
+					}, nil)
+				}
+			}
+		}
+		return
+	}
+
 	var reqRetry seqRecBatches // handled at the end
 
 	pr := resp.(*kmsg.ProduceResponse)
@@ -579,7 +613,7 @@ func (s *sink) handleReqResp(req *produceRequest, resp kmsg.Response, err error)
 			switch {
 			case kerr.IsRetriable(err) &&
 				err != kerr.CorruptMessage &&
-				batch.tries < s.cl.cfg.retries:
+				batch.tries < s.cl.cfg.produceRetries:
 				reqRetry.addSeqBatch(topic, partition, batch)
 
 			case err == kerr.OutOfOrderSequenceNumber,
@@ -632,7 +666,7 @@ func (s *sink) handleReqResp(req *produceRequest, resp kmsg.Response, err error)
 						"err", err,
 					)
 					s.cl.failProducerID(req.producerID, req.producerEpoch, err)
-					s.cl.finishBatch(batch.recBatch, req.producerID, req.producerEpoch, partition, rPartition.BaseOffset, err)
+					s.cl.finishBatch(batch.recBatch, req, s.nodeID, &rPartition, err)
 					continue
 				}
 				if s.cl.cfg.onDataLoss != nil {
@@ -677,6 +711,45 @@ func (s *sink) handleReqResp(req *produceRequest, resp kmsg.Response, err error)
 				batch.owner.resetSeq()
 				reqRetry.addSeqBatch(topic, partition, batch)
 
+			case err == kerr.UnsupportedCompressionType,
+				err == kerr.UnsupportedForMessageFormat:
+
+				// Older brokers or topics with an old message format
+				// reject features they do not understand. If the
+				// rejected feature is our compression codec, we can
+				// optionally disable the codec and retry.
+				codec := req.codec
+				if s.cl.cfg.downgradeCompression &&
+					codec > 0 &&
+					(err == kerr.UnsupportedCompressionType || codec == 4) &&
+					batch.tries < s.cl.cfg.produceRetries {
+
+					s.cl.cfg.logger.Log(LogLevelWarn, "broker does not support our compression codec, disabling the codec and retrying the batch",
+						"broker", s.nodeID,
+						"topic", topic,
+						"partition", partition,
+						"codec", codecName(codec),
+						"err", err,
+					)
+					req.compressor.disable(codec)
+					reqRetry.addSeqBatch(topic, partition, batch)
+					continue
+				}
+				err = &ErrUnsupportedFeature{
+					Topic:         topic,
+					Partition:     partition,
+					NodeID:        s.nodeID,
+					BrokerVersion: s.brokerVersionGuess(),
+					Feature:       unsupportedFeature(req, batch, codec, err),
+					Err:           err,
+				}
+				s.cl.cfg.logger.Log(LogLevelWarn, "batch in a produce request failed due to an unsupported feature",
+					"topic", topic,
+					"partition", partition,
+					"err", err,
+				)
+				s.cl.finishBatch(batch.recBatch, req, s.nodeID, &rPartition, err)
+
 			case err == kerr.DuplicateSequenceNumber: // ignorable, but we should not get
 				s.cl.cfg.logger.Log(LogLevelInfo, "received unexpected duplicate sequence number, ignoring and treating batch as successful",
 					"topic", topic,
@@ -685,16 +758,19 @@ func (s *sink) handleReqResp(req *produceRequest, resp kmsg.Response, err error)
 				err = nil
 				fallthrough
 			default:
+				if kerr.IsRetriable(err) && err != kerr.CorruptMessage {
+					err = &errRecordRetries{err} // we are out of tries
+				}
 				if err != nil {
 					s.cl.cfg.logger.Log(LogLevelInfo, "batch in a produce request failed",
 						"topic", topic,
 						"partition", partition,
 						"err", err,
 						"err_is_retriable", kerr.IsRetriable(err),
-						"max_retries_reached", batch.tries == s.cl.cfg.retries,
+						"max_retries_reached", batch.tries == s.cl.cfg.produceRetries,
 					)
 				}
-				s.cl.finishBatch(batch.recBatch, req.producerID, req.producerEpoch, partition, rPartition.BaseOffset, err)
+				s.cl.finishBatch(batch.recBatch, req, s.nodeID, &rPartition, err)
 			}
 		}
 
@@ -717,12 +793,49 @@ func (s *sink) handleReqResp(req *produceRequest, resp kmsg.Response, err error)
 	}
 }
 
+// brokerVersionGuess returns the guessed Kafka version of the broker this
+// sink produces to.
+func (s *sink) brokerVersionGuess() string {
+	s.cl.brokersMu.RLock()
+	b := s.cl.brokers[s.nodeID]
+	s.cl.brokersMu.RUnlock()
+	if b == nil {
+		return "unknown"
+	}
+	return b.loadVersionGuess()
+}
+
+// unsupportedFeature returns the feature a broker most likely rejected for a
+// batch that failed with UNSUPPORTED_COMPRESSION_TYPE or
+// UNSUPPORTED_FOR_MESSAGE_FORMAT. Brokers can down convert record batches to
+// an old message format unless the batch uses zstd, transactions, record
+// headers, or idempotence, which we check in that order.
+func unsupportedFeature(req *produceRequest, batch seqRecBatch, codec int8, err error) string {
+	if err == kerr.UnsupportedCompressionType || codec == 4 {
+		return codecName(codec) + " compression"
+	}
+	if req.txnID != nil {
+		return "transactions"
+	}
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	for _, pnr := range batch.records {
+		if len(pnr.Headers) > 0 {
+			return "record headers"
+		}
+	}
+	if req.producerID >= 0 {
+		return "idempotent produce"
+	}
+	return "the topic's message format"
+}
+
 // finishBatch removes a batch from its owning record buffer and finishes all
-// records in the batch.
+// records in the batch, per the response partition from the given broker.
 //
 // This is safe even if the owning recBuf migrated sinks, since we are
 // finishing based off the status of an inflight req from the original sink.
-func (cl *Client) finishBatch(batch *recBatch, producerID int64, producerEpoch int16, partition int32, baseOffset int64, err error) {
+func (cl *Client) finishBatch(batch *recBatch, req *produceRequest, nodeID int32, rPartition *kmsg.ProduceResponseTopicPartition, err error) {
 	recBuf := batch.owner
 	recBuf.mu.Lock()
 	defer recBuf.mu.Unlock()
@@ -748,11 +861,21 @@ func (cl *Client) finishBatch(batch *recBatch, producerID int64, producerEpoch i
 	recBuf.batches = recBuf.batches[1:]
 	recBuf.batchDrainIdx--
 
+	// LogAppendTime is only returned in v2+, and is -1 unless the topic
+	// uses log append time.
+	var appendTime time.Time
+	if req.version >= 2 && rPartition.LogAppendTime >= 0 {
+		appendTime = timeFromMillis(rPartition.LogAppendTime)
+	}
+
 	for i, pnr := range batch.records {
-		pnr.Offset = baseOffset + int64(i)
-		pnr.Partition = partition
-		pnr.ProducerID = producerID
-		pnr.ProducerEpoch = producerEpoch
+		pnr.Offset = rPartition.BaseOffset + int64(i)
+		if rPartition.BaseOffset < 0 {
+			pnr.Offset = -1 // unknown with no acks
+		}
+		pnr.Partition = rPartition.Partition
+		pnr.ProducerID = req.producerID
+		pnr.ProducerEpoch = req.producerEpoch
 
 		// A recBuf.attrs is updated when appending to be written.  For
 		// v0 && v1 produce requests, we set bit 8 in the attrs
@@ -761,7 +884,16 @@ func (cl *Client) finishBatch(batch *recBatch, producerID int64, producerEpoch i
 		// attrs to our own RecordAttrs.
 		pnr.Attrs = RecordAttrs{uint8(batch.attrs)}
 
-		cl.finishRecordPromise(pnr.promisedRec, err)
+		res := ProduceResult{
+			Partition: pnr.Partition,
+			Offset:    pnr.Offset,
+			Timestamp: pnr.Timestamp,
+			BrokerID:  nodeID,
+		}
+		if !appendTime.IsZero() {
+			res.Timestamp = appendTime
+		}
+		cl.finishRecord(pnr.promisedRec, res, nil, false)
 		batch.records[i] = noPNR
 	}
 	emptyRecordsPool.Put(&batch.records)
@@ -776,10 +908,9 @@ func (s *sink) handleRetryBatches(retry seqRecBatches) {
 		// order seq nums; hopefully the client user does not stop
 		// on data loss, since this is not truly data loss.
 		if batch.isTimedOut(s.cl.cfg.recordTimeout) {
-			batch.owner.lockedFailAllRecords(ErrRecordTimeout)
-		} else if batch.tries == s.cl.cfg.retries {
-			err := errors.New("record failed after being retried too many times")
-			batch.owner.lockedFailAllRecords(err)
+			batch.owner.lockedGiveUpAllRecords(ErrRecordTimeout)
+		} else if batch.tries == s.cl.cfg.produceRetries {
+			batch.owner.lockedGiveUpAllRecords(ErrRecordRetries)
 		}
 		batch.owner.resetBatchDrainIdx()
 		batch.owner.failing = true
@@ -1136,8 +1267,8 @@ func (recBuf *recBuf) bumpRepeatedLoadErr(err error) {
 	}
 	batch0 := recBuf.batches[0]
 	batch0.tries++
-	if batch0.tries > recBuf.cl.cfg.retries {
-		recBuf.lockedFailAllRecords(err)
+	if batch0.tries > recBuf.cl.cfg.produceRetries {
+		recBuf.lockedGiveUpAllRecords(&errRecordRetries{err})
 	}
 }
 
@@ -1152,6 +1283,17 @@ func (recBuf *recBuf) failAllRecords(err error) {
 // This is used anywhere where we have to fail and remove an entire batch,
 // if we just removed the one batch, the seq num chain would be broken.
 func (recBuf *recBuf) lockedFailAllRecords(err error) {
+	recBuf.lockedFinishAllRecords(err, recBuf.cl.finishRecordPromise)
+}
+
+// lockedGiveUpAllRecords is the same as lockedFailAllRecords, but for when
+// the first batch ran out of retries or timed out. Records are passed to the
+// dead letter function, if there is one.
+func (recBuf *recBuf) lockedGiveUpAllRecords(err error) {
+	recBuf.lockedFinishAllRecords(err, recBuf.cl.giveUpRecordPromise)
+}
+
+func (recBuf *recBuf) lockedFinishAllRecords(err error, finish func(promisedRec, error)) {
 	recBuf.lockedStopLinger()
 	for _, batch := range recBuf.batches {
 		// We need to guard our clearing of records against a
@@ -1163,7 +1305,7 @@ func (recBuf *recBuf) lockedFailAllRecords(err error) {
 		// batch. So, we lock while we clear.
 		batch.mu.Lock()
 		for i, pnr := range batch.records {
-			recBuf.cl.finishRecordPromise(pnr.promisedRec, err)
+			finish(pnr.promisedRec, err)
 			batch.records[i] = noPNR
 		}
 		batch.records = nil
@@ -1218,7 +1360,8 @@ func (recBuf *recBuf) resetSeq() {
 // promisedRec ties a record with the callback that will be called once
 // a batch is finally written and receives a response.
 type promisedRec struct {
-	promise func(*Record, error)
+	promise       func(*Record, error)
+	resultPromise func(*Record, ProduceResult, error) // if non-nil, used instead of promise
 	*Record
 }
 
@@ -1285,23 +1428,26 @@ func (b *recBatch) appendRecord(pr promisedRec, nums recordNumbers) {
 	})
 }
 
+// recordBatchOverhead is the length of a record batch with no records,
+// including the length prefix of the record bytes in a produce request.
+const recordBatchOverhead = 4 + // array len
+	8 + // firstOffset
+	4 + // batchLength
+	4 + // partitionLeaderEpoch
+	1 + // magic
+	4 + // crc
+	2 + // attributes
+	4 + // lastOffsetDelta
+	8 + // firstTimestamp
+	8 + // maxTimestamp
+	8 + // producerID
+	2 + // producerEpoch
+	4 + // seq
+	4 // record array length
+
 // newRecordBatch returns a new record batch for a topic and partition
 // containing the given record.
 func (recBuf *recBuf) newRecordBatch(pr promisedRec) *recBatch {
-	const recordBatchOverhead = 4 + // array len
-		8 + // firstOffset
-		4 + // batchLength
-		4 + // partitionLeaderEpoch
-		1 + // magic
-		4 + // crc
-		2 + // attributes
-		4 + // lastOffsetDelta
-		8 + // firstTimestamp
-		8 + // maxTimestamp
-		8 + // producerID
-		2 + // producerEpoch
-		4 + // seq
-		4 // record array length
 	b := &recBatch{
 		owner:          recBuf,
 		firstTimestamp: pr.Timestamp.UnixNano() / 1e6,
@@ -1317,6 +1463,15 @@ func (recBuf *recBuf) newRecordBatch(pr promisedRec) *recBatch {
 	return b
 }
 
+// singleRecordBatchLength returns the uncompressed length of a record batch
+// containing only r, which is how Kafka measures a record against a topic's
+// max.message.bytes. This does not include the produce request's length
+// prefix of the batch.
+func singleRecordBatchLength(r *Record) int32 {
+	b := recBatch{firstTimestamp: r.Timestamp.UnixNano() / 1e6}
+	return recordBatchOverhead - 4 + b.calculateRecordNumbers(r).wireLength
+}
+
 // calculateRecordNumbers returns the numbers for a record if it were added to
 // the record batch. Nothing accounts for overflows; that should be done prior.
 func (b *recBatch) calculateRecordNumbers(r *Record) recordNumbers {
@@ -1393,6 +1548,12 @@ type produceRequest struct {
 	producerEpoch int16
 
 	compressor *compressor
+
+	// codec is the compression codec chosen for every batch when this
+	// request was last encoded, which is what the broker is replying to.
+	// The compressor's preferred codec can change after encoding if a
+	// codec is disabled.
+	codec int8
 }
 
 type seqRecBatches map[string]map[int32]seqRecBatch
@@ -1440,6 +1601,8 @@ func (p *produceRequest) SetVersion(v int16) { p.version = v }
 func (p *produceRequest) GetVersion() int16  { return p.version }
 func (p *produceRequest) IsFlexible() bool   { return false } // version 8 is not flexible
 func (p *produceRequest) AppendTo(dst []byte) []byte {
+	p.codec = p.compressor.codecFor(p.version)
+
 	if p.version >= 3 {
 		dst = kbin.AppendNullableString(dst, p.txnID)
 	}
@@ -1463,15 +1626,15 @@ func (p *produceRequest) AppendTo(dst []byte) []byte {
 			}
 			dst = kbin.AppendInt32(dst, partition)
 			if p.version < 3 {
-				dst = batch.appendToAsMessageSet(dst, uint8(p.version), p.compressor)
+				dst = batch.appendToAsMessageSet(dst, uint8(p.version), p.compressor, p.codec)
 			} else {
 				dst = batch.appendTo(
 					dst,
-					p.version,
 					p.producerID,
 					p.producerEpoch,
 					p.txnID != nil,
 					p.compressor,
+					p.codec,
 				)
 			}
 			batch.mu.Unlock()
@@ -1489,11 +1652,11 @@ func (p *produceRequest) ResponseKind() kmsg.Response {
 
 func (r seqRecBatch) appendTo(
 	dst []byte,
-	version int16,
 	producerID int64,
 	producerEpoch int16,
 	transactional bool,
 	compressor *compressor,
+	codec int8,
 ) []byte {
 	nullableBytesLen := r.wireLength - 4 // NULLABLE_BYTES leading length, minus itself
 	nullableBytesLenAt := len(dst)       // in case compression adjusting
@@ -1534,12 +1697,12 @@ func (r seqRecBatch) appendTo(
 		dst = pnr.appendTo(dst, int32(i))
 	}
 
-	if compressor != nil {
+	if compressor != nil && codec > 0 {
 		toCompress := dst[recordsAt:]
 		w := sliceWriters.Get().(*sliceWriter)
 		defer sliceWriters.Put(w)
 
-		compressed, codec := compressor.compress(w, toCompress, int16(version))
+		compressed, codec := compressor.compressWith(w, toCompress, codec)
 		if compressed != nil && // nil would be from an error
 			len(compressed) < len(toCompress) {
 
@@ -1580,7 +1743,7 @@ func (pnr promisedNumberedRecord) appendTo(dst []byte, offsetDelta int32) []byte
 	return dst
 }
 
-func (r seqRecBatch) appendToAsMessageSet(dst []byte, version uint8, compressor *compressor) []byte {
+func (r seqRecBatch) appendToAsMessageSet(dst []byte, version uint8, compressor *compressor, codec int8) []byte {
 	nullableBytesLenAt := len(dst)
 	dst = append(dst, 0, 0, 0, 0) // nullable bytes len
 	for i, pnr := range r.records {
@@ -1606,12 +1769,12 @@ func (r seqRecBatch) appendToAsMessageSet(dst []byte, version uint8, compressor
 		r.attrs |= 0b1000_0000
 	}
 
-	if compressor != nil {
+	if compressor != nil && codec > 0 {
 		toCompress := dst[nullableBytesLenAt+4:] // skip nullable bytes leading prefix
 		w := sliceWriters.Get().(*sliceWriter)
 		defer sliceWriters.Put(w)
 
-		compressed, codec := compressor.compress(w, toCompress, int16(version))
+		compressed, codec := compressor.compressWith(w, toCompress, codec)
 		inner := &Record{Value: compressed}
 		wrappedLength := messageSet0Length(inner)
 		if version == 2 {
@@ -31,6 +31,11 @@ type source struct {
 
 	session fetchSession // supports fetch sessions as per KIP-227
 
+	// Set if our prior fetch was answered with a preferred replica for a
+	// partition that must be consumed from the leader; the next fetch
+	// omits our rack so the broker replies with records.
+	omitRack bool
+
 	cursorsMu    sync.Mutex
 	cursors      []*cursor // contains all partitions being consumed on this source
 	cursorsStart int       // incremented every fetch req to ensure all partitions are fetched
@@ -52,6 +57,10 @@ func (s *source) addCursor(add *cursor) {
 	s.cursors = append(s.cursors, add)
 	s.cursorsMu.Unlock()
 
+	if s.cl.cfg.fetchBrokers != nil && s.cl.cfg.canFetchBroker(s.nodeID) {
+		s.cl.consumer.trackRestricted(add.topic, add.partition, false)
+	}
+
 	// Adding a new cursor may allow a new partition to be fetched.
 	// We do not need to cancel any current fetch nor kill the session,
 	// since adding a cursor is non-destructive to work in progress.
@@ -132,6 +141,28 @@ type cursor struct {
 	// off and retry. For the latter, we update our metadata.
 	leaderEpoch int32
 
+	// If we moved to a preferred replica, when we return to the leader to
+	// re-evaluate the preferred replica (see FetchPreferredReplicaLease).
+	// This is only used in the context of a session, while on a source
+	// other than our leader's.
+	preferredUntil time.Time
+
+	// If positive, the offset at which we stop consuming (see
+	// Offset.StopAt). This is set when a partition is assigned, which can
+	// happen while a session is fetching, and read while processing fetch
+	// responses, so it is accessed atomically.
+	stopOffset int64
+
+	// stats accumulates what has been fetched for this partition since it
+	// was assigned; see FetchPartitionStats. These are atomics so that
+	// loading stats does not contend with fetching.
+	stats cursorStats
+
+	// state is the last CursorState reported to OnCursorStateChange, and
+	// is only tracked if that option is set. This is an atomic because
+	// pausing and resuming the client swap usable and paused states.
+	state uint32
+
 	// NOTE if adding new fields, see the note preceeding the struct.
 
 	// cursorOffset is our epoch/offset that we are consuming. When a fetch
@@ -141,6 +172,67 @@ type cursor struct {
 	cursorOffset
 }
 
+// CursorState is the state of consuming a partition, as reported to
+// OnCursorStateChange.
+type CursorState uint8
+
+const (
+	// CursorUnset is the state of a partition that is not being consumed,
+	// either because it was never assigned or because it was unassigned.
+	CursorUnset CursorState = iota
+	// CursorLoading is the state of a partition whose offset or leader
+	// epoch is being loaded before consuming (or resuming consuming)
+	// begins.
+	CursorLoading
+	// CursorUsable is the state of a partition that is ready to be
+	// fetched.
+	CursorUsable
+	// CursorPaused is the state of a usable partition while the client is
+	// paused; see Client.Pause and Client.PauseFetching.
+	CursorPaused
+)
+
+func (s CursorState) String() string {
+	switch s {
+	case CursorUnset:
+		return "UNSET"
+	case CursorLoading:
+		return "LOADING"
+	case CursorUsable:
+		return "USABLE"
+	case CursorPaused:
+		return "PAUSED"
+	}
+	return "UNKNOWN"
+}
+
+// cursorStats is cumulative fetch statistics for a cursor.
+type cursorStats struct {
+	fetches int64
+	records int64
+	bytes   int64
+}
+
+func (s *cursorStats) add(records, bytes int) {
+	atomic.AddInt64(&s.fetches, 1)
+	atomic.AddInt64(&s.records, int64(records))
+	atomic.AddInt64(&s.bytes, int64(bytes))
+}
+
+func (s *cursorStats) reset() {
+	atomic.StoreInt64(&s.fetches, 0)
+	atomic.StoreInt64(&s.records, 0)
+	atomic.StoreInt64(&s.bytes, 0)
+}
+
+func (s *cursorStats) load() PartitionFetchStats {
+	return PartitionFetchStats{
+		Fetches: atomic.LoadInt64(&s.fetches),
+		Records: atomic.LoadInt64(&s.records),
+		Bytes:   atomic.LoadInt64(&s.bytes),
+	}
+}
+
 // cursorOffset tracks offsets/epochs for a cursor.
 type cursorOffset struct {
 	// What the cursor is at: we request this offset next.
@@ -174,15 +266,27 @@ func (c *cursor) use() *cursorOffsetNext {
 
 // unset transitions a cursor to an unusable state when the cursor is no longer
 // to be consumed. This is called exclusively after sources are stopped.
-// This also unsets the cursor offset, which is assumed to be unused now.
+// This also unsets the cursor offset, which is assumed to be unused now, and
+// resets the cursor's fetch stats.
 func (c *cursor) unset() {
 	c.useState = 0
+	c.setState(CursorUnset)
+	c.setStopOffset(0)
+	c.stats.reset()
 	c.setOffset(cursorOffset{
 		offset:            -1,
 		lastConsumedEpoch: -1,
 	})
 }
 
+func (c *cursor) setStopOffset(stop int64) {
+	atomic.StoreInt64(&c.stopOffset, stop)
+}
+
+func (c *cursor) loadStopOffset() int64 {
+	return atomic.LoadInt64(&c.stopOffset)
+}
+
 // usable returns whether a cursor can be used for building a fetch request.
 func (c *cursor) usable() bool {
 	return atomic.LoadUint32(&c.useState) == 1
@@ -191,11 +295,51 @@ func (c *cursor) usable() bool {
 // allowUsable allows a cursor to be fetched, and is called either in assigning
 // offsets, or when a buffered fetch is taken or discarded,  or when listing /
 // epoch loading finishes.
+//
+// If the cursor has reached its stop offset, the cursor is left unusable and
+// the consumer is notified that this partition is complete.
 func (c *cursor) allowUsable() {
+	if stop := c.loadStopOffset(); stop > 0 && c.offset >= stop {
+		c.source.cl.consumer.stopReached(c.topic, c.partition)
+		return
+	}
 	atomic.SwapUint32(&c.useState, 1)
 	c.source.maybeConsume()
 }
 
+// setState reports a transition to state to OnCursorStateChange, if the
+// cursor is not already in that state. Usable cursors are reported as paused
+// while fetching is paused.
+func (c *cursor) setState(state CursorState) {
+	fn := c.source.cl.cfg.onCursorStateChange
+	if fn == nil {
+		return
+	}
+	if state == CursorUsable && c.source.cl.isFetchPaused() {
+		state = CursorPaused
+	}
+	if old := CursorState(atomic.SwapUint32(&c.state, uint32(state))); old != state {
+		fn(c.topic, c.partition, state)
+	}
+	c.refreshPaused() // the client may have been paused or resumed while we swapped
+}
+
+// refreshPaused swaps a usable cursor to paused or a paused cursor to usable
+// to match whether fetching is paused.
+func (c *cursor) refreshPaused() {
+	fn := c.source.cl.cfg.onCursorStateChange
+	if fn == nil {
+		return
+	}
+	from, to := CursorPaused, CursorUsable
+	if c.source.cl.isFetchPaused() {
+		from, to = to, from
+	}
+	if atomic.CompareAndSwapUint32(&c.state, uint32(from), uint32(to)) {
+		fn(c.topic, c.partition, to)
+	}
+}
+
 // setOffset sets the cursors offset which will be used the next time a fetch
 // request is built. This function is called under the source mutex while the
 // source is stopped, and the caller is responsible for calling maybeConsume
@@ -251,6 +395,11 @@ func (p *cursorOffsetPreferred) move() {
 	// This remove clears the source's session and buffered fetch, although
 	// we will not have a buffered fetch since moving replicas is called
 	// before buffering a fetch.
+	c.preferredUntil = time.Time{}
+	if p.preferredReplica != c.leader {
+		c.preferredUntil = c.source.cl.cfg.clock.Now().Add(c.source.cl.cfg.preferredReplicaLease())
+	}
+
 	c.source.removeCursor(c)
 	c.source = sns.source
 	c.source.addCursor(c)
@@ -300,6 +449,91 @@ func (s *source) takeBuffered() Fetch {
 	return r.fetch
 }
 
+// pollBytes tracks the record bytes remaining in a PollFetchesBytes call.
+type pollBytes struct {
+	left int
+	took bool // whether any record was taken; we always allow one
+}
+
+// take returns how many of records fit in the remaining bytes, subtracting
+// their size. The first record taken in a poll always fits, so that a record
+// larger than the budget does not stall polling.
+func (b *pollBytes) take(records []*Record) int {
+	for i, r := range records {
+		size := recordBytes(r)
+		if b.took && size > b.left {
+			return i
+		}
+		b.left -= size
+		b.took = true
+	}
+	return len(records)
+}
+
+// recordBytes returns the size of a record's key, value, and headers.
+func recordBytes(r *Record) int {
+	size := len(r.Key) + len(r.Value)
+	for _, h := range r.Headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return size
+}
+
+// takeBufferedBytes drains as many records from a buffered fetch as fit in b,
+// leaving the rest buffered, and returns whether the fetch was fully drained.
+// Partitions without records, such as those with only an error, are always
+// taken. If a partition is split, its filtered record count and aborted
+// transactions are returned with the first records taken, while its error
+// stays with its remaining records.
+//
+// Cursors of taken records are moved immediately, so that discarding the rest
+// of the fetch does not redeliver what was taken, but cursors only become
+// usable once the entire fetch is taken.
+func (s *source) takeBufferedBytes(b *pollBytes) (Fetch, bool) {
+	var taken Fetch
+	var keep []FetchTopic
+	for _, t := range s.buffered.fetch.Topics {
+		takenT := FetchTopic{Topic: t.Topic}
+		keepT := FetchTopic{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			o := s.buffered.usedOffsets[t.Topic][p.Partition]
+			switch n := b.take(p.Records); n {
+			case len(p.Records):
+				takenT.Partitions = append(takenT.Partitions, p)
+				if o != nil {
+					o.from.setOffset(o.cursorOffset)
+				}
+			case 0:
+				keepT.Partitions = append(keepT.Partitions, p)
+			default:
+				head, last := p, p.Records[n-1]
+				head.Records, head.Err = p.Records[:n:n], nil
+				p.Records, p.FilteredRecords, p.AbortedTransactions = p.Records[n:], 0, nil
+				takenT.Partitions = append(takenT.Partitions, head)
+				keepT.Partitions = append(keepT.Partitions, p)
+				if o != nil {
+					o.from.setOffset(cursorOffset{
+						offset:            last.Offset + 1,
+						lastConsumedEpoch: last.LeaderEpoch,
+					})
+				}
+			}
+		}
+		if len(takenT.Partitions) > 0 {
+			taken.Topics = append(taken.Topics, takenT)
+		}
+		if len(keepT.Partitions) > 0 {
+			keep = append(keep, keepT)
+		}
+	}
+	if len(keep) > 0 {
+		s.buffered.fetch.Topics = keep
+		return taken, false
+	}
+	s.takeBuffered()
+	return taken, true
+}
+
 func (s *source) discardBuffered() {
 	r := s.buffered
 	s.buffered = bufferedFetch{}
@@ -323,10 +557,14 @@ func (s *source) createReq() *fetchRequest {
 		// its copy of the original fields.
 		session: s.session,
 	}
+	if s.cl.cfg.reuseFetchResps {
+		req.respPool = &s.cl.consumer.fetchResps
+	}
 
 	s.cursorsMu.Lock()
 	defer s.cursorsMu.Unlock()
 
+	var anyFollower bool
 	cursorIdx := s.cursorsStart
 	for i := 0; i < len(s.cursors); i++ {
 		c := s.cursors[cursorIdx]
@@ -335,7 +573,15 @@ func (s *source) createReq() *fetchRequest {
 			continue
 		}
 		req.addCursor(c)
+		anyFollower = anyFollower || s.cl.cfg.canFetchFollower(c.topic)
+	}
+
+	// We only send our rack if something in this request can be moved to
+	// a follower (see FetchFollowerTopics).
+	if !anyFollower || s.omitRack {
+		req.rack = ""
 	}
+	s.omitRack = false
 
 	// We could have lost our only record buffer just before we grabbed the
 	// source lock above.
@@ -347,11 +593,48 @@ func (s *source) createReq() *fetchRequest {
 }
 
 func (s *source) maybeConsume() {
+	if s.cl.isFetchPaused() {
+		return
+	}
+	if !s.cl.cfg.canFetchBroker(s.nodeID) {
+		s.reportRestricted()
+		return
+	}
 	if s.fetchState.maybeBegin() {
 		go s.loopFetch()
 	}
 }
 
+// reportRestricted reports every usable cursor on a source that we cannot
+// fetch from; see RestrictFetchToBrokers.
+func (s *source) reportRestricted() {
+	s.cursorsMu.Lock()
+	var usable []*cursor
+	for _, c := range s.cursors {
+		if c.usable() {
+			usable = append(usable, c)
+		}
+	}
+	s.cursorsMu.Unlock()
+
+	for _, c := range usable {
+		s.cl.consumer.trackRestricted(c.topic, c.partition, true)
+	}
+}
+
+// stopPaused stops the fetch loop if fetching is paused, returning whether it
+// did. If fetching was resumed while we were stopping, Resume or
+// ResumeFetching may have seen us still working, so we begin consuming again
+// ourself.
+func (s *source) stopPaused() bool {
+	if !s.cl.isFetchPaused() {
+		return false
+	}
+	s.fetchState.hardFinish()
+	s.maybeConsume()
+	return true
+}
+
 func (s *source) loopFetch() {
 	consumer := &s.cl.consumer
 	session := consumer.loadSession()
@@ -377,12 +660,17 @@ func (s *source) loopFetch() {
 
 	again := true
 	for again {
+		if s.stopPaused() {
+			return
+		}
+
 		select {
 		case <-session.ctx.Done():
 			s.fetchState.hardFinish()
 			return
 		case <-s.sem:
 		}
+
 		again = s.fetchState.maybeFinish(s.fetch(session))
 	}
 
@@ -410,6 +698,7 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 	if req.numOffsets == 0 { // cursors could have been set unusable
 		return
 	}
+	s.cl.consumer.trackFetchIssued()
 
 	// If our fetch is killed, we want to cancel waiting for the response.
 	var (
@@ -444,10 +733,10 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 	if err != nil {
 		s.cl.triggerUpdateMetadata()
 		s.consecutiveFailures++
-		after := time.NewTimer(s.cl.cfg.retryBackoff(s.consecutiveFailures))
+		after := s.cl.cfg.clock.NewTimer(s.cl.cfg.retryBackoff(s.consecutiveFailures))
 		defer after.Stop()
 		select {
-		case <-after.C:
+		case <-after.C():
 		case <-ctx.Done():
 		}
 		s.session.reset()
@@ -456,16 +745,38 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 	}
 	s.consecutiveFailures = 0
 
-	resp := kresp.(*kmsg.FetchResponse)
+	var resp *kmsg.FetchResponse
+	if pooled, ok := kresp.(*pooledFetchResponse); ok {
+		resp = &pooled.FetchResponse
+	} else {
+		resp = kresp.(*kmsg.FetchResponse)
+	}
+	if resp.ThrottleMillis > 0 {
+		atomic.StoreUint32(&s.cl.consumer.fetchThrottled, 1)
+	}
 
 	var (
 		fetch         Fetch
 		reloadOffsets listOrEpochLoads
 		preferreds    cursorPreferreds
 		updateMeta    bool
+		omitRack      bool
 		handled       = make(chan struct{})
 	)
 
+	// If fetches are limited, we wait for a slot to process the response.
+	// We do not hold a slot while waiting for the response: the broker
+	// can hold the request for FetchMaxWait, and this would block every
+	// other source from processing its response. We are still a session
+	// worker while waiting, but we quit as soon as the session is
+	// canceled, so stopping a session is not blocked on fetches ahead of
+	// us.
+	if !s.cl.consumer.acquireFetchSem(ctx) {
+		req.usedOffsets.finishUsingAll()
+		s.session.reset()
+		return
+	}
+
 	// Theoretically, handleReqResp could take a bit of CPU time due to
 	// decompressing and processing the response. We do this in a goroutine
 	// to allow the session to be canceled at any moment.
@@ -473,7 +784,8 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 	// Processing the response only needs the source's nodeID and client.
 	go func() {
 		defer close(handled)
-		fetch, reloadOffsets, preferreds, updateMeta = s.handleReqResp(req, resp)
+		defer s.cl.consumer.releaseFetchSem()
+		fetch, reloadOffsets, preferreds, updateMeta, omitRack = s.handleReqResp(req, resp)
 	}()
 
 	select {
@@ -484,6 +796,10 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 		return
 	}
 
+	// The response is fully processed into our fetch; once we are done
+	// with the top level fields below, it can be reused.
+	defer req.releaseResp(kresp)
+
 	// The logic below here should be relatively quick.
 
 	deleteReqUsedOffset := func(topic string, partition int32) {
@@ -509,6 +825,7 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 
 	// The session on the request was updated; we keep those updates.
 	s.session = req.session
+	s.omitRack = omitRack
 
 	// handleReqResp only parses the body of the response, not the top
 	// level error code.
@@ -537,9 +854,7 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 		return
 	}
 
-	if resp.SessionID > 0 {
-		s.session.bumpEpoch(resp.SessionID)
-	}
+	s.session.bumpEpoch(resp.SessionID)
 
 	// If we moved any partitions to preferred replicas, we reset the
 	// session. We do this after bumping the epoch just to ensure that we
@@ -560,6 +875,7 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 			usedOffsets: req.usedOffsets,
 		}
 		s.sem = make(chan struct{})
+		s.cl.consumer.trackFetchBuffered(fetch)
 		s.cl.consumer.addSourceReadyForDraining(s)
 	} else {
 		req.usedOffsets.finishUsingAll()
@@ -567,14 +883,14 @@ func (s *source) fetch(consumerSession *consumerSession) (fetched bool) {
 	return
 }
 
-// Parses a fetch response into a Fetch, offsets to reload, and whether
-// metadata needs updating.
+// Parses a fetch response into a Fetch, offsets to reload, whether metadata
+// needs updating, and whether the next fetch should omit our rack.
 //
 // This only uses a source's broker and client, and thus does not need
 // the source mutex.
 //
 // This function, and everything it calls, is side effect free.
-func (s *source) handleReqResp(req *fetchRequest, resp *kmsg.FetchResponse) (Fetch, listOrEpochLoads, cursorPreferreds, bool) {
+func (s *source) handleReqResp(req *fetchRequest, resp *kmsg.FetchResponse) (Fetch, listOrEpochLoads, cursorPreferreds, bool, bool) {
 	var (
 		f = Fetch{
 			Topics: make([]FetchTopic, 0, len(resp.Topics)),
@@ -582,6 +898,10 @@ func (s *source) handleReqResp(req *fetchRequest, resp *kmsg.FetchResponse) (Fet
 		reloadOffsets listOrEpochLoads
 		preferreds    []cursorOffsetPreferred
 		updateMeta    bool
+		omitRack      bool
+		decodes       []respPartitionDecode
+
+		now = s.cl.cfg.clock.Now()
 	)
 	for _, rt := range resp.Topics {
 		topic := rt.Topic
@@ -593,11 +913,6 @@ func (s *source) handleReqResp(req *fetchRequest, resp *kmsg.FetchResponse) (Fet
 			continue
 		}
 
-		fetchTopic := FetchTopic{
-			Topic:      topic,
-			Partitions: make([]FetchPartition, 0, len(rt.Partitions)),
-		}
-
 		for i := range rt.Partitions {
 			rp := &rt.Partitions[i]
 			partition := rp.Partition
@@ -606,10 +921,36 @@ func (s *source) handleReqResp(req *fetchRequest, resp *kmsg.FetchResponse) (Fet
 				continue
 			}
 
+			// If we are on a preferred replica whose lease expired,
+			// we drop this response and move back to the leader,
+			// which re-evaluates which replica we should use.
+			if c := partOffset.from; s.nodeID != c.leader && !now.Before(c.preferredUntil) {
+				s.cl.cfg.logger.Log(LogLevelDebug, "preferred replica lease expired, returning to the leader",
+					"topic", topic,
+					"partition", partition,
+					"replica", s.nodeID,
+					"leader", c.leader,
+				)
+				preferreds = append(preferreds, cursorOffsetPreferred{
+					*partOffset,
+					c.leader,
+				})
+				continue
+			}
+
 			// If we are fetching from the replica already, Kafka replies with a -1
 			// preferred read replica. If Kafka replies with a preferred replica,
 			// it sends no records.
+			//
+			// We only migrate to a preferred replica if this topic is
+			// allowed to be consumed from followers and the replica
+			// is an allowed fetch broker; if not, the partition stays
+			// on the leader and we refetch it without our rack.
 			if preferred := rp.PreferredReadReplica; resp.Version >= 11 && preferred >= 0 {
+				if !s.cl.cfg.canFetchFollower(topic) || !s.cl.cfg.canFetchBroker(preferred) {
+					omitRack = true
+					continue
+				}
 				preferreds = append(preferreds, cursorOffsetPreferred{
 					*partOffset,
 					preferred,
@@ -617,98 +958,172 @@ func (s *source) handleReqResp(req *fetchRequest, resp *kmsg.FetchResponse) (Fet
 				continue
 			}
 
-			fetchTopic.Partitions = append(fetchTopic.Partitions, partOffset.processRespPartition(resp.Version, rp, s.cl.decompressor))
-			fp := &fetchTopic.Partitions[len(fetchTopic.Partitions)-1]
-			updateMeta = updateMeta || fp.Err != nil
+			decodes = append(decodes, respPartitionDecode{
+				topic:      topic,
+				partOffset: partOffset,
+				rp:         rp,
+			})
+		}
+	}
 
-			switch fp.Err {
-			default:
-				// - bad auth
-				// - unsupported compression
-				// - unsupported message version
-				// - unknown error
-				// - or, no error
-
-			case kerr.UnknownTopicOrPartition,
-				kerr.NotLeaderForPartition,
-				kerr.ReplicaNotAvailable,
-				kerr.KafkaStorageError,
-				kerr.UnknownLeaderEpoch, // our meta is newer than broker we fetched from
-				kerr.OffsetNotAvailable: // fetched from out of sync replica or a behind in-sync one (KIP-392: case 1 and case 2)
-
-				fp.Err = nil // recoverable with client backoff; hide the error
-
-			case kerr.OffsetOutOfRange:
-				fp.Err = nil
-
-				// If we are out of range, we reset to what we can.
-				// With Kafka >= 2.1.0, we should only get offset out
-				// of range if we fetch before the start, but a user
-				// could start past the end and want to reset to
-				// the end. We respect that.
-				//
-				// KIP-392 (case 3) specifies that if we are consuming
-				// from a follower, then if our offset request is before
-				// the low watermark, we list offsets from the follower.
-				//
-				// KIP-392 (case 4) specifies that if we are consuming
-				// a follower and our request is larger than the high
-				// watermark, then we should first check for truncation
-				// from the leader and then if we still get out of
-				// range, reset with list offsets.
-				//
-				// It further goes on to say that "out of range errors
-				// due to ISR propagation delays should be extremely
-				// rare". Rather than falling back to listing offsets,
-				// we stay in a cycle of validating the leader epoch
-				// until the follower has caught up.
-
-				if s.nodeID == partOffset.from.leader { // non KIP-392 case
-					reloadOffsets.addLoad(topic, partition, loadTypeList, offsetLoad{
-						replica: -1,
-						Offset:  s.cl.cfg.resetOffset,
-					})
-				} else if partOffset.offset < fp.LogStartOffset { // KIP-392 case 3
-					reloadOffsets.addLoad(topic, partition, loadTypeList, offsetLoad{
-						replica: s.nodeID,
-						Offset:  s.cl.cfg.resetOffset,
-					})
-				} else { // partOffset.offset > fp.HighWatermark, KIP-392 case 4
-					reloadOffsets.addLoad(topic, partition, loadTypeEpoch, offsetLoad{
-						replica: -1,
-						Offset: Offset{
-							at:    partOffset.offset,
-							epoch: partOffset.lastConsumedEpoch,
-						},
-					})
-				}
+	s.decodeRespPartitions(resp.Version, decodes)
 
-			case kerr.FencedLeaderEpoch:
-				fp.Err = nil
-
-				// With fenced leader epoch, we notify an error only
-				// if necessary after we find out if loss occurred.
-				// If we have consumed nothing, then we got unlucky
-				// by being fenced right after we grabbed metadata.
-				// We just refresh metadata and try again.
-				if partOffset.lastConsumedEpoch >= 0 {
-					reloadOffsets.addLoad(topic, partition, loadTypeEpoch, offsetLoad{
-						replica: -1,
-						Offset: Offset{
-							at:    partOffset.offset,
-							epoch: partOffset.lastConsumedEpoch,
-						},
-					})
-				}
+	for i := range decodes {
+		d := &decodes[i]
+		var (
+			topic      = d.topic
+			partition  = d.rp.Partition
+			partOffset = d.partOffset
+		)
+		if len(f.Topics) == 0 || f.Topics[len(f.Topics)-1].Topic != topic {
+			f.Topics = append(f.Topics, FetchTopic{Topic: topic})
+		}
+		fetchTopic := &f.Topics[len(f.Topics)-1]
+		fetchTopic.Partitions = append(fetchTopic.Partitions, d.fp)
+		fp := &fetchTopic.Partitions[len(fetchTopic.Partitions)-1]
+		updateMeta = updateMeta || fp.Err != nil
+
+		switch fp.Err {
+		default:
+			// - bad auth
+			// - unsupported compression
+			// - unsupported message version
+			// - unknown error
+			// - or, no error
+
+		case kerr.UnknownTopicOrPartition,
+			kerr.NotLeaderForPartition,
+			kerr.ReplicaNotAvailable,
+			kerr.KafkaStorageError,
+			kerr.UnknownLeaderEpoch, // our meta is newer than broker we fetched from
+			kerr.OffsetNotAvailable: // fetched from out of sync replica or a behind in-sync one (KIP-392: case 1 and case 2)
+
+			fp.Err = nil // recoverable with client backoff; hide the error
+
+		case kerr.OffsetOutOfRange:
+			fp.Err = nil
+
+			// If we are out of range, we reset to what we can.
+			// With Kafka >= 2.1.0, we should only get offset out
+			// of range if we fetch before the start, such as if
+			// retention deleted what we were resuming from. We
+			// list the start offset: if we are before it, we seek
+			// to it; otherwise, a user could start past the end
+			// and want to reset to the end, and we reload with the
+			// reset offset. We respect that.
+			//
+			// KIP-392 (case 3) specifies that if we are consuming
+			// from a follower, then if our offset request is before
+			// the low watermark, we list offsets from the follower.
+			//
+			// KIP-392 (case 4) specifies that if we are consuming
+			// a follower and our request is larger than the high
+			// watermark, then we should first check for truncation
+			// from the leader and then if we still get out of
+			// range, reset with list offsets.
+			//
+			// It further goes on to say that "out of range errors
+			// due to ISR propagation delays should be extremely
+			// rare". Rather than falling back to listing offsets,
+			// we stay in a cycle of validating the leader epoch
+			// until the follower has caught up.
+
+			if s.nodeID == partOffset.from.leader { // non KIP-392 case
+				reloadOffsets.addLoad(topic, partition, loadTypeList, offsetLoad{
+					replica:      -1,
+					Offset:       NewOffset().AtStart(),
+					outOfRange:   true,
+					outOfRangeAt: partOffset.offset,
+				})
+			} else if partOffset.offset < fp.LogStartOffset { // KIP-392 case 3
+				reloadOffsets.addLoad(topic, partition, loadTypeList, offsetLoad{
+					replica:      s.nodeID,
+					Offset:       NewOffset().AtStart(),
+					outOfRange:   true,
+					outOfRangeAt: partOffset.offset,
+				})
+			} else { // partOffset.offset > fp.HighWatermark, KIP-392 case 4
+				reloadOffsets.addLoad(topic, partition, loadTypeEpoch, offsetLoad{
+					replica: -1,
+					Offset: Offset{
+						at:    partOffset.offset,
+						epoch: partOffset.lastConsumedEpoch,
+					},
+				})
+			}
+
+		case kerr.FencedLeaderEpoch:
+			fp.Err = nil
+
+			// With fenced leader epoch, we notify an error only
+			// if necessary after we find out if loss occurred.
+			// If we have consumed nothing, then we got unlucky
+			// by being fenced right after we grabbed metadata.
+			// We just refresh metadata and try again.
+			if partOffset.lastConsumedEpoch >= 0 {
+				reloadOffsets.addLoad(topic, partition, loadTypeEpoch, offsetLoad{
+					replica: -1,
+					Offset: Offset{
+						at:    partOffset.offset,
+						epoch: partOffset.lastConsumedEpoch,
+					},
+				})
 			}
 		}
+	}
+
+	return f, reloadOffsets, preferreds, updateMeta, omitRack
+}
+
+// respPartitionDecode is a partition in a fetch response to be processed
+// into a FetchPartition.
+type respPartitionDecode struct {
+	topic      string
+	partOffset *cursorOffsetNext
+	rp         *kmsg.FetchResponseTopicPartition
+	fp         FetchPartition // set by decodeRespPartitions
+}
 
-		if len(fetchTopic.Partitions) > 0 {
-			f.Topics = append(f.Topics, fetchTopic)
+// decodeRespPartitions processes every partition to be decoded, parsing and
+// decompressing all record batches. With FetchDecodeConcurrency, partitions
+// are processed by a bounded number of goroutines. A partition appears once in
+// a fetch response and is processed entirely by one goroutine, so records
+// within a partition stay in order.
+func (s *source) decodeRespPartitions(version int16, decodes []respPartitionDecode) {
+	decode := func(d *respPartitionDecode) {
+		d.fp = d.partOffset.processRespPartition(version, d.rp, s.cl.decompressor)
+		d.partOffset.from.stats.add(len(d.fp.Records), len(d.rp.RecordBatches))
+	}
+
+	workers := s.cl.cfg.fetchDecodeConcurrency
+	if workers > len(decodes) {
+		workers = len(decodes)
+	}
+	if workers < 2 {
+		for i := range decodes {
+			decode(&decodes[i])
 		}
+		return
 	}
 
-	return f, reloadOffsets, preferreds, updateMeta
+	var (
+		wg   sync.WaitGroup
+		next int64 = -1
+	)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				idx := int(atomic.AddInt64(&next, 1))
+				if idx >= len(decodes) {
+					return
+				}
+				decode(&decodes[idx])
+			}
+		}()
+	}
+	wg.Wait()
 }
 
 // processRespPartition processes all records in all potentially compressed
@@ -747,6 +1162,12 @@ func (o *cursorOffsetNext) processRespPartition(version int16, rp *kmsg.FetchRes
 			numPartitionRecords += int(batches[i].NumRecords)
 		}
 		fp.Records = make([]*Record, 0, numPartitionRecords)
+		for _, abort := range rp.AbortedTransactions {
+			fp.AbortedTransactions = append(fp.AbortedTransactions, AbortedTransaction{
+				ProducerID:  abort.ProducerID,
+				FirstOffset: abort.FirstOffset,
+			})
+		}
 		aborter := buildAborter(rp)
 		for i := range batches {
 			o.processRecordBatch(&fp, &batches[i], aborter, decompressor)
@@ -841,6 +1262,26 @@ func (o *cursorOffsetNext) processRecordBatch(
 	if abortBatch && lastRecord != nil && lastRecord.Attrs.IsControl() {
 		aborter.trackAbortedPID(batch.ProducerID)
 	}
+
+	// Compaction can remove the tail of a batch, or every record in it;
+	// Kafka keeps the emptied batch to retain producer state. The batch's
+	// offsets still belong to it, so we skip past them rather than asking
+	// for the same offset again (and again).
+	o.skipPastBatch(batch)
+}
+
+// skipPastBatch moves our offset past the last offset of a batch, if the
+// records we kept have not already done so.
+func (o *cursorOffsetNext) skipPastBatch(batch *kmsg.RecordBatch) {
+	next := batch.FirstOffset + int64(batch.LastOffsetDelta) + 1
+	if stop := o.from.loadStopOffset(); stop > 0 && next > stop {
+		next = stop
+	}
+	if next <= o.offset {
+		return
+	}
+	o.offset = next
+	o.lastConsumedEpoch = batch.PartitionLeaderEpoch
 }
 
 func (o *cursorOffsetNext) processV1Messages(
@@ -964,12 +1405,28 @@ func (o *cursorOffsetNext) maybeKeepRecord(fp *FetchPartition, record *Record, a
 		return
 	}
 
+	// If we are consuming up to a stop offset, we never keep anything at
+	// or past the stop. We bump our offset to the stop so that the cursor
+	// is complete even if the topic is compacted and the exact stop
+	// offset does not exist.
+	if stop := o.from.loadStopOffset(); stop > 0 && record.Offset >= stop {
+		if o.offset < stop {
+			o.offset = stop
+		}
+		return
+	}
+
 	// We only keep control records if specifically requested.
 	if record.Attrs.IsControl() && !o.from.keepControl {
 		abort = true
 	}
 	if !abort {
-		fp.Records = append(fp.Records, record)
+		o.maybeClampTimestamp(record)
+		if o.intercept(record) {
+			fp.Records = append(fp.Records, record)
+		}
+	} else if o.from.source.cl.cfg.isolationLevel == 1 {
+		fp.FilteredRecords++
 	}
 
 	// The record offset may be much larger than our expected offset if the
@@ -978,6 +1435,31 @@ func (o *cursorOffsetNext) maybeKeepRecord(fp *FetchPartition, record *Record, a
 	o.lastConsumedEpoch = record.LeaderEpoch
 }
 
+// intercept calls any ConsumerInterceptors on a record, returning whether to
+// keep the record. A dropped record still advances our offset.
+func (o *cursorOffsetNext) intercept(record *Record) bool {
+	for _, intercept := range o.from.source.cl.cfg.consumerInterceptors {
+		if !intercept(record) {
+			return false
+		}
+	}
+	return true
+}
+
+// maybeClampTimestamp clamps a record's timestamp to now if the client
+// clamps timestamps and the record is too far in the future.
+func (o *cursorOffsetNext) maybeClampTimestamp(record *Record) {
+	cfg := &o.from.source.cl.cfg
+	if !cfg.clampTimestamps {
+		return
+	}
+	now := cfg.clock.Now()
+	if record.Timestamp.Sub(now) > cfg.timestampClamp {
+		record.OriginalTimestamp = record.Timestamp
+		record.Timestamp = now
+	}
+}
+
 ///////////////////////////////
 // kmsg.Record to kgo.Record //
 ///////////////////////////////
@@ -1084,6 +1566,10 @@ type fetchRequest struct {
 	// built. If the source is reset, the session it has is reset at the
 	// field level only. Our view of the original session is still valid.
 	session fetchSession
+
+	// respPool, if non-nil, is where we get responses to decode into;
+	// see ReuseFetchResponses.
+	respPool *sync.Pool
 }
 
 func (f *fetchRequest) addCursor(c *cursor) {
@@ -1154,7 +1640,38 @@ func (*fetchRequest) ReadFrom([]byte) error {
 	panic("unreachable -- the client never uses ReadFrom on its internal fetchRequest")
 }
 func (f *fetchRequest) ResponseKind() kmsg.Response {
-	return &kmsg.FetchResponse{Version: f.version}
+	if f.respPool == nil {
+		return &kmsg.FetchResponse{Version: f.version}
+	}
+	if resp, ok := f.respPool.Get().(*pooledFetchResponse); ok {
+		resp.Version = f.version
+		return resp
+	}
+	return &pooledFetchResponse{kmsg.FetchResponse{Version: f.version}}
+}
+
+// releaseResp returns a fully processed response to our pool, if we are
+// pooling. Every field is zeroed, but the capacity of the topic, partition,
+// and aborted transaction slices is kept for the next decode. Zeroing drops
+// the record batches, which reference the raw response bytes.
+func (f *fetchRequest) releaseResp(kresp kmsg.Response) {
+	pooled, ok := kresp.(*pooledFetchResponse)
+	if !ok {
+		return
+	}
+	resp := &pooled.FetchResponse
+	topics := resp.Topics
+	for i := range topics {
+		t := &topics[i]
+		partitions := t.Partitions
+		for j := range partitions {
+			p := &partitions[j]
+			*p = kmsg.FetchResponseTopicPartition{AbortedTransactions: p.AbortedTransactions[:0]}
+		}
+		*t = kmsg.FetchResponseTopic{Partitions: partitions[:0]}
+	}
+	*resp = kmsg.FetchResponse{Topics: topics[:0]}
+	f.respPool.Put(pooled)
 }
 
 // fetchSessions, introduced in KIP-227, allow us to send less information back
@@ -1191,10 +1708,20 @@ func (s *fetchSession) reset() {
 //
 // Kafka replies with the session ID of the session to use. When it does, we
 // start from epoch 1, wrapping back to 1 if we go negative.
+//
+// If Kafka replies with no session ID, it did not create a session for us,
+// such as when its session cache is full. Our next request must then be
+// another full fetch listing every partition, so we reset rather than keep
+// what we sent: otherwise, partitions whose offsets did not change would be
+// left out of the request and never fetched again.
 func (s *fetchSession) bumpEpoch(id int32) {
 	if s.killed {
 		return
 	}
+	if id <= 0 {
+		s.reset()
+		return
+	}
 	if id != s.id {
 		s.epoch = 0 // new session: reset to 0 for the increment below
 	}
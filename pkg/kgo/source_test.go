@@ -0,0 +1,857 @@
+package kgo
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestProcessRecordBatchSkipsCompactedBatch(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		stop   int64
+		offset int64
+		epoch  int32
+	}{
+		{"empty_batch", 0, 8, 2},
+		{"capped_at_stop", 6, 6, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := &cursorOffsetNext{
+				cursorOffset: cursorOffset{offset: 3, lastConsumedEpoch: 1},
+				from:         &cursor{stopOffset: test.stop},
+			}
+			// Compaction removed every record in offsets 3 thru 7.
+			batch := &kmsg.RecordBatch{
+				FirstOffset:          3,
+				LastOffsetDelta:      4,
+				PartitionLeaderEpoch: 2,
+				Magic:                2,
+			}
+			var fp FetchPartition
+			o.processRecordBatch(&fp, batch, nil, nil)
+
+			if fp.Err != nil || len(fp.Records) != 0 {
+				t.Fatalf("got err %v and %d records, expected neither", fp.Err, len(fp.Records))
+			}
+			if o.offset != test.offset || o.lastConsumedEpoch != test.epoch {
+				t.Errorf("got offset %d epoch %d, expected offset %d epoch %d", o.offset, o.lastConsumedEpoch, test.offset, test.epoch)
+			}
+		})
+	}
+}
+
+func TestRecordAttrs(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		attrs         RecordAttrs
+		timestampType int8
+		compression   uint8
+		transactional bool
+		control       bool
+	}{
+		{"create_time", RecordAttrs{0b0000_0000}, 0, 0, false, false},
+		{"log_append_time_lz4", RecordAttrs{0b0000_1011}, 1, 3, false, false},
+		{"transactional_zstd", RecordAttrs{0b0001_0100}, 0, 4, true, false},
+		{"control", RecordAttrs{0b0011_0000}, 0, 0, true, true},
+		{"v0_message", messageAttrsToRecordAttrs(0b0000_0001, true), -1, 1, false, false},
+		{"v1_message_log_append_time", messageAttrsToRecordAttrs(0b0000_0100, false), 1, 0, false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := test.attrs
+			if got := a.TimestampType(); got != test.timestampType {
+				t.Errorf("got timestamp type %d, expected %d", got, test.timestampType)
+			}
+			if got := a.CompressionType(); got != test.compression {
+				t.Errorf("got compression %d, expected %d", got, test.compression)
+			}
+			if got := a.IsTransactional(); got != test.transactional {
+				t.Errorf("got transactional %v, expected %v", got, test.transactional)
+			}
+			if got := a.IsControl(); got != test.control {
+				t.Errorf("got control %v, expected %v", got, test.control)
+			}
+		})
+	}
+}
+
+func TestFetchTimestampClamp(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+	for _, test := range []struct {
+		name    string
+		clamp   bool
+		ts      time.Time
+		expTs   time.Time
+		expOrig time.Time
+	}{
+		{"no_clamp", false, now.Add(time.Hour), now.Add(time.Hour), time.Time{}},
+		{"past", true, now.Add(-time.Hour), now.Add(-time.Hour), time.Time{}},
+		{"within_max", true, now.Add(time.Minute), now.Add(time.Minute), time.Time{}},
+		{"beyond_max", true, now.Add(time.Hour), now, now.Add(time.Hour)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := defaultCfg()
+			cfg.clock = clock
+			cfg.clampTimestamps = test.clamp
+			cfg.timestampClamp = time.Minute
+			o := &cursorOffsetNext{
+				from: &cursor{source: &source{cl: &Client{cfg: cfg}}},
+			}
+
+			var fp FetchPartition
+			o.maybeKeepRecord(&fp, &Record{Timestamp: test.ts}, false)
+
+			if len(fp.Records) != 1 {
+				t.Fatalf("got %d records, expected 1", len(fp.Records))
+			}
+			r := fp.Records[0]
+			if !r.Timestamp.Equal(test.expTs) || !r.OriginalTimestamp.Equal(test.expOrig) {
+				t.Errorf("got timestamp %v original %v, expected timestamp %v original %v", r.Timestamp, r.OriginalTimestamp, test.expTs, test.expOrig)
+			}
+		})
+	}
+}
+
+func TestPreferredReplicaLeaseExpiry(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+
+	cfg := defaultCfg()
+	cfg.clock = clock
+	cfg.rack = "rack"
+	s := &source{cl: &Client{cfg: cfg}, nodeID: 2}
+
+	// Both partitions are led by broker 1 but are on preferred replica 2;
+	// only the lease for partition 0 has expired.
+	expired := &cursor{topic: "foo", partition: 0, source: s, leader: 1, preferredUntil: now}
+	live := &cursor{topic: "foo", partition: 1, source: s, leader: 1, preferredUntil: now.Add(time.Minute)}
+	req := &fetchRequest{usedOffsets: usedOffsets{"foo": {
+		0: expired.use(),
+		1: live.use(),
+	}}}
+	resp := &kmsg.FetchResponse{
+		Version: 11,
+		Topics: []kmsg.FetchResponseTopic{{
+			Topic: "foo",
+			Partitions: []kmsg.FetchResponseTopicPartition{
+				{Partition: 0, PreferredReadReplica: -1},
+				{Partition: 1, PreferredReadReplica: -1},
+			},
+		}},
+	}
+
+	f, _, preferreds, _, _ := s.handleReqResp(req, resp)
+	if len(preferreds) != 1 || preferreds[0].from != expired || preferreds[0].preferredReplica != 1 {
+		t.Fatalf("got preferreds %v, expected only partition 0 to return to leader 1", preferreds)
+	}
+	if len(f.Topics) != 1 || len(f.Topics[0].Partitions) != 1 || f.Topics[0].Partitions[0].Partition != 1 {
+		t.Errorf("got fetch %v, expected only partition 1", f)
+	}
+}
+
+func TestOmitRackAfterUnusablePreferredReplica(t *testing.T) {
+	cfg := defaultCfg()
+	cfg.rack = "rack"
+	cfg.followerTopics = map[string]struct{}{"bar": {}}
+	s := &source{cl: &Client{cfg: cfg}, nodeID: 1}
+
+	// foo must be consumed from the leader, but the leader tells us to
+	// move to replica 2 since we sent our rack for bar.
+	foo := &cursor{topic: "foo", partition: 0, source: s, leader: 1}
+	bar := &cursor{topic: "bar", partition: 0, source: s, leader: 1}
+	req := &fetchRequest{usedOffsets: usedOffsets{"foo": {0: foo.use()}}}
+	resp := &kmsg.FetchResponse{
+		Version: 11,
+		Topics: []kmsg.FetchResponseTopic{{
+			Topic:      "foo",
+			Partitions: []kmsg.FetchResponseTopicPartition{{Partition: 0, PreferredReadReplica: 2}},
+		}},
+	}
+	_, _, preferreds, _, omitRack := s.handleReqResp(req, resp)
+	if len(preferreds) != 0 || !omitRack {
+		t.Fatalf("got preferreds %v and omitRack %v, expected no preferreds and to omit our rack", preferreds, omitRack)
+	}
+	s.omitRack = omitRack
+
+	// Only the next request omits our rack.
+	s.cursors = []*cursor{foo, bar}
+	for i, exp := range []string{"", "rack"} {
+		atomic.StoreUint32(&foo.useState, 1)
+		atomic.StoreUint32(&bar.useState, 1)
+		if req := s.createReq(); req.rack != exp {
+			t.Errorf("request %d: got rack %q, expected %q", i, req.rack, exp)
+		}
+	}
+}
+
+func TestFetchFollowerTopics(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		followerTopics map[string]struct{}
+		topics         []string
+
+		expRack      string
+		expPreferred []string // topics moved to the preferred replica
+	}{
+		{"leader_only", map[string]struct{}{"bar": {}}, []string{"foo"}, "", nil},
+		{"follower_only", map[string]struct{}{"bar": {}}, []string{"bar"}, "rack", []string{"bar"}},
+		{"mixed", map[string]struct{}{"bar": {}}, []string{"foo", "bar"}, "rack", []string{"bar"}},
+		{"all_topics", nil, []string{"foo", "bar"}, "rack", []string{"foo", "bar"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := defaultCfg()
+			cfg.rack = "rack"
+			cfg.followerTopics = test.followerTopics
+			s := &source{cl: &Client{cfg: cfg}, nodeID: 1}
+
+			var cursors []*cursor
+			for _, topic := range test.topics {
+				cursors = append(cursors, &cursor{topic: topic, partition: 0, source: s, leader: 1})
+			}
+			s.cursors = cursors
+
+			// Our rack is only sent if something in the request
+			// can move to a follower, no matter which cursor the
+			// request starts with.
+			var req *fetchRequest
+			for i := 0; i < 2*len(cursors); i++ {
+				for _, c := range cursors {
+					atomic.StoreUint32(&c.useState, 1)
+				}
+				req = s.createReq()
+				if req.rack != test.expRack {
+					t.Fatalf("request %d: got rack %q, expected %q", i, req.rack, test.expRack)
+				}
+			}
+
+			// Every partition is told to move to replica 2; only
+			// follower topics do.
+			resp := &kmsg.FetchResponse{Version: 11}
+			for _, topic := range test.topics {
+				resp.Topics = append(resp.Topics, kmsg.FetchResponseTopic{
+					Topic:      topic,
+					Partitions: []kmsg.FetchResponseTopicPartition{{Partition: 0, PreferredReadReplica: 2}},
+				})
+			}
+			_, _, preferreds, _, omitRack := s.handleReqResp(req, resp)
+
+			var moved []string
+			for _, p := range preferreds {
+				if p.preferredReplica != 2 {
+					t.Errorf("got preferred replica %d for %s, expected 2", p.preferredReplica, p.from.topic)
+				}
+				moved = append(moved, p.from.topic)
+			}
+			sort.Strings(moved)
+			exp := append([]string(nil), test.expPreferred...)
+			sort.Strings(exp)
+			if !reflect.DeepEqual(moved, exp) {
+				t.Errorf("got topics %v moved to the preferred replica, expected %v", moved, exp)
+			}
+			if expOmit := len(test.expPreferred) < len(test.topics); omitRack != expOmit {
+				t.Errorf("got omitRack %v, expected %v", omitRack, expOmit)
+			}
+		})
+	}
+}
+
+func TestReuseFetchResponses(t *testing.T) {
+	encode := func(version int16, topics, partitions int) []byte {
+		resp := kmsg.FetchResponse{Version: version, SessionID: 3}
+		for i := 0; i < topics; i++ {
+			rt := kmsg.FetchResponseTopic{Topic: string(rune('a' + i))}
+			for j := 0; j < partitions; j++ {
+				rp := kmsg.NewFetchResponseTopicPartition()
+				rp.Partition = int32(j)
+				rp.HighWatermark = int64(i + j)
+				rp.PreferredReadReplica = int32(j)
+				rp.AbortedTransactions = []kmsg.FetchResponseTopicPartitionAbortedTransaction{{ProducerID: 1, FirstOffset: 2}}
+				rp.RecordBatches = []byte{1, 2, 3}
+				rt.Partitions = append(rt.Partitions, rp)
+			}
+			resp.Topics = append(resp.Topics, rt)
+		}
+		return resp.AppendTo(nil)
+	}
+
+	pool := new(sync.Pool)
+	req := &fetchRequest{version: 11, respPool: pool}
+
+	// We first decode a large response with every field set, and then
+	// decode a smaller response at an older version into the same
+	// released response. Nothing from the first response should remain.
+	resp := req.ResponseKind().(*pooledFetchResponse)
+	if err := resp.ReadFrom(encode(11, 3, 4)); err != nil {
+		t.Fatalf("unable to read first response: %v", err)
+	}
+	firstTopic := &resp.Topics[0]
+	req.releaseResp(resp)
+
+	// A pool may drop what is put into it (the race detector does so at
+	// random), so we decode into our released response directly.
+	reused := resp
+	reused.Version = 4
+	raw := encode(4, 2, 3)
+	if err := reused.ReadFrom(raw); err != nil {
+		t.Fatalf("unable to read reused response: %v", err)
+	}
+	if &reused.Topics[0] != firstTopic {
+		t.Error("reused response did not decode into its prior topics slice")
+	}
+	fresh := &kmsg.FetchResponse{Version: 4}
+	if err := fresh.ReadFrom(raw); err != nil {
+		t.Fatalf("unable to read fresh response: %v", err)
+	}
+
+	// We compare at the latest version so that fields the older version
+	// does not have must have been reset as well.
+	reused.Version, fresh.Version = 11, 11
+	if got, exp := reused.AppendTo(nil), fresh.AppendTo(nil); !bytes.Equal(got, exp) {
+		t.Errorf("reused response does not match fresh response:\ngot %v\nexp %v", got, exp)
+	}
+}
+
+func BenchmarkFetchResponseDecode(b *testing.B) {
+	resp := kmsg.FetchResponse{Version: 11}
+	for i := 0; i < 50; i++ {
+		rt := kmsg.FetchResponseTopic{Topic: "topic"}
+		for j := 0; j < 100; j++ {
+			rp := kmsg.NewFetchResponseTopicPartition()
+			rp.Partition = int32(j)
+			rp.RecordBatches = make([]byte, 100)
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+	}
+	raw := resp.AppendTo(nil)
+
+	for _, test := range []struct {
+		name string
+		pool *sync.Pool
+	}{
+		{"fresh", nil},
+		{"reused", new(sync.Pool)},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			req := &fetchRequest{version: 11, respPool: test.pool}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				resp := req.ResponseKind()
+				if err := resp.ReadFrom(raw); err != nil {
+					b.Fatal(err)
+				}
+				req.releaseResp(resp)
+			}
+		})
+	}
+}
+
+type brokerKeysHook struct {
+	mu   sync.Mutex
+	reqs map[int32]map[int16]int // node => key => count
+}
+
+func (h *brokerKeysHook) OnRequestComplete(meta BrokerMetadata, key, _ int16, _ int32, _, _, _, _ time.Duration, _ error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reqs[meta.NodeID] == nil {
+		h.reqs[meta.NodeID] = make(map[int16]int)
+	}
+	h.reqs[meta.NodeID][key]++
+}
+
+func TestRestrictFetchToBrokers(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(2), kfake.SeedTopics(2, "foo"))
+	defer c.Close()
+
+	producer := newTestClient(t, c, RecordPartitioner(ManualPartitioner(nil)))
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for partition := int32(0); partition < 2; partition++ {
+		for i := 0; i < 5; i++ {
+			done := make(chan error, 1)
+			producer.Produce(ctx, &Record{Topic: "foo", Partition: partition}, func(_ *Record, err error) { done <- err })
+			if err := <-done; err != nil {
+				t.Fatalf("unable to produce: %v", err)
+			}
+		}
+	}
+
+	meta, err := producer.Request(ctx, kmsg.NewPtrMetadataRequest())
+	if err != nil {
+		t.Fatalf("unable to request metadata: %v", err)
+	}
+	allowed, restricted := int32(-1), int32(-1)
+	for _, p := range meta.(*kmsg.MetadataResponse).Topics[0].Partitions {
+		if p.Leader == 0 {
+			allowed = p.Partition
+		} else {
+			restricted = p.Partition
+		}
+	}
+	if allowed < 0 || restricted < 0 {
+		t.Fatal("expected one partition led by each broker")
+	}
+
+	hook := &brokerKeysHook{reqs: make(map[int32]map[int16]int)}
+	cl := newTestClient(t, c, RestrictFetchToBrokers(0), WithHooks(hook))
+	defer cl.Close()
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+	// We consume everything from the allowed partition and see one
+	// restricted error for the other; polling longer sees nothing new.
+	var records, restrictedErrs int
+	pollCtx, pollCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer pollCancel()
+	for pollCtx.Err() == nil {
+		fetches := cl.PollFetches(pollCtx)
+		for _, err := range fetches.Errors() {
+			if err.Err == ErrFetchRestricted && err.Partition == restricted {
+				restrictedErrs++
+			} else if err.Err != context.DeadlineExceeded {
+				t.Fatalf("unexpected fetch error on %s[%d]: %v", err.Topic, err.Partition, err.Err)
+			}
+		}
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			if r := iter.Next(); r.Partition != allowed {
+				t.Fatalf("consumed a record from restricted partition %d", r.Partition)
+			}
+			records++
+		}
+	}
+	if records != 5 || restrictedErrs != 1 {
+		t.Errorf("got %d records and %d restricted errors, expected 5 and 1", records, restrictedErrs)
+	}
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	for _, key := range []int16{1, 2, 23} {
+		if n := hook.reqs[1][key]; n != 0 {
+			t.Errorf("issued %d %s requests to restricted broker 1", n, kmsg.NameForKey(key))
+		}
+	}
+}
+
+func TestFetchDecodeConcurrency(t *testing.T) {
+	t.Parallel()
+
+	const nparts, perPart = 10, 50
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(nparts, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c,
+		RecordPartitioner(ManualPartitioner(nil)),
+		BatchCompression(GzipCompression()),
+		FetchDecodeConcurrency(4),
+	)
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errs := make(chan error, nparts*perPart)
+	for i := 0; i < perPart; i++ {
+		for p := int32(0); p < nparts; p++ {
+			r := &Record{Topic: "foo", Partition: p, Value: []byte(strconv.Itoa(i))}
+			if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+				t.Fatalf("unable to produce: %v", err)
+			}
+		}
+	}
+	for i := 0; i < nparts*perPart; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+
+	// Every partition lives on our one broker, so each fetch response
+	// has every partition, processed concurrently.
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	next := make(map[int32]int)
+	for consumed := 0; consumed < nparts*perPart; {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out after consuming %d of %d records", consumed, nparts*perPart)
+		}
+		for _, err := range fetches.Errors() {
+			t.Fatalf("fetch error on %s[%d]: %v", err.Topic, err.Partition, err.Err)
+		}
+		for iter := fetches.RecordIter(); !iter.Done(); consumed++ {
+			r := iter.Next()
+			if got, exp := string(r.Value), strconv.Itoa(next[r.Partition]); got != exp {
+				t.Fatalf("partition %d: got record %s != exp %s", r.Partition, got, exp)
+			}
+			next[r.Partition]++
+		}
+	}
+}
+
+func TestRecordIsTombstone(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c)
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	for _, r := range []*Record{
+		{Topic: "foo", Key: []byte("deleted")},
+		{Topic: "foo", Key: []byte("empty"), Value: []byte{}},
+	} {
+		if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+			t.Fatalf("unable to produce: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("produce error: %v", err)
+		}
+	}
+
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	tombstones := make(map[string]bool)
+	for len(tombstones) < 2 {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out after consuming %d of 2 records", len(tombstones))
+		}
+		for _, err := range fetches.Errors() {
+			t.Fatalf("fetch error on %s[%d]: %v", err.Topic, err.Partition, err.Err)
+		}
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			r := iter.Next()
+			tombstones[string(r.Key)] = r.IsTombstone()
+		}
+	}
+	if !tombstones["deleted"] {
+		t.Error("record with a nil value is not a tombstone")
+	}
+	if tombstones["empty"] {
+		t.Error("record with an empty value is a tombstone")
+	}
+}
+
+func TestFetchAbortedTransactions(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, TransactionalID("txn"))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, commit := range []bool{false, true} {
+		if err := cl.BeginTransaction(); err != nil {
+			t.Fatalf("unable to begin transaction: %v", err)
+		}
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			r := &Record{Topic: "foo", Value: []byte(strconv.FormatBool(commit))}
+			if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+				t.Fatalf("unable to produce: %v", err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("unable to produce: %v", err)
+			}
+		}
+		end := cl.AbortTransaction
+		if commit {
+			end = cl.CommitTransaction
+		}
+		if err := end(ctx); err != nil {
+			t.Fatalf("unable to end transaction: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		name       string
+		opts       []Opt
+		expRecords int
+		expAborted bool
+	}{
+		{"read uncommitted", nil, 4, false},
+		{"read committed", []Opt{FetchIsolationLevel(ReadCommitted())}, 2, true},
+	} {
+		consumer := newTestClient(t, c, test.opts...)
+		defer consumer.Close()
+		consumer.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+
+		var (
+			records []*Record
+			aborted []AbortedTransaction
+		)
+		for len(records) < test.expRecords {
+			fetches := consumer.PollFetches(ctx)
+			if ctx.Err() != nil {
+				t.Fatalf("%s: timed out after consuming %d records", test.name, len(records))
+			}
+			for _, f := range fetches {
+				for _, ft := range f.Topics {
+					for _, fp := range ft.Partitions {
+						records = append(records, fp.Records...)
+						aborted = append(aborted, fp.AbortedTransactions...)
+					}
+				}
+			}
+		}
+
+		if !test.expAborted {
+			if len(aborted) != 0 {
+				t.Errorf("%s: got aborted transactions %v, expected none", test.name, aborted)
+			}
+			continue
+		}
+		exp := []AbortedTransaction{{ProducerID: records[0].ProducerID, FirstOffset: 0}}
+		if !reflect.DeepEqual(aborted, exp) {
+			t.Errorf("%s: got aborted transactions %v, expected %v", test.name, aborted, exp)
+		}
+	}
+}
+
+func TestFilteredRecords(t *testing.T) {
+	t.Parallel()
+
+	type tp struct {
+		topic     string
+		partition int32
+	}
+	type txn struct {
+		commit bool
+		to     []tp // each partition is produced two records
+	}
+	mixed := []txn{
+		{false, []tp{{"foo", 0}, {"bar", 0}}},
+		{true, []tp{{"foo", 0}, {"bar", 1}}},
+	}
+	for _, test := range []struct {
+		name        string
+		txns        []txn
+		uncommitted bool
+
+		expKept     map[tp]int
+		expFiltered map[tp]int
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:        "committed",
+			txns:        []txn{{true, []tp{{"foo", 0}, {"bar", 1}}}},
+			expKept:     map[tp]int{{"foo", 0}: 2, {"bar", 1}: 2},
+			expFiltered: map[tp]int{{"foo", 0}: 1, {"bar", 1}: 1}, // commit markers
+		},
+		{
+			name:        "aborted",
+			txns:        []txn{{false, []tp{{"foo", 0}, {"foo", 1}}}},
+			expFiltered: map[tp]int{{"foo", 0}: 3, {"foo", 1}: 3},
+		},
+		{
+			name:        "mixed",
+			txns:        mixed,
+			expKept:     map[tp]int{{"foo", 0}: 2, {"bar", 1}: 2},
+			expFiltered: map[tp]int{{"foo", 0}: 4, {"bar", 0}: 3, {"bar", 1}: 1},
+		},
+		{
+			name:        "mixed_uncommitted",
+			txns:        mixed,
+			uncommitted: true,
+			expKept:     map[tp]int{{"foo", 0}: 4, {"bar", 0}: 2, {"bar", 1}: 2},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newTestCluster(t, kfake.NumBrokers(1), kfake.SeedTopics(2, "foo", "bar"))
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			producer := newTestClient(t, c, TransactionalID("txn"), RecordPartitioner(ManualPartitioner(nil)))
+			defer producer.Close()
+			for _, txn := range test.txns {
+				if err := producer.BeginTransaction(); err != nil {
+					t.Fatalf("unable to begin transaction: %v", err)
+				}
+				errs := make(chan error, 2*len(txn.to))
+				for _, tp := range txn.to {
+					for i := 0; i < 2; i++ {
+						r := &Record{Topic: tp.topic, Partition: tp.partition}
+						if err := producer.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+							t.Fatalf("unable to produce: %v", err)
+						}
+					}
+				}
+				for range txn.to {
+					for i := 0; i < 2; i++ {
+						if err := <-errs; err != nil {
+							t.Fatalf("unable to produce: %v", err)
+						}
+					}
+				}
+				if err := producer.EndTransaction(ctx, TransactionEndTry(txn.commit)); err != nil {
+					t.Fatalf("unable to end transaction: %v", err)
+				}
+			}
+
+			var opts []Opt
+			if !test.uncommitted {
+				opts = append(opts, FetchIsolationLevel(ReadCommitted()))
+			}
+			cl := newTestClient(t, c, opts...)
+			defer cl.Close()
+			cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo", "bar"))
+
+			kept, filtered := make(map[tp]int), make(map[tp]int)
+			poll := func(timeout time.Duration) {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				for _, f := range cl.PollFetches(ctx) {
+					for _, ft := range f.Topics {
+						for _, fp := range ft.Partitions {
+							if fp.Err != nil {
+								t.Fatalf("fetch error on %s[%d]: %v", ft.Topic, fp.Partition, fp.Err)
+							}
+							at := tp{ft.Topic, fp.Partition}
+							if n := len(fp.Records); n > 0 {
+								kept[at] += n
+							}
+							if fp.FilteredRecords > 0 {
+								filtered[at] += fp.FilteredRecords
+							}
+						}
+					}
+				}
+			}
+			equal := func(got, exp map[tp]int) bool {
+				return len(got) == 0 && len(exp) == 0 || reflect.DeepEqual(got, exp)
+			}
+
+			for !equal(kept, test.expKept) || !equal(filtered, test.expFiltered) {
+				if ctx.Err() != nil {
+					t.Fatalf("timed out with kept %v filtered %v, expected kept %v filtered %v", kept, filtered, test.expKept, test.expFiltered)
+				}
+				poll(time.Second)
+			}
+
+			// Nothing more is kept or filtered, including from
+			// fetches that return no records.
+			poll(300 * time.Millisecond)
+			if !equal(kept, test.expKept) || !equal(filtered, test.expFiltered) {
+				t.Errorf("got kept %v filtered %v, expected kept %v filtered %v", kept, filtered, test.expKept, test.expFiltered)
+			}
+		})
+	}
+}
+
+func TestReuseFetchResponsesConsume(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.SeedTopics(3, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, ReuseFetchResponses(), FetchMaxPartitionBytes(100))
+	defer cl.Close()
+
+	const n = 300
+	produceN(t, cl, "foo", n)
+
+	// With small partition bytes, consuming takes many fetches that each
+	// reuse a response. Records from earlier polls must be unaffected.
+	cl.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var records []*Record
+	for len(records) < n {
+		fetches := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("timed out after consuming %d of %d records", len(records), n)
+		}
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			records = append(records, iter.Next())
+		}
+	}
+
+	seen := make(map[string]int)
+	for _, r := range records {
+		seen[string(r.Value)]++
+	}
+	for i := 0; i < n; i++ {
+		if seen[strconv.Itoa(i)] != 1 {
+			t.Errorf("record %d seen %d times, expected once", i, seen[strconv.Itoa(i)])
+		}
+	}
+}
+
+func TestFetchSessionNotCreated(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		sessionID int32
+		exp       int // partitions in the second request
+	}{
+		{"session", 7, 0},
+		{"no_session", 0, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			foo0 := &cursor{topic: "foo", partition: 0}
+			foo1 := &cursor{topic: "foo", partition: 1}
+
+			// Neither partition's offset changes between requests, so
+			// the second request only lists them if it is a full fetch.
+			var session fetchSession
+			for i, exp := range []int{2, test.exp} {
+				req := &fetchRequest{
+					version: 12,
+					session: session,
+					usedOffsets: usedOffsets{"foo": {
+						0: foo0.use(),
+						1: foo1.use(),
+					}},
+				}
+				var decoded kmsg.FetchRequest
+				decoded.Version = req.version
+				if err := decoded.ReadFrom(req.AppendTo(nil)); err != nil {
+					t.Fatalf("request %d: unable to decode: %v", i, err)
+				}
+				var got int
+				for _, rt := range decoded.Topics {
+					got += len(rt.Partitions)
+				}
+				if got != exp {
+					t.Errorf("request %d: got %d partitions at session epoch %d, expected %d", i, got, decoded.SessionEpoch, exp)
+				}
+
+				session = req.session
+				session.bumpEpoch(test.sessionID)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package kgo
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/twmb/franz-go/pkg/kerr"
 )
@@ -33,6 +34,31 @@ func (cl *Client) loadShortTopics() map[string]int32 {
 	return short
 }
 
+// loadLeaderRacks returns topic names and the rack of each partition's leader,
+// or an empty string if the leader or its rack is unknown.
+func (cl *Client) loadLeaderRacks() map[string][]string {
+	cl.brokersMu.RLock()
+	brokerRacks := make(map[int32]string, len(cl.brokers))
+	for id, b := range cl.brokers {
+		if b.meta.Rack != nil {
+			brokerRacks[id] = *b.meta.Rack
+		}
+	}
+	cl.brokersMu.RUnlock()
+
+	topics := cl.loadTopics()
+	racks := make(map[string][]string, len(topics))
+	for topic, partitions := range topics {
+		ps := partitions.load().partitions
+		topicRacks := make([]string, len(ps))
+		for i, p := range ps {
+			topicRacks[i] = brokerRacks[p.leader]
+		}
+		racks[topic] = topicRacks
+	}
+	return racks
+}
+
 // updates the stored list of topics if any in the list is not yet stored in
 // the client. The input is allowed to have duplicates.
 func (cl *Client) storeTopics(topics []string) {
@@ -56,7 +82,7 @@ func (cl *Client) storeTopics(topics []string) {
 }
 
 func newTopicPartitions() *topicPartitions {
-	parts := new(topicPartitions)
+	parts := &topicPartitions{lastUsed: time.Now()}
 	parts.v.Store(new(topicPartitionsData))
 	return parts
 }
@@ -67,6 +93,12 @@ type topicPartitions struct {
 
 	partsMu     sync.Mutex
 	partitioner TopicPartitioner
+
+	// The following are also guarded by partsMu and are used for
+	// pruning topics; see PruneMetadataTopics.
+	pruned   bool      // if true, this topic was removed from the topics map
+	produced bool      // set when a record is partitioned, cleared in ttl checks
+	lastUsed time.Time // last ttl check that saw produced
 }
 
 func (t *topicPartitions) load() *topicPartitionsData {
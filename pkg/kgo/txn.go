@@ -234,6 +234,38 @@ func (cl *Client) BeginTransaction() error {
 	return nil
 }
 
+// CommitTransaction flushes all buffered records and then commits the
+// transaction, making every record produced since BeginTransaction visible
+// to read committed consumers.
+//
+// This is a shortcut for Flush followed by EndTransaction with TryCommit.
+// Only commit if every record produced in the transaction succeeded; if any
+// record failed, use AbortTransaction, otherwise the records that did
+// succeed are committed without those that failed. If flushing is canceled
+// by the context, this returns the context's error and the client remains
+// in the transaction.
+func (cl *Client) CommitTransaction(ctx context.Context) error {
+	if err := cl.Flush(ctx); err != nil {
+		return err
+	}
+	return cl.EndTransaction(ctx, TryCommit)
+}
+
+// AbortTransaction fails all buffered records with ErrAborting and then
+// aborts the transaction, ensuring read committed consumers never see any
+// record produced since BeginTransaction.
+//
+// This is a shortcut for AbortBufferedRecords followed by EndTransaction with
+// TryAbort. If waiting for buffered records to be failed is canceled by the
+// context, this returns the context's error and the client remains in the
+// transaction.
+func (cl *Client) AbortTransaction(ctx context.Context) error {
+	if err := cl.AbortBufferedRecords(ctx); err != nil {
+		return err
+	}
+	return cl.EndTransaction(ctx, TryAbort)
+}
+
 // AbortBufferedRecords fails all unflushed records with ErrAborted and waits
 // for there to be no buffered records.
 //
@@ -5,11 +5,14 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
 )
 
 // This test is identical to TestGroupETL but based around transactions.
@@ -255,3 +258,104 @@ func (c *testConsumer) transact(txnsBeforeQuit int) {
 	}
 
 }
+
+func TestTransactions(t *testing.T) {
+	t.Parallel()
+
+	c := newTestCluster(t, kfake.NumBrokers(2), kfake.SeedTopics(1, "foo"))
+	defer c.Close()
+
+	cl := newTestClient(t, c, TransactionalID("txn"))
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	produceTxn := func(prefix string, n int, end func(context.Context) error) {
+		t.Helper()
+		if err := cl.BeginTransaction(); err != nil {
+			t.Fatalf("unable to begin transaction: %v", err)
+		}
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			r := &Record{Topic: "foo", Value: []byte(prefix + strconv.Itoa(i))}
+			if err := cl.Produce(ctx, r, func(_ *Record, err error) { errs <- err }); err != nil {
+				t.Fatalf("unable to produce: %v", err)
+			}
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("unable to produce: %v", err)
+			}
+		}
+		if end == nil {
+			return
+		}
+		if err := end(ctx); err != nil {
+			t.Fatalf("unable to end transaction: %v", err)
+		}
+	}
+
+	produceTxn("aborted-", 3, cl.AbortTransaction)
+	produceTxn("committed-", 3, cl.CommitTransaction)
+	produceTxn("pending-", 2, nil)
+
+	consume := func(cl *Client, n int) []string {
+		t.Helper()
+		var values []string
+		for len(values) < n {
+			fetches := cl.PollFetches(ctx)
+			if ctx.Err() != nil {
+				t.Fatalf("timed out after consuming %v", values)
+			}
+			for _, err := range fetches.Errors() {
+				t.Fatalf("fetch error on %s[%d]: %v", err.Topic, err.Partition, err.Err)
+			}
+			for iter := fetches.RecordIter(); !iter.Done(); {
+				r := iter.Next()
+				if !r.Attrs.IsTransactional() || r.Attrs.IsControl() {
+					t.Errorf("record %q: got transactional %v control %v, expected transactional non-control",
+						r.Value, r.Attrs.IsTransactional(), r.Attrs.IsControl())
+				}
+				values = append(values, string(r.Value))
+			}
+		}
+		return values
+	}
+	consumeNone := func(cl *Client) {
+		t.Helper()
+		pollCtx, pollCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+		defer pollCancel()
+		if iter := cl.PollFetches(pollCtx).RecordIter(); !iter.Done() {
+			t.Fatalf("unexpectedly consumed %q", iter.Next().Value)
+		}
+	}
+
+	// A read uncommitted consumer sees everything, including the aborted
+	// and pending records.
+	uncommitted := newTestClient(t, c)
+	defer uncommitted.Close()
+	uncommitted.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	if got := consume(uncommitted, 8); len(got) != 8 {
+		t.Errorf("read uncommitted: got %v, expected all 8 records", got)
+	}
+
+	// A read committed consumer sees only the committed records, and
+	// not the pending records until they are committed.
+	committed := newTestClient(t, c, FetchIsolationLevel(ReadCommitted()))
+	defer committed.Close()
+	committed.AssignPartitions(ConsumeTopics(NewOffset().AtStart(), "foo"))
+	exp := []string{"committed-0", "committed-1", "committed-2"}
+	if got := consume(committed, 3); !reflect.DeepEqual(got, exp) {
+		t.Errorf("read committed: got %v, expected %v", got, exp)
+	}
+	consumeNone(committed)
+
+	if err := cl.CommitTransaction(ctx); err != nil {
+		t.Fatalf("unable to commit pending transaction: %v", err)
+	}
+	exp = []string{"pending-0", "pending-1"}
+	if got := consume(committed, 2); !reflect.DeepEqual(got, exp) {
+		t.Errorf("read committed after commit: got %v, expected %v", got, exp)
+	}
+}
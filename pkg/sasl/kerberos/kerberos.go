@@ -1,16 +1,27 @@
-// Package scram provides Kerberos v5 sasl authentication.
+// Package kerberos provides Kerberos v5 sasl authentication (GSSAPI).
+//
+// A session establishes a GSS-API context with the broker by sending an
+// AP-REQ for the broker's service principal, verifying the broker's wrap
+// token, and replying with our own. This works both with and without the
+// SASLHandshake; see kgo.SASLGSSAPIUseHandshake.
 package kerberos
 
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
 	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/keytab"
 	"github.com/jcmturner/gokrb5/v8/messages"
 	"github.com/jcmturner/gokrb5/v8/types"
 
@@ -23,7 +34,9 @@ type Auth struct {
 	// Client is a Kerberos client.
 	Client *client.Client
 
-	// Service is the service name we will get a ticket for.
+	// Service is the service name we will get a ticket for, defaulting to
+	// "kafka". The ticket is for the service principal Service/host, where
+	// host is the host of the broker being connected to.
 	Service string
 
 	// PersistAfterAuth specifies whether the client should persist after
@@ -51,10 +64,103 @@ func (a Auth) AsMechanism() sasl.Mechanism {
 
 // Kerberos returns a sasl mechanism that will call authFn whenever sasl
 // authentication is needed. The returned Auth is used for a single session.
+//
+// See KeytabAuth and CCacheAuth for authFns that log in with a keytab or an
+// existing credential cache.
 func Kerberos(authFn func(context.Context) (Auth, error)) sasl.Mechanism {
 	return k(authFn)
 }
 
+// KeytabAuth returns an authFn for Kerberos that logs in as username in realm
+// using the keys in the keytab at keytabPath.
+//
+// The keytab and the krb5.conf at krb5ConfPath are loaded for every session,
+// so that replacing either on disk takes effect for new connections. If
+// krb5ConfPath is empty, this uses $KRB5_CONFIG, falling back to
+// /etc/krb5.conf.
+func KeytabAuth(service, username, realm, keytabPath, krb5ConfPath string) func(context.Context) (Auth, error) {
+	return func(context.Context) (Auth, error) {
+		cfg, err := loadKrb5Conf(krb5ConfPath)
+		if err != nil {
+			return Auth{}, err
+		}
+		kt, err := keytab.Load(keytabPath)
+		if err != nil {
+			return Auth{}, fmt.Errorf("unable to load keytab %s: %w", keytabPath, err)
+		}
+		return Auth{
+			Client:  client.NewWithKeytab(username, realm, kt, cfg, client.DisablePAFXFAST(true)),
+			Service: service,
+		}, nil
+	}
+}
+
+// CCacheAuth returns an authFn for Kerberos that uses the tickets in the
+// credential cache at ccachePath, such as one populated by kinit.
+//
+// The cache and the krb5.conf at krb5ConfPath are loaded for every session,
+// so that tickets renewed by an external kinit are picked up by new
+// connections. A credential cache cannot be used to log in again: once its
+// ticket granting ticket expires, authentication fails until the cache is
+// renewed.
+//
+// If ccachePath is empty, this uses $KRB5CCNAME, falling back to
+// /tmp/krb5cc_<uid>. If krb5ConfPath is empty, this uses $KRB5_CONFIG, falling
+// back to /etc/krb5.conf.
+func CCacheAuth(service, ccachePath, krb5ConfPath string) func(context.Context) (Auth, error) {
+	return func(context.Context) (Auth, error) {
+		cfg, err := loadKrb5Conf(krb5ConfPath)
+		if err != nil {
+			return Auth{}, err
+		}
+		path := ccachePath
+		if path == "" {
+			if path = strings.TrimPrefix(os.Getenv("KRB5CCNAME"), "FILE:"); path == "" {
+				path = "/tmp/krb5cc_" + strconv.Itoa(os.Getuid())
+			}
+		}
+		ccache, err := credentials.LoadCCache(path)
+		if err != nil {
+			return Auth{}, fmt.Errorf("unable to load credential cache %s: %w", path, err)
+		}
+		cl, err := client.NewFromCCache(ccache, cfg, client.DisablePAFXFAST(true))
+		if err != nil {
+			return Auth{}, fmt.Errorf("unable to use credential cache %s: %w", path, err)
+		}
+		return Auth{
+			Client:  cl,
+			Service: service,
+		}, nil
+	}
+}
+
+func loadKrb5Conf(path string) (*config.Config, error) {
+	if path == "" {
+		if path = os.Getenv("KRB5_CONFIG"); path == "" {
+			path = "/etc/krb5.conf"
+		}
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load krb5 config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// servicePrincipal returns the name of the service principal to get a ticket
+// for when connecting to the broker at host.
+func servicePrincipal(service, host string) string {
+	// The broker address usually has a port, which is not part of the
+	// service principal name.
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if service == "" {
+		service = "kafka"
+	}
+	return service + "/" + host
+}
+
 type k func(context.Context) (Auth, error)
 type wrapped struct{ *client.Client }
 
@@ -76,13 +182,8 @@ func (k k) Authenticate(ctx context.Context, host string) (sasl.Session, []byte,
 	if err = c.AffirmLogin(); err != nil {
 		return nil, nil, err
 	}
-	if strings.IndexByte(host, ':') != 0 {
-		if host, _, err = net.SplitHostPort(host); err != nil {
-			return nil, nil, err
-		}
-	}
 
-	ticket, encKey, err := c.GetServiceTicket(auther.Service + "/" + host)
+	ticket, encKey, err := c.GetServiceTicket(servicePrincipal(auther.Service, host))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -141,6 +242,9 @@ func (s *session) Challenge(resp []byte) (bool, []byte, error) {
 		}
 		isValid, err := challenge.Verify(s.encKey, 22) // 22 == GSSAPI ACCEPTOR SEAL
 		if !isValid {
+			if err == nil {
+				err = errors.New("invalid GSSAPI wrap token from broker")
+			}
 			return false, nil, err
 		}
 		response, err := gssapi.NewInitiatorWrapToken(challenge.Payload, s.encKey)
@@ -0,0 +1,25 @@
+package kerberos
+
+import "testing"
+
+func TestServicePrincipal(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		service string
+		host    string
+		exp     string
+	}{
+		{"host_port", "kafka", "broker.example.com:9092", "kafka/broker.example.com"},
+		{"host_only", "kafka", "broker.example.com", "kafka/broker.example.com"},
+		{"default_service", "", "broker.example.com:9092", "kafka/broker.example.com"},
+		{"custom_service", "kafka-prod", "broker.example.com:9092", "kafka-prod/broker.example.com"},
+		{"ipv4", "kafka", "10.0.0.1:9092", "kafka/10.0.0.1"},
+		{"ipv6", "kafka", "[::1]:9092", "kafka/::1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := servicePrincipal(test.service, test.host); got != test.exp {
+				t.Errorf("got %q, expected %q", got, test.exp)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ package plain
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/twmb/franz-go/pkg/sasl"
 )
@@ -22,6 +23,15 @@ type Auth struct {
 	_internal struct{} // require explicit field initalization
 }
 
+// String returns the authorization ID and user with the password redacted, so
+// that printing or logging an Auth does not leak credentials.
+func (a Auth) String() string {
+	return fmt.Sprintf("plain.Auth{Zid:%q User:%q Pass:<redacted>}", a.Zid, a.User)
+}
+
+// GoString is the same as String, so that %#v also redacts the password.
+func (a Auth) GoString() string { return a.String() }
+
 // AsMechanism returns a sasl mechanism that will use a as credentials for all
 // sasl sessions.
 //
@@ -35,6 +45,12 @@ func (a Auth) AsMechanism() sasl.Mechanism {
 
 // Plain returns a sasl mechanism that will call authFn whenever sasl
 // authentication is needed. The returned Auth is used for a single session.
+//
+// Every new connection and every reauthentication of a connection whose
+// session lifetime is limited by the broker (KIP-368) starts a new session,
+// so authFn can return rotated credentials, such as short lived secrets from
+// a vault. The credentials are only ever written to the broker; the client
+// never logs sasl bytes.
 func Plain(authFn func(context.Context) (Auth, error)) sasl.Mechanism {
 	return plain(authFn)
 }
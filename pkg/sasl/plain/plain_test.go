@@ -0,0 +1,50 @@
+package plain
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestAuthRedacted(t *testing.T) {
+	a := Auth{Zid: "zid", User: "user", Pass: "hunter2"}
+
+	for _, test := range []struct {
+		name string
+		s    string
+	}{
+		{"String", a.String()},
+		{"GoString", a.GoString()},
+		{"v", fmt.Sprintf("%v", a)},
+		{"+v", fmt.Sprintf("%+v", a)},
+		{"#v", fmt.Sprintf("%#v", a)},
+		{"s", fmt.Sprintf("%s", a)},
+		{"pointer", fmt.Sprintf("%v", &a)},
+		{"slice", fmt.Sprintf("%v", []Auth{a})},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if strings.Contains(test.s, a.Pass) {
+				t.Errorf("got %q, expected the password to be redacted", test.s)
+			}
+			if !strings.Contains(test.s, a.User) || !strings.Contains(test.s, "<redacted>") {
+				t.Errorf("got %q, expected the user and a redacted password", test.s)
+			}
+		})
+	}
+}
+
+func TestAuthRedactedInLogs(t *testing.T) {
+	a := Auth{User: "user", Pass: "hunter2"}
+
+	var buf bytes.Buffer
+	log.New(&buf, "", 0).Printf("authenticating with %v", a)
+	kgo.BasicLogger(&buf, kgo.LogLevelDebug, nil).Log(kgo.LogLevelInfo, "authenticating", "auth", a)
+
+	if logged := buf.String(); strings.Contains(logged, a.Pass) || strings.Count(logged, "<redacted>") != 2 {
+		t.Errorf("got logs %q, expected the password to be redacted from both", logged)
+	}
+}
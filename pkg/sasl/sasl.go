@@ -2,7 +2,10 @@
 // to interop with Kafka SASL.
 package sasl
 
-import "context"
+import (
+	"context"
+	"crypto/tls"
+)
 
 // Session is an authentication session.
 type Session interface {
@@ -31,3 +34,19 @@ type Mechanism interface {
 	// The provided context can be used through the duration of the session.
 	Authenticate(ctx context.Context, host string) (Session, []byte, error)
 }
+
+// ChannelBinder is an optional interface that a Mechanism can implement to use
+// TLS channel binding, such as SCRAM-SHA-256-PLUS.
+//
+// If a mechanism implements this interface and the connection to the broker
+// uses TLS, AuthenticateTLS is called instead of Authenticate with the state
+// of the completed TLS handshake. If the connection does not use TLS,
+// Authenticate is called as normal, and the mechanism should fall back to not
+// using channel binding (or return an error if binding is required).
+type ChannelBinder interface {
+	// AuthenticateTLS is the same as Authenticate, but is additionally
+	// passed the connection's TLS state, from which channel binding data
+	// (such as the tls-unique or tls-server-end-point data) can be
+	// derived.
+	AuthenticateTLS(ctx context.Context, host string, state tls.ConnectionState) (Session, []byte, error)
+}